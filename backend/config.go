@@ -16,6 +16,7 @@ type Config struct {
 	Database DatabaseConfig `yaml:"database"`
 	Server   ServerConfig   `yaml:"server"`
 	Static   StaticConfig   `yaml:"static"`
+	Customer CustomerConfig `yaml:"customer"`
 }
 
 // DatabaseConfig 数据库配置
@@ -44,6 +45,20 @@ type StaticConfig struct {
 	EnableHealthCheck bool `yaml:"enable_health_check"`
 }
 
+// CustomerConfig 客户配置
+type CustomerConfig struct {
+	TrashRetentionDays int                `yaml:"trash_retention_days"` // 回收站保留天数，超过后彻底删除
+	Pool               CustomerPoolConfig `yaml:"pool"`
+}
+
+// CustomerPoolConfig 公海配置
+type CustomerPoolConfig struct {
+	DailyClaimLimit int `yaml:"daily_claim_limit"` // 每个销售员每天最多领取的客户数（用户未单独设置时使用）
+	MaxCustomers    int `yaml:"max_customers"`     // 每个销售员最多负责的客户数，超过后不能再领取，0表示不限
+	RecycleDays     int `yaml:"recycle_days"`      // 超过该天数没有跟进、通话、拜访或下单时自动回收，负数或未配置表示不回收
+	WarningDays     int `yaml:"warning_days"`      // 回收前提前提醒的天数
+}
+
 // 全局变量
 var (
 	DB        *gorm.DB
@@ -115,3 +130,33 @@ func SetGinMode() {
 		}
 	}
 }
+
+// GetTrashRetentionDays 获取客户回收站保留天数，未配置时默认30天
+func GetTrashRetentionDays() int {
+	if AppConfig == nil || AppConfig.Customer.TrashRetentionDays <= 0 {
+		return 30
+	}
+	return AppConfig.Customer.TrashRetentionDays
+}
+
+// GetCustomerPoolConfig 获取公海配置，未配置的项使用默认值
+func GetCustomerPoolConfig() CustomerPoolConfig {
+	config := CustomerPoolConfig{DailyClaimLimit: 20, RecycleDays: -1, WarningDays: 3}
+	if AppConfig == nil {
+		return config
+	}
+	pool := AppConfig.Customer.Pool
+	if pool.DailyClaimLimit > 0 {
+		config.DailyClaimLimit = pool.DailyClaimLimit
+	}
+	if pool.MaxCustomers > 0 {
+		config.MaxCustomers = pool.MaxCustomers
+	}
+	if pool.RecycleDays != 0 {
+		config.RecycleDays = pool.RecycleDays
+	}
+	if pool.WarningDays > 0 {
+		config.WarningDays = pool.WarningDays
+	}
+	return config
+}
@@ -1,24 +1,53 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/lib/pq"
+	"github.com/xuri/excelize/v2"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // ========== 客户相关业务函数 ==========
 
 // getCustomers 获取客户列表
-func getCustomers(page, limit int, search string) ([]*CustomerResponse, int64) {
+func getCustomers(page, limit int, filter CustomerFilter) ([]*CustomerResponse, int64, error) {
 	var customers []Customer
 	var total int64
 
-	query := DB.Model(&Customer{})
-	if search != "" {
-		query = query.Where("name LIKE ? OR contact_name LIKE ?", "%"+search+"%", "%"+search+"%")
+	query, err := applyCustomerFilter(DB.Model(&Customer{}), filter)
+	if err != nil {
+		return nil, 0, err
 	}
-
 	query.Count(&total)
+
+	query, err = applyCustomerSort(query, filter.Sort)
+	if err != nil {
+		return nil, 0, err
+	}
 	query.Offset((page - 1) * limit).Limit(limit).Find(&customers)
 
 	responses := make([]*CustomerResponse, len(customers))
@@ -26,28 +55,34 @@ func getCustomers(page, limit int, search string) ([]*CustomerResponse, int64) {
 		responses[i] = CustomerToResponse(&customer)
 	}
 
-	return responses, total
+	return responses, total, nil
 }
 
-// getCustomer 获取单个客户
+// getCustomer 获取单个客户，客户不存在或已删除时返回 nil
 func getCustomer(id uint64) *CustomerResponse {
 	var customer Customer
-	DB.First(&customer, id)
-	return CustomerToResponse(&customer)
+	if err := DB.Where("is_deleted = ?", false).First(&customer, id).Error; err != nil {
+		return nil
+	}
+	response := CustomerToResponse(&customer)
+	response.Groups = getCustomerGroups(customer.GroupID)
+	return response
 }
 
-// createCustomer 创建客户
-func createCustomer(req CustomerRequest) *CustomerResponse {
+// createCustomer 创建客户，客户和变更历史在同一事务中写入
+func createCustomer(req CustomerRequest, operatorID uint64) (*CustomerResponse, error) {
 	customer := &Customer{
 		Name:         req.Name,
 		ContactName:  req.ContactName,
 		Phones:       pq.StringArray(req.Phones),
+		WorkPhone:    pq.StringArray(req.WorkPhone),
 		Wechats:      pq.StringArray(req.Wechats),
 		Province:     req.Province,
 		City:         req.City,
 		District:     req.District,
+		DistrictID:   int(req.DistrictID),
 		Address:      req.Address,
-		Products:     pq.StringArray(req.Products),
+		Products:     pq.StringArray(canonicalProductNames(DB, req.Products)),
 		Category:     req.Category,
 		Tags:         pq.StringArray(req.Tags),
 		State:        req.State,
@@ -58,27 +93,61 @@ func createCustomer(req CustomerRequest) *CustomerResponse {
 		SallerName:   req.SallerName,
 		Sellers:      pq.Int64Array(req.Sellers),
 		CreatedAt:    time.Now(),
+		CreatedBy:    uint(operatorID),
 		UpdatedAt:    time.Now(),
+		UpdatedBy:    uint(operatorID),
 	}
+	applyParsedAddress(customer)
 
-	DB.Create(customer)
-	return CustomerToResponse(customer)
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(customer).Error; err != nil {
+			return err
+		}
+		if err := recordCustomerStateChange(tx, uint64(customer.ID), nil, customer.State, req.StateReason, CustomerChangeAPI, operatorID, customer.CreatedAt); err != nil {
+			return err
+		}
+		return recordCustomerChange(tx, uint64(customer.ID), nil, customerSnapshot(customer), ActionCreate, CustomerChangeAPI, operatorID, "")
+	})
+	if err != nil {
+		return nil, err
+	}
+	return CustomerToResponse(customer), nil
 }
 
-// updateCustomer 更新客户
-func updateCustomer(id uint64, req CustomerRequest) *CustomerResponse {
+// updateCustomer 更新客户，状态变化时按流转规则检查
+func updateCustomer(id uint64, req CustomerRequest, operatorID uint64) (*CustomerResponse, error) {
 	var customer Customer
-	DB.First(&customer, id)
+	if err := DB.Where("is_deleted = ?", false).First(&customer, id).Error; err != nil {
+		return nil, err
+	}
+	if err := validateCustomerStateTransition(DB, customer.State, req.State, req.StateReason); err != nil {
+		return nil, err
+	}
+	before := customerSnapshot(&customer)
+	fromState := customer.State
+
+	// 地址或省市区变化时，街道和区县编码需要重新解析
+	if customer.Address != req.Address || customer.Province != req.Province ||
+		customer.City != req.City || customer.District != req.District {
+		customer.Street = ""
+		customer.DistrictID = 0
+	}
+	if req.DistrictID != 0 {
+		customer.DistrictID = int(req.DistrictID)
+	}
 
 	customer.Name = req.Name
 	customer.ContactName = req.ContactName
 	customer.Phones = pq.StringArray(req.Phones)
+	if req.WorkPhone != nil {
+		customer.WorkPhone = pq.StringArray(req.WorkPhone)
+	}
 	customer.Wechats = pq.StringArray(req.Wechats)
 	customer.Province = req.Province
 	customer.City = req.City
 	customer.District = req.District
 	customer.Address = req.Address
-	customer.Products = pq.StringArray(req.Products)
+	customer.Products = pq.StringArray(canonicalProductNames(DB, req.Products))
 	customer.Category = req.Category
 	customer.Tags = pq.StringArray(req.Tags)
 	customer.State = req.State
@@ -89,14 +158,45 @@ func updateCustomer(id uint64, req CustomerRequest) *CustomerResponse {
 	customer.SallerName = req.SallerName
 	customer.Sellers = pq.Int64Array(req.Sellers)
 	customer.UpdatedAt = time.Now()
+	customer.UpdatedBy = uint(operatorID)
+	applyParsedAddress(&customer)
 
-	DB.Save(&customer)
-	return CustomerToResponse(&customer)
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&customer).Error; err != nil {
+			return err
+		}
+		if err := recordCustomerStateChange(tx, id, &fromState, customer.State, req.StateReason, CustomerChangeAPI, operatorID, customer.UpdatedAt); err != nil {
+			return err
+		}
+		return recordCustomerChange(tx, id, before, customerSnapshot(&customer), ActionUpdate, CustomerChangeAPI, operatorID, "")
+	})
+	if err != nil {
+		return nil, err
+	}
+	return CustomerToResponse(&customer), nil
 }
 
-// deleteCustomer 删除客户
-func deleteCustomer(id uint64) {
-	DB.Delete(&Customer{}, id)
+// deleteCustomer 软删除客户，同时软删除其未完成的待办和待发送的提醒，客户进入回收站
+func deleteCustomer(id uint64, operatorID uint64) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		var customer Customer
+		if err := tx.Where("is_deleted = ?", false).First(&customer, id).Error; err != nil {
+			return err
+		}
+		before := customerSnapshot(&customer)
+		now := time.Now().Truncate(time.Microsecond)
+		customer.IsDeleted = true
+		customer.DeletedAt = &now
+		customer.UpdatedAt = now
+		customer.UpdatedBy = uint(operatorID)
+		if err := tx.Model(&customer).Select("is_deleted", "deleted_at", "updated_at", "updated_by").Updates(&customer).Error; err != nil {
+			return err
+		}
+		if err := softDeleteCustomerRecords(tx, []uint64{id}, now); err != nil {
+			return err
+		}
+		return recordCustomerChange(tx, id, before, customerSnapshot(&customer), ActionDelete, CustomerChangeAPI, operatorID, "")
+	})
 }
 
 // ========== 待办事项相关业务函数 ==========
@@ -106,7 +206,8 @@ func getTodos(customerID uint64, page, pageSize int) ([]TodoResponse, int64) {
 	var todos []Todo
 	var total int64
 
-	query := DB.Model(&Todo{}).Preload("Customer").Preload("Creator").Preload("Executor")
+	query := DB.Model(&Todo{}).Preload("Customer").Preload("Creator").Preload("Executor").
+		Where("is_deleted = ?", false)
 	if customerID > 0 {
 		query = query.Where("customer_id = ?", customerID)
 	}
@@ -354,6 +455,26 @@ func getUsers() []UserResponse {
 	return responses
 }
 
+// userNamesByID 批量查询用户姓名，返回用户ID到姓名的映射（忽略0和重复ID）
+func userNamesByID(ids []uint64) map[uint64]string {
+	var userIDs []uint64
+	for _, id := range ids {
+		if id > 0 && !containsUint64(userIDs, id) {
+			userIDs = append(userIDs, id)
+		}
+	}
+	names := make(map[uint64]string)
+	if len(userIDs) == 0 {
+		return names
+	}
+	var users []User
+	DB.Select("id", "name").Where("id IN ?", userIDs).Find(&users)
+	for _, user := range users {
+		names[user.ID] = user.Name
+	}
+	return names
+}
+
 // getUserDetail 获取用户详情（智能判断员工/客户身份）
 func getUserDetail(id uint64) *UserDetailResponse {
 	var user User
@@ -363,7 +484,7 @@ func getUserDetail(id uint64) *UserDetailResponse {
 
 	// 检查是否为员工（ID存在于customers表的sellers字段中）
 	var customerCount int64
-	DB.Table("customers").Where("? = ANY(sellers)", id).Count(&customerCount)
+	DB.Table("customers").Where("? = ANY(sellers) AND is_deleted = ?", id, false).Count(&customerCount)
 	isEmployee := customerCount > 0
 
 	var displayInfo string
@@ -380,7 +501,7 @@ func getUserDetail(id uint64) *UserDetailResponse {
 	} else {
 		// 客户：显示所在公司名称（从customers表查找）
 		var customer Customer
-		if err := DB.Where("name = ?", user.Name).First(&customer).Error; err == nil {
+		if err := DB.Where("name = ? AND is_deleted = ?", user.Name, false).First(&customer).Error; err == nil {
 			displayInfo = customer.Name
 		}
 	}
@@ -391,19 +512,27 @@ func getUserDetail(id uint64) *UserDetailResponse {
 	var todayFollowUps int64
 
 	DB.Model(&Todo{}).
-		Where("executor_id = ? AND DATE(planned_time) = ? AND status != 'completed'", id, today).
+		Where("executor_id = ? AND DATE(planned_time) = ? AND status != 'completed' AND is_deleted = false", id, today).
 		Count(&todayTodos)
 
 	DB.Model(&FollowUpRecord{}).
 		Where("user_id = ? AND DATE(created_at) = ?", id, today).
 		Count(&todayFollowUps)
 
+	// 今日营业额：今日订单金额减去今日退款
+	todayRevenue := 0
+	now := time.Now()
+	start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	if revenue, err := getSellerRevenue(SalesReportQuery{StartDate: &start, EndDate: &start, SellerID: id}); err == nil && len(revenue) > 0 {
+		todayRevenue = int(math.Round(revenue[0].NetRevenue))
+	}
+
 	return &UserDetailResponse{
 		ID:           user.ID,
 		Name:         user.Name,
 		DisplayInfo:  displayInfo,
 		IsEmployee:   isEmployee,
-		TodayRevenue: 0, // 暂时默认为0
+		TodayRevenue: todayRevenue,
 		TodayFollows: int(todayTodos + todayFollowUps),
 		AvatarURL:    user.AvatarURL,
 	}
@@ -416,7 +545,8 @@ func searchDashboardData(req DashboardSearchRequest) ([]DashboardSearchResponse,
 
 	query := DB.Model(&Todo{}).
 		Preload("Customer").
-		Where("executor_id = ? AND status != 'completed' AND is_deleted = false", req.UserID)
+		Where("todos.executor_id = ? AND todos.status != 'completed' AND todos.is_deleted = false", req.UserID).
+		Where("todos.customer_id IN (SELECT id FROM customers WHERE is_deleted = false)")
 
 	// 时间筛选条件：时间和客户状态维度
 	switch req.TimeFilter {
@@ -434,7 +564,7 @@ func searchDashboardData(req DashboardSearchRequest) ([]DashboardSearchResponse,
 			Where("customers.last_order_date IS NULL")
 	case "公海":
 		query = query.Joins("JOIN customers ON customers.id = todos.customer_id").
-			Where("customers.sellers IS NULL OR array_length(customers.sellers, 1) = 0")
+			Where("customers.sellers IS NULL OR cardinality(customers.sellers) = 0")
 	case "不用跟进":
 		query = query.Joins("JOIN customers ON customers.id = todos.customer_id").
 			Where("customers.remark LIKE '%不用跟进%'")
@@ -518,11 +648,9 @@ func searchDashboardData(req DashboardSearchRequest) ([]DashboardSearchResponse,
 	return responses, total
 }
 
-// searchCustomers 客户搜索
-func searchCustomers(keyword, systemTagsStr string) []CustomerSearchResponse {
-	var customers []Customer
-
-	query := DB.Model(&Customer{})
+// buildCustomerSearchQuery 构建客户搜索的筛选条件（关键词、系统标签、行政区划），供搜索和地图导出共用
+func buildCustomerSearchQuery(keyword, systemTagsStr, regionCode string) *gorm.DB {
+	query := DB.Model(&Customer{}).Where("is_deleted = ?", false)
 
 	// 关键词搜索（客户名称或联系人）
 	if keyword != "" {
@@ -548,6 +676,20 @@ func searchCustomers(keyword, systemTagsStr string) []CustomerSearchResponse {
 		}
 	}
 
+	// 行政区划筛选（省/市/区县任意层级）
+	if regionCode != "" {
+		query = applyRegionFilter(query, regionCode)
+	}
+
+	return query
+}
+
+// searchCustomers 客户搜索
+func searchCustomers(keyword, systemTagsStr, regionCode string) []CustomerSearchResponse {
+	var customers []Customer
+
+	query := buildCustomerSearchQuery(keyword, systemTagsStr, regionCode)
+
 	// 查询所有匹配的客户
 	query.Order("updated_at DESC").Find(&customers)
 
@@ -632,7 +774,7 @@ func getReminders(userID uint64, page, pageSize int) ([]ReminderResponse, int64)
 	var reminders []Reminder
 	var total int64
 
-	query := DB.Model(&Reminder{}).Preload("Todo").Preload("User")
+	query := DB.Model(&Reminder{}).Preload("Todo").Preload("User").Where("is_deleted = ?", false)
 	if userID > 0 {
 		query = query.Where("user_id = ?", userID)
 	}
@@ -675,10 +817,12 @@ func createReminder(req ReminderCreateRequest) *ReminderResponse {
 
 // ========== 客户偏好相关业务函数 ==========
 
-// getCustomerPreferences 获取客户偏好列表
+// getCustomerPreferences 获取客户偏好列表，客户不存在或已删除时返回 nil
 func getCustomerPreferences(customerID uint64) *CustomerPreferenceListResponse {
 	var customer Customer
-	DB.First(&customer, customerID)
+	if err := DB.Where("is_deleted = ?", false).First(&customer, customerID).Error; err != nil {
+		return nil
+	}
 
 	// 解析JSONB格式的偏好数据
 	preferences := []CustomerPreferenceItem{}
@@ -691,6 +835,7 @@ func getCustomerPreferences(customerID uint64) *CustomerPreferenceListResponse {
 					Name:        getStringFromMap(favorMap, "name"),
 					Value:       favorMap["value"],
 					Description: getStringFromMap(favorMap, "description"),
+					ProductID:   getUint64FromMap(favorMap, "product_id"),
 					CreatedAt:   getTimeFromMap(favorMap, "created_at"),
 					UpdatedAt:   getTimeFromMap(favorMap, "updated_at"),
 				}
@@ -707,10 +852,13 @@ func getCustomerPreferences(customerID uint64) *CustomerPreferenceListResponse {
 	}
 }
 
-// createCustomerPreference 创建客户偏好
-func createCustomerPreference(req CustomerPreferenceCreateRequest) *CustomerPreferenceResponse {
+// createCustomerPreference 创建客户偏好，客户不存在或已删除时返回 gorm.ErrRecordNotFound
+func createCustomerPreference(req CustomerPreferenceCreateRequest, operatorID uint64) (*CustomerPreferenceResponse, error) {
 	var customer Customer
-	DB.First(&customer, req.CustomerID)
+	if err := DB.Where("is_deleted = ?", false).First(&customer, req.CustomerID).Error; err != nil {
+		return nil, err
+	}
+	before := customerSnapshot(&customer)
 
 	// 初始化favors字段
 	if customer.Favors == nil {
@@ -730,39 +878,47 @@ func createCustomerPreference(req CustomerPreferenceCreateRequest) *CustomerPref
 		"created_at":  now,
 		"updated_at":  now,
 	}
+	linkPreferenceProduct(DB, preferenceData)
 
 	customer.Favors[preferenceID] = preferenceData
 	customer.UpdatedAt = now
+	customer.UpdatedBy = uint(operatorID)
 
-	DB.Save(&customer)
+	if err := saveCustomerPreferences(&customer, before, operatorID); err != nil {
+		return nil, err
+	}
 
 	return &CustomerPreferenceResponse{
 		CustomerPreferenceItem: CustomerPreferenceItem{
 			ID:          preferenceID,
 			Category:    req.Category,
-			Name:        req.Name,
+			Name:        getStringFromMap(preferenceData, "name"),
 			Value:       req.Value,
 			Description: req.Description,
+			ProductID:   getUint64FromMap(preferenceData, "product_id"),
 			CreatedAt:   now,
 			UpdatedAt:   now,
 		},
 		CustomerID:   req.CustomerID,
 		CustomerName: customer.Name,
-	}
+	}, nil
 }
 
-// updateCustomerPreference 更新客户偏好
-func updateCustomerPreference(customerID uint64, preferenceID string, req CustomerPreferenceUpdateRequest) *CustomerPreferenceResponse {
+// updateCustomerPreference 更新客户偏好，客户或偏好不存在时返回 gorm.ErrRecordNotFound
+func updateCustomerPreference(customerID uint64, preferenceID string, req CustomerPreferenceUpdateRequest, operatorID uint64) (*CustomerPreferenceResponse, error) {
 	var customer Customer
-	DB.First(&customer, customerID)
+	if err := DB.Where("is_deleted = ?", false).First(&customer, customerID).Error; err != nil {
+		return nil, err
+	}
+	before := customerSnapshot(&customer)
 
 	if customer.Favors == nil || customer.Favors[preferenceID] == nil {
-		return nil
+		return nil, gorm.ErrRecordNotFound
 	}
 
 	preferenceData, ok := customer.Favors[preferenceID].(map[string]interface{})
 	if !ok {
-		return nil
+		return nil, gorm.ErrRecordNotFound
 	}
 
 	now := time.Now()
@@ -781,11 +937,15 @@ func updateCustomerPreference(customerID uint64, preferenceID string, req Custom
 		preferenceData["description"] = *req.Description
 	}
 	preferenceData["updated_at"] = now
+	linkPreferenceProduct(DB, preferenceData)
 
 	customer.Favors[preferenceID] = preferenceData
 	customer.UpdatedAt = now
+	customer.UpdatedBy = uint(operatorID)
 
-	DB.Save(&customer)
+	if err := saveCustomerPreferences(&customer, before, operatorID); err != nil {
+		return nil, err
+	}
 
 	return &CustomerPreferenceResponse{
 		CustomerPreferenceItem: CustomerPreferenceItem{
@@ -794,22 +954,8414 @@ func updateCustomerPreference(customerID uint64, preferenceID string, req Custom
 			Name:        getStringFromMap(preferenceData, "name"),
 			Value:       preferenceData["value"],
 			Description: getStringFromMap(preferenceData, "description"),
+			ProductID:   getUint64FromMap(preferenceData, "product_id"),
 			CreatedAt:   getTimeFromMap(preferenceData, "created_at"),
 			UpdatedAt:   now,
 		},
 		CustomerID:   customerID,
 		CustomerName: customer.Name,
+	}, nil
+}
+
+// deleteCustomerPreference 删除客户偏好，客户或偏好不存在时返回 gorm.ErrRecordNotFound
+func deleteCustomerPreference(customerID uint64, preferenceID string, operatorID uint64) error {
+	var customer Customer
+	if err := DB.Where("is_deleted = ?", false).First(&customer, customerID).Error; err != nil {
+		return err
+	}
+	if customer.Favors == nil || customer.Favors[preferenceID] == nil {
+		return gorm.ErrRecordNotFound
+	}
+	before := customerSnapshot(&customer)
+
+	delete(customer.Favors, preferenceID)
+	customer.UpdatedAt = time.Now()
+	customer.UpdatedBy = uint(operatorID)
+	return saveCustomerPreferences(&customer, before, operatorID)
+}
+
+// saveCustomerPreferences 保存客户偏好的修改并记录变更历史
+func saveCustomerPreferences(customer *Customer, before JSONB, operatorID uint64) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(customer).Error; err != nil {
+			return err
+		}
+		return recordCustomerChange(tx, uint64(customer.ID), before, customerSnapshot(customer), ActionUpdate, CustomerChangeAPI, operatorID, "")
+	})
+}
+
+// ========== 客户导入相关业务函数 ==========
+
+// customerImportColumns 销售记录导入文件的标准列（共53列，按顺序）
+var customerImportColumns = []string{
+	"公司名称", "仓库名称", "销售单日期", "销售单号", "退货单号", "退货单日期", "销售员ID", "销售员",
+	"公司手机ID", "公司手机号", "客户ID", "客户", "商品编码", "批次号", "任务标记",
+	"商品分类一", "商品分类二", "商品分类三", "商品分类四", "商品名称", "商品别名", "单位", "单位重量",
+	"进价", "商品单价（含税）", "数量", "商品金额（含税）", "税率", "折扣金额", "销售金额（含税）",
+	"包装费", "运费", "客户承担费用", "余额充值", "余额支付", "收款方式", "收款金额", "收款日期",
+	"收入金额（含税）", "审核人", "审核时间", "审核状态", "审核备注", "单据状态", "客户电话",
+	"发货方式", "发货备注", "快递单号", "收货人", "收货号码", "收货地址", "创建者", "备注",
+}
+
+// readImportRecords 读取导入文件的全部行，支持 .xlsx 和 .csv（UTF-8 或 GBK 编码）
+func readImportRecords(filename string, r io.Reader) ([][]string, error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".xlsx":
+		f, err := excelize.OpenReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("无法解析Excel文件: %w", err)
+		}
+		defer f.Close()
+
+		sheets := f.GetSheetList()
+		if len(sheets) == 0 {
+			return nil, fmt.Errorf("Excel文件中没有工作表")
+		}
+		return f.GetRows(sheets[0])
+	case ".csv":
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("读取CSV文件失败: %w", err)
+		}
+
+		// 去除BOM，Excel另存的CSV通常为GBK编码
+		data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+		if !utf8.Valid(data) {
+			if decoded, err := simplifiedchinese.GBK.NewDecoder().Bytes(data); err == nil {
+				data = decoded
+			}
+		}
+
+		reader := csv.NewReader(bytes.NewReader(data))
+		reader.FieldsPerRecord = -1
+		reader.LazyQuotes = true
+		return reader.ReadAll()
+	default:
+		return nil, fmt.Errorf("不支持的文件格式 %q，仅支持 .xlsx 和 .csv", filepath.Ext(filename))
+	}
+}
+
+// parseCustomerImportRows 将文件行解析为导入行
+// 首行为表头时按列名定位，否则按标准列顺序定位；空行会被忽略
+func parseCustomerImportRows(records [][]string) []CustomerImportRow {
+	if len(records) == 0 {
+		return nil
+	}
+
+	index := make(map[string]int, len(customerImportColumns))
+	start := 0
+	if isCustomerImportHeader(records[0]) {
+		for i, cell := range records[0] {
+			index[strings.TrimSpace(cell)] = i
+		}
+		start = 1
+	} else {
+		for i, name := range customerImportColumns {
+			index[name] = i
+		}
+	}
+
+	cell := func(record []string, column string) string {
+		i, ok := index[column]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	var rows []CustomerImportRow
+	for i := start; i < len(records); i++ {
+		record := records[i]
+		if strings.TrimSpace(strings.Join(record, "")) == "" {
+			continue
+		}
+
+		rows = append(rows, CustomerImportRow{
+			RowNumber:            i + 1,
+			OriginalCustomerID:   cell(record, "客户ID"),
+			CustomerName:         cell(record, "客户"),
+			CustomerPhone:        cell(record, "客户电话"),
+			Receiver:             cell(record, "收货人"),
+			ReceiverPhone:        cell(record, "收货号码"),
+			ReceiverAddress:      cell(record, "收货地址"),
+			SellerID:             cell(record, "销售员ID"),
+			SellerName:           cell(record, "销售员"),
+			ProductName:          cell(record, "商品名称"),
+			ProductCode:          cell(record, "商品编码"),
+			ProductCategories:    []string{cell(record, "商品分类一"), cell(record, "商品分类二"), cell(record, "商品分类三"), cell(record, "商品分类四")},
+			ProductAliases:       cell(record, "商品别名"),
+			ProductUnit:          cell(record, "单位"),
+			ProductUnitWeight:    cell(record, "单位重量"),
+			ProductPurchasePrice: cell(record, "进价"),
+			DeliveryMethod:       cell(record, "发货方式"),
+		})
+	}
+
+	return rows
+}
+
+// isCustomerImportHeader 判断是否为表头行
+func isCustomerImportHeader(record []string) bool {
+	for _, cell := range record {
+		switch strings.TrimSpace(cell) {
+		case "客户", "客户电话", "客户ID":
+			return true
+		}
+	}
+	return false
+}
+
+// importCustomers 逐行导入客户，返回逐行结果报告
+// dryRun 为 true 时在事务中执行并最终回滚，报告的是"将会"新建或合并的结果
+func importCustomers(rows []CustomerImportRow, importSource string, dryRun bool, operatorID uint64) *CustomerImportResponse {
+	response := &CustomerImportResponse{
+		ImportSource: importSource,
+		DryRun:       dryRun,
+		Rows:         make([]CustomerImportRowResult, 0, len(rows)),
+	}
+
+	tx := DB
+	if dryRun {
+		tx = DB.Begin()
+		defer tx.Rollback()
+	}
+
+	for _, row := range rows {
+		addImportRowResult(response, importCustomerRowAtomic(tx, row, importSource, operatorID))
+	}
+
+	return response
+}
+
+// addImportRowResult 记录单行导入结果并累计统计
+func addImportRowResult(response *CustomerImportResponse, result CustomerImportRowResult) {
+	response.Total++
+	switch result.Status {
+	case ImportRowCreated:
+		response.Created++
+	case ImportRowUpdated:
+		response.Updated++
+	case ImportRowSkipped:
+		response.Skipped++
+	case ImportRowFailed:
+		response.Failed++
+	}
+	response.Rows = append(response.Rows, result)
+}
+
+// errImportRowFailed 导入行失败，用于回滚该行的写入
+var errImportRowFailed = errors.New("导入行失败")
+
+// importCustomerRowAtomic 在独立事务中导入单行，失败的行整体回滚，不影响其他行
+// tx 已在事务中（试运行）时使用保存点，避免一行出错导致整个事务中止、后续各行都报同一个错误
+func importCustomerRowAtomic(tx *gorm.DB, row CustomerImportRow, importSource string, operatorID uint64) CustomerImportRowResult {
+	var result CustomerImportRowResult
+	err := tx.Transaction(func(rowTx *gorm.DB) error {
+		result = importCustomerRow(rowTx, row, importSource, operatorID)
+		if result.Status == ImportRowFailed {
+			return errImportRowFailed
+		}
+		return nil
+	})
+	if err != nil && result.Status != ImportRowFailed {
+		result = CustomerImportRowResult{Row: row.RowNumber, CustomerName: row.CustomerName, Status: ImportRowFailed, Message: err.Error()}
 	}
+	return result
 }
 
-// deleteCustomerPreference 删除客户偏好
-func deleteCustomerPreference(customerID uint64, preferenceID string) {
+// importCustomerRow 导入单行：以电话号码为唯一标识，已存在则合并更新，否则新建
+func importCustomerRow(tx *gorm.DB, row CustomerImportRow, importSource string, operatorID uint64) CustomerImportRowResult {
+	result := CustomerImportRowResult{Row: row.RowNumber, CustomerName: row.CustomerName}
+
+	if row.CustomerName == "" {
+		result.Status = ImportRowFailed
+		result.Message = "客户名称为空"
+		return result
+	}
+
+	rawPhones := append(splitMultiValue(row.CustomerPhone), splitMultiValue(row.ReceiverPhone)...)
+	if len(rawPhones) == 0 {
+		result.Status = ImportRowSkipped
+		result.Message = "缺少客户电话和收货号码，无法识别客户"
+		return result
+	}
+	// 格式不正确的号码不参与识别和保存
+	var phones pq.StringArray
+	for _, phone := range rawPhones {
+		if p, err := validatePhone(phone); err == nil && !containsString(phones, p) {
+			phones = append(phones, p)
+		}
+	}
+	if len(phones) == 0 {
+		result.Status = ImportRowSkipped
+		result.Message = "客户电话和收货号码格式均不正确，无法识别客户"
+		return result
+	}
+
+	// 商品登记到商品目录，客户产品使用目录中的商品名称
+	row.ProductName = importCatalogProduct(tx, row)
+
 	var customer Customer
-	DB.First(&customer, customerID)
+	err := tx.Where("phones && ? AND is_deleted = ?", phones, false).Order("id ASC").First(&customer).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		result.Status = ImportRowFailed
+		result.Message = err.Error()
+		return result
+	}
 
-	if customer.Favors != nil {
-		delete(customer.Favors, preferenceID)
-		customer.UpdatedAt = time.Now()
-		DB.Save(&customer)
+	now := time.Now()
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		customer = Customer{CreatedAt: now, CreatedBy: uint(operatorID), UpdatedAt: now, UpdatedBy: uint(operatorID)}
+		applyImportRow(&customer, row, phones, importSource)
+		if err := tx.Create(&customer).Error; err != nil {
+			result.Status = ImportRowFailed
+			result.Message = err.Error()
+			return result
+		}
+		err := recordCustomerStateChange(tx, uint64(customer.ID), nil, customer.State, "", CustomerChangeImport, operatorID, now)
+		if err == nil {
+			err = recordCustomerChange(tx, uint64(customer.ID), nil, customerSnapshot(&customer), ActionCreate, CustomerChangeImport, operatorID, importSource)
+		}
+		if err != nil {
+			result.Status = ImportRowFailed
+			result.Message = err.Error()
+			return result
+		}
+		result.Status = ImportRowCreated
+		result.CustomerID = customer.ID
+		return result
+	}
+
+	result.CustomerID = customer.ID
+	before := customerSnapshot(&customer)
+	if !applyImportRow(&customer, row, phones, importSource) {
+		result.Status = ImportRowSkipped
+		result.Message = "没有需要更新的信息"
+		return result
+	}
+
+	customer.UpdatedAt = now
+	customer.UpdatedBy = uint(operatorID)
+	if err := tx.Save(&customer).Error; err != nil {
+		result.Status = ImportRowFailed
+		result.Message = err.Error()
+		return result
+	}
+	if err := recordCustomerChange(tx, uint64(customer.ID), before, customerSnapshot(&customer), ActionUpdate, CustomerChangeImport, operatorID, importSource); err != nil {
+		result.Status = ImportRowFailed
+		result.Message = err.Error()
+		return result
+	}
+	result.Status = ImportRowUpdated
+	return result
+}
+
+// applyImportRow 将导入行合并到客户：数组字段取并集，其余字段仅补全空缺，返回是否有变化
+func applyImportRow(customer *Customer, row CustomerImportRow, phones []string, importSource string) bool {
+	changed := false
+	var merged bool
+
+	customer.Phones, merged = mergeStringArray(customer.Phones, phones...)
+	changed = changed || merged
+
+	var sellerIDs []int64
+	for _, part := range splitMultiValue(row.SellerID) {
+		if id, err := parseInt64(part); err == nil {
+			sellerIDs = append(sellerIDs, id)
+		}
+	}
+	customer.Sellers, merged = mergeInt64Array(customer.Sellers, sellerIDs...)
+	changed = changed || merged
+
+	customer.Products, merged = mergeStringArray(customer.Products, row.ProductName)
+	changed = changed || merged
+
+	changed = fillEmptyString(&customer.Name, row.CustomerName) || changed
+	changed = fillEmptyString(&customer.ContactName, row.Receiver) || changed
+	changed = fillEmptyString(&customer.Address, row.ReceiverAddress) || changed
+	changed = fillEmptyString(&customer.OriginalCustomerID, row.OriginalCustomerID) || changed
+	changed = fillEmptyString(&customer.ImportSource, importSource) || changed
+	changed = fillEmptyString(&customer.SallerName, row.SellerName) || changed
+	changed = fillEmptyString(&customer.PreferredDeliveryMethod, row.DeliveryMethod) || changed
+	changed = applyParsedAddress(customer) || changed
+
+	return changed
+}
+
+// ========== 导入任务相关业务函数 ==========
+
+// importFileMaxBytes 导入文件上传的最大字节数
+const importFileMaxBytes = 50 << 20
+
+// importJobBatchSize 导入任务每处理多少行落库一次进度和逐行结果
+const importJobBatchSize = 200
+
+// importJobCancelWait 取消运行中的任务时等待后台协程退出的最长时间
+const importJobCancelWait = 5 * time.Second
+
+// importJobHandle 运行中导入任务的取消函数和结束通知
+type importJobHandle struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// importJobCancels 运行中的导入任务（任务ID -> *importJobHandle）
+var importJobCancels sync.Map
+
+// createImportJob 创建导入任务并在后台执行
+func createImportJob(filename string, data []byte, req ImportJobCreateRequest) (*ImportJobResponse, error) {
+	importSource := req.ImportSource
+	if importSource == "" {
+		importSource = filename
+	}
+
+	job := &ImportJob{
+		FileName:     filename,
+		ImportSource: importSource,
+		DryRun:       req.DryRun,
+		Status:       ImportJobPending,
+		CreatedBy:    req.CreatedBy,
+	}
+	if err := DB.Create(job).Error; err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	handle := &importJobHandle{cancel: cancel, done: make(chan struct{})}
+	importJobCancels.Store(job.ID, handle)
+	go runImportJob(ctx, job.ID, filename, data)
+
+	return importJobToResponse(job), nil
+}
+
+// runImportJob 后台执行导入任务
+// 试运行任务按批在事务中执行并回滚，同一批内的行能看到前面行的效果；正式任务被取消时，已处理的行保持生效
+func runImportJob(ctx context.Context, jobID uint64, filename string, data []byte) {
+	defer func() {
+		if handle, ok := importJobCancels.LoadAndDelete(jobID); ok {
+			handle.(*importJobHandle).cancel()
+			close(handle.(*importJobHandle).done)
+		}
+	}()
+
+	var job ImportJob
+	if err := DB.First(&job, jobID).Error; err != nil {
+		return
+	}
+
+	now := time.Now()
+	job.Status = ImportJobRunning
+	job.StartedAt = &now
+	DB.Model(&job).Updates(map[string]interface{}{"status": job.Status, "started_at": job.StartedAt})
+
+	records, err := readImportRecords(filename, bytes.NewReader(data))
+	if err != nil {
+		finishImportJob(&job, ImportJobFailed, err.Error())
+		return
+	}
+
+	rows := parseCustomerImportRows(records)
+	job.TotalRows = len(rows)
+	job.Header = pq.StringArray(customerImportColumns)
+	if len(records) > 0 && isCustomerImportHeader(records[0]) {
+		job.Header = pq.StringArray(records[0])
+	}
+	DB.Model(&job).Updates(map[string]interface{}{"total_rows": job.TotalRows, "header": job.Header})
+
+	// 试运行每批行在各自的事务中执行，保存该批进度前回滚，避免整个文件占用一个长事务
+	var dryRunTx *gorm.DB
+	defer func() {
+		if dryRunTx != nil {
+			dryRunTx.Rollback()
+		}
+	}()
+	status := processImportJobRows(ctx, &job, rows, records,
+		func(row CustomerImportRow) CustomerImportRowResult {
+			tx := DB
+			if job.DryRun {
+				if dryRunTx == nil {
+					dryRunTx = DB.Begin()
+				}
+				tx = dryRunTx
+			}
+			return importCustomerRowAtomic(tx, row, job.ImportSource, job.CreatedBy)
+		},
+		func(batch []ImportJobRow) {
+			if dryRunTx != nil {
+				dryRunTx.Rollback()
+				dryRunTx = nil
+			}
+			saveImportJobProgress(&job, batch)
+		})
+
+	finishImportJob(&job, status, "")
+}
+
+// processImportJobRows 逐行导入并累计任务进度，每 importJobBatchSize 行调用 save 保存一次逐行结果和进度
+// 每行处理前检查是否已取消，取消时停止处理并返回 ImportJobCancelled，已处理的行照常保存
+func processImportJobRows(ctx context.Context, job *ImportJob, rows []CustomerImportRow, records [][]string,
+	importRow func(CustomerImportRow) CustomerImportRowResult, save func([]ImportJobRow)) ImportJobStatus {
+	status := ImportJobCompleted
+	batch := make([]ImportJobRow, 0, importJobBatchSize)
+	for _, row := range rows {
+		if ctx.Err() != nil {
+			status = ImportJobCancelled
+			break
+		}
+
+		result := importRow(row)
+		job.ProcessedRows++
+		switch result.Status {
+		case ImportRowCreated:
+			job.CreatedRows++
+		case ImportRowUpdated:
+			job.UpdatedRows++
+		case ImportRowSkipped:
+			job.SkippedRows++
+		case ImportRowFailed:
+			job.FailedRows++
+		}
+
+		var rawData pq.StringArray
+		if row.RowNumber >= 1 && row.RowNumber <= len(records) {
+			rawData = pq.StringArray(records[row.RowNumber-1])
+		}
+		batch = append(batch, ImportJobRow{
+			JobID:      job.ID,
+			RowNumber:  result.Row,
+			Status:     result.Status,
+			CustomerID: result.CustomerID,
+			Message:    result.Message,
+			RawData:    rawData,
+		})
+		if len(batch) >= importJobBatchSize {
+			save(batch)
+			batch = batch[:0]
+		}
+	}
+	save(batch)
+	return status
+}
+
+// saveImportJobProgress 保存逐行结果并更新任务进度
+func saveImportJobProgress(job *ImportJob, rows []ImportJobRow) {
+	if len(rows) > 0 {
+		DB.CreateInBatches(rows, importJobBatchSize)
+	}
+	DB.Model(job).Updates(map[string]interface{}{
+		"processed_rows": job.ProcessedRows,
+		"created_rows":   job.CreatedRows,
+		"updated_rows":   job.UpdatedRows,
+		"skipped_rows":   job.SkippedRows,
+		"failed_rows":    job.FailedRows,
+	})
+}
+
+// finishImportJob 结束导入任务
+func finishImportJob(job *ImportJob, status ImportJobStatus, errorMessage string) {
+	now := time.Now()
+	job.Status = status
+	job.ErrorMessage = errorMessage
+	job.FinishedAt = &now
+	DB.Model(job).Updates(map[string]interface{}{
+		"status":        job.Status,
+		"error_message": job.ErrorMessage,
+		"finished_at":   job.FinishedAt,
+	})
+}
+
+// recoverImportJobs 将服务重启前未完成的导入任务标记为失败
+func recoverImportJobs() {
+	DB.Model(&ImportJob{}).
+		Where("status IN ?", []ImportJobStatus{ImportJobPending, ImportJobRunning}).
+		Updates(map[string]interface{}{
+			"status":        ImportJobFailed,
+			"error_message": "服务重启，任务中断",
+			"finished_at":   time.Now(),
+		})
+}
+
+// getImportJobs 获取导入任务列表
+func getImportJobs(page, pageSize int) ([]*ImportJobResponse, int64) {
+	var jobs []ImportJob
+	var total int64
+
+	query := DB.Model(&ImportJob{})
+	query.Count(&total)
+	query.Offset((page - 1) * pageSize).Limit(pageSize).Order("created_at DESC").Find(&jobs)
+
+	responses := make([]*ImportJobResponse, len(jobs))
+	for i := range jobs {
+		responses[i] = importJobToResponse(&jobs[i])
+	}
+
+	return responses, total
+}
+
+// getImportJob 获取导入任务状态和进度
+func getImportJob(id uint64) (*ImportJobResponse, error) {
+	var job ImportJob
+	if err := DB.First(&job, id).Error; err != nil {
+		return nil, err
+	}
+	return importJobToResponse(&job), nil
+}
+
+// getImportJobRows 获取导入任务的逐行结果（可按处理结果筛选）
+func getImportJobRows(jobID uint64, status string, page, pageSize int) ([]ImportJobRow, int64) {
+	var rows []ImportJobRow
+	var total int64
+
+	query := DB.Model(&ImportJobRow{}).Where("job_id = ?", jobID)
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	query.Count(&total)
+	query.Offset((page - 1) * pageSize).Limit(pageSize).Order("row_number ASC").Find(&rows)
+
+	return rows, total
+}
+
+// cancelImportJob 取消等待中或运行中的导入任务
+func cancelImportJob(id uint64) (*ImportJobResponse, error) {
+	var job ImportJob
+	if err := DB.First(&job, id).Error; err != nil {
+		return nil, err
+	}
+
+	if job.Status != ImportJobPending && job.Status != ImportJobRunning {
+		return nil, fmt.Errorf("任务状态为 %s，无法取消", job.Status)
+	}
+
+	// 运行中的任务由后台协程在下一行处理前退出并更新状态，等待其退出后返回最新的任务状态
+	if handle, ok := importJobCancels.Load(id); ok {
+		handle.(*importJobHandle).cancel()
+		select {
+		case <-handle.(*importJobHandle).done:
+		case <-time.After(importJobCancelWait):
+		}
+		if err := DB.First(&job, id).Error; err != nil {
+			return nil, err
+		}
+	} else {
+		finishImportJob(&job, ImportJobCancelled, "")
+	}
+
+	return importJobToResponse(&job), nil
+}
+
+// exportImportJobErrors 导出失败和跳过的行为CSV（原始列 + 处理结果 + 错误原因），修正后可直接重新导入
+func exportImportJobErrors(jobID uint64) ([]byte, error) {
+	var job ImportJob
+	if err := DB.First(&job, jobID).Error; err != nil {
+		return nil, err
+	}
+
+	var rows []ImportJobRow
+	DB.Where("job_id = ? AND status IN ?", jobID, []ImportRowStatus{ImportRowFailed, ImportRowSkipped}).
+		Order("row_number ASC").Find(&rows)
+
+	var buf bytes.Buffer
+	buf.WriteString("\xef\xbb\xbf")
+	writer := csv.NewWriter(&buf)
+
+	header := append([]string{}, job.Header...)
+	writer.Write(append(header, "处理结果", "错误原因"))
+	for _, row := range rows {
+		record := make([]string, len(job.Header))
+		copy(record, row.RawData)
+		writer.Write(append(record, string(row.Status), row.Message))
+	}
+	writer.Flush()
+
+	return buf.Bytes(), writer.Error()
+}
+
+// importJobToResponse 将导入任务转换为响应
+func importJobToResponse(job *ImportJob) *ImportJobResponse {
+	response := &ImportJobResponse{ImportJob: *job}
+	if job.Status == ImportJobCompleted {
+		response.Progress = 100
+	} else if job.TotalRows > 0 {
+		response.Progress = job.ProcessedRows * 100 / job.TotalRows
+	}
+	return response
+}
+
+// ========== 行政区划与地址解析相关业务函数 ==========
+
+// regionData 内嵌的行政区划字典（省/市/区县三级，code/name/children 嵌套结构）
+//
+//go:embed regions.json
+var regionData []byte
+
+// regionPlaceholderNames 直辖市、省直辖县级行政区划等占位的市级节点，解析时跳过该层
+var regionPlaceholderNames = map[string]bool{
+	"市辖区":         true,
+	"县":           true,
+	"省直辖县级行政区划":   true,
+	"自治区直辖县级行政区划": true,
+}
+
+// regionEthnicNames 民族自治地方名称中的民族词，用于生成简称（如"恩施土家族苗族自治州"->"恩施"）
+var regionEthnicNames = []string{
+	"土家族", "苗族", "朝鲜族", "藏族", "羌族", "彝族", "布依族", "侗族", "哈尼族", "壮族",
+	"傣族", "白族", "景颇族", "傈僳族", "回族", "蒙古", "柯尔克孜", "哈萨克", "黎族", "维吾尔",
+}
+
+// regionSuffixes 区划名称的通用后缀，较长的后缀在前
+var regionSuffixes = []string{"特别行政区", "自治区", "自治州", "自治县", "自治旗", "新区", "林区", "地区", "省", "市", "区", "县", "盟", "旗"}
+
+// addressStreetSuffixes 街道/乡镇级名称的后缀
+var addressStreetSuffixes = []string{"街道办事处", "街道", "镇", "乡", "苏木"}
+
+// regionIndex 行政区划索引
+type regionIndex struct {
+	provinces []*Region
+	cities    []*Region // 市级节点（不含占位节点）
+	districts []*Region // 区县级节点
+	byCode    map[string]*Region
+}
+
+var (
+	regionIndexOnce sync.Once
+	regionIdx       *regionIndex
+)
+
+// getRegionIndex 加载内嵌的行政区划字典并建立索引
+func getRegionIndex() *regionIndex {
+	regionIndexOnce.Do(func() {
+		idx := &regionIndex{byCode: make(map[string]*Region)}
+		if err := json.Unmarshal(regionData, &idx.provinces); err != nil {
+			log.Printf("加载行政区划字典失败: %v", err)
+		}
+		for _, province := range idx.provinces {
+			indexRegion(idx, province, nil, 1)
+		}
+		regionIdx = idx
+	})
+	return regionIdx
+}
+
+// indexRegion 递归设置层级和上级节点并加入索引
+func indexRegion(idx *regionIndex, region, parent *Region, level int) {
+	region.parent = parent
+	region.Level = level
+	idx.byCode[region.Code] = region
+	switch level {
+	case 2:
+		if !regionPlaceholderNames[region.Name] {
+			idx.cities = append(idx.cities, region)
+		}
+	case 3:
+		idx.districts = append(idx.districts, region)
+	}
+	for _, child := range region.Children {
+		indexRegion(idx, child, region, level+1)
+	}
+}
+
+// regionShortName 区划简称（去掉民族词和通用后缀），不足两个字时返回空
+func regionShortName(name string) string {
+	short := name
+	for _, ethnic := range regionEthnicNames {
+		if i := strings.Index(short, ethnic); i > 0 && utf8.RuneCountInString(short[:i]) >= 2 {
+			short = short[:i]
+		}
+	}
+	for _, suffix := range regionSuffixes {
+		if strings.HasSuffix(short, suffix) {
+			short = strings.TrimSuffix(short, suffix)
+			break
+		}
+	}
+	if utf8.RuneCountInString(short) < 2 {
+		return ""
+	}
+	return short
+}
+
+// matchRegionPrefix 在候选区划中查找出现在地址开头的名称（优先最长匹配），返回命中的区划和剩余地址
+func matchRegionPrefix(candidates []*Region, address string, allowShort bool) (*Region, string) {
+	var best *Region
+	bestLen := 0
+	for _, region := range candidates {
+		names := []string{region.Name}
+		if allowShort {
+			if short := regionShortName(region.Name); short != "" {
+				names = append(names, short)
+			}
+		}
+		for _, name := range names {
+			if len(name) > bestLen && strings.HasPrefix(address, name) {
+				best, bestLen = region, len(name)
+			}
+		}
+	}
+	if best == nil {
+		return nil, address
+	}
+	return best, address[bestLen:]
+}
+
+// regionCities 省份下的市级节点（跳过占位节点）
+func regionCities(province *Region) []*Region {
+	var cities []*Region
+	for _, child := range province.Children {
+		if !regionPlaceholderNames[child.Name] {
+			cities = append(cities, child)
+		}
+	}
+	return cities
+}
+
+// regionDistricts 省份下的全部区县级节点
+func regionDistricts(province *Region) []*Region {
+	var districts []*Region
+	for _, child := range province.Children {
+		districts = append(districts, child.Children...)
+	}
+	return districts
+}
+
+// parseChineseAddress 解析中文地址，识别省、市、区县和街道/乡镇
+func parseChineseAddress(address string) ParsedAddress {
+	var parsed ParsedAddress
+	idx := getRegionIndex()
+	rest := strings.Join(strings.Fields(address), "")
+	if rest == "" {
+		return parsed
+	}
+
+	province, rest := matchRegionPrefix(idx.provinces, rest, true)
+
+	cities := idx.cities
+	if province != nil {
+		cities = regionCities(province)
+	}
+	city, rest := matchRegionPrefix(cities, rest, true)
+	if province != nil && city == nil {
+		// 直辖市常写作"北京市北京市朝阳区"
+		_, rest = matchRegionPrefix([]*Region{province}, rest, true)
+	}
+
+	var district *Region
+	switch {
+	case city != nil:
+		district, rest = matchRegionPrefix(city.Children, rest, true)
+	case province != nil:
+		district, rest = matchRegionPrefix(regionDistricts(province), rest, true)
+	default:
+		// 没有省市时简称容易误判，只按全称匹配
+		district, rest = matchRegionPrefix(idx.districts, rest, false)
+	}
+
+	if district != nil && city == nil {
+		city = district.parent
+	}
+	if city != nil && province == nil {
+		province = city.parent
+	}
+
+	if province != nil {
+		parsed.Province = province.Name
+	}
+	if city != nil {
+		parsed.City = city.Name
+		if regionPlaceholderNames[city.Name] {
+			// 直辖市的市级取省级名称，省直辖县级市取自身名称
+			parsed.City = province.Name
+			if city.Name != "市辖区" && city.Name != "县" && district != nil {
+				parsed.City = district.Name
+			}
+		}
+	}
+	if district != nil {
+		parsed.District = district.Name
+		parsed.DistrictID, _ = strconv.Atoi(district.Code)
+	}
+	parsed.Street, parsed.Detail = splitAddressStreet(rest)
+	return parsed
+}
+
+// splitAddressStreet 从区县之后的地址中拆出街道/乡镇名称和详细地址
+func splitAddressStreet(rest string) (string, string) {
+	start, end := -1, -1
+	for _, suffix := range addressStreetSuffixes {
+		i := strings.Index(rest, suffix)
+		// 街道/乡镇名称一般为2~8个字
+		if i < 0 || utf8.RuneCountInString(rest[:i]) < 2 || utf8.RuneCountInString(rest[:i]) > 8 {
+			continue
+		}
+		if start < 0 || i < start || (i == start && i+len(suffix) > end) {
+			start, end = i, i+len(suffix)
+		}
+	}
+	if end < 0 {
+		return "", rest
+	}
+	return rest[:end], rest[end:]
+}
+
+// applyParsedAddress 根据客户地址补全省市区、街道和区县编码，只填充空缺字段，返回是否有变化
+func applyParsedAddress(customer *Customer) bool {
+	changed := false
+	if customer.Address != "" {
+		parsed := parseChineseAddress(customer.Address)
+		changed = fillEmptyString(&customer.Province, parsed.Province) || changed
+		changed = fillEmptyString(&customer.City, parsed.City) || changed
+		changed = fillEmptyString(&customer.District, parsed.District) || changed
+		changed = fillEmptyString(&customer.Street, parsed.Street) || changed
+	}
+
+	// 区县编码以省市区名称为准，避免与手工填写的省市区不一致
+	districtID := parseChineseAddress(customer.Province + customer.City + customer.District).DistrictID
+	if districtID != 0 && districtID != customer.DistrictID {
+		customer.DistrictID = districtID
+		changed = true
+	}
+	return changed
+}
+
+// addressBackfillBatchSize 地址批量补全每批处理的客户数
+const addressBackfillBatchSize = 500
+
+// addressBackfillUnresolvedLimit 地址批量补全结果中最多列出的未解析客户数
+const addressBackfillUnresolvedLimit = 100
+
+// addressUnresolvedReason 客户地址无法确定区县编码的原因；字典只收录部分省份的区县，未收录城市的客户无法解析出区县
+func addressUnresolvedReason(customer *Customer) string {
+	parsed := parseChineseAddress(customer.Province + customer.City + customer.District)
+	if parsed.City == "" {
+		return "地址中未识别到城市"
+	}
+	for _, city := range getRegionIndex().cities {
+		if city.Name == parsed.City && len(city.Children) == 0 {
+			return "行政区划字典未收录该城市的区县"
+		}
+	}
+	return "地址中未识别到区县"
+}
+
+// backfillCustomerAddresses 解析已有客户的地址，补全缺失的省市区、街道和区县编码，并列出仍无法确定区县编码的客户
+func backfillCustomerAddresses() (*AddressBackfillResponse, error) {
+	resp := &AddressBackfillResponse{UnresolvedCustomers: []AddressBackfillUnresolved{}}
+	var customers []Customer
+	result := DB.Where("address IS NOT NULL AND address <> ''").
+		Where("(province IS NULL OR province = '' OR city IS NULL OR city = '' OR district IS NULL OR district = '' OR street IS NULL OR street = '' OR district_id IS NULL OR district_id = 0)").
+		FindInBatches(&customers, addressBackfillBatchSize, func(_ *gorm.DB, batch int) error {
+			// 每批的客户更新和变更记录在同一事务中提交
+			updated := 0
+			err := DB.Transaction(func(tx *gorm.DB) error {
+				for i := range customers {
+					before := customerSnapshot(&customers[i])
+					changed := applyParsedAddress(&customers[i])
+					if customers[i].DistrictID == 0 {
+						resp.Unresolved++
+						if len(resp.UnresolvedCustomers) < addressBackfillUnresolvedLimit {
+							resp.UnresolvedCustomers = append(resp.UnresolvedCustomers, AddressBackfillUnresolved{
+								CustomerID: customers[i].ID,
+								Name:       customers[i].Name,
+								Address:    customers[i].Address,
+								Reason:     addressUnresolvedReason(&customers[i]),
+							})
+						}
+					}
+					if !changed {
+						continue
+					}
+					err := tx.Model(&customers[i]).
+						Select("province", "city", "district", "street", "district_id").
+						Updates(&customers[i]).Error
+					if err != nil {
+						return err
+					}
+					if err := recordCustomerChange(tx, uint64(customers[i].ID), before, customerSnapshot(&customers[i]), ActionUpdate, CustomerChangeSystem, 0, "地址结构化回填"); err != nil {
+						return err
+					}
+					updated++
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			resp.Scanned += len(customers)
+			resp.Updated += updated
+			return nil
+		})
+	return resp, result.Error
+}
+
+// errRegionNotFound 行政区划代码不存在
+var errRegionNotFound = errors.New("行政区划不存在")
+
+// normalizeRegionCode 规范化行政区划代码：支持2/4/6位代码、补零的6位代码（如420900）和12位统计用代码（如420902000000）
+func normalizeRegionCode(code string) string {
+	code = strings.TrimSpace(code)
+	if len(code) == 12 && strings.HasSuffix(code, "000000") {
+		code = code[:6]
+	}
+	if len(code) == 6 {
+		switch {
+		case strings.HasSuffix(code, "0000"):
+			code = code[:2]
+		case strings.HasSuffix(code, "00"):
+			code = code[:4]
+		}
+	}
+	return code
+}
+
+// findRegion 按代码查找行政区划
+func findRegion(code string) *Region {
+	return getRegionIndex().byCode[normalizeRegionCode(code)]
+}
+
+// regionNames 区划的全称和简称，用于匹配客户表中手工填写的名称
+func regionNames(region *Region) []string {
+	names := []string{region.Name}
+	if short := regionShortName(region.Name); short != "" {
+		names = append(names, short)
+	}
+	return names
+}
+
+// regionFullName 含上级的完整名称（跳过占位节点），如"湖北省孝感市孝南区"
+func regionFullName(region *Region) string {
+	var parts []string
+	for r := region; r != nil; r = r.parent {
+		if !regionPlaceholderNames[r.Name] {
+			parts = append([]string{r.Name}, parts...)
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+// regionToResponse 将行政区划转换为响应
+func regionToResponse(region *Region) RegionResponse {
+	response := RegionResponse{
+		Code:        region.Code,
+		Name:        region.Name,
+		Level:       region.Level,
+		FullName:    regionFullName(region),
+		HasChildren: len(region.Children) > 0,
+	}
+	if region.parent != nil {
+		response.ParentCode = region.parent.Code
+	}
+	return response
+}
+
+// regionsToResponses 批量转换行政区划
+func regionsToResponses(regions []*Region) []RegionResponse {
+	responses := make([]RegionResponse, len(regions))
+	for i, region := range regions {
+		responses[i] = regionToResponse(region)
+	}
+	return responses
+}
+
+// getRegionChildren 获取下级区划列表，parentCode 为空时返回全部省份
+func getRegionChildren(parentCode string) ([]RegionResponse, error) {
+	if parentCode == "" {
+		return regionsToResponses(getRegionIndex().provinces), nil
+	}
+	parent := findRegion(parentCode)
+	if parent == nil {
+		return nil, errRegionNotFound
+	}
+	return regionsToResponses(parent.Children), nil
+}
+
+// getRegionDetail 按代码查询行政区划，包含上级路径和下级区划
+func getRegionDetail(code string) (*RegionDetailResponse, error) {
+	region := findRegion(code)
+	if region == nil {
+		return nil, errRegionNotFound
+	}
+	detail := &RegionDetailResponse{
+		RegionResponse: regionToResponse(region),
+		Children:       regionsToResponses(region.Children),
+	}
+	for r := region.parent; r != nil; r = r.parent {
+		detail.Ancestors = append([]RegionResponse{regionToResponse(r)}, detail.Ancestors...)
+	}
+	return detail, nil
+}
+
+// searchRegions 按名称模糊匹配行政区划，完全匹配优先，其次前缀匹配，最后包含匹配
+func searchRegions(keyword string, level int, parentCode string, limit int) ([]RegionResponse, error) {
+	keyword = strings.TrimSpace(keyword)
+	roots := getRegionIndex().provinces
+	if parentCode != "" {
+		parent := findRegion(parentCode)
+		if parent == nil {
+			return nil, errRegionNotFound
+		}
+		roots = parent.Children
+	}
+	if limit <= 0 {
+		limit = 20
+	}
+
+	var buckets [3][]*Region
+	var walk func(regions []*Region)
+	walk = func(regions []*Region) {
+		for _, region := range regions {
+			if !regionPlaceholderNames[region.Name] && (level == 0 || region.Level == level) {
+				score := -1
+				for _, name := range regionNames(region) {
+					switch {
+					case name == keyword:
+						score = 0
+					case strings.HasPrefix(name, keyword) && (score < 0 || score > 1):
+						score = 1
+					case strings.Contains(name, keyword) && score < 0:
+						score = 2
+					}
+				}
+				if score >= 0 {
+					buckets[score] = append(buckets[score], region)
+				}
+			}
+			walk(region.Children)
+		}
+	}
+	if keyword != "" {
+		walk(roots)
+	}
+
+	var matched []*Region
+	for _, bucket := range buckets {
+		matched = append(matched, bucket...)
+	}
+	if len(matched) > limit {
+		matched = matched[:limit]
+	}
+	return regionsToResponses(matched), nil
+}
+
+// validateDistrictID 校验区县编码（6位或12位）是否存在于行政区划字典，返回对应的区县。
+// 字典未收录的区县编码一律视为不存在，与按区划筛选使用同一份字典
+func validateDistrictID(districtID int64) (*Region, error) {
+	region := findRegion(strconv.FormatInt(districtID, 10))
+	if region == nil || region.Level != 3 {
+		return nil, fmt.Errorf("区县编码 %d 不存在", districtID)
+	}
+	return region, nil
+}
+
+// regionNameMatches 手工填写的名称是否与区划一致（允许简称）
+func regionNameMatches(name string, region *Region) bool {
+	if name == "" || region == nil {
+		return true
+	}
+	return containsString(regionNames(region), name)
+}
+
+// validateRegionNames 校验省市区名称与区县编码是否一致
+func validateRegionNames(district *Region, province, city, districtName string) error {
+	cityRegion := district.parent
+	provinceRegion := cityRegion.parent
+	if !regionNameMatches(province, provinceRegion) {
+		return fmt.Errorf("省份 %s 与区县编码不一致", province)
+	}
+	// 直辖市和省直辖县级市的城市名称分别取省级和区县自身的名称
+	if regionPlaceholderNames[cityRegion.Name] {
+		if !regionNameMatches(city, provinceRegion) && !regionNameMatches(city, district) {
+			return fmt.Errorf("城市 %s 与区县编码不一致", city)
+		}
+	} else if !regionNameMatches(city, cityRegion) {
+		return fmt.Errorf("城市 %s 与区县编码不一致", city)
+	}
+	if !regionNameMatches(districtName, district) {
+		return fmt.Errorf("区县 %s 与区县编码不一致", districtName)
+	}
+	return nil
+}
+
+// validateCustomerRegion 校验客户请求中的区县编码，并用字典补全空缺的省市区名称
+func validateCustomerRegion(req *CustomerRequest) error {
+	if req.DistrictID == 0 {
+		return nil
+	}
+	district, err := validateDistrictID(req.DistrictID)
+	if err != nil {
+		return err
+	}
+	if err := validateRegionNames(district, req.Province, req.City, req.District); err != nil {
+		return err
+	}
+	// 统一保存为6位区县编码
+	req.DistrictID, _ = parseInt64(district.Code)
+	parsed := parseChineseAddress(regionFullName(district))
+	fillEmptyString(&req.Province, parsed.Province)
+	fillEmptyString(&req.City, parsed.City)
+	fillEmptyString(&req.District, parsed.District)
+	return nil
+}
+
+// validateShippingInfos 校验收货信息中的 districtId 及省市区名称，返回每条收货信息的错误
+func validateShippingInfos(infos []JSONB) []string {
+	var errs []string
+	for i, info := range infos {
+		raw, ok := info["districtId"]
+		if !ok || raw == nil {
+			continue
+		}
+		var districtID int64
+		switch v := raw.(type) {
+		case float64:
+			districtID = int64(v)
+		case string:
+			districtID, _ = parseInt64(v)
+		}
+		district, err := validateDistrictID(districtID)
+		if err == nil {
+			province, _ := info["province"].(string)
+			city, _ := info["city"].(string)
+			districtName, _ := info["district"].(string)
+			err = validateRegionNames(district, province, city, districtName)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("第%d条收货信息：%s", i+1, err.Error()))
+		}
+	}
+	return errs
+}
+
+// regionCodeRange 行政区划代码对应的区县编码范围，如 42 对应 420000-429999
+func regionCodeRange(code string) (int, int) {
+	value, _ := strconv.Atoi(code)
+	switch len(code) {
+	case 2:
+		return value * 10000, value*10000 + 9999
+	case 4:
+		return value * 100, value*100 + 99
+	}
+	return value, value
+}
+
+// applyRegionFilter 按任意层级的行政区划代码筛选客户：区县编码落在该区划范围内，或省市区名称逐级匹配。
+// 代码不在字典中时不匹配任何客户（接口层已先返回400）
+func applyRegionFilter(query *gorm.DB, code string) *gorm.DB {
+	region := findRegion(code)
+	if region == nil {
+		return query.Where("1 = 0")
+	}
+	var conditions []string
+	var args []interface{}
+	for r := region; r != nil; r = r.parent {
+		switch r.Level {
+		case 1:
+			conditions = append(conditions, "province IN ?")
+		case 2:
+			if regionPlaceholderNames[r.Name] {
+				continue
+			}
+			conditions = append(conditions, "city IN ?")
+		case 3:
+			conditions = append(conditions, "district IN ?")
+		}
+		args = append(args, regionNames(r))
+	}
+	minID, maxID := regionCodeRange(region.Code)
+	args = append([]interface{}{minID, maxID}, args...)
+	return query.Where("(district_id BETWEEN ? AND ? OR ("+strings.Join(conditions, " AND ")+"))", args...)
+}
+
+// ========== 客户地理位置相关业务函数 ==========
+
+// defaultNearbyRadiusKm 附近客户默认搜索半径（千米）
+const defaultNearbyRadiusKm = 5
+
+// defaultGeoCustomerLimit 地理位置搜索默认返回数量
+const defaultGeoCustomerLimit = 200
+
+// applyGeoCustomerFilter 按等级、状态和销售员筛选有坐标的客户
+func applyGeoCustomerFilter(query *gorm.DB, filter GeoCustomerFilter) *gorm.DB {
+	// 未定位的客户坐标为 0,0
+	query = query.Where("NOT (lat = 0 AND lon = 0)")
+	if levels := parseCommaSeparatedInt64(filter.Level); len(levels) > 0 {
+		query = query.Where("level IN ?", levels)
+	}
+	if states := parseCommaSeparatedInt64(filter.State); len(states) > 0 {
+		query = query.Where("state IN ?", states)
+	}
+	if sellers := parseCommaSeparatedInt64(filter.Sellers); len(sellers) > 0 {
+		query = query.Where("sellers && ?", pq.Int64Array(sellers))
+	}
+	return query
+}
+
+// geoDistanceSQL 与 haversineKm 一致的球面距离（千米）SQL 表达式，参数依次为参考点纬度、纬度、经度
+var geoDistanceSQL = fmt.Sprintf("2 * %g * asin(least(1, sqrt(power(sin(radians(lat - ?) / 2), 2) + "+
+	"cos(radians(?)) * cos(radians(lat)) * power(sin(radians(lon - ?) / 2), 2))))", earthRadiusKm)
+
+// findCustomersInBox 先用经纬度矩形在数据库预筛选，再在数据库中按球面距离过滤、排序并限制数量
+func findCustomersInBox(minLat, minLon, maxLat, maxLon, refLat, refLon, radiusKm float64, filter GeoCustomerFilter) []NearbyCustomerResponse {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultGeoCustomerLimit
+	}
+	var customers []Customer
+	query := DB.Model(&Customer{}).
+		Where("lat BETWEEN ? AND ? AND lon BETWEEN ? AND ?", minLat, maxLat, minLon, maxLon).
+		Where("is_deleted = ?", false)
+	if radiusKm > 0 {
+		query = query.Where(geoDistanceSQL+" <= ?", refLat, refLat, refLon, radiusKm)
+	}
+	applyGeoCustomerFilter(query, filter).
+		Order(clause.OrderBy{Expression: clause.Expr{SQL: geoDistanceSQL + ", id", Vars: []interface{}{refLat, refLat, refLon}}}).
+		Limit(limit).
+		Find(&customers)
+
+	results := make([]NearbyCustomerResponse, 0, len(customers))
+	for i := range customers {
+		distance := haversineKm(refLat, refLon, customers[i].Lat, customers[i].Lon)
+		results = append(results, NearbyCustomerResponse{
+			CustomerResponse: CustomerToResponse(&customers[i]),
+			DistanceKm:       math.Round(distance*1000) / 1000,
+		})
+	}
+	return results
+}
+
+// getNearbyCustomers 查询指定位置周边半径内的客户，按距离由近到远排序
+func getNearbyCustomers(req NearbyCustomerRequest) []NearbyCustomerResponse {
+	radiusKm := req.RadiusKm
+	if radiusKm <= 0 {
+		radiusKm = defaultNearbyRadiusKm
+	}
+	minLat, minLon, maxLat, maxLon := geoBoundingBox(*req.Lat, *req.Lon, radiusKm)
+	return findCustomersInBox(minLat, minLon, maxLat, maxLon, *req.Lat, *req.Lon, radiusKm, req.GeoCustomerFilter)
+}
+
+// getCustomersInBoundingBox 查询地图矩形范围内的客户，按与参考点（默认矩形中心）的距离排序
+func getCustomersInBoundingBox(req BoundingBoxCustomerRequest) []NearbyCustomerResponse {
+	refLat := (*req.MinLat + *req.MaxLat) / 2
+	refLon := (*req.MinLon + *req.MaxLon) / 2
+	if req.Lat != nil && req.Lon != nil {
+		refLat, refLon = *req.Lat, *req.Lon
+	}
+	return findCustomersInBox(*req.MinLat, *req.MinLon, *req.MaxLat, *req.MaxLon, refLat, refLon, 0, req.GeoCustomerFilter)
+}
+
+// ========== 拜访路线规划相关业务函数 ==========
+
+// 拜访目标纳入原因
+const (
+	visitReasonTodoDue      = "todo_due"      // 当天到期的待办
+	visitReasonTodoOverdue  = "todo_overdue"  // 已逾期未完成的待办
+	visitReasonVisitOverdue = "visit_overdue" // 超过拜访周期未拜访
+)
+
+const (
+	defaultVisitIntervalDays = 30
+	defaultVisitMaxStops     = 30
+)
+
+// planVisitRoute 为销售员规划指定日期的拜访路线
+func planVisitRoute(sellerID uint64, req VisitRoutePlanRequest) (*VisitRoutePlanResponse, error) {
+	day, err := time.ParseInLocation("2006-01-02", req.Date, time.Local)
+	if err != nil {
+		return nil, fmt.Errorf("日期格式错误，应为 YYYY-MM-DD")
+	}
+	intervalDays := defaultVisitIntervalDays
+	if req.VisitIntervalDays != nil {
+		intervalDays = *req.VisitIntervalDays
+	}
+	maxStops := req.MaxStops
+	if maxStops <= 0 {
+		maxStops = defaultVisitMaxStops
+	}
+
+	candidates, unlisted := collectVisitCandidates(sellerID, day, intervalDays, maxStops)
+
+	resp := &VisitRoutePlanResponse{SellerID: sellerID, Date: req.Date, Stops: []VisitRouteStop{}, Dropped: []VisitRouteStop{}}
+	var points [][2]float64
+	for _, stop := range candidates {
+		if stop.Lat == 0 && stop.Lon == 0 {
+			resp.Skipped = append(resp.Skipped, stop)
+			continue
+		}
+		if len(resp.Stops) >= maxStops {
+			resp.Dropped = append(resp.Dropped, stop)
+			continue
+		}
+		resp.Stops = append(resp.Stops, stop)
+		points = append(points, [2]float64{stop.Lat, stop.Lon})
+	}
+
+	resp.DroppedTotal = int64(len(resp.Dropped)) + unlisted
+
+	startLat, startLon := *req.StartLat, *req.StartLon
+	order := planVisitOrder(startLat, startLon, points, req.ReturnToStart)
+	stops := make([]VisitRouteStop, len(order))
+	prevLat, prevLon := startLat, startLon
+	total := 0.0
+	for i, idx := range order {
+		stop := resp.Stops[idx]
+		leg := haversineKm(prevLat, prevLon, stop.Lat, stop.Lon)
+		total += leg
+		stop.Sequence = i + 1
+		stop.LegDistanceKm = math.Round(leg*1000) / 1000
+		stop.CumulativeDistanceKm = math.Round(total*1000) / 1000
+		stops[i] = stop
+		prevLat, prevLon = stop.Lat, stop.Lon
+	}
+	if req.ReturnToStart && len(stops) > 0 {
+		total += haversineKm(prevLat, prevLon, startLat, startLon)
+	}
+	resp.Stops = stops
+	resp.TotalDistanceKm = math.Round(total*1000) / 1000
+
+	if req.GeoJSON {
+		coordinates := [][]float64{{startLon, startLat}}
+		for _, stop := range stops {
+			coordinates = append(coordinates, []float64{stop.Lon, stop.Lat})
+		}
+		if req.ReturnToStart && len(stops) > 0 {
+			coordinates = append(coordinates, []float64{startLon, startLat})
+		}
+		resp.GeoJSON = &GeoJSONFeature{
+			Type:     "Feature",
+			Geometry: GeoJSONGeometry{Type: "LineString", Coordinates: coordinates},
+			Properties: map[string]interface{}{
+				"seller_id":         sellerID,
+				"date":              req.Date,
+				"total_distance_km": resp.TotalDistanceKm,
+			},
+		}
+	}
+	return resp, nil
+}
+
+// collectVisitCandidates 收集拜访候选客户：当天到期待办优先，其次逾期待办，最后是超过拜访周期未拜访的客户。
+// 逾期拜访客户最多取 maxStops 个，另返回未取出的逾期拜访客户数
+func collectVisitCandidates(sellerID uint64, day time.Time, intervalDays, maxStops int) ([]VisitRouteStop, int64) {
+	nextDay := day.AddDate(0, 0, 1)
+	var candidates []VisitRouteStop
+	byCustomer := make(map[uint]int)
+
+	var todos []Todo
+	DB.Preload("Customer").
+		Where("executor_id = ? AND status IN ? AND is_deleted = false AND planned_time < ?",
+			sellerID, []TodoStatus{TodoStatusPending, TodoStatusOverdue}, nextDay).
+		Order("planned_time DESC").
+		Find(&todos)
+	// 当天到期的排在逾期之前
+	sort.SliceStable(todos, func(i, j int) bool {
+		return !todos[i].PlannedTime.Before(day) && todos[j].PlannedTime.Before(day)
+	})
+	for _, todo := range todos {
+		if todo.Customer.ID == 0 {
+			continue
+		}
+		if i, ok := byCustomer[todo.Customer.ID]; ok {
+			candidates[i].TodoIDs = append(candidates[i].TodoIDs, todo.ID)
+			continue
+		}
+		reason := visitReasonTodoDue
+		if todo.PlannedTime.Before(day) {
+			reason = visitReasonTodoOverdue
+		}
+		stop := newVisitRouteStop(&todo.Customer, reason)
+		stop.TodoIDs = []uint64{todo.ID}
+		byCustomer[todo.Customer.ID] = len(candidates)
+		candidates = append(candidates, stop)
+	}
+
+	var unlisted int64
+	if intervalDays > 0 {
+		query := DB.Model(&Customer{}).
+			Where("? = ANY(sellers) AND is_deleted = ?", sellerID, false).
+			Where("NOT (lat = 0 AND lon = 0)").
+			Where("(last_visited IS NULL OR last_visited < ?)", day.AddDate(0, 0, -intervalDays))
+		if len(byCustomer) > 0 {
+			customerIDs := make([]uint, 0, len(byCustomer))
+			for id := range byCustomer {
+				customerIDs = append(customerIDs, id)
+			}
+			query = query.Where("id NOT IN ?", customerIDs)
+		}
+		var total int64
+		query.Count(&total)
+		var customers []Customer
+		query.Order("last_visited ASC NULLS FIRST").Order("id").Limit(maxStops).Find(&customers)
+		for i := range customers {
+			byCustomer[customers[i].ID] = len(candidates)
+			candidates = append(candidates, newVisitRouteStop(&customers[i], visitReasonVisitOverdue))
+		}
+		unlisted = total - int64(len(customers))
+	}
+	return candidates, unlisted
+}
+
+// newVisitRouteStop 由客户生成路线站点
+func newVisitRouteStop(customer *Customer, reason string) VisitRouteStop {
+	return VisitRouteStop{
+		CustomerID:   customer.ID,
+		CustomerName: customer.Name,
+		Address:      customer.Address,
+		Lat:          customer.Lat,
+		Lon:          customer.Lon,
+		Reason:       reason,
+		TodoIDs:      []uint64{},
+		LastVisited:  customer.LastVisited,
+	}
+}
+
+// planVisitOrder 以出发点为起点，先用最近邻构造路线，再用2-opt消除交叉，返回 points 的访问顺序
+func planVisitOrder(startLat, startLon float64, points [][2]float64, returnToStart bool) []int {
+	n := len(points)
+	if n == 0 {
+		return []int{}
+	}
+
+	// 节点0为出发点，1..n 为拜访点
+	nodes := append([][2]float64{{startLat, startLon}}, points...)
+	dist := make([][]float64, n+1)
+	for i := range dist {
+		dist[i] = make([]float64, n+1)
+		for j := range dist[i] {
+			dist[i][j] = haversineKm(nodes[i][0], nodes[i][1], nodes[j][0], nodes[j][1])
+		}
+	}
+
+	// 最近邻
+	path := []int{0}
+	visited := make([]bool, n+1)
+	visited[0] = true
+	for len(path) <= n {
+		last := path[len(path)-1]
+		next := -1
+		for j := 1; j <= n; j++ {
+			if !visited[j] && (next < 0 || dist[last][j] < dist[last][next]) {
+				next = j
+			}
+		}
+		visited[next] = true
+		path = append(path, next)
+	}
+
+	// 2-opt：反转 path[i..k]，出发点固定；不返回出发点时末段没有后继边
+	edge := func(a, k int) float64 {
+		if k+1 < len(path) {
+			return dist[a][path[k+1]]
+		}
+		if returnToStart {
+			return dist[a][0]
+		}
+		return 0
+	}
+	for improved, rounds := true, 0; improved && rounds < 100; rounds++ {
+		improved = false
+		for i := 1; i < n; i++ {
+			for k := i + 1; k <= n; k++ {
+				delta := dist[path[i-1]][path[k]] + edge(path[i], k) -
+					dist[path[i-1]][path[i]] - edge(path[k], k)
+				if delta < -1e-9 {
+					for l, r := i, k; l < r; l, r = l+1, r-1 {
+						path[l], path[r] = path[r], path[l]
+					}
+					improved = true
+				}
+			}
+		}
+	}
+
+	order := make([]int, n)
+	for i := 1; i <= n; i++ {
+		order[i-1] = path[i] - 1
+	}
+	return order
+}
+
+// ========== 客户地图数据相关业务函数 ==========
+
+const (
+	defaultGeoJSONLimit = 5000
+	// clusterMaxZoom 达到该缩放级别后不再聚合，直接返回每个客户
+	clusterMaxZoom = 16
+	// clusterCellPixels 聚合网格边长（像素），按256像素瓦片换算成经纬度
+	clusterCellPixels = 64
+)
+
+// customerGeoCell 网格聚合结果
+type customerGeoCell struct {
+	GX         int64
+	GY         int64
+	Count      int64
+	Lat        float64
+	Lon        float64
+	CustomerID uint
+}
+
+// clusterCellSize 指定缩放级别下聚合网格的边长（度）
+func clusterCellSize(zoom int) float64 {
+	return 360 / math.Pow(2, float64(zoom)) * clusterCellPixels / 256
+}
+
+// getCustomerGeoJSON 导出有坐标客户的 GeoJSON；传入低于 clusterMaxZoom 的缩放级别时在数据库中按网格聚合
+func getCustomerGeoJSON(req CustomerGeoJSONRequest) *GeoJSONFeatureCollection {
+	query := buildCustomerSearchQuery(req.Keyword, req.SystemTags, req.RegionCode).
+		Where("NOT (lat = 0 AND lon = 0)")
+	if req.MinLat != nil && req.MaxLat != nil {
+		query = query.Where("lat BETWEEN ? AND ?", *req.MinLat, *req.MaxLat)
+	}
+	if req.MinLon != nil && req.MaxLon != nil {
+		query = query.Where("lon BETWEEN ? AND ?", *req.MinLon, *req.MaxLon)
+	}
+	limit := req.Limit
+	if limit <= 0 {
+		limit = defaultGeoJSONLimit
+	}
+
+	collection := &GeoJSONFeatureCollection{Type: "FeatureCollection", Features: []GeoJSONFeature{}}
+	if req.Zoom == nil || *req.Zoom >= clusterMaxZoom {
+		// 多取一条用于判断是否截断
+		var customers []Customer
+		query.Order("id ASC").Limit(limit + 1).Find(&customers)
+		if len(customers) > limit {
+			customers = customers[:limit]
+			collection.Truncated = true
+		}
+		for i := range customers {
+			collection.Features = append(collection.Features, customerToGeoJSONFeature(&customers[i]))
+		}
+		return collection
+	}
+
+	cellSize := clusterCellSize(*req.Zoom)
+	var cells []customerGeoCell
+	query.Select("FLOOR(lon / ?) AS gx, FLOOR(lat / ?) AS gy, COUNT(*) AS count, AVG(lat) AS lat, AVG(lon) AS lon, MIN(id) AS customer_id", cellSize, cellSize).
+		Group("gx, gy").
+		Order("count DESC").
+		Limit(limit + 1).
+		Scan(&cells)
+	if len(cells) > limit {
+		cells = cells[:limit]
+		collection.Truncated = true
+	}
+
+	// 只有一个客户的网格直接输出该客户
+	var singleIDs []uint
+	for _, cell := range cells {
+		if cell.Count == 1 {
+			singleIDs = append(singleIDs, cell.CustomerID)
+		}
+	}
+	singles := make(map[uint]*Customer)
+	if len(singleIDs) > 0 {
+		var customers []Customer
+		DB.Where("id IN ?", singleIDs).Find(&customers)
+		for i := range customers {
+			singles[customers[i].ID] = &customers[i]
+		}
+	}
+
+	for _, cell := range cells {
+		if customer, ok := singles[cell.CustomerID]; ok && cell.Count == 1 {
+			collection.Features = append(collection.Features, customerToGeoJSONFeature(customer))
+			continue
+		}
+		collection.Features = append(collection.Features, GeoJSONFeature{
+			Type:     "Feature",
+			ID:       fmt.Sprintf("cluster_%d_%d_%d", *req.Zoom, cell.GX, cell.GY),
+			Geometry: GeoJSONGeometry{Type: "Point", Coordinates: []float64{cell.Lon, cell.Lat}},
+			Properties: map[string]interface{}{
+				"cluster":     true,
+				"point_count": cell.Count,
+				"zoom":        *req.Zoom,
+			},
+		})
+	}
+	return collection
+}
+
+// customerToGeoJSONFeature 将客户转换为 GeoJSON 点要素
+func customerToGeoJSONFeature(customer *Customer) GeoJSONFeature {
+	var lastOrderDate interface{}
+	if customer.LastOrderDate != nil {
+		lastOrderDate = customer.LastOrderDate.Format("2006-01-02")
+	}
+	return GeoJSONFeature{
+		Type:     "Feature",
+		ID:       customer.ID,
+		Geometry: GeoJSONGeometry{Type: "Point", Coordinates: []float64{customer.Lon, customer.Lat}},
+		Properties: map[string]interface{}{
+			"id":              customer.ID,
+			"name":            customer.Name,
+			"level":           customer.Level,
+			"state":           customer.State,
+			"sellers":         []int64(customer.Sellers),
+			"last_order_date": lastOrderDate,
+		},
+	}
+}
+
+// ========== 客户查重与合并相关业务函数 ==========
+
+// defaultDuplicateThreshold 名称地址相似度默认阈值
+const defaultDuplicateThreshold = 0.8
+
+// duplicateBlockLimit 同一城市同一首字的客户超过该数量时不再两两比较名称地址，避免扫描过慢
+const duplicateBlockLimit = 2000
+
+var (
+	errDuplicateGroupHandled = errors.New("重复分组已处理")
+	errMergeAlreadyUndone    = errors.New("合并记录已撤销")
+	errMergeSurvivorModified = errors.New("保留客户在合并后已被修改，撤销会覆盖这些修改，请先手动处理")
+)
+
+// duplicateCandidate 查重得到的分组（members 为客户下标）
+type duplicateCandidate struct {
+	members []int
+	reasons []string
+	score   float64
+}
+
+// findDuplicateGroups 查找疑似重复客户：电话、微信有重合的直接归为一组，同城客户再按名称地址相似度归组
+func findDuplicateGroups(customers []Customer, threshold float64) []duplicateCandidate {
+	n := len(customers)
+	parent := make([]int, n)
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	type edge struct {
+		a, b   int
+		reason string
+		score  float64
+	}
+	var edges []edge
+	link := func(a, b int, reason string, score float64) {
+		edges = append(edges, edge{a, b, reason, score})
+		if ra, rb := find(a), find(b); ra != rb {
+			parent[rb] = ra
+		}
+	}
+
+	// 电话、微信重合
+	owners := make(map[string]int)
+	for i := range customers {
+		c := &customers[i]
+		var keys, labels []string
+		for _, phone := range append(append([]string{}, c.Phones...), c.WorkPhone...) {
+			if p := normalizePhone(phone); len(p) >= 7 {
+				keys, labels = append(keys, "phone:"+p), append(labels, "电话 "+p)
+			}
+		}
+		for _, wechat := range append(append([]string{}, c.Wechats...), c.WorkWechat...) {
+			if w := normalizeWechat(wechat); w != "" {
+				keys, labels = append(keys, "wechat:"+w), append(labels, "微信 "+w)
+			}
+		}
+		for k, key := range keys {
+			if j, ok := owners[key]; ok {
+				if j != i {
+					link(j, i, labels[k]+" 重合", 1)
+				}
+				continue
+			}
+			owners[key] = i
+		}
+	}
+
+	// 同城、名称首字相同的客户两两比较名称和地址
+	blocks := make(map[string][]int)
+	for i := range customers {
+		name := []rune(normalizeText(customers[i].Name))
+		city := strings.TrimSpace(customers[i].City)
+		if len(name) == 0 || city == "" {
+			continue
+		}
+		key := city + "|" + string(name[0])
+		blocks[key] = append(blocks[key], i)
+	}
+	for _, members := range blocks {
+		if len(members) < 2 || len(members) > duplicateBlockLimit {
+			continue
+		}
+		for x := 0; x < len(members); x++ {
+			for y := x + 1; y < len(members); y++ {
+				a, b := &customers[members[x]], &customers[members[y]]
+				score := customerSimilarity(a, b)
+				if score >= threshold {
+					link(members[x], members[y], fmt.Sprintf("名称地址相似度 %.2f", score), score)
+				}
+			}
+		}
+	}
+
+	groups := make(map[int]*duplicateCandidate)
+	var roots []int
+	for _, e := range edges {
+		root := find(e.a)
+		group, ok := groups[root]
+		if !ok {
+			group = &duplicateCandidate{}
+			groups[root] = group
+			roots = append(roots, root)
+		}
+		if !containsString(group.reasons, e.reason) {
+			group.reasons = append(group.reasons, e.reason)
+		}
+		if e.score > group.score {
+			group.score = e.score
+		}
+	}
+	for i := 0; i < n; i++ {
+		if group, ok := groups[find(i)]; ok {
+			group.members = append(group.members, i)
+		}
+	}
+
+	result := make([]duplicateCandidate, 0, len(roots))
+	for _, root := range roots {
+		result = append(result, *groups[root])
+	}
+	return result
+}
+
+// customerSimilarity 客户名称地址相似度：双方都有地址时名称占六成、地址占四成，缺地址时按名称相似度打九折
+func customerSimilarity(a, b *Customer) float64 {
+	nameScore := textSimilarity(a.Name, b.Name)
+	if strings.TrimSpace(a.Address) == "" || strings.TrimSpace(b.Address) == "" {
+		return nameScore * 0.9
+	}
+	return nameScore*0.6 + textSimilarity(a.Address, b.Address)*0.4
+}
+
+// createDuplicateScanJob 创建客户查重任务并在后台执行
+func createDuplicateScanJob(req DuplicateScanRequest) (*DuplicateScanJob, error) {
+	threshold := req.Threshold
+	if threshold <= 0 {
+		threshold = defaultDuplicateThreshold
+	}
+	job := &DuplicateScanJob{
+		Status:    ImportJobPending,
+		Threshold: threshold,
+		CreatedBy: req.CreatedBy,
+	}
+	if err := DB.Create(job).Error; err != nil {
+		return nil, err
+	}
+	go runDuplicateScanJob(job)
+	return job, nil
+}
+
+// runDuplicateScanJob 执行查重：新结果替换之前未处理的分组，已忽略过的相同分组不再出现
+func runDuplicateScanJob(job *DuplicateScanJob) {
+	now := time.Now()
+	DB.Model(job).Updates(map[string]interface{}{"status": ImportJobRunning, "started_at": now})
+
+	var customers []Customer
+	err := DB.Select("id", "name", "phones", "wechats", "work_phone", "work_wechat", "city", "address").
+		Where("is_deleted = ?", false).
+		Order("id ASC").
+		Find(&customers).Error
+	if err != nil {
+		finishDuplicateScanJob(job, ImportJobFailed, err.Error())
+		return
+	}
+	job.TotalCustomers = len(customers)
+
+	var ignored []DuplicateGroup
+	DB.Where("status = ?", DuplicateGroupIgnored).Find(&ignored)
+	ignoredKeys := make(map[string]bool)
+	for _, group := range ignored {
+		ignoredKeys[duplicateGroupKey(group.CustomerIDs)] = true
+	}
+
+	var records []DuplicateGroup
+	for _, candidate := range findDuplicateGroups(customers, job.Threshold) {
+		ids := make(pq.Int64Array, len(candidate.members))
+		for i, member := range candidate.members {
+			ids[i] = int64(customers[member].ID)
+		}
+		if ignoredKeys[duplicateGroupKey(ids)] {
+			continue
+		}
+		records = append(records, DuplicateGroup{
+			ScanID:      job.ID,
+			CustomerIDs: ids,
+			Reasons:     pq.StringArray(candidate.reasons),
+			Score:       math.Round(candidate.score*100) / 100,
+			Status:      DuplicateGroupPending,
+		})
+	}
+
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("status = ?", DuplicateGroupPending).Delete(&DuplicateGroup{}).Error; err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			return nil
+		}
+		return tx.CreateInBatches(records, importJobBatchSize).Error
+	})
+	if err != nil {
+		finishDuplicateScanJob(job, ImportJobFailed, err.Error())
+		return
+	}
+	job.GroupCount = len(records)
+	finishDuplicateScanJob(job, ImportJobCompleted, "")
+}
+
+// duplicateGroupKey 分组成员的唯一键（排序后的客户ID）
+func duplicateGroupKey(ids []int64) string {
+	sorted := append([]int64{}, ids...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	parts := make([]string, len(sorted))
+	for i, id := range sorted {
+		parts[i] = strconv.FormatInt(id, 10)
+	}
+	return strings.Join(parts, ",")
+}
+
+// finishDuplicateScanJob 结束查重任务
+func finishDuplicateScanJob(job *DuplicateScanJob, status ImportJobStatus, errorMessage string) {
+	now := time.Now()
+	job.Status = status
+	job.ErrorMessage = errorMessage
+	job.FinishedAt = &now
+	DB.Model(job).Updates(map[string]interface{}{
+		"status":          job.Status,
+		"error_message":   job.ErrorMessage,
+		"total_customers": job.TotalCustomers,
+		"group_count":     job.GroupCount,
+		"finished_at":     job.FinishedAt,
+	})
+}
+
+// recoverDuplicateScanJobs 将服务重启前未完成的查重任务标记为失败
+func recoverDuplicateScanJobs() {
+	DB.Model(&DuplicateScanJob{}).
+		Where("status IN ?", []ImportJobStatus{ImportJobPending, ImportJobRunning}).
+		Updates(map[string]interface{}{
+			"status":        ImportJobFailed,
+			"error_message": "服务重启，任务中断",
+			"finished_at":   time.Now(),
+		})
+}
+
+// getDuplicateScanJob 获取查重任务状态
+func getDuplicateScanJob(id uint64) (*DuplicateScanJob, error) {
+	var job DuplicateScanJob
+	if err := DB.First(&job, id).Error; err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// getDuplicateGroups 获取疑似重复分组，附带分组内客户概要
+func getDuplicateGroups(scanID uint64, status string, page, pageSize int) ([]DuplicateGroupResponse, int64) {
+	var groups []DuplicateGroup
+	var total int64
+
+	query := DB.Model(&DuplicateGroup{})
+	if scanID > 0 {
+		query = query.Where("scan_id = ?", scanID)
+	}
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	query.Count(&total)
+	query.Offset((page - 1) * pageSize).Limit(pageSize).Order("score DESC, id ASC").Find(&groups)
+
+	var ids []int64
+	for _, group := range groups {
+		ids = append(ids, group.CustomerIDs...)
+	}
+	customers := make(map[int64]*Customer)
+	if len(ids) > 0 {
+		var list []Customer
+		DB.Where("id IN ? AND is_deleted = ?", ids, false).Find(&list)
+		for i := range list {
+			customers[int64(list[i].ID)] = &list[i]
+		}
+	}
+
+	responses := make([]DuplicateGroupResponse, len(groups))
+	for i, group := range groups {
+		responses[i] = DuplicateGroupResponse{DuplicateGroup: group, Customers: []DuplicateGroupCustomer{}}
+		for _, id := range group.CustomerIDs {
+			customer, ok := customers[id]
+			if !ok {
+				continue
+			}
+			responses[i].Customers = append(responses[i].Customers, DuplicateGroupCustomer{
+				ID:         customer.ID,
+				Name:       customer.Name,
+				Phones:     []string(customer.Phones),
+				Wechats:    []string(customer.Wechats),
+				City:       customer.City,
+				Address:    customer.Address,
+				Sellers:    []int64(customer.Sellers),
+				SallerName: customer.SallerName,
+				CreatedAt:  customer.CreatedAt.Format("2006-01-02 15:04:05"),
+			})
+		}
+	}
+	return responses, total
+}
+
+// ignoreDuplicateGroup 将分组标记为不是重复客户，之后的扫描不再提示
+func ignoreDuplicateGroup(id uint64) (*DuplicateGroup, error) {
+	var group DuplicateGroup
+	if err := DB.First(&group, id).Error; err != nil {
+		return nil, err
+	}
+	if group.Status != DuplicateGroupPending {
+		return nil, errDuplicateGroupHandled
+	}
+	group.Status = DuplicateGroupIgnored
+	if err := DB.Model(&group).Update("status", group.Status).Error; err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+// mergeCustomerFields 将被合并客户并入保留客户：数组字段取并集，空缺字段补全，时间取较晚值，统计字段累加
+func mergeCustomerFields(survivor, other *Customer) {
+	survivor.Phones, _ = mergeStringArray(survivor.Phones, other.Phones...)
+	survivor.Wechats, _ = mergeStringArray(survivor.Wechats, other.Wechats...)
+	survivor.Douyins, _ = mergeStringArray(survivor.Douyins, other.Douyins...)
+	survivor.Kwais, _ = mergeStringArray(survivor.Kwais, other.Kwais...)
+	survivor.Redbooks, _ = mergeStringArray(survivor.Redbooks, other.Redbooks...)
+	survivor.WeworkOpenids, _ = mergeStringArray(survivor.WeworkOpenids, other.WeworkOpenids...)
+	survivor.WorkPhone, _ = mergeStringArray(survivor.WorkPhone, other.WorkPhone...)
+	survivor.WorkWechat, _ = mergeStringArray(survivor.WorkWechat, other.WorkWechat...)
+	survivor.Photos, _ = mergeStringArray(survivor.Photos, other.Photos...)
+	survivor.Tags, _ = mergeStringArray(survivor.Tags, other.Tags...)
+	survivor.Products, _ = mergeStringArray(survivor.Products, other.Products...)
+	survivor.Sellers, _ = mergeInt64Array(survivor.Sellers, other.Sellers...)
+	survivor.GroupID, _ = mergeInt64Array(survivor.GroupID, other.GroupID...)
+	survivor.SystemTags, _ = mergeInt64Array(survivor.SystemTags, other.SystemTags...)
+
+	fillEmptyString(&survivor.ContactName, other.ContactName)
+	fillEmptyString(&survivor.Avatar, other.Avatar)
+	fillEmptyString(&survivor.Source, other.Source)
+	fillEmptyString(&survivor.Province, other.Province)
+	fillEmptyString(&survivor.City, other.City)
+	fillEmptyString(&survivor.District, other.District)
+	fillEmptyString(&survivor.Street, other.Street)
+	fillEmptyString(&survivor.Address, other.Address)
+	fillEmptyString(&survivor.Category, other.Category)
+	fillEmptyString(&survivor.BirthPlace, other.BirthPlace)
+	fillEmptyString(&survivor.AnnualTurnover, other.AnnualTurnover)
+	fillEmptyString(&survivor.OriginalCustomerID, other.OriginalCustomerID)
+	fillEmptyString(&survivor.ImportSource, other.ImportSource)
+	fillEmptyString(&survivor.SallerName, other.SallerName)
+	fillEmptyString(&survivor.PreferredDeliveryMethod, other.PreferredDeliveryMethod)
+	if other.Remark != "" && !strings.Contains(survivor.Remark, other.Remark) {
+		if survivor.Remark != "" {
+			survivor.Remark += "；"
+		}
+		survivor.Remark += other.Remark
+	}
+
+	if survivor.DistrictID == 0 {
+		survivor.DistrictID = other.DistrictID
+	}
+	if survivor.Lat == 0 && survivor.Lon == 0 {
+		survivor.Lat, survivor.Lon = other.Lat, other.Lon
+	}
+	if survivor.Gender == 0 {
+		survivor.Gender = other.Gender
+	}
+	if survivor.BirthYear == 0 {
+		survivor.BirthYear, survivor.BirthMonth, survivor.BirthDate = other.BirthYear, other.BirthMonth, other.BirthDate
+	}
+	survivor.AddedWechat = survivor.AddedWechat || other.AddedWechat
+
+	survivor.LastVisited = laterTime(survivor.LastVisited, other.LastVisited)
+	survivor.LastCalled = laterTime(survivor.LastCalled, other.LastCalled)
+	// 订单数、平均订单金额和最后下单时间在订单改挂后按订单重新统计
+	survivor.CreditSale += other.CreditSale
+
+	// 偏好、扩展信息、收货信息按键合并，键冲突时保留存活客户的值
+	survivor.Favors = mergeJSONB(survivor.Favors, other.Favors)
+	survivor.ExtraInfo = mergeJSONB(survivor.ExtraInfo, other.ExtraInfo)
+	survivor.ShippingInfos = mergeJSONB(survivor.ShippingInfos, other.ShippingInfos)
+}
+
+// relinkCustomerRecords 将被合并客户的记录改挂到保留客户，返回记录ID到原客户ID的映射
+func relinkCustomerRecords(tx *gorm.DB, model interface{}, fromIDs []uint64, toID uint64) (JSONB, error) {
+	var rows []struct {
+		ID         uint64
+		CustomerID uint64
+	}
+	if err := tx.Model(model).Select("id", "customer_id").Where("customer_id IN ?", fromIDs).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	moved := JSONB{}
+	for _, row := range rows {
+		moved[strconv.FormatUint(row.ID, 10)] = row.CustomerID
+	}
+	if len(rows) == 0 {
+		return moved, nil
+	}
+	return moved, tx.Model(model).Where("customer_id IN ?", fromIDs).Update("customer_id", toID).Error
+}
+
+// sameCustomerRelation 两条关系是否重复：类型相同且两端相同，亲属关系不区分方向
+func sameCustomerRelation(a, b CustomerRelation) bool {
+	if a.Type != b.Type {
+		return false
+	}
+	if a.FromCustomerID == b.FromCustomerID && a.ToCustomerID == b.ToCustomerID {
+		return true
+	}
+	return a.Type == CustomerRelationRelativeOf && a.FromCustomerID == b.ToCustomerID && a.ToCustomerID == b.FromCustomerID
+}
+
+// relinkCustomerRelations 将被合并客户的关系改挂到保留客户，返回关系ID到原起点/终点的映射和被删除的关系。
+// 改挂后成为自环、与已有关系重复、超出分店/介绍关系单一上级限制或成环的关系会被删除，撤销合并时重建
+func relinkCustomerRelations(tx *gorm.DB, fromIDs []uint64, toID uint64) (JSONB, []CustomerRelation, error) {
+	moved := JSONB{}
+	var relations []CustomerRelation
+	err := tx.Where("from_customer_id IN ? OR to_customer_id IN ?", fromIDs, fromIDs).Order("id ASC").Find(&relations).Error
+	if err != nil || len(relations) == 0 {
+		return moved, nil, err
+	}
+	var kept []CustomerRelation
+	err = tx.Where("(from_customer_id = ? OR to_customer_id = ?) AND from_customer_id NOT IN ? AND to_customer_id NOT IN ?",
+		toID, toID, fromIDs, fromIDs).Order("id ASC").Find(&kept).Error
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var removed, updated []CustomerRelation
+	for _, relation := range relations {
+		relinked := relation
+		if containsUint64(fromIDs, relinked.FromCustomerID) {
+			relinked.FromCustomerID = toID
+		}
+		if containsUint64(fromIDs, relinked.ToCustomerID) {
+			relinked.ToCustomerID = toID
+		}
+		duplicate := relinked.FromCustomerID == relinked.ToCustomerID
+		for _, existing := range kept {
+			if duplicate {
+				break
+			}
+			duplicate = sameCustomerRelation(existing, relinked) ||
+				(customerRelationSingleParent[relinked.Type] && existing.Type == relinked.Type && existing.FromCustomerID == relinked.FromCustomerID)
+		}
+		if duplicate {
+			removed = append(removed, relation)
+			continue
+		}
+		moved[strconv.FormatUint(relation.ID, 10)] = map[string]uint64{
+			"from_customer_id": relation.FromCustomerID,
+			"to_customer_id":   relation.ToCustomerID,
+		}
+		kept = append(kept, relinked)
+		updated = append(updated, relinked)
+	}
+	for _, relation := range removed {
+		if err := tx.Delete(&CustomerRelation{}, relation.ID).Error; err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, relation := range updated {
+		err := tx.Model(&CustomerRelation{}).Where("id = ?", relation.ID).
+			Updates(map[string]interface{}{"from_customer_id": relation.FromCustomerID, "to_customer_id": relation.ToCustomerID}).Error
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// 新形成的环必然经过保留客户：沿保留客户的上级链追溯，末端又指回保留客户时删除保留客户的上级关系
+	for relationType := range customerRelationSingleParent {
+		chain, err := customerRelationChain(tx, toID, relationType, customerReferralMaxDepth*10)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(chain) == 0 {
+			continue
+		}
+		var count int64
+		err = tx.Model(&CustomerRelation{}).
+			Where("from_customer_id = ? AND to_customer_id = ? AND type = ?", chain[len(chain)-1].ToCustomerID, toID, relationType).
+			Count(&count).Error
+		if err != nil {
+			return nil, nil, err
+		}
+		if count == 0 {
+			continue
+		}
+		parent := chain[0]
+		key := strconv.FormatUint(parent.ID, 10)
+		if original, ok := moved[key].(map[string]uint64); ok {
+			parent.FromCustomerID = original["from_customer_id"]
+			parent.ToCustomerID = original["to_customer_id"]
+			delete(moved, key)
+		}
+		if err := tx.Delete(&CustomerRelation{}, parent.ID).Error; err != nil {
+			return nil, nil, err
+		}
+		removed = append(removed, parent)
+	}
+	return moved, removed, nil
+}
+
+// mergeCustomers 合并客户：保留客户吸收被合并客户的信息，待办、跟进记录、订单和客户关系改挂到保留客户，被合并客户删除
+func mergeCustomers(req CustomerMergeRequest) (*CustomerMergeResponse, error) {
+	var mergedIDs []uint64
+	for _, id := range req.MergedIDs {
+		if id == req.SurvivorID {
+			return nil, fmt.Errorf("保留客户不能同时作为被合并客户")
+		}
+		if !containsUint64(mergedIDs, id) {
+			mergedIDs = append(mergedIDs, id)
+		}
+	}
+
+	var result *CustomerMergeResponse
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var survivor Customer
+		if err := tx.Where("is_deleted = ?", false).First(&survivor, req.SurvivorID).Error; err != nil {
+			return err
+		}
+		var merged []Customer
+		if err := tx.Where("id IN ? AND is_deleted = ?", mergedIDs, false).Order("id ASC").Find(&merged).Error; err != nil {
+			return err
+		}
+		if len(merged) != len(mergedIDs) {
+			return gorm.ErrRecordNotFound
+		}
+
+		snapshot, err := toJSONB(map[string]interface{}{"survivor": survivor, "merged": merged})
+		if err != nil {
+			return err
+		}
+
+		todos, err := relinkCustomerRecords(tx, &Todo{}, mergedIDs, req.SurvivorID)
+		if err != nil {
+			return err
+		}
+		records, err := relinkCustomerRecords(tx, &FollowUpRecord{}, mergedIDs, req.SurvivorID)
+		if err != nil {
+			return err
+		}
+		orders, err := relinkCustomerRecords(tx, &Order{}, mergedIDs, req.SurvivorID)
+		if err != nil {
+			return err
+		}
+		returns, err := relinkCustomerRecords(tx, &OrderReturn{}, mergedIDs, req.SurvivorID)
+		if err != nil {
+			return err
+		}
+		relations, removedRelations, err := relinkCustomerRelations(tx, mergedIDs, req.SurvivorID)
+		if err != nil {
+			return err
+		}
+
+		before := customerSnapshot(&survivor)
+		for i := range merged {
+			mergeCustomerFields(&survivor, &merged[i])
+		}
+		survivor.UpdatedAt = time.Now()
+		survivor.UpdatedBy = uint(req.OperatorID)
+		if err := tx.Save(&survivor).Error; err != nil {
+			return err
+		}
+		if err := refreshCustomerOrderStats(tx, req.SurvivorID); err != nil {
+			return err
+		}
+		if err := tx.First(&survivor, req.SurvivorID).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&Customer{}, mergedIDs).Error; err != nil {
+			return err
+		}
+		remark := fmt.Sprintf("合并客户 %v", mergedIDs)
+		if err := recordCustomerChange(tx, req.SurvivorID, before, customerSnapshot(&survivor), ActionUpdate, CustomerChangeMerge, req.OperatorID, remark); err != nil {
+			return err
+		}
+		for i := range merged {
+			remark := fmt.Sprintf("合并到客户 %d", req.SurvivorID)
+			if err := recordCustomerChange(tx, uint64(merged[i].ID), customerSnapshot(&merged[i]), nil, ActionDelete, CustomerChangeMerge, req.OperatorID, remark); err != nil {
+				return err
+			}
+		}
+
+		ids := make(pq.Int64Array, len(mergedIDs))
+		for i, id := range mergedIDs {
+			ids[i] = int64(id)
+		}
+		merge := CustomerMerge{
+			SurvivorID: req.SurvivorID,
+			MergedIDs:  ids,
+			GroupID:    req.GroupID,
+			Snapshot:   snapshot,
+			Relinked: JSONB{
+				"todos": todos, "follow_up_records": records, "orders": orders, "order_returns": returns,
+				"customer_relations": relations, "removed_customer_relations": removedRelations,
+			},
+			Status:     CustomerMergeDone,
+			OperatorID: req.OperatorID,
+		}
+		if err := tx.Create(&merge).Error; err != nil {
+			return err
+		}
+		if req.GroupID != nil {
+			err := tx.Model(&DuplicateGroup{}).Where("id = ?", *req.GroupID).
+				Updates(map[string]interface{}{"status": DuplicateGroupMerged, "merge_id": merge.ID}).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		result = &CustomerMergeResponse{Merge: merge, Customer: CustomerToResponse(&survivor)}
+		return nil
+	})
+	return result, err
+}
+
+// undoCustomerMerge 撤销合并：按原ID重建被合并客户，保留客户恢复到合并前，改挂的记录和客户关系还原
+func undoCustomerMerge(id uint64, operatorID uint64) (*CustomerMergeResponse, error) {
+	var result *CustomerMergeResponse
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var merge CustomerMerge
+		if err := tx.First(&merge, id).Error; err != nil {
+			return err
+		}
+		if merge.Status != CustomerMergeDone {
+			return errMergeAlreadyUndone
+		}
+
+		var snapshot struct {
+			Survivor Customer   `json:"survivor"`
+			Merged   []Customer `json:"merged"`
+		}
+		if err := fromJSONB(merge.Snapshot, &snapshot); err != nil {
+			return err
+		}
+		// 保留客户在合并之后有修改时拒绝撤销，避免用合并前的快照覆盖
+		var current Customer
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&current, merge.SurvivorID).Error; err != nil {
+			return err
+		}
+		if current.UpdatedAt.After(merge.CreatedAt) {
+			return errMergeSurvivorModified
+		}
+		remark := fmt.Sprintf("撤销合并 #%d", merge.ID)
+		for i := range snapshot.Merged {
+			if err := tx.Create(&snapshot.Merged[i]).Error; err != nil {
+				return err
+			}
+			if err := recordCustomerChange(tx, uint64(snapshot.Merged[i].ID), nil, customerSnapshot(&snapshot.Merged[i]), ActionCreate, CustomerChangeMerge, operatorID, remark); err != nil {
+				return err
+			}
+		}
+		if err := tx.Save(&snapshot.Survivor).Error; err != nil {
+			return err
+		}
+		if err := recordCustomerStateChange(tx, merge.SurvivorID, &current.State, snapshot.Survivor.State, remark, CustomerChangeMerge, operatorID, time.Now()); err != nil {
+			return err
+		}
+
+		for key, model := range map[string]interface{}{
+			"todos": &Todo{}, "follow_up_records": &FollowUpRecord{}, "orders": &Order{}, "order_returns": &OrderReturn{},
+		} {
+			moved, _ := merge.Relinked[key].(map[string]interface{})
+			for recordID, customerID := range moved {
+				original, ok := customerID.(float64)
+				if !ok {
+					continue
+				}
+				err := tx.Model(model).
+					Where("id = ? AND customer_id = ?", recordID, merge.SurvivorID).
+					Update("customer_id", uint64(original)).Error
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := restoreCustomerRelations(tx, merge); err != nil {
+			return err
+		}
+		// 订单还原后重新统计保留客户和被合并客户的订单数据，合并后新建的订单仍计入保留客户
+		if err := refreshCustomerOrderStats(tx, merge.SurvivorID); err != nil {
+			return err
+		}
+		for i := range snapshot.Merged {
+			if err := refreshCustomerOrderStats(tx, uint64(snapshot.Merged[i].ID)); err != nil {
+				return err
+			}
+		}
+		if err := tx.First(&snapshot.Survivor, merge.SurvivorID).Error; err != nil {
+			return err
+		}
+		if err := recordCustomerChange(tx, merge.SurvivorID, customerSnapshot(&current), customerSnapshot(&snapshot.Survivor), ActionUpdate, CustomerChangeMerge, operatorID, remark); err != nil {
+			return err
+		}
+
+		if merge.GroupID != nil {
+			err := tx.Model(&DuplicateGroup{}).Where("id = ?", *merge.GroupID).
+				Updates(map[string]interface{}{"status": DuplicateGroupPending, "merge_id": nil}).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		now := time.Now()
+		merge.Status = CustomerMergeUndone
+		merge.UndoneAt = &now
+		if err := tx.Model(&merge).Updates(map[string]interface{}{"status": merge.Status, "undone_at": now}).Error; err != nil {
+			return err
+		}
+		result = &CustomerMergeResponse{Merge: merge, Customer: CustomerToResponse(&snapshot.Survivor)}
+		return nil
+	})
+	return result, err
+}
+
+// restoreCustomerRelations 撤销合并时还原改挂的客户关系并重建合并时删除的关系，已存在相同关系时跳过
+func restoreCustomerRelations(tx *gorm.DB, merge CustomerMerge) error {
+	moved, _ := merge.Relinked["customer_relations"].(map[string]interface{})
+	for relationID, value := range moved {
+		original, _ := value.(map[string]interface{})
+		from, fromOK := original["from_customer_id"].(float64)
+		to, toOK := original["to_customer_id"].(float64)
+		if !fromOK || !toOK {
+			continue
+		}
+		err := tx.Model(&CustomerRelation{}).Where("id = ?", relationID).
+			Updates(map[string]interface{}{"from_customer_id": uint64(from), "to_customer_id": uint64(to)}).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(merge.Relinked["removed_customer_relations"])
+	if err != nil {
+		return err
+	}
+	var removed []CustomerRelation
+	if err := json.Unmarshal(data, &removed); err != nil {
+		return err
+	}
+	for i := range removed {
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&removed[i]).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getCustomerMerges 获取合并记录，customerID 不为0时只返回与该客户相关的记录
+func getCustomerMerges(customerID uint64, page, pageSize int) ([]CustomerMerge, int64) {
+	var merges []CustomerMerge
+	var total int64
+
+	query := DB.Model(&CustomerMerge{})
+	if customerID > 0 {
+		query = query.Where("survivor_id = ? OR ? = ANY(merged_ids)", customerID, customerID)
+	}
+	query.Count(&total)
+	query.Offset((page - 1) * pageSize).Limit(pageSize).Order("created_at DESC").Find(&merges)
+	return merges, total
+}
+
+// ========== 创建客户查重相关业务函数 ==========
+
+// createDuplicateMatchLimit 每种查重条件最多返回的客户数
+const createDuplicateMatchLimit = 20
+
+// normalizedWechatSQL 数据库中微信号的规范化表达式（去掉首尾空白并忽略大小写），与 normalizeWechat 一致
+const normalizedWechatSQL = `lower(trim(w))`
+
+// findCreateDuplicates 创建客户前查重：电话与已有电话/工作电话比对，微信与已有微信/工作微信比对，同城同名也视为疑似重复
+func findCreateDuplicates(req CustomerRequest) []CustomerDuplicateMatch {
+	var matches []CustomerDuplicateMatch
+	index := make(map[uint]int)
+	add := func(customers []Customer, reason func(*Customer) string) {
+		for i := range customers {
+			customer := &customers[i]
+			if j, ok := index[customer.ID]; ok {
+				if r := reason(customer); !containsString(matches[j].MatchedBy, r) {
+					matches[j].MatchedBy = append(matches[j].MatchedBy, r)
+				}
+				continue
+			}
+			index[customer.ID] = len(matches)
+			matches = append(matches, CustomerDuplicateMatch{
+				ID:         customer.ID,
+				Name:       customer.Name,
+				Phones:     []string(customer.Phones),
+				Wechats:    []string(customer.Wechats),
+				City:       customer.City,
+				Sellers:    []int64(customer.Sellers),
+				SallerName: customer.SallerName,
+				MatchedBy:  []string{reason(customer)},
+			})
+		}
+	}
+
+	// 电话写入时已规范化，直接用数组重叠比较以便走 GIN 索引
+	var phones pq.StringArray
+	for _, phone := range append(append([]string{}, req.Phones...), req.WorkPhone...) {
+		if p := normalizePhone(phone); p != "" && !containsString(phones, p) {
+			phones = append(phones, p)
+		}
+	}
+	if len(phones) > 0 {
+		var customers []Customer
+		DB.Where("is_deleted = ?", false).
+			Where("phones && ? OR work_phone && ?", phones, phones).
+			Limit(createDuplicateMatchLimit).Find(&customers)
+		add(customers, func(c *Customer) string {
+			for _, phone := range append(append([]string{}, c.Phones...), c.WorkPhone...) {
+				if containsString(phones, normalizePhone(phone)) {
+					return "电话 " + normalizePhone(phone)
+				}
+			}
+			return "电话"
+		})
+	}
+
+	var wechats []string
+	for _, wechat := range req.Wechats {
+		if w := normalizeWechat(wechat); w != "" && !containsString(wechats, w) {
+			wechats = append(wechats, w)
+		}
+	}
+	if len(wechats) > 0 {
+		var customers []Customer
+		DB.Where("is_deleted = ?", false).
+			Where("EXISTS (SELECT 1 FROM unnest(wechats || work_wechat) AS w WHERE "+normalizedWechatSQL+" IN ?)", wechats).
+			Limit(createDuplicateMatchLimit).Find(&customers)
+		add(customers, func(c *Customer) string {
+			for _, wechat := range append(append([]string{}, c.Wechats...), c.WorkWechat...) {
+				if w := normalizeWechat(wechat); containsString(wechats, w) {
+					return "微信 " + w
+				}
+			}
+			return "微信"
+		})
+	}
+
+	// 城市未填写时从地址中解析
+	city := req.City
+	if city == "" {
+		city = parseChineseAddress(req.Address).City
+	}
+	name := strings.ToLower(strings.Join(strings.Fields(req.Name), ""))
+	if name != "" && city != "" {
+		var customers []Customer
+		DB.Where("lower(regexp_replace(name, '\\s', '', 'g')) = ? AND city = ? AND is_deleted = ?", name, city, false).
+			Limit(createDuplicateMatchLimit).Find(&customers)
+		add(customers, func(c *Customer) string { return "同城同名 " + city })
+	}
+
+	fillDuplicateSellerNames(matches)
+	return matches
+}
+
+// fillDuplicateSellerNames 补充疑似重复客户归属销售员的姓名
+func fillDuplicateSellerNames(matches []CustomerDuplicateMatch) {
+	var sellerIDs []int64
+	for _, match := range matches {
+		for _, id := range match.Sellers {
+			if !containsInt64(sellerIDs, id) {
+				sellerIDs = append(sellerIDs, id)
+			}
+		}
+	}
+	if len(sellerIDs) == 0 {
+		return
+	}
+	var users []User
+	DB.Select("id", "name").Where("id IN ?", sellerIDs).Find(&users)
+	names := make(map[int64]string)
+	for _, user := range users {
+		names[int64(user.ID)] = user.Name
+	}
+	for i := range matches {
+		matches[i].SellerNames = []string{}
+		for _, id := range matches[i].Sellers {
+			if name, ok := names[id]; ok {
+				matches[i].SellerNames = append(matches[i].SellerNames, name)
+			}
+		}
+	}
+}
+
+// ========== 联系方式规范化与查找相关业务函数 ==========
+
+// phoneMigrationBatchSize 电话号码规范化迁移每批处理的客户数
+const phoneMigrationBatchSize = 500
+
+// contactLookupLimit 按联系方式查找客户最多返回的数量
+const contactLookupLimit = 20
+
+// validateCustomerPhones 校验客户请求中的电话和工作电话，并统一保存为规范化后的纯数字格式；微信号同时按 normalizeWechat 规范化
+func validateCustomerPhones(req *CustomerRequest) error {
+	phones, err := normalizePhones(req.Phones)
+	if err != nil {
+		return err
+	}
+	req.Phones = phones
+	if req.WorkPhone != nil {
+		workPhones, err := normalizePhones(req.WorkPhone)
+		if err != nil {
+			return err
+		}
+		req.WorkPhone = append([]string{}, workPhones...)
+	}
+	req.Wechats = normalizeWechats(req.Wechats)
+	return nil
+}
+
+// normalizeStoredPhones 规范化已保存的电话号码并去重；无法识别的号码保留原值，避免丢失数据
+func normalizeStoredPhones(phones pq.StringArray) (pq.StringArray, int) {
+	var result pq.StringArray
+	invalid := 0
+	for _, phone := range phones {
+		value := strings.TrimSpace(phone)
+		if value == "" {
+			continue
+		}
+		if p, err := validatePhone(value); err == nil {
+			value = p
+		} else {
+			invalid++
+		}
+		if !containsString(result, value) {
+			result = append(result, value)
+		}
+	}
+	return result, invalid
+}
+
+// migrateCustomerPhones 将历史客户的电话和工作电话规范化为纯数字格式（启动时执行，可重复执行）
+func migrateCustomerPhones() {
+	var customers []Customer
+	var updated, invalid int
+	result := DB.Select("id", "phones", "work_phone").
+		Where("EXISTS (SELECT 1 FROM unnest(phones || work_phone) AS p WHERE p !~ '^[0-9]+$' OR p ~ '^(0086|86)1[0-9]{10}$')").
+		FindInBatches(&customers, phoneMigrationBatchSize, func(_ *gorm.DB, batch int) error {
+			// 每批的客户更新和变更记录在同一事务中提交
+			batchUpdated, batchInvalid := 0, 0
+			err := DB.Transaction(func(tx *gorm.DB) error {
+				for i := range customers {
+					phones, badPhones := normalizeStoredPhones(customers[i].Phones)
+					workPhones, badWorkPhones := normalizeStoredPhones(customers[i].WorkPhone)
+					batchInvalid += badPhones + badWorkPhones
+					if strings.Join(phones, ",") == strings.Join(customers[i].Phones, ",") &&
+						strings.Join(workPhones, ",") == strings.Join(customers[i].WorkPhone, ",") {
+						continue
+					}
+					err := tx.Model(&Customer{}).Where("id = ?", customers[i].ID).
+						Updates(map[string]interface{}{"phones": phones, "work_phone": workPhones}).Error
+					if err != nil {
+						return err
+					}
+					before, err := toJSONB(map[string]interface{}{"phones": customers[i].Phones, "work_phone": customers[i].WorkPhone})
+					if err != nil {
+						return err
+					}
+					after, err := toJSONB(map[string]interface{}{"phones": phones, "work_phone": workPhones})
+					if err != nil {
+						return err
+					}
+					if err := recordCustomerChange(tx, uint64(customers[i].ID), before, after, ActionUpdate, CustomerChangeSystem, 0, "电话号码规范化"); err != nil {
+						return err
+					}
+					batchUpdated++
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			updated += batchUpdated
+			invalid += batchInvalid
+			return nil
+		})
+	if result.Error != nil {
+		log.Printf("电话号码规范化失败: %v", result.Error)
+		return
+	}
+	if updated > 0 || invalid > 0 {
+		log.Printf("电话号码规范化完成：更新 %d 个客户，%d 个号码无法识别已保留原值", updated, invalid)
+	}
+}
+
+// findCustomersByContact 按电话、微信、抖音、快手、小红书账号精确查找客户，多个条件之间为“或”关系
+func findCustomersByContact(req ContactLookupRequest) []*CustomerResponse {
+	query := DB.Model(&Customer{}).Where("is_deleted = ?", false)
+	conditions := DB.Where("1 = 0")
+	if phone := normalizePhone(req.Phone); phone != "" {
+		value := pq.StringArray{phone}
+		conditions = conditions.Or("phones && ?", value).Or("work_phone && ?", value)
+	}
+	if wechat := normalizeWechat(req.Wechat); wechat != "" {
+		conditions = conditions.Or("EXISTS (SELECT 1 FROM unnest(wechats || work_wechat) AS w WHERE "+normalizedWechatSQL+" = ?)", wechat)
+	}
+	accounts := []struct{ column, value string }{
+		{"douyins", req.Douyin},
+		{"kwais", req.Kwai},
+		{"redbooks", req.Redbook},
+	}
+	for _, account := range accounts {
+		if value := strings.TrimSpace(account.value); value != "" {
+			conditions = conditions.Or(account.column+" && ?", pq.StringArray{value})
+		}
+	}
+
+	var customers []Customer
+	query.Where(conditions).Order("updated_at DESC").Limit(contactLookupLimit).Find(&customers)
+
+	responses := make([]*CustomerResponse, len(customers))
+	for i := range customers {
+		responses[i] = CustomerToResponse(&customers[i])
+	}
+	return responses
+}
+
+// ========== 客户导出相关业务函数 ==========
+
+// customerExportBatchSize 导出时每批从数据库读取的客户数
+const customerExportBatchSize = 500
+
+// customerExportSeparator 数组字段展开为单元格时的分隔符（与导入时的多值拆分兼容）
+const customerExportSeparator = ","
+
+// customerExportContext 导出时预先加载的标签和用户名称
+type customerExportContext struct {
+	tagNames  map[int64]string
+	userNames map[int64]string
+}
+
+// customerExportColumn 客户导出列定义
+type customerExportColumn struct {
+	Key     string
+	Title   string
+	Default bool
+	Value   func(c *Customer, ctx *customerExportContext) interface{}
+}
+
+// exportStrings 数组字段展开为单个单元格
+func exportStrings(values []string) string {
+	return strings.Join(values, customerExportSeparator)
+}
+
+// exportIDs 整型数组展开为单个单元格
+func exportIDs(ids []int64) string {
+	values := make([]string, len(ids))
+	for i, id := range ids {
+		values[i] = strconv.FormatInt(id, 10)
+	}
+	return exportStrings(values)
+}
+
+// exportNames 将ID数组解析为名称，找不到名称时保留ID
+func exportNames(ids []int64, names map[int64]string) string {
+	values := make([]string, len(ids))
+	for i, id := range ids {
+		if name, ok := names[id]; ok {
+			values[i] = name
+		} else {
+			values[i] = strconv.FormatInt(id, 10)
+		}
+	}
+	return exportStrings(values)
+}
+
+// exportTime 时间字段格式化，空值导出为空字符串
+func exportTime(t *time.Time) string {
+	if t == nil || t.IsZero() {
+		return ""
+	}
+	return t.Format("2006-01-02 15:04:05")
+}
+
+// customerExportColumns 可导出的列（按导出时的默认顺序排列）
+var customerExportColumns = []customerExportColumn{
+	{"id", "客户ID", true, func(c *Customer, _ *customerExportContext) interface{} { return c.ID }},
+	{"name", "客户名称", true, func(c *Customer, _ *customerExportContext) interface{} { return c.Name }},
+	{"contact_name", "联系人", true, func(c *Customer, _ *customerExportContext) interface{} { return c.ContactName }},
+	{"gender", "性别", false, func(c *Customer, _ *customerExportContext) interface{} { return c.Gender }},
+	{"phones", "电话", true, func(c *Customer, _ *customerExportContext) interface{} { return exportStrings(c.Phones) }},
+	{"work_phone", "工作电话", false, func(c *Customer, _ *customerExportContext) interface{} { return exportStrings(c.WorkPhone) }},
+	{"wechats", "微信", false, func(c *Customer, _ *customerExportContext) interface{} { return exportStrings(c.Wechats) }},
+	{"work_wechat", "工作微信", false, func(c *Customer, _ *customerExportContext) interface{} { return exportStrings(c.WorkWechat) }},
+	{"douyins", "抖音", false, func(c *Customer, _ *customerExportContext) interface{} { return exportStrings(c.Douyins) }},
+	{"kwais", "快手", false, func(c *Customer, _ *customerExportContext) interface{} { return exportStrings(c.Kwais) }},
+	{"redbooks", "小红书", false, func(c *Customer, _ *customerExportContext) interface{} { return exportStrings(c.Redbooks) }},
+	{"province", "省份", true, func(c *Customer, _ *customerExportContext) interface{} { return c.Province }},
+	{"city", "城市", true, func(c *Customer, _ *customerExportContext) interface{} { return c.City }},
+	{"district", "区县", true, func(c *Customer, _ *customerExportContext) interface{} { return c.District }},
+	{"district_id", "区县编码", false, func(c *Customer, _ *customerExportContext) interface{} { return c.DistrictID }},
+	{"street", "街道", false, func(c *Customer, _ *customerExportContext) interface{} { return c.Street }},
+	{"address", "地址", true, func(c *Customer, _ *customerExportContext) interface{} { return c.Address }},
+	{"lat", "纬度", false, func(c *Customer, _ *customerExportContext) interface{} { return c.Lat }},
+	{"lon", "经度", false, func(c *Customer, _ *customerExportContext) interface{} { return c.Lon }},
+	{"category", "分类", true, func(c *Customer, _ *customerExportContext) interface{} { return c.Category }},
+	{"tags", "标签", true, func(c *Customer, _ *customerExportContext) interface{} { return exportStrings(c.Tags) }},
+	{"system_tags", "系统标签", true, func(c *Customer, ctx *customerExportContext) interface{} {
+		return exportNames(c.SystemTags, ctx.tagNames)
+	}},
+	{"level", "等级", true, func(c *Customer, _ *customerExportContext) interface{} { return c.Level }},
+	{"state", "状态", true, func(c *Customer, _ *customerExportContext) interface{} { return c.State }},
+	{"kind", "类型", false, func(c *Customer, _ *customerExportContext) interface{} { return c.Kind }},
+	{"sellers", "销售员ID", false, func(c *Customer, _ *customerExportContext) interface{} { return exportIDs(c.Sellers) }},
+	{"seller_names", "销售员", true, func(c *Customer, ctx *customerExportContext) interface{} {
+		return exportNames(c.Sellers, ctx.userNames)
+	}},
+	{"saller_name", "业务员", false, func(c *Customer, _ *customerExportContext) interface{} { return c.SallerName }},
+	{"products", "产品", false, func(c *Customer, _ *customerExportContext) interface{} { return exportStrings(c.Products) }},
+	{"source", "来源", false, func(c *Customer, _ *customerExportContext) interface{} { return c.Source }},
+	{"import_source", "导入来源", false, func(c *Customer, _ *customerExportContext) interface{} { return c.ImportSource }},
+	{"credit_sale", "赊销金额", false, func(c *Customer, _ *customerExportContext) interface{} { return c.CreditSale }},
+	{"last_visited", "最后拜访时间", false, func(c *Customer, _ *customerExportContext) interface{} { return exportTime(c.LastVisited) }},
+	{"last_called", "最后通话时间", false, func(c *Customer, _ *customerExportContext) interface{} { return exportTime(c.LastCalled) }},
+	{"last_order_date", "最后下单时间", false, func(c *Customer, _ *customerExportContext) interface{} { return exportTime(c.LastOrderDate) }},
+	{"order_count", "订单数量", false, func(c *Customer, _ *customerExportContext) interface{} { return c.OrderCount }},
+	{"avg_order_value", "平均订单金额", false, func(c *Customer, _ *customerExportContext) interface{} {
+		if c.AvgOrderValue == nil {
+			return ""
+		}
+		return *c.AvgOrderValue
+	}},
+	{"remark", "备注", false, func(c *Customer, _ *customerExportContext) interface{} { return c.Remark }},
+	{"created_at", "创建时间", true, func(c *Customer, _ *customerExportContext) interface{} { return exportTime(&c.CreatedAt) }},
+	{"updated_at", "更新时间", false, func(c *Customer, _ *customerExportContext) interface{} { return exportTime(&c.UpdatedAt) }},
+}
+
+// getCustomerExportColumns 获取可导出的列
+func getCustomerExportColumns() []CustomerExportColumnResponse {
+	responses := make([]CustomerExportColumnResponse, len(customerExportColumns))
+	for i, column := range customerExportColumns {
+		responses[i] = CustomerExportColumnResponse{Key: column.Key, Title: column.Title, Default: column.Default}
+	}
+	return responses
+}
+
+// resolveCustomerExportColumns 按逗号分隔的列名选择导出列（保持调用方给出的顺序），为空时使用默认列
+func resolveCustomerExportColumns(keys string) ([]customerExportColumn, error) {
+	var columns []customerExportColumn
+	if strings.TrimSpace(keys) == "" {
+		for _, column := range customerExportColumns {
+			if column.Default {
+				columns = append(columns, column)
+			}
+		}
+		return columns, nil
+	}
+
+	byKey := make(map[string]customerExportColumn, len(customerExportColumns))
+	for _, column := range customerExportColumns {
+		byKey[column.Key] = column
+	}
+	seen := make(map[string]bool)
+	for _, key := range strings.Split(keys, ",") {
+		key = strings.ToLower(strings.TrimSpace(key))
+		if key == "" || seen[key] {
+			continue
+		}
+		column, ok := byKey[key]
+		if !ok {
+			return nil, fmt.Errorf("不支持导出的列: %s", key)
+		}
+		seen[key] = true
+		columns = append(columns, column)
+	}
+	if len(columns) == 0 {
+		return nil, errors.New("没有可导出的列")
+	}
+	return columns, nil
+}
+
+// newCustomerExportContext 按导出列按需加载系统标签和销售员名称
+func newCustomerExportContext(columns []customerExportColumn) *customerExportContext {
+	ctx := &customerExportContext{tagNames: map[int64]string{}, userNames: map[int64]string{}}
+	for _, column := range columns {
+		switch column.Key {
+		case "system_tags":
+			var tags []Tag
+			DB.Select("id", "name").Find(&tags)
+			for _, tag := range tags {
+				ctx.tagNames[int64(tag.ID)] = tag.Name
+			}
+		case "seller_names":
+			var users []User
+			DB.Select("id", "name").Find(&users)
+			for _, user := range users {
+				ctx.userNames[int64(user.ID)] = user.Name
+			}
+		}
+	}
+	return ctx
+}
+
+// customerExportRecord 将客户转换为一行导出数据
+func customerExportRecord(customer *Customer, columns []customerExportColumn, ctx *customerExportContext) []interface{} {
+	record := make([]interface{}, len(columns))
+	for i, column := range columns {
+		record[i] = column.Value(customer, ctx)
+	}
+	return record
+}
+
+// exportCustomers 按排序键集分批读取客户并以 CSV 或 XLSX 格式流式写出，不会一次性加载全部客户，顺序与列表一致
+func exportCustomers(w io.Writer, query *gorm.DB, sorts []CustomerSortField, format string, columns []customerExportColumn) error {
+	ctx := newCustomerExportContext(columns)
+	header := make([]interface{}, len(columns))
+	for i, column := range columns {
+		header[i] = column.Title
+	}
+
+	batches := func(fn func([]Customer) error) error {
+		return findCustomersByKeyset(query, sorts, customerExportBatchSize, fn)
+	}
+	if format == "xlsx" {
+		return exportCustomersXLSX(w, batches, header, columns, ctx)
+	}
+	return exportCustomersCSV(w, batches, header, columns, ctx)
+}
+
+// exportCustomersCSV 以带 BOM 的 UTF-8 CSV 流式导出，每批写完立即刷新到客户端
+func exportCustomersCSV(w io.Writer, batches func(func([]Customer) error) error, header []interface{}, columns []customerExportColumn, ctx *customerExportContext) error {
+	if _, err := io.WriteString(w, "\xef\xbb\xbf"); err != nil {
+		return err
+	}
+	writer := csv.NewWriter(w)
+	toStrings := func(values []interface{}) []string {
+		record := make([]string, len(values))
+		for i, value := range values {
+			record[i] = fmt.Sprint(value)
+		}
+		return record
+	}
+	if err := writer.Write(toStrings(header)); err != nil {
+		return err
+	}
+
+	err := batches(func(customers []Customer) error {
+		for i := range customers {
+			if err := writer.Write(toStrings(customerExportRecord(&customers[i], columns, ctx))); err != nil {
+				return err
+			}
+		}
+		writer.Flush()
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		return writer.Error()
+	})
+	if err != nil {
+		return err
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// exportCustomersXLSX 使用 excelize 流式写入器（NewStreamWriter）逐批写入行，不在内存中构建整个工作簿：
+// 行数据超出内存阈值时由 excelize 暂存到临时文件，最后直接压缩写入响应
+func exportCustomersXLSX(w io.Writer, batches func(func([]Customer) error) error, header []interface{}, columns []customerExportColumn, ctx *customerExportContext) error {
+	f := excelize.NewFile()
+	defer f.Close()
+	sheet := f.GetSheetName(0)
+	sw, err := f.NewStreamWriter(sheet)
+	if err != nil {
+		return err
+	}
+	if err := sw.SetRow("A1", header); err != nil {
+		return err
+	}
+
+	row := 1
+	err = batches(func(customers []Customer) error {
+		for i := range customers {
+			row++
+			cell, err := excelize.CoordinatesToCellName(1, row)
+			if err != nil {
+				return err
+			}
+			if err := sw.SetRow(cell, customerExportRecord(&customers[i], columns, ctx)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := sw.Flush(); err != nil {
+		return err
+	}
+	return f.Write(w)
+}
+
+// ========== 客户结构化筛选相关业务函数 ==========
+
+// customerFilterFieldType 可筛选字段的值类型，决定支持的操作符和值的解析方式
+type customerFilterFieldType int
+
+const (
+	filterFieldInt customerFilterFieldType = iota
+	filterFieldFloat
+	filterFieldString
+	filterFieldBool
+	filterFieldTime
+	filterFieldStringArray
+	filterFieldIntArray
+)
+
+// customerFilterFields 可筛选和排序的字段白名单（字段名即数据库列名）
+var customerFilterFields = map[string]customerFilterFieldType{
+	"id":              filterFieldInt,
+	"name":            filterFieldString,
+	"contact_name":    filterFieldString,
+	"level":           filterFieldInt,
+	"state":           filterFieldInt,
+	"kind":            filterFieldInt,
+	"gender":          filterFieldInt,
+	"category":        filterFieldString,
+	"province":        filterFieldString,
+	"city":            filterFieldString,
+	"district":        filterFieldString,
+	"district_id":     filterFieldInt,
+	"source":          filterFieldString,
+	"import_source":   filterFieldString,
+	"saller_name":     filterFieldString,
+	"sellers":         filterFieldIntArray,
+	"tags":            filterFieldStringArray,
+	"system_tags":     filterFieldIntArray,
+	"products":        filterFieldStringArray,
+	"added_wechat":    filterFieldBool,
+	"credit_sale":     filterFieldFloat,
+	"order_count":     filterFieldInt,
+	"avg_order_value": filterFieldFloat,
+	"last_order_date": filterFieldTime,
+	"last_visited":    filterFieldTime,
+	"last_called":     filterFieldTime,
+	"created_at":      filterFieldTime,
+	"updated_at":      filterFieldTime,
+}
+
+// customerFilterOps 各类型字段支持的操作符
+var customerFilterOps = map[customerFilterFieldType][]string{
+	filterFieldInt:         {"eq", "ne", "in", "nin", "gt", "gte", "lt", "lte", "between", "is_null", "not_null"},
+	filterFieldFloat:       {"eq", "ne", "gt", "gte", "lt", "lte", "between", "is_null", "not_null"},
+	filterFieldString:      {"eq", "ne", "in", "nin", "contains", "is_null", "not_null"},
+	filterFieldBool:        {"eq", "ne", "is_null", "not_null"},
+	filterFieldTime:        {"gt", "gte", "lt", "lte", "between", "is_null", "not_null"},
+	filterFieldStringArray: {"any", "all", "none", "is_null", "not_null"},
+	filterFieldIntArray:    {"any", "all", "none", "is_null", "not_null"},
+}
+
+// relativeTimePattern 相对时间，如 -90d（90天前）、-12h、+1w
+var relativeTimePattern = regexp.MustCompile(`^([+-]?\d+)([hdw])$`)
+
+// parseFilterTime 解析筛选用的时间值：RFC3339、日期、日期时间、now 或相对时间（-90d 表示90天前）
+func parseFilterTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	now := time.Now()
+	if s == "now" {
+		return now, nil
+	}
+	if m := relativeTimePattern.FindStringSubmatch(s); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		switch m[2] {
+		case "h":
+			return now.Add(time.Duration(n) * time.Hour), nil
+		case "d":
+			return now.AddDate(0, 0, n), nil
+		default:
+			return now.AddDate(0, 0, n*7), nil
+		}
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("无法识别的时间 %q", s)
+}
+
+// filterRawValues 将条件值展开为字符串列表：数组逐项展开，字符串按逗号拆分（查询参数形式）
+func filterRawValues(value interface{}) []string {
+	var values []string
+	switch v := value.(type) {
+	case nil:
+	case []interface{}:
+		for _, item := range v {
+			values = append(values, filterRawValues(item)...)
+		}
+	case []string:
+		for _, item := range v {
+			values = append(values, strings.TrimSpace(item))
+		}
+	case string:
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				values = append(values, item)
+			}
+		}
+	case float64:
+		values = append(values, strconv.FormatFloat(v, 'f', -1, 64))
+	default:
+		values = append(values, fmt.Sprint(v))
+	}
+	return values
+}
+
+// parseFilterValues 按字段类型解析条件值
+func parseFilterValues(fieldType customerFilterFieldType, raw []string) ([]interface{}, error) {
+	values := make([]interface{}, 0, len(raw))
+	for _, s := range raw {
+		switch fieldType {
+		case filterFieldInt, filterFieldIntArray:
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%q 不是整数", s)
+			}
+			values = append(values, n)
+		case filterFieldFloat:
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%q 不是数字", s)
+			}
+			values = append(values, f)
+		case filterFieldBool:
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return nil, fmt.Errorf("%q 不是布尔值", s)
+			}
+			values = append(values, b)
+		case filterFieldTime:
+			t, err := parseFilterTime(s)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, t)
+		default:
+			values = append(values, s)
+		}
+	}
+	return values, nil
+}
+
+// customerFilterClause 将单个筛选条件转换为 SQL 条件和参数
+func customerFilterClause(cond CustomerFilterCondition) (string, []interface{}, error) {
+	field := strings.ToLower(strings.TrimSpace(cond.Field))
+	op := strings.ToLower(strings.TrimSpace(cond.Op))
+	if op == "" {
+		op = "eq"
+	}
+	fieldType, ok := customerFilterFields[field]
+	if !ok {
+		return "", nil, fmt.Errorf("不支持筛选的字段: %s", cond.Field)
+	}
+	if !containsString(customerFilterOps[fieldType], op) {
+		return "", nil, fmt.Errorf("字段 %s 不支持操作符 %s", field, op)
+	}
+
+	isArray := fieldType == filterFieldStringArray || fieldType == filterFieldIntArray
+	switch op {
+	case "is_null":
+		if isArray {
+			return fmt.Sprintf("(%s IS NULL OR cardinality(%s) = 0)", field, field), nil, nil
+		}
+		if fieldType == filterFieldString {
+			return fmt.Sprintf("(%s IS NULL OR %s = '')", field, field), nil, nil
+		}
+		return field + " IS NULL", nil, nil
+	case "not_null":
+		if isArray {
+			return fmt.Sprintf("cardinality(%s) > 0", field), nil, nil
+		}
+		if fieldType == filterFieldString {
+			return fmt.Sprintf("(%s IS NOT NULL AND %s <> '')", field, field), nil, nil
+		}
+		return field + " IS NOT NULL", nil, nil
+	}
+
+	values, err := parseFilterValues(fieldType, filterRawValues(cond.Value))
+	if err != nil {
+		return "", nil, fmt.Errorf("字段 %s: %v", field, err)
+	}
+	switch op {
+	case "between":
+		if len(values) != 2 {
+			return "", nil, fmt.Errorf("字段 %s 的 between 需要两个值", field)
+		}
+		return field + " BETWEEN ? AND ?", values, nil
+	case "in", "nin", "any", "all", "none":
+		if len(values) == 0 {
+			return "", nil, fmt.Errorf("字段 %s 的 %s 至少需要一个值", field, op)
+		}
+	default:
+		if len(values) != 1 {
+			return "", nil, fmt.Errorf("字段 %s 的 %s 需要一个值", field, op)
+		}
+	}
+
+	var array interface{}
+	if isArray {
+		if fieldType == filterFieldIntArray {
+			ids := make(pq.Int64Array, len(values))
+			for i, v := range values {
+				ids[i] = v.(int64)
+			}
+			array = ids
+		} else {
+			strs := make(pq.StringArray, len(values))
+			for i, v := range values {
+				strs[i] = v.(string)
+			}
+			array = strs
+		}
+	}
+
+	switch op {
+	case "eq":
+		return field + " = ?", values, nil
+	case "ne":
+		return field + " IS DISTINCT FROM ?", values, nil
+	case "gt":
+		return field + " > ?", values, nil
+	case "gte":
+		return field + " >= ?", values, nil
+	case "lt":
+		return field + " < ?", values, nil
+	case "lte":
+		return field + " <= ?", values, nil
+	case "in":
+		return field + " IN ?", []interface{}{values}, nil
+	case "nin":
+		return fmt.Sprintf("(%s IS NULL OR %s NOT IN ?)", field, field), []interface{}{values}, nil
+	case "contains":
+		return field + " ILIKE ?", []interface{}{"%" + escapeLike(values[0].(string)) + "%"}, nil
+	case "any":
+		return field + " && ?", []interface{}{array}, nil
+	case "all":
+		return field + " @> ?", []interface{}{array}, nil
+	default: // none
+		return fmt.Sprintf("(%s IS NULL OR NOT %s && ?)", field, field), []interface{}{array}, nil
+	}
+}
+
+// customerSortClause 将排序字段转换为 ORDER BY 子句
+func customerSortClause(sort CustomerSortField) (string, error) {
+	field := strings.ToLower(strings.TrimSpace(sort.Field))
+	fieldType, ok := customerFilterFields[field]
+	if !ok || fieldType == filterFieldStringArray || fieldType == filterFieldIntArray {
+		return "", fmt.Errorf("不支持排序的字段: %s", sort.Field)
+	}
+	clause := field + " ASC"
+	if sort.Desc {
+		clause = field + " DESC"
+	}
+	switch strings.ToLower(sort.Nulls) {
+	case "":
+	case "first":
+		clause += " NULLS FIRST"
+	case "last":
+		clause += " NULLS LAST"
+	default:
+		return "", fmt.Errorf("排序字段 %s 的 nulls 只能为 first 或 last", field)
+	}
+	return clause, nil
+}
+
+// applyCustomerFilter 校验并应用结构化筛选条件（不含排序）
+func applyCustomerFilter(query *gorm.DB, filter CustomerFilter) (*gorm.DB, error) {
+	query = query.Where("is_deleted = ?", false)
+	if filter.Search != "" {
+		query = query.Where("name LIKE ? OR contact_name LIKE ?", "%"+filter.Search+"%", "%"+filter.Search+"%")
+	}
+	if filter.RegionCode != "" {
+		if findRegion(filter.RegionCode) == nil {
+			return nil, errors.New("行政区划代码不存在")
+		}
+		query = applyRegionFilter(query, filter.RegionCode)
+	}
+	for _, cond := range filter.Conditions {
+		clause, args, err := customerFilterClause(cond)
+		if err != nil {
+			return nil, err
+		}
+		query = query.Where(clause, args...)
+	}
+	return query, nil
+}
+
+// applyCustomerSort 校验并应用排序字段，最后按ID排序保证分页稳定
+func applyCustomerSort(query *gorm.DB, sorts []CustomerSortField) (*gorm.DB, error) {
+	hasID := false
+	for _, sort := range sorts {
+		clause, err := customerSortClause(sort)
+		if err != nil {
+			return nil, err
+		}
+		query = query.Order(clause)
+		hasID = hasID || strings.EqualFold(strings.TrimSpace(sort.Field), "id")
+	}
+	if !hasID {
+		query = query.Order("id ASC")
+	}
+	return query, nil
+}
+
+// customerKeysetAfter 键集分页条件：按排序字段（末尾补 id 升序）位于客户 lastID 之后的客户。
+// 比较值取 lastID 当前的字段值，空值位置与 ORDER BY 一致（未指定时升序空值在后、倒序空值在前）
+func customerKeysetAfter(sorts []CustomerSortField, lastID uint) (string, []interface{}, error) {
+	type keysetField struct {
+		field      string
+		desc       bool
+		nullsFirst bool
+	}
+	var keys []keysetField
+	for _, sort := range sorts {
+		if _, err := customerSortClause(sort); err != nil {
+			return "", nil, err
+		}
+		field := strings.ToLower(strings.TrimSpace(sort.Field))
+		nullsFirst := sort.Desc
+		if sort.Nulls != "" {
+			nullsFirst = strings.EqualFold(sort.Nulls, "first")
+		}
+		keys = append(keys, keysetField{field: field, desc: sort.Desc, nullsFirst: nullsFirst})
+		if field == "id" {
+			break
+		}
+	}
+	if len(keys) == 0 || keys[len(keys)-1].field != "id" {
+		keys = append(keys, keysetField{field: "id"})
+	}
+
+	var alternatives []string
+	var args []interface{}
+	for i, key := range keys {
+		var parts []string
+		for _, prev := range keys[:i] {
+			parts = append(parts, fmt.Sprintf("%s IS NOT DISTINCT FROM (SELECT k.%s FROM customers k WHERE k.id = ?)", prev.field, prev.field))
+			args = append(args, lastID)
+		}
+		value := fmt.Sprintf("(SELECT k.%s FROM customers k WHERE k.id = ?)", key.field)
+		op := ">"
+		if key.desc {
+			op = "<"
+		}
+		if key.field == "id" {
+			// 主键不为空且唯一，直接与 lastID 比较
+			parts = append(parts, "id "+op+" ?")
+			args = append(args, lastID)
+		} else if key.nullsFirst {
+			// 当前值为空时其后是全部非空值，否则按方向比较
+			parts = append(parts, fmt.Sprintf("((%s IS NULL AND %s IS NOT NULL) OR %s %s %s)", value, key.field, key.field, op, value))
+			args = append(args, lastID, lastID)
+		} else {
+			// 当前值为空时其后没有更大的值，否则按方向比较，空值排在最后
+			parts = append(parts, fmt.Sprintf("(%s IS NOT NULL AND (%s %s %s OR %s IS NULL))", value, key.field, op, value, key.field))
+			args = append(args, lastID, lastID)
+		}
+		alternatives = append(alternatives, "("+strings.Join(parts, " AND ")+")")
+	}
+	return "(" + strings.Join(alternatives, " OR ") + ")", args, nil
+}
+
+// findCustomersByKeyset 按排序字段以键集分页逐批读取客户，每批最多 batchSize 个，顺序与列表接口一致
+func findCustomersByKeyset(query *gorm.DB, sorts []CustomerSortField, batchSize int, fn func([]Customer) error) error {
+	ordered, err := applyCustomerSort(query, sorts)
+	if err != nil {
+		return err
+	}
+	ordered = ordered.Session(&gorm.Session{})
+	var lastID uint
+	for {
+		page := ordered
+		if lastID > 0 {
+			clause, args, err := customerKeysetAfter(sorts, lastID)
+			if err != nil {
+				return err
+			}
+			page = page.Where(clause, args...)
+		}
+		var customers []Customer
+		if err := page.Limit(batchSize).Find(&customers).Error; err != nil {
+			return err
+		}
+		if len(customers) > 0 {
+			if err := fn(customers); err != nil {
+				return err
+			}
+		}
+		if len(customers) < batchSize {
+			return nil
+		}
+		lastID = customers[len(customers)-1].ID
+	}
+}
+
+// parseCustomerFilterQuery 从查询参数解析筛选条件：
+// filter 可重复，格式为 字段:操作符:值（如 level:in:1,2、last_visited:is_null）；
+// sort 为逗号分隔的字段，前缀 - 表示倒序，后缀 :nulls_first/:nulls_last 指定空值位置
+func parseCustomerFilterQuery(values url.Values) (CustomerFilter, error) {
+	filter := CustomerFilter{
+		Search:     values.Get("search"),
+		RegionCode: values.Get("region_code"),
+	}
+	for _, raw := range values["filter"] {
+		parts := strings.SplitN(raw, ":", 3)
+		if len(parts) < 2 {
+			return filter, fmt.Errorf("筛选条件 %q 格式应为 字段:操作符:值", raw)
+		}
+		cond := CustomerFilterCondition{Field: parts[0], Op: parts[1]}
+		if len(parts) == 3 {
+			cond.Value = parts[2]
+		}
+		filter.Conditions = append(filter.Conditions, cond)
+	}
+	for _, raw := range values["sort"] {
+		for _, item := range strings.Split(raw, ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			var sort CustomerSortField
+			if strings.HasPrefix(item, "-") {
+				sort.Desc = true
+				item = item[1:]
+			}
+			if i := strings.Index(item, ":"); i >= 0 {
+				nulls := item[i+1:]
+				item = item[:i]
+				if !strings.HasPrefix(nulls, "nulls_") {
+					return filter, fmt.Errorf("排序 %q 的空值位置应为 nulls_first 或 nulls_last", raw)
+				}
+				sort.Nulls = strings.TrimPrefix(nulls, "nulls_")
+			}
+			sort.Field = item
+			filter.Sort = append(filter.Sort, sort)
+		}
+	}
+	return filter, nil
+}
+
+// ========== 客户分群相关业务函数 ==========
+
+// errSegmentForbidden 私有分群只有创建人可以查看和使用，共享分群只有创建人可以修改
+var errSegmentForbidden = errors.New("无权访问该客户分群")
+
+// validateCustomerFilter 校验筛选和排序条件（只构建查询不执行）
+func validateCustomerFilter(filter CustomerFilter) error {
+	query, err := applyCustomerFilter(DB.Model(&Customer{}), filter)
+	if err != nil {
+		return err
+	}
+	_, err = applyCustomerSort(query, filter.Sort)
+	return err
+}
+
+// segmentFilter 读取分群保存的筛选条件
+func segmentFilter(segment *CustomerSegment) CustomerFilter {
+	var filter CustomerFilter
+	fromJSONB(segment.Filter, &filter)
+	return filter
+}
+
+// customerSegmentToResponse 将客户分群转换为响应
+func customerSegmentToResponse(segment *CustomerSegment) *CustomerSegmentResponse {
+	return customerSegmentsToResponse([]CustomerSegment{*segment})[0]
+}
+
+// customerSegmentsToResponse 批量转换客户分群，创建人姓名一次查出
+func customerSegmentsToResponse(segments []CustomerSegment) []*CustomerSegmentResponse {
+	ownerIDs := make([]uint64, len(segments))
+	for i := range segments {
+		ownerIDs[i] = segments[i].OwnerID
+	}
+	ownerNames := userNamesByID(ownerIDs)
+
+	responses := make([]*CustomerSegmentResponse, len(segments))
+	for i := range segments {
+		responses[i] = newCustomerSegmentResponse(&segments[i], ownerNames[segments[i].OwnerID])
+	}
+	return responses
+}
+
+// newCustomerSegmentResponse 由分群和创建人姓名生成响应
+func newCustomerSegmentResponse(segment *CustomerSegment, ownerName string) *CustomerSegmentResponse {
+	return &CustomerSegmentResponse{
+		ID:            segment.ID,
+		Name:          segment.Name,
+		Description:   segment.Description,
+		OwnerID:       segment.OwnerID,
+		OwnerName:     ownerName,
+		Shared:        segment.Shared,
+		Mode:          segment.Mode,
+		Filter:        segmentFilter(segment),
+		SnapshotCount: len(segment.SnapshotIDs),
+		SnapshotAt:    segment.SnapshotAt,
+		CreatedAt:     segment.CreatedAt,
+		UpdatedAt:     segment.UpdatedAt,
+	}
+}
+
+// applySegmentRequest 校验请求并写入分群字段，快照模式下筛选条件或模式变化时重新生成快照
+func applySegmentRequest(segment *CustomerSegment, req CustomerSegmentRequest) error {
+	if req.Mode == "" {
+		req.Mode = CustomerSegmentDynamic
+	}
+	if req.Mode != CustomerSegmentDynamic && req.Mode != CustomerSegmentSnapshot {
+		return fmt.Errorf("分群模式只能为 %s 或 %s", CustomerSegmentDynamic, CustomerSegmentSnapshot)
+	}
+	if err := validateCustomerFilter(req.Filter); err != nil {
+		return err
+	}
+	filter, err := toJSONB(req.Filter)
+	if err != nil {
+		return err
+	}
+
+	oldFilter, _ := json.Marshal(segment.Filter)
+	newFilter, _ := json.Marshal(filter)
+	retake := req.Mode == CustomerSegmentSnapshot &&
+		(segment.Mode != CustomerSegmentSnapshot || segment.SnapshotAt == nil || string(oldFilter) != string(newFilter))
+
+	segment.Name = strings.TrimSpace(req.Name)
+	segment.Description = req.Description
+	segment.Shared = req.Shared
+	segment.Mode = req.Mode
+	segment.Filter = filter
+	if req.Mode == CustomerSegmentDynamic {
+		segment.SnapshotIDs = nil
+		segment.SnapshotAt = nil
+	}
+	if retake {
+		return takeSegmentSnapshot(segment)
+	}
+	return nil
+}
+
+// takeSegmentSnapshot 按分群筛选条件记录当前符合条件的客户ID
+func takeSegmentSnapshot(segment *CustomerSegment) error {
+	query, err := applyCustomerFilter(DB.Model(&Customer{}), segmentFilter(segment))
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	if err := query.Order("id ASC").Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+	now := time.Now()
+	segment.SnapshotIDs = pq.Int64Array(ids)
+	segment.SnapshotAt = &now
+	return nil
+}
+
+// createCustomerSegment 创建客户分群
+func createCustomerSegment(req CustomerSegmentRequest) (*CustomerSegmentResponse, error) {
+	if req.OwnerID == 0 {
+		return nil, errors.New("owner_id 不能为空")
+	}
+	segment := &CustomerSegment{OwnerID: req.OwnerID}
+	if err := applySegmentRequest(segment, req); err != nil {
+		return nil, err
+	}
+	if err := DB.Create(segment).Error; err != nil {
+		return nil, err
+	}
+	return customerSegmentToResponse(segment), nil
+}
+
+// getCustomerSegments 获取用户可见的客户分群（自己创建的和团队共享的）
+func getCustomerSegments(userID uint64) []*CustomerSegmentResponse {
+	var segments []CustomerSegment
+	DB.Where("owner_id = ? OR shared = ?", userID, true).Order("updated_at DESC").Find(&segments)
+	return customerSegmentsToResponse(segments)
+}
+
+// findCustomerSegment 查找分群并校验访问权限
+func findCustomerSegment(id, userID uint64) (*CustomerSegment, error) {
+	var segment CustomerSegment
+	if err := DB.First(&segment, id).Error; err != nil {
+		return nil, err
+	}
+	if !segment.Shared && segment.OwnerID != userID {
+		return nil, errSegmentForbidden
+	}
+	return &segment, nil
+}
+
+// findOwnedCustomerSegment 查找分群并校验是否为创建人（修改、删除、刷新快照）
+func findOwnedCustomerSegment(id, userID uint64) (*CustomerSegment, error) {
+	segment, err := findCustomerSegment(id, userID)
+	if err != nil {
+		return nil, err
+	}
+	if segment.OwnerID != userID {
+		return nil, errSegmentForbidden
+	}
+	return segment, nil
+}
+
+// getCustomerSegment 获取客户分群详情
+func getCustomerSegment(id, userID uint64) (*CustomerSegmentResponse, error) {
+	segment, err := findCustomerSegment(id, userID)
+	if err != nil {
+		return nil, err
+	}
+	return customerSegmentToResponse(segment), nil
+}
+
+// updateCustomerSegment 更新客户分群
+func updateCustomerSegment(id, userID uint64, req CustomerSegmentRequest) (*CustomerSegmentResponse, error) {
+	segment, err := findOwnedCustomerSegment(id, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := applySegmentRequest(segment, req); err != nil {
+		return nil, err
+	}
+	if err := DB.Save(segment).Error; err != nil {
+		return nil, err
+	}
+	return customerSegmentToResponse(segment), nil
+}
+
+// deleteCustomerSegment 删除客户分群
+func deleteCustomerSegment(id, userID uint64) error {
+	segment, err := findOwnedCustomerSegment(id, userID)
+	if err != nil {
+		return err
+	}
+	return DB.Delete(segment).Error
+}
+
+// refreshCustomerSegmentSnapshot 重新生成快照模式分群的快照
+func refreshCustomerSegmentSnapshot(id, userID uint64) (*CustomerSegmentResponse, error) {
+	segment, err := findOwnedCustomerSegment(id, userID)
+	if err != nil {
+		return nil, err
+	}
+	if segment.Mode != CustomerSegmentSnapshot {
+		return nil, errors.New("只有快照模式的分群可以刷新快照")
+	}
+	if err := takeSegmentSnapshot(segment); err != nil {
+		return nil, err
+	}
+	if err := DB.Model(segment).Select("snapshot_ids", "snapshot_at").Updates(segment).Error; err != nil {
+		return nil, err
+	}
+	return customerSegmentToResponse(segment), nil
+}
+
+// customerSegmentQuery 分群成员查询：动态模式按筛选条件实时计算，快照模式限定为快照中的客户
+func customerSegmentQuery(segment *CustomerSegment) (*gorm.DB, error) {
+	if segment.Mode == CustomerSegmentSnapshot {
+		ids := segment.SnapshotIDs
+		if ids == nil {
+			ids = pq.Int64Array{}
+		}
+		return DB.Model(&Customer{}).Where("id = ANY(?) AND is_deleted = ?", ids, false), nil
+	}
+	return applyCustomerFilter(DB.Model(&Customer{}), segmentFilter(segment))
+}
+
+// evaluateCustomerSegment 分页获取分群成员（按分群保存的排序条件排序）
+func evaluateCustomerSegment(id, userID uint64, page, limit int) ([]*CustomerResponse, int64, error) {
+	segment, err := findCustomerSegment(id, userID)
+	if err != nil {
+		return nil, 0, err
+	}
+	query, err := customerSegmentQuery(segment)
+	if err != nil {
+		return nil, 0, err
+	}
+	var total int64
+	query.Count(&total)
+	query, err = applyCustomerSort(query, segmentFilter(segment).Sort)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var customers []Customer
+	query.Offset((page - 1) * limit).Limit(limit).Find(&customers)
+	responses := make([]*CustomerResponse, len(customers))
+	for i := range customers {
+		responses[i] = CustomerToResponse(&customers[i])
+	}
+	return responses, total, nil
+}
+
+// countCustomerSegment 统计分群成员数
+func countCustomerSegment(id, userID uint64) (int64, error) {
+	segment, err := findCustomerSegment(id, userID)
+	if err != nil {
+		return 0, err
+	}
+	query, err := customerSegmentQuery(segment)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	err = query.Count(&total).Error
+	return total, err
+}
+
+// applyCustomerSegmentScope 将查询限定在分群成员内（供导出、批量操作使用）
+func applyCustomerSegmentScope(query *gorm.DB, segmentID, userID uint64) (*gorm.DB, error) {
+	segment, err := findCustomerSegment(segmentID, userID)
+	if err != nil {
+		return nil, err
+	}
+	members, err := customerSegmentQuery(segment)
+	if err != nil {
+		return nil, err
+	}
+	return query.Where("id IN (?)", members.Select("id")), nil
+}
+
+// ========== 客户批量操作相关业务函数 ==========
+
+// customerBulkChunkSize 批量操作每个事务处理的客户数
+const customerBulkChunkSize = 100
+
+// customerBulkMaxTargets 单次批量操作最多处理的客户数
+const customerBulkMaxTargets = 10000
+
+// validateCustomerBulkActions 校验批量操作内容
+func validateCustomerBulkActions(actions CustomerBulkActions) error {
+	hasUpdate := len(actions.AddTags) > 0 || len(actions.RemoveTags) > 0 ||
+		len(actions.AddSystemTags) > 0 || len(actions.RemoveSystemTags) > 0 ||
+		actions.SetLevel != nil || actions.SetState != nil || actions.SetCategory != nil ||
+		len(actions.AddSellers) > 0 || len(actions.RemoveSellers) > 0
+	if actions.Delete && hasUpdate {
+		return errors.New("删除不能与其他操作同时进行")
+	}
+	if !actions.Delete && !hasUpdate {
+		return errors.New("没有指定批量操作")
+	}
+	if actions.SetState != nil {
+		if err := validateCustomerState(*actions.SetState); err != nil {
+			return err
+		}
+	}
+	for _, tag := range actions.AddTags {
+		if containsString(actions.RemoveTags, tag) {
+			return fmt.Errorf("标签 %s 不能同时添加和移除", tag)
+		}
+	}
+	for _, id := range actions.AddSystemTags {
+		if containsInt64(actions.RemoveSystemTags, id) {
+			return fmt.Errorf("系统标签 %d 不能同时添加和移除", id)
+		}
+	}
+	for _, id := range actions.AddSellers {
+		if containsInt64(actions.RemoveSellers, id) {
+			return fmt.Errorf("销售员 %d 不能同时添加和移除", id)
+		}
+	}
+	return nil
+}
+
+// resolveCustomerBulkTargets 解析批量操作的目标客户ID：直接给出的ID列表，或筛选条件/分群的成员
+func resolveCustomerBulkTargets(req CustomerBulkRequest) ([]uint64, error) {
+	if len(req.IDs) > 0 {
+		if req.Filter != nil || req.SegmentID > 0 {
+			return nil, errors.New("ids 与 filter/segment_id 只能选择一种")
+		}
+		var ids []uint64
+		for _, id := range req.IDs {
+			if id > 0 && !containsUint64(ids, id) {
+				ids = append(ids, id)
+			}
+		}
+		if len(ids) > customerBulkMaxTargets {
+			return nil, fmt.Errorf("单次最多操作 %d 个客户", customerBulkMaxTargets)
+		}
+		return ids, nil
+	}
+
+	if req.Filter == nil && req.SegmentID == 0 {
+		return nil, errors.New("请提供 ids、filter 或 segment_id")
+	}
+	filter := CustomerFilter{}
+	if req.Filter != nil {
+		// 防止空条件误操作全部客户
+		if req.Filter.Search == "" && req.Filter.RegionCode == "" && len(req.Filter.Conditions) == 0 {
+			return nil, errors.New("筛选条件不能为空")
+		}
+		filter = *req.Filter
+	}
+	query, err := applyCustomerFilter(DB.Model(&Customer{}), filter)
+	if err != nil {
+		return nil, err
+	}
+	if req.SegmentID > 0 {
+		if query, err = applyCustomerSegmentScope(query, req.SegmentID, req.OperatorID); err != nil {
+			return nil, err
+		}
+	}
+
+	var ids []uint64
+	if err := query.Order("id ASC").Limit(customerBulkMaxTargets+1).Pluck("id", &ids).Error; err != nil {
+		return nil, err
+	}
+	if len(ids) > customerBulkMaxTargets {
+		return nil, fmt.Errorf("符合条件的客户超过 %d 个，请缩小范围", customerBulkMaxTargets)
+	}
+	return ids, nil
+}
+
+// applyCustomerBulkActions 对单个客户执行批量操作，返回变化的字段（字段->{old,new}）和需要更新的列
+func applyCustomerBulkActions(customer *Customer, actions CustomerBulkActions, now time.Time) (JSONB, []string) {
+	changes := JSONB{}
+	var columns []string
+	record := func(column string, oldValue, newValue interface{}) {
+		changes[column] = map[string]interface{}{"old": oldValue, "new": newValue}
+		columns = append(columns, column)
+	}
+
+	if actions.Delete {
+		customer.IsDeleted = true
+		customer.DeletedAt = &now
+		record("is_deleted", false, true)
+		columns = append(columns, "deleted_at")
+		return changes, columns
+	}
+
+	if len(actions.AddTags) > 0 || len(actions.RemoveTags) > 0 {
+		old := append([]string{}, customer.Tags...)
+		tags, added := mergeStringArray(append(pq.StringArray{}, customer.Tags...), actions.AddTags...)
+		tags, removed := removeStringArray(tags, actions.RemoveTags...)
+		if added || removed {
+			customer.Tags = tags
+			record("tags", old, []string(tags))
+		}
+	}
+	if len(actions.AddSystemTags) > 0 || len(actions.RemoveSystemTags) > 0 {
+		old := append([]int64{}, customer.SystemTags...)
+		tags, added := mergeInt64Array(append(pq.Int64Array{}, customer.SystemTags...), actions.AddSystemTags...)
+		tags, removed := removeInt64Array(tags, actions.RemoveSystemTags...)
+		if added || removed {
+			customer.SystemTags = tags
+			record("system_tags", old, []int64(tags))
+		}
+	}
+	if len(actions.AddSellers) > 0 || len(actions.RemoveSellers) > 0 {
+		old := append([]int64{}, customer.Sellers...)
+		sellers, added := mergeInt64Array(append(pq.Int64Array{}, customer.Sellers...), actions.AddSellers...)
+		sellers, removed := removeInt64Array(sellers, actions.RemoveSellers...)
+		if added || removed {
+			customer.Sellers = sellers
+			record("sellers", old, []int64(sellers))
+		}
+	}
+	if actions.SetLevel != nil && customer.Level != *actions.SetLevel {
+		record("level", customer.Level, *actions.SetLevel)
+		customer.Level = *actions.SetLevel
+	}
+	if actions.SetState != nil && customer.State != *actions.SetState {
+		record("state", customer.State, *actions.SetState)
+		customer.State = *actions.SetState
+	}
+	if actions.SetCategory != nil && customer.Category != *actions.SetCategory {
+		record("category", customer.Category, *actions.SetCategory)
+		customer.Category = *actions.SetCategory
+	}
+	return changes, columns
+}
+
+// bulkUpdateCustomers 批量操作客户：按块分事务处理，每个客户记录处理结果和字段变化
+func bulkUpdateCustomers(req CustomerBulkRequest) (*CustomerBulkResponse, error) {
+	if err := validateCustomerBulkActions(req.Actions); err != nil {
+		return nil, err
+	}
+	ids, err := resolveCustomerBulkTargets(req)
+	if err != nil {
+		return nil, err
+	}
+
+	target := JSONB{}
+	if len(req.IDs) > 0 {
+		target["ids"] = ids
+	}
+	if req.Filter != nil {
+		target["filter"] = req.Filter
+	}
+	if req.SegmentID > 0 {
+		target["segment_id"] = req.SegmentID
+	}
+	target, _ = toJSONB(target)
+	actions, _ := toJSONB(req.Actions)
+	operation := &CustomerBulkOperation{
+		OperatorID: req.OperatorID,
+		Target:     target,
+		Actions:    actions,
+		Total:      len(ids),
+		CreatedAt:  time.Now(),
+	}
+	if err := DB.Create(operation).Error; err != nil {
+		return nil, err
+	}
+
+	results := make([]CustomerBulkResult, 0, len(ids))
+	for start := 0; start < len(ids); start += customerBulkChunkSize {
+		end := start + customerBulkChunkSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		results = append(results, bulkUpdateCustomerChunk(operation.ID, ids[start:end], req)...)
+	}
+
+	for _, result := range results {
+		switch result.Status {
+		case CustomerBulkUpdated:
+			operation.Updated++
+		case CustomerBulkDeleted:
+			operation.Deleted++
+		case CustomerBulkUnchanged:
+			operation.Unchanged++
+		case CustomerBulkNotFound:
+			operation.NotFound++
+		default:
+			operation.Failed++
+		}
+	}
+	DB.Model(operation).Select("updated", "deleted", "unchanged", "not_found", "failed").Updates(operation)
+
+	return &CustomerBulkResponse{Operation: operation, Results: results}, nil
+}
+
+// bulkUpdateCustomerChunk 在一个事务内处理一块客户，事务失败时整块标记为失败
+func bulkUpdateCustomerChunk(operationID uint64, ids []uint64, req CustomerBulkRequest) []CustomerBulkResult {
+	var results []CustomerBulkResult
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		results = results[:0]
+		var customers []Customer
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id IN ? AND is_deleted = ?", ids, false).Find(&customers).Error; err != nil {
+			return err
+		}
+		byID := make(map[uint64]*Customer, len(customers))
+		for i := range customers {
+			byID[uint64(customers[i].ID)] = &customers[i]
+		}
+		var stateRules customerStateRules
+		if req.Actions.SetState != nil {
+			var err error
+			if stateRules, err = loadCustomerStateRules(tx); err != nil {
+				return err
+			}
+		}
+
+		// 截断到微秒与数据库精度一致，恢复时按删除时间找回级联删除的待办和提醒
+		now := time.Now().Truncate(time.Microsecond)
+		var changes []CustomerBulkChange
+		var deletedIDs []uint64
+		for _, id := range ids {
+			result := CustomerBulkResult{CustomerID: id}
+			customer, ok := byID[id]
+			if !ok {
+				result.Status = CustomerBulkNotFound
+				result.Message = "客户不存在或已删除"
+				results = append(results, result)
+				continue
+			}
+
+			// 状态流转不合法的客户整体跳过，不影响同批其他客户
+			fromState := customer.State
+			if req.Actions.SetState != nil {
+				if err := checkCustomerStateTransition(stateRules, fromState, *req.Actions.SetState, req.Actions.StateReason); err != nil {
+					result.Status = CustomerBulkFailed
+					result.Message = err.Error()
+					results = append(results, result)
+					continue
+				}
+			}
+
+			before := customerSnapshot(customer)
+			fields, columns := applyCustomerBulkActions(customer, req.Actions, now)
+			if len(columns) == 0 {
+				result.Status = CustomerBulkUnchanged
+				results = append(results, result)
+				continue
+			}
+			customer.UpdatedAt = now
+			customer.UpdatedBy = uint(req.OperatorID)
+			columns = append(columns, "updated_at", "updated_by")
+			if err := tx.Model(customer).Select(columns).Updates(customer).Error; err != nil {
+				return err
+			}
+			action := ActionUpdate
+			if req.Actions.Delete {
+				action = ActionDelete
+			}
+			remark := fmt.Sprintf("批量操作 #%d", operationID)
+			if err := recordCustomerStateChange(tx, id, &fromState, customer.State, req.Actions.StateReason, CustomerChangeBulk, req.OperatorID, now); err != nil {
+				return err
+			}
+			if err := recordCustomerChange(tx, id, before, customerSnapshot(customer), action, CustomerChangeBulk, req.OperatorID, remark); err != nil {
+				return err
+			}
+
+			result.Status = CustomerBulkUpdated
+			if req.Actions.Delete {
+				result.Status = CustomerBulkDeleted
+				deletedIDs = append(deletedIDs, id)
+			}
+			result.Changes = fields
+			results = append(results, result)
+		}
+		if err := softDeleteCustomerRecords(tx, deletedIDs, now); err != nil {
+			return err
+		}
+
+		for _, result := range results {
+			changes = append(changes, CustomerBulkChange{
+				OperationID: operationID,
+				CustomerID:  result.CustomerID,
+				Status:      result.Status,
+				Message:     result.Message,
+				Changes:     result.Changes,
+				CreatedAt:   now,
+			})
+		}
+		return tx.Create(&changes).Error
+	})
+	if err == nil {
+		return results
+	}
+
+	// 整块回滚：所有客户标记为失败并单独记录
+	results = make([]CustomerBulkResult, len(ids))
+	now := time.Now()
+	for i, id := range ids {
+		results[i] = CustomerBulkResult{CustomerID: id, Status: CustomerBulkFailed, Message: err.Error()}
+		DB.Create(&CustomerBulkChange{
+			OperationID: operationID,
+			CustomerID:  id,
+			Status:      CustomerBulkFailed,
+			Message:     err.Error(),
+			CreatedAt:   now,
+		})
+	}
+	return results
+}
+
+// getCustomerBulkOperation 获取批量操作记录及分页的逐个客户结果（可按 status 筛选）
+func getCustomerBulkOperation(id uint64, status string, page, pageSize int) (*CustomerBulkOperation, []CustomerBulkChange, int64, error) {
+	var operation CustomerBulkOperation
+	if err := DB.First(&operation, id).Error; err != nil {
+		return nil, nil, 0, err
+	}
+
+	query := DB.Model(&CustomerBulkChange{}).Where("operation_id = ?", id)
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	var total int64
+	var changes []CustomerBulkChange
+	query.Count(&total)
+	query.Order("id ASC").Offset((page - 1) * pageSize).Limit(pageSize).Find(&changes)
+	return &operation, changes, total, nil
+}
+
+// ========== 客户部分更新相关业务函数 ==========
+
+// validateTextLength 校验文本长度（按字符计），与 CustomerRequest 的 binding 规则一致
+func validateTextLength(errs FieldErrors, field string, value *string, min, max int) {
+	if value == nil {
+		return
+	}
+	if n := utf8.RuneCountInString(strings.TrimSpace(*value)); n < min || n > max {
+		if min > 0 {
+			errs[field] = fmt.Sprintf("长度需在 %d~%d 个字符之间", min, max)
+		} else {
+			errs[field] = fmt.Sprintf("长度不能超过 %d 个字符", max)
+		}
+	}
+}
+
+// validateIntRange 校验整数取值范围
+func validateIntRange(errs FieldErrors, field string, value *int, min, max int) {
+	if value != nil && (*value < min || *value > max) {
+		errs[field] = fmt.Sprintf("取值需在 %d~%d 之间", min, max)
+	}
+}
+
+// validatePhoneList 校验电话号码列表，返回规范化结果
+func validatePhoneList(errs FieldErrors, field string, phones []string) []string {
+	normalized, err := normalizePhones(phones)
+	if err != nil {
+		errs[field] = err.Error()
+	}
+	return normalized
+}
+
+// validatePositiveIDs 校验ID列表均为正数
+func validatePositiveIDs(errs FieldErrors, field string, ids []int64) {
+	for _, id := range ids {
+		if id <= 0 {
+			errs[field] = fmt.Sprintf("ID %d 无效", id)
+			return
+		}
+	}
+}
+
+// parseExtraInfoPatch 解析部分更新中的 extra_info：未传时 present 为 false，显式 null 时 patch 为 nil（清空），对象按 JSON Merge Patch 合并
+func parseExtraInfoPatch(raw json.RawMessage) (patch map[string]interface{}, present bool, err error) {
+	if len(raw) == 0 {
+		return nil, false, nil
+	}
+	if string(bytes.TrimSpace(raw)) == "null" {
+		return nil, true, nil
+	}
+	if err := json.Unmarshal(raw, &patch); err != nil {
+		return nil, true, errors.New("必须为 JSON 对象或 null")
+	}
+	return patch, true, nil
+}
+
+// customerStringArrayOp 部分更新中字符串数组字段的列名、客户字段和请求中的值
+type customerStringArrayOp struct {
+	column string
+	dst    *pq.StringArray
+	values []string
+}
+
+// customerStringArrayOps 列出 add/remove 中的字符串数组字段与客户字段的对应关系
+func customerStringArrayOps(customer *Customer, ops *CustomerArrayOps) []customerStringArrayOp {
+	return []customerStringArrayOp{
+		{"phones", &customer.Phones, ops.Phones},
+		{"work_phone", &customer.WorkPhone, ops.WorkPhone},
+		{"wechats", &customer.Wechats, ops.Wechats},
+		{"work_wechat", &customer.WorkWechat, ops.WorkWechat},
+		{"douyins", &customer.Douyins, ops.Douyins},
+		{"kwais", &customer.Kwais, ops.Kwais},
+		{"redbooks", &customer.Redbooks, ops.Redbooks},
+		{"tags", &customer.Tags, ops.Tags},
+		{"products", &customer.Products, ops.Products},
+	}
+}
+
+// validateCustomerPatch 校验部分更新请求（不依赖客户当前数据的部分），电话号码和微信号会被规范化
+func validateCustomerPatch(req *CustomerPatchRequest) FieldErrors {
+	errs := FieldErrors{}
+	validateTextLength(errs, "name", req.Name, 1, 100)
+	validateTextLength(errs, "contact_name", req.ContactName, 0, 50)
+	validateTextLength(errs, "province", req.Province, 0, 20)
+	validateTextLength(errs, "city", req.City, 0, 20)
+	validateTextLength(errs, "district", req.District, 0, 20)
+	validateTextLength(errs, "address", req.Address, 0, 200)
+	validateTextLength(errs, "category", req.Category, 0, 50)
+	validateTextLength(errs, "source", req.Source, 0, 50)
+	validateTextLength(errs, "import_source", req.ImportSource, 0, 50)
+	validateTextLength(errs, "remark", req.Remark, 0, 500)
+	validateTextLength(errs, "state_reason", &req.StateReason, 0, 500)
+	validateTextLength(errs, "saller_name", req.SallerName, 0, 50)
+	validateIntRange(errs, "gender", req.Gender, 0, 2)
+	if req.State != nil {
+		if err := validateCustomerState(*req.State); err != nil {
+			errs["state"] = err.Error()
+		}
+	}
+	validateIntRange(errs, "level", req.Level, 0, 10)
+	if req.Lat != nil && (*req.Lat < -90 || *req.Lat > 90) {
+		errs["lat"] = "纬度需在 -90~90 之间"
+	}
+	if req.Lon != nil && (*req.Lon < -180 || *req.Lon > 180) {
+		errs["lon"] = "经度需在 -180~180 之间"
+	}
+	if req.CreditSale != nil && *req.CreditSale < 0 {
+		errs["credit_sale"] = "不能为负数"
+	}
+	if req.DistrictID != nil && *req.DistrictID != 0 {
+		if _, err := validateDistrictID(*req.DistrictID); err != nil {
+			errs["district_id"] = err.Error()
+		}
+	}
+
+	if _, _, err := parseExtraInfoPatch(req.ExtraInfo); err != nil {
+		errs["extra_info"] = err.Error()
+	}
+
+	if req.Phones != nil {
+		phones := validatePhoneList(errs, "phones", *req.Phones)
+		req.Phones = &phones
+	}
+	if req.WorkPhone != nil {
+		workPhones := validatePhoneList(errs, "work_phone", *req.WorkPhone)
+		req.WorkPhone = &workPhones
+	}
+	for _, wechats := range []*[]string{req.Wechats, req.WorkWechat} {
+		if wechats != nil {
+			*wechats = append([]string{}, normalizeWechats(*wechats)...)
+		}
+	}
+	if req.Sellers != nil {
+		validatePositiveIDs(errs, "sellers", *req.Sellers)
+	}
+	if req.SystemTags != nil {
+		validatePositiveIDs(errs, "system_tags", *req.SystemTags)
+	}
+	for prefix, ops := range map[string]*CustomerArrayOps{"add": req.Add, "remove": req.Remove} {
+		if ops == nil {
+			continue
+		}
+		if len(ops.Phones) > 0 {
+			ops.Phones = validatePhoneList(errs, prefix+".phones", ops.Phones)
+		}
+		if len(ops.WorkPhone) > 0 {
+			ops.WorkPhone = validatePhoneList(errs, prefix+".work_phone", ops.WorkPhone)
+		}
+		// 移除时同时匹配原值和规范化后的微信号，兼容规范化之前保存的数据
+		if prefix == "add" {
+			ops.Wechats = normalizeWechats(ops.Wechats)
+			ops.WorkWechat = normalizeWechats(ops.WorkWechat)
+		} else {
+			ops.Wechats, _ = mergeStringArray(ops.Wechats, normalizeWechats(ops.Wechats)...)
+			ops.WorkWechat, _ = mergeStringArray(ops.WorkWechat, normalizeWechats(ops.WorkWechat)...)
+		}
+		validatePositiveIDs(errs, prefix+".sellers", ops.Sellers)
+		validatePositiveIDs(errs, prefix+".system_tags", ops.SystemTags)
+	}
+
+	// 同一字段不能既整体替换又逐项增删
+	for _, ops := range []*CustomerArrayOps{req.Add, req.Remove} {
+		if ops == nil {
+			continue
+		}
+		conflicts := map[string]bool{
+			"phones":      req.Phones != nil && len(ops.Phones) > 0,
+			"work_phone":  req.WorkPhone != nil && len(ops.WorkPhone) > 0,
+			"wechats":     req.Wechats != nil && len(ops.Wechats) > 0,
+			"work_wechat": req.WorkWechat != nil && len(ops.WorkWechat) > 0,
+			"douyins":     req.Douyins != nil && len(ops.Douyins) > 0,
+			"kwais":       req.Kwais != nil && len(ops.Kwais) > 0,
+			"redbooks":    req.Redbooks != nil && len(ops.Redbooks) > 0,
+			"tags":        req.Tags != nil && len(ops.Tags) > 0,
+			"products":    req.Products != nil && len(ops.Products) > 0,
+			"sellers":     req.Sellers != nil && len(ops.Sellers) > 0,
+			"system_tags": req.SystemTags != nil && len(ops.SystemTags) > 0,
+		}
+		for field, conflict := range conflicts {
+			if conflict {
+				errs[field] = "不能同时整体设置和通过 add/remove 修改"
+			}
+		}
+	}
+	return errs
+}
+
+// applyCustomerPatch 将部分更新应用到客户，返回发生变化的列；省市区与区县编码不一致时返回字段错误
+func applyCustomerPatch(customer *Customer, req CustomerPatchRequest) ([]string, FieldErrors) {
+	var columns []string
+	changed := func(column string) {
+		if !containsString(columns, column) {
+			columns = append(columns, column)
+		}
+	}
+	setString := func(column string, dst *string, value *string) {
+		if value != nil && *dst != *value {
+			*dst = *value
+			changed(column)
+		}
+	}
+	setInt := func(column string, dst *int, value *int) {
+		if value != nil && *dst != *value {
+			*dst = *value
+			changed(column)
+		}
+	}
+	setFloat := func(column string, dst *float64, value *float64) {
+		if value != nil && *dst != *value {
+			*dst = *value
+			changed(column)
+		}
+	}
+	setStrings := func(column string, dst *pq.StringArray, value *[]string) {
+		if value != nil && strings.Join(*dst, "\x00") != strings.Join(*value, "\x00") {
+			*dst = pq.StringArray(*value)
+			changed(column)
+		}
+	}
+	setIDs := func(column string, dst *pq.Int64Array, value *[]int64) {
+		if value != nil && exportIDs(*dst) != exportIDs(*value) {
+			*dst = pq.Int64Array(*value)
+			changed(column)
+		}
+	}
+
+	original := *customer
+	addressChanged := (req.Address != nil && *req.Address != customer.Address) ||
+		(req.Province != nil && *req.Province != customer.Province) ||
+		(req.City != nil && *req.City != customer.City) ||
+		(req.District != nil && *req.District != customer.District)
+
+	setString("name", &customer.Name, req.Name)
+	setString("contact_name", &customer.ContactName, req.ContactName)
+	setInt("gender", &customer.Gender, req.Gender)
+	setStrings("phones", &customer.Phones, req.Phones)
+	setStrings("work_phone", &customer.WorkPhone, req.WorkPhone)
+	setStrings("wechats", &customer.Wechats, req.Wechats)
+	setStrings("work_wechat", &customer.WorkWechat, req.WorkWechat)
+	setStrings("douyins", &customer.Douyins, req.Douyins)
+	setStrings("kwais", &customer.Kwais, req.Kwais)
+	setStrings("redbooks", &customer.Redbooks, req.Redbooks)
+	setString("province", &customer.Province, req.Province)
+	setString("city", &customer.City, req.City)
+	setString("district", &customer.District, req.District)
+	setString("address", &customer.Address, req.Address)
+	setFloat("lat", &customer.Lat, req.Lat)
+	setFloat("lon", &customer.Lon, req.Lon)
+	setStrings("products", &customer.Products, req.Products)
+	setString("category", &customer.Category, req.Category)
+	setStrings("tags", &customer.Tags, req.Tags)
+	setIDs("system_tags", &customer.SystemTags, req.SystemTags)
+	setInt("state", &customer.State, req.State)
+	setInt("level", &customer.Level, req.Level)
+	setInt("kind", &customer.Kind, req.Kind)
+	setFloat("credit_sale", &customer.CreditSale, req.CreditSale)
+	setString("source", &customer.Source, req.Source)
+	setString("import_source", &customer.ImportSource, req.ImportSource)
+	setString("remark", &customer.Remark, req.Remark)
+	setString("saller_name", &customer.SallerName, req.SallerName)
+	setIDs("sellers", &customer.Sellers, req.Sellers)
+	if req.AddedWechat != nil && customer.AddedWechat != *req.AddedWechat {
+		customer.AddedWechat = *req.AddedWechat
+		changed("added_wechat")
+	}
+
+	if patch, present, _ := parseExtraInfoPatch(req.ExtraInfo); present {
+		var merged JSONB
+		if patch != nil {
+			merged = JSONB(mergePatchJSONB(customer.ExtraInfo, patch))
+		}
+		before, _ := json.Marshal(customer.ExtraInfo)
+		if after, _ := json.Marshal(merged); string(before) != string(after) {
+			customer.ExtraInfo = merged
+			changed("extra_info")
+		}
+	}
+
+	if ops := req.Add; ops != nil {
+		var merged bool
+		for _, op := range customerStringArrayOps(customer, ops) {
+			if *op.dst, merged = mergeStringArray(*op.dst, op.values...); merged {
+				changed(op.column)
+			}
+		}
+		if customer.Sellers, merged = mergeInt64Array(customer.Sellers, ops.Sellers...); merged {
+			changed("sellers")
+		}
+		if customer.SystemTags, merged = mergeInt64Array(customer.SystemTags, ops.SystemTags...); merged {
+			changed("system_tags")
+		}
+	}
+	if ops := req.Remove; ops != nil {
+		var removed bool
+		for _, op := range customerStringArrayOps(customer, ops) {
+			if len(op.values) == 0 {
+				continue
+			}
+			if *op.dst, removed = removeStringArray(*op.dst, op.values...); removed {
+				changed(op.column)
+			}
+		}
+		if len(ops.Sellers) > 0 {
+			if customer.Sellers, removed = removeInt64Array(customer.Sellers, ops.Sellers...); removed {
+				changed("sellers")
+			}
+		}
+		if len(ops.SystemTags) > 0 {
+			if customer.SystemTags, removed = removeInt64Array(customer.SystemTags, ops.SystemTags...); removed {
+				changed("system_tags")
+			}
+		}
+	}
+
+	// 地址或省市区变化时，街道和区县编码需要重新解析
+	if addressChanged {
+		customer.Street = ""
+		customer.DistrictID = 0
+	}
+	if req.DistrictID != nil {
+		customer.DistrictID = 0
+		if *req.DistrictID != 0 {
+			district, err := validateDistrictID(*req.DistrictID)
+			if err != nil {
+				return nil, FieldErrors{"district_id": err.Error()}
+			}
+			if err := validateRegionNames(district, customer.Province, customer.City, customer.District); err != nil {
+				return nil, FieldErrors{"district_id": err.Error()}
+			}
+			parsed := parseChineseAddress(regionFullName(district))
+			fillEmptyString(&customer.Province, parsed.Province)
+			fillEmptyString(&customer.City, parsed.City)
+			fillEmptyString(&customer.District, parsed.District)
+			customer.DistrictID, _ = strconv.Atoi(district.Code)
+		}
+	}
+	if addressChanged || req.DistrictID != nil {
+		applyParsedAddress(customer)
+		if customer.Province != original.Province {
+			changed("province")
+		}
+		if customer.City != original.City {
+			changed("city")
+		}
+		if customer.District != original.District {
+			changed("district")
+		}
+		if customer.Street != original.Street {
+			changed("street")
+		}
+		if customer.DistrictID != original.DistrictID {
+			changed("district_id")
+		}
+	}
+	return columns, nil
+}
+
+// patchCustomer 部分更新客户，只修改请求中出现的字段
+func patchCustomer(id uint64, req CustomerPatchRequest, operatorID uint64) (*CustomerResponse, error) {
+	if errs := validateCustomerPatch(&req); len(errs) > 0 {
+		return nil, errs
+	}
+	var customer Customer
+	if err := DB.Where("is_deleted = ?", false).First(&customer, id).Error; err != nil {
+		return nil, err
+	}
+
+	// 产品名称统一为商品目录中的名称，移除时原名称和商品名称都会移除
+	if req.Products != nil {
+		products := canonicalProductNames(DB, *req.Products)
+		req.Products = &products
+	}
+	if req.Add != nil {
+		req.Add.Products = canonicalProductNames(DB, req.Add.Products)
+	}
+	if req.Remove != nil && len(req.Remove.Products) > 0 {
+		req.Remove.Products, _ = mergeStringArray(req.Remove.Products, canonicalProductNames(DB, req.Remove.Products)...)
+	}
+
+	before := customerSnapshot(&customer)
+	fromState := customer.State
+	columns, errs := applyCustomerPatch(&customer, req)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	if err := validateCustomerStateTransition(DB, fromState, customer.State, req.StateReason); err != nil {
+		var validationErr *ValidationError
+		if errors.As(err, &validationErr) {
+			return nil, FieldErrors{"state": validationErr.Message}
+		}
+		return nil, err
+	}
+	if len(columns) > 0 {
+		customer.UpdatedAt = time.Now()
+		customer.UpdatedBy = uint(operatorID)
+		columns = append(columns, "updated_at", "updated_by")
+		err := DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&customer).Select(columns).Updates(&customer).Error; err != nil {
+				return err
+			}
+			if err := recordCustomerStateChange(tx, id, &fromState, customer.State, req.StateReason, CustomerChangeAPI, operatorID, customer.UpdatedAt); err != nil {
+				return err
+			}
+			return recordCustomerChange(tx, id, before, customerSnapshot(&customer), ActionUpdate, CustomerChangeAPI, operatorID, "")
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return CustomerToResponse(&customer), nil
+}
+
+// ========== 客户变更历史相关业务函数 ==========
+
+// customerHistoryIgnoredFields 每次修改都会变化、不单独记录的字段
+var customerHistoryIgnoredFields = map[string]bool{"updated_at": true, "updated_by": true}
+
+// customerRevertBlockedFields 不能单独恢复的字段（删除状态通过恢复接口处理，客户状态通过状态变更接口处理，订单统计由订单维护）
+var customerRevertBlockedFields = map[string]bool{
+	"id": true, "created_at": true, "created_by": true, "is_deleted": true, "deleted_at": true, "state": true,
+	"order_count": true, "avg_order_value": true, "last_order_date": true,
+}
+
+// customerSnapshot 将客户序列化为字段快照（字段名与数据库列名一致）
+func customerSnapshot(customer *Customer) JSONB {
+	snapshot, _ := toJSONB(customer)
+	return snapshot
+}
+
+// isEmptyJSONValue 判断 JSON 值是否为空（null、空字符串、0、false、空数组、空对象）
+func isEmptyJSONValue(v interface{}) bool {
+	switch x := v.(type) {
+	case nil:
+		return true
+	case string:
+		return x == ""
+	case float64:
+		return x == 0
+	case bool:
+		return !x
+	case []interface{}:
+		return len(x) == 0
+	case map[string]interface{}:
+		return len(x) == 0
+	}
+	return false
+}
+
+// diffCustomerSnapshots 对比变更前后的快照，返回变化的字段（已排序）及其新旧值；空值之间视为相同
+func diffCustomerSnapshots(before, after JSONB) ([]string, JSONB, JSONB) {
+	var fields []string
+	oldData, newData := JSONB{}, JSONB{}
+	keys := make(map[string]bool)
+	for k := range before {
+		keys[k] = true
+	}
+	for k := range after {
+		keys[k] = true
+	}
+	for k := range keys {
+		o, n := before[k], after[k]
+		if customerHistoryIgnoredFields[k] || reflect.DeepEqual(o, n) || (isEmptyJSONValue(o) && isEmptyJSONValue(n)) {
+			continue
+		}
+		fields = append(fields, k)
+		oldData[k] = o
+		newData[k] = n
+	}
+	sort.Strings(fields)
+	return fields, oldData, newData
+}
+
+// recordCustomerChange 记录客户变更：before 为空表示新建，after 为空表示删除；更新没有字段变化时不记录
+func recordCustomerChange(tx *gorm.DB, customerID uint64, before, after JSONB, action ActionType, source CustomerChangeSource, operatorID uint64, remark string) error {
+	fields, oldData, newData := diffCustomerSnapshots(before, after)
+	if len(fields) == 0 && action == ActionUpdate {
+		return nil
+	}
+	return tx.Create(&CustomerChangeLog{
+		CustomerID: customerID,
+		OperatorID: operatorID,
+		Action:     action,
+		Source:     source,
+		Fields:     pq.StringArray(fields),
+		OldData:    oldData,
+		NewData:    newData,
+		Remark:     remark,
+		CreatedAt:  time.Now(),
+	}).Error
+}
+
+// customerChangeLogToResponse 将变更日志转换为逐字段的差异视图
+func customerChangeLogToResponse(changeLog *CustomerChangeLog, operatorNames map[uint64]string) *CustomerChangeLogResponse {
+	response := &CustomerChangeLogResponse{
+		ID:           changeLog.ID,
+		CustomerID:   changeLog.CustomerID,
+		OperatorID:   changeLog.OperatorID,
+		OperatorName: operatorNames[changeLog.OperatorID],
+		Action:       changeLog.Action,
+		Source:       changeLog.Source,
+		Remark:       changeLog.Remark,
+		Changes:      make([]CustomerFieldChange, len(changeLog.Fields)),
+		CreatedAt:    changeLog.CreatedAt,
+	}
+	for i, field := range changeLog.Fields {
+		response.Changes[i] = CustomerFieldChange{
+			Field:      field,
+			Old:        changeLog.OldData[field],
+			New:        changeLog.NewData[field],
+			Revertable: changeLog.Action == ActionUpdate && !customerRevertBlockedFields[field],
+		}
+	}
+	return response
+}
+
+// getCustomerHistory 分页获取客户变更历史（按时间倒序，可按字段和来源筛选）
+func getCustomerHistory(customerID uint64, field, source string, page, pageSize int) ([]*CustomerChangeLogResponse, int64) {
+	var logs []CustomerChangeLog
+	var total int64
+
+	query := DB.Model(&CustomerChangeLog{}).Where("customer_id = ?", customerID)
+	if field != "" {
+		query = query.Where("? = ANY(fields)", field)
+	}
+	if source != "" {
+		query = query.Where("source = ?", source)
+	}
+	query.Count(&total)
+	query.Order("created_at DESC, id DESC").Offset((page - 1) * pageSize).Limit(pageSize).Find(&logs)
+
+	operatorIDs := make([]uint64, len(logs))
+	for i := range logs {
+		operatorIDs[i] = logs[i].OperatorID
+	}
+	operatorNames := userNamesByID(operatorIDs)
+
+	responses := make([]*CustomerChangeLogResponse, len(logs))
+	for i := range logs {
+		responses[i] = customerChangeLogToResponse(&logs[i], operatorNames)
+	}
+	return responses, total
+}
+
+// revertCustomerField 将客户的单个字段恢复为某条变更日志中的旧值，恢复操作本身也记录到历史
+func revertCustomerField(customerID, logID uint64, req CustomerRevertRequest) (*CustomerResponse, error) {
+	var changeLog CustomerChangeLog
+	if err := DB.Where("id = ? AND customer_id = ?", logID, customerID).First(&changeLog).Error; err != nil {
+		return nil, err
+	}
+	if changeLog.Action != ActionUpdate {
+		return nil, errors.New("只能恢复修改操作中的字段")
+	}
+	if !containsString(changeLog.Fields, req.Field) {
+		return nil, fmt.Errorf("该变更没有修改字段 %s", req.Field)
+	}
+	if customerRevertBlockedFields[req.Field] {
+		return nil, fmt.Errorf("字段 %s 不能单独恢复", req.Field)
+	}
+
+	var customer Customer
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var current Customer
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("is_deleted = ?", false).First(&current, customerID).Error; err != nil {
+			return err
+		}
+		before := customerSnapshot(&current)
+		values := customerSnapshot(&current)
+		values[req.Field] = changeLog.OldData[req.Field]
+		if err := fromJSONB(values, &customer); err != nil {
+			return err
+		}
+		customer.UpdatedAt = time.Now()
+		customer.UpdatedBy = uint(req.OperatorID)
+		if err := tx.Model(&customer).Select(req.Field, "updated_at", "updated_by").Updates(&customer).Error; err != nil {
+			return err
+		}
+		remark := fmt.Sprintf("恢复变更 #%d 中字段 %s 的旧值", logID, req.Field)
+		return recordCustomerChange(tx, customerID, before, customerSnapshot(&customer), ActionUpdate, CustomerChangeAPI, req.OperatorID, remark)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return CustomerToResponse(&customer), nil
+}
+
+// ========== 客户回收站相关业务函数 ==========
+
+// customerPurgeBatchSize 回收站清理时每个事务彻底删除的客户数
+const customerPurgeBatchSize = 100
+
+// customerPurgeInterval 回收站清理任务的执行间隔
+const customerPurgeInterval = 6 * time.Hour
+
+// openTodoStatuses 未完成的待办状态，删除客户时随客户一起软删除
+var openTodoStatuses = []TodoStatus{TodoStatusPending, TodoStatusOverdue}
+
+// softDeleteCustomerRecords 软删除客户未完成的待办及其待发送的提醒，删除时间与客户一致以便恢复时找回
+func softDeleteCustomerRecords(tx *gorm.DB, customerIDs []uint64, deletedAt time.Time) error {
+	if len(customerIDs) == 0 {
+		return nil
+	}
+	var todoIDs []uint64
+	err := tx.Model(&Todo{}).
+		Where("customer_id IN ? AND status IN ? AND is_deleted = ?", customerIDs, openTodoStatuses, false).
+		Pluck("id", &todoIDs).Error
+	if err != nil || len(todoIDs) == 0 {
+		return err
+	}
+	values := map[string]interface{}{"is_deleted": true, "deleted_at": deletedAt}
+	if err := tx.Model(&Todo{}).Where("id IN ?", todoIDs).Updates(values).Error; err != nil {
+		return err
+	}
+	return tx.Model(&Reminder{}).
+		Where("todo_id IN ? AND status = ? AND is_deleted = ?", todoIDs, ReminderStatusPending, false).
+		Updates(values).Error
+}
+
+// restoreCustomerRecords 恢复与客户同时被软删除的待办和提醒
+func restoreCustomerRecords(tx *gorm.DB, customerID uint64, deletedAt time.Time) error {
+	var todoIDs []uint64
+	err := tx.Model(&Todo{}).
+		Where("customer_id = ? AND is_deleted = ? AND deleted_at = ?", customerID, true, deletedAt).
+		Pluck("id", &todoIDs).Error
+	if err != nil || len(todoIDs) == 0 {
+		return err
+	}
+	values := map[string]interface{}{"is_deleted": false, "deleted_at": nil}
+	if err := tx.Model(&Todo{}).Where("id IN ?", todoIDs).Updates(values).Error; err != nil {
+		return err
+	}
+	return tx.Model(&Reminder{}).
+		Where("todo_id IN ? AND is_deleted = ? AND deleted_at = ?", todoIDs, true, deletedAt).
+		Updates(values).Error
+}
+
+// getCustomerTrash 分页获取回收站中的客户（按删除时间倒序，可按名称或联系人搜索）
+func getCustomerTrash(keyword string, page, limit int) ([]*CustomerTrashResponse, int64) {
+	var customers []Customer
+	var total int64
+
+	query := DB.Model(&Customer{}).Where("is_deleted = ?", true)
+	if keyword != "" {
+		like := "%" + escapeLike(keyword) + "%"
+		query = query.Where("name LIKE ? OR contact_name LIKE ?", like, like)
+	}
+	query.Count(&total)
+	query.Order("deleted_at DESC, id DESC").Offset((page - 1) * limit).Limit(limit).Find(&customers)
+
+	ids := make([]uint64, len(customers))
+	for i := range customers {
+		ids[i] = uint64(customers[i].ID)
+	}
+	var keptIDs []uint64
+	if len(ids) > 0 {
+		DB.Model(&Customer{}).Where("id IN ?", ids).Where(customerPurgeKeptSQL).Pluck("id", &keptIDs)
+	}
+
+	retention := GetTrashRetentionDays()
+	responses := make([]*CustomerTrashResponse, len(customers))
+	for i := range customers {
+		responses[i] = &CustomerTrashResponse{
+			CustomerResponse: CustomerToResponse(&customers[i]),
+			DeletedAt:        customers[i].DeletedAt,
+			DeletedBy:        customers[i].UpdatedBy,
+		}
+		if containsUint64(keptIDs, ids[i]) {
+			responses[i].KeptReason = "有订单或退货单，不会被彻底删除"
+			continue
+		}
+		if customers[i].DeletedAt != nil {
+			purgeAt := customers[i].DeletedAt.AddDate(0, 0, retention)
+			responses[i].PurgeAt = &purgeAt
+		}
+	}
+	return responses, total
+}
+
+// restoreCustomer 从回收站恢复客户，同时恢复随客户一起删除的待办和提醒
+func restoreCustomer(id uint64, operatorID uint64) (*CustomerResponse, error) {
+	var customer Customer
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("is_deleted = ?", true).First(&customer, id).Error; err != nil {
+			return err
+		}
+		before := customerSnapshot(&customer)
+		deletedAt := customer.DeletedAt
+		customer.IsDeleted = false
+		customer.DeletedAt = nil
+		customer.UpdatedAt = time.Now()
+		customer.UpdatedBy = uint(operatorID)
+		if err := tx.Model(&customer).Select("is_deleted", "deleted_at", "updated_at", "updated_by").Updates(&customer).Error; err != nil {
+			return err
+		}
+		if deletedAt != nil {
+			if err := restoreCustomerRecords(tx, id, *deletedAt); err != nil {
+				return err
+			}
+		}
+		return recordCustomerChange(tx, id, before, customerSnapshot(&customer), ActionRestore, CustomerChangeAPI, operatorID, "")
+	})
+	if err != nil {
+		return nil, err
+	}
+	return CustomerToResponse(&customer), nil
+}
+
+// customerPurgeKeptSQL 回收站中不会被彻底删除的客户：订单和退货单是财务记录，有订单或退货单的客户一直保留
+const customerPurgeKeptSQL = `EXISTS (SELECT 1 FROM orders WHERE orders.customer_id = customers.id)
+	OR EXISTS (SELECT 1 FROM order_returns WHERE order_returns.customer_id = customers.id)`
+
+// purgeDeletedCustomers 彻底删除在回收站中超过保留天数的客户及其待办、提醒、跟进记录和客户关系，并清理其他记录对这些客户的引用；有订单或退货单的客户不删除并计入 Kept，变更历史保留
+func purgeDeletedCustomers(retentionDays int) (*CustomerPurgeResponse, error) {
+	resp := &CustomerPurgeResponse{}
+	cutoff := time.Now().AddDate(0, 0, -retentionDays)
+	for {
+		var customers []Customer
+		err := DB.Where("is_deleted = ? AND deleted_at < ?", true, cutoff).
+			Where("NOT (" + customerPurgeKeptSQL + ")").
+			Order("id ASC").Limit(customerPurgeBatchSize).Find(&customers).Error
+		if err != nil {
+			return resp, err
+		}
+		if len(customers) == 0 {
+			err := DB.Model(&Customer{}).Where("is_deleted = ? AND deleted_at < ?", true, cutoff).
+				Where(customerPurgeKeptSQL).Count(&resp.Kept).Error
+			return resp, err
+		}
+
+		ids := make([]uint64, len(customers))
+		for i := range customers {
+			ids[i] = uint64(customers[i].ID)
+		}
+		err = DB.Transaction(func(tx *gorm.DB) error {
+			todoIDs := tx.Model(&Todo{}).Select("id").Where("customer_id IN ?", ids)
+			reminders := tx.Where("todo_id IN (?)", todoIDs).Delete(&Reminder{})
+			if reminders.Error != nil {
+				return reminders.Error
+			}
+			if err := tx.Where("todo_id IN (?)", todoIDs).Delete(&TodoLog{}).Error; err != nil {
+				return err
+			}
+			todos := tx.Where("customer_id IN ?", ids).Delete(&Todo{})
+			if todos.Error != nil {
+				return todos.Error
+			}
+			records := tx.Where("customer_id IN ?", ids).Delete(&FollowUpRecord{})
+			if records.Error != nil {
+				return records.Error
+			}
+			if err := tx.Where("from_customer_id IN ? OR to_customer_id IN ?", ids, ids).Delete(&CustomerRelation{}).Error; err != nil {
+				return err
+			}
+			if err := purgeCustomerReferences(tx, ids); err != nil {
+				return err
+			}
+			if err := tx.Where("id IN ?", ids).Delete(&Customer{}).Error; err != nil {
+				return err
+			}
+			remark := fmt.Sprintf("回收站超过%d天自动清理", retentionDays)
+			for i := range customers {
+				if err := recordCustomerChange(tx, ids[i], customerSnapshot(&customers[i]), nil, ActionDelete, CustomerChangeSystem, 0, remark); err != nil {
+					return err
+				}
+			}
+			resp.Customers += int64(len(customers))
+			resp.Todos += todos.RowsAffected
+			resp.Reminders += reminders.RowsAffected
+			resp.Records += records.RowsAffected
+			return nil
+		})
+		if err != nil {
+			return resp, err
+		}
+	}
+}
+
+// purgeCustomerReferences 清理其他记录对彻底删除客户的引用：删除批量操作明细、状态变更记录和公海记录，
+// 从查重分组、分群快照和转移记录的客户ID中移除这些客户，移除后不足两个客户的待处理查重分组和不再包含客户的转移记录一并删除
+func purgeCustomerReferences(tx *gorm.DB, ids []uint64) error {
+	idArray := make(pq.Int64Array, len(ids))
+	for i, id := range ids {
+		idArray[i] = int64(id)
+	}
+	if err := tx.Where("customer_id IN ?", ids).Delete(&CustomerBulkChange{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("customer_id IN ?", ids).Delete(&CustomerStateChange{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("customer_id IN ?", ids).Delete(&CustomerPoolRecord{}).Error; err != nil {
+		return err
+	}
+	err := tx.Model(&DuplicateGroup{}).Where("customer_ids && ?", idArray).
+		Update("customer_ids", gorm.Expr("ARRAY(SELECT x FROM unnest(customer_ids) AS x WHERE x <> ALL(?))", idArray)).Error
+	if err != nil {
+		return err
+	}
+	err = tx.Where("status = ? AND COALESCE(array_length(customer_ids, 1), 0) < 2", DuplicateGroupPending).Delete(&DuplicateGroup{}).Error
+	if err != nil {
+		return err
+	}
+	err = tx.Model(&CustomerSegment{}).Where("snapshot_ids && ?", idArray).
+		Update("snapshot_ids", gorm.Expr("ARRAY(SELECT x FROM unnest(snapshot_ids) AS x WHERE x <> ALL(?))", idArray)).Error
+	if err != nil {
+		return err
+	}
+	err = tx.Model(&CustomerTransfer{}).Where("customer_ids && ?", idArray).
+		Update("customer_ids", gorm.Expr("ARRAY(SELECT x FROM unnest(customer_ids) AS x WHERE x <> ALL(?))", idArray)).Error
+	if err != nil {
+		return err
+	}
+	return tx.Where("COALESCE(array_length(customer_ids, 1), 0) = 0").Delete(&CustomerTransfer{}).Error
+}
+
+// runCustomerTrashPurgeJob 后台定期清理回收站，服务启动时立即执行一次
+func runCustomerTrashPurgeJob() {
+	for {
+		resp, err := purgeDeletedCustomers(GetTrashRetentionDays())
+		if err != nil {
+			log.Printf("清理客户回收站失败: %v", err)
+		} else if resp.Customers > 0 || resp.Kept > 0 {
+			log.Printf("清理客户回收站完成：彻底删除 %d 个客户、%d 个待办、%d 个提醒、%d 条跟进记录，%d 个已到期客户因有订单或退货单保留",
+				resp.Customers, resp.Todos, resp.Reminders, resp.Records, resp.Kept)
+		}
+		time.Sleep(customerPurgeInterval)
+	}
+}
+
+// ========== 客户状态流转相关业务函数 ==========
+
+// defaultCustomerStateTransitions 默认状态流转规则，流转规则表为空时写入
+var defaultCustomerStateTransitions = []CustomerStateTransition{
+	{FromState: CustomerStateUnknown, ToState: CustomerStateUndeveloped},
+	{FromState: CustomerStateUnknown, ToState: CustomerStateDeveloping},
+	{FromState: CustomerStateUnknown, ToState: CustomerStateDeveloped},
+	{FromState: CustomerStateUnknown, ToState: CustomerStateBlacklisted, RequireReason: true},
+	{FromState: CustomerStateUnknown, ToState: CustomerStateClosed, RequireReason: true},
+	{FromState: CustomerStateUnknown, ToState: CustomerStateColleague},
+	{FromState: CustomerStateUnknown, ToState: CustomerStatePeer},
+	{FromState: CustomerStateUndeveloped, ToState: CustomerStateDeveloping},
+	{FromState: CustomerStateUndeveloped, ToState: CustomerStateBlacklisted, RequireReason: true},
+	{FromState: CustomerStateUndeveloped, ToState: CustomerStateClosed, RequireReason: true},
+	{FromState: CustomerStateUndeveloped, ToState: CustomerStatePeer},
+	{FromState: CustomerStateDeveloping, ToState: CustomerStateUndeveloped},
+	{FromState: CustomerStateDeveloping, ToState: CustomerStateDeveloped},
+	{FromState: CustomerStateDeveloping, ToState: CustomerStateBlacklisted, RequireReason: true},
+	{FromState: CustomerStateDeveloping, ToState: CustomerStateClosed, RequireReason: true},
+	{FromState: CustomerStateDeveloping, ToState: CustomerStatePeer},
+	{FromState: CustomerStateDeveloped, ToState: CustomerStateDeveloping},
+	{FromState: CustomerStateDeveloped, ToState: CustomerStateBlacklisted, RequireReason: true},
+	{FromState: CustomerStateDeveloped, ToState: CustomerStateClosed, RequireReason: true},
+	{FromState: CustomerStateDeveloped, ToState: CustomerStatePeer},
+	{FromState: CustomerStateBlacklisted, ToState: CustomerStateUndeveloped, RequireReason: true},
+	{FromState: CustomerStateBlacklisted, ToState: CustomerStateDeveloping, RequireReason: true},
+	{FromState: CustomerStateClosed, ToState: CustomerStateUndeveloped, RequireReason: true},
+	{FromState: CustomerStateClosed, ToState: CustomerStateDeveloping, RequireReason: true},
+	{FromState: CustomerStateColleague, ToState: CustomerStateTraitor, RequireReason: true},
+	{FromState: CustomerStateTraitor, ToState: CustomerStateBlacklisted, RequireReason: true},
+	{FromState: CustomerStatePeer, ToState: CustomerStateUndeveloped},
+	{FromState: CustomerStatePeer, ToState: CustomerStateDeveloping},
+	{FromState: CustomerStatePeer, ToState: CustomerStateBlacklisted, RequireReason: true},
+}
+
+// customerStateRules 状态流转规则：键为 [原状态, 目标状态]，值为是否必须填写原因
+type customerStateRules map[[2]int]bool
+
+// customerStateName 状态名称，未定义的状态显示为数字
+func customerStateName(state int) string {
+	if name, ok := CustomerStateNames[state]; ok {
+		return name
+	}
+	return strconv.Itoa(state)
+}
+
+// validateCustomerState 校验状态是否已定义
+func validateCustomerState(state int) error {
+	if _, ok := CustomerStateNames[state]; !ok {
+		return &ValidationError{Message: fmt.Sprintf("未知的客户状态 %d", state)}
+	}
+	return nil
+}
+
+// checkCustomerStateTransition 按流转规则检查状态变更，状态不变时不检查
+func checkCustomerStateTransition(rules customerStateRules, from, to int, reason string) error {
+	if from == to {
+		return nil
+	}
+	if err := validateCustomerState(to); err != nil {
+		return err
+	}
+	requireReason, ok := rules[[2]int{from, to}]
+	if !ok {
+		return &ValidationError{Message: fmt.Sprintf("不允许从「%s」变更为「%s」", customerStateName(from), customerStateName(to))}
+	}
+	if requireReason && strings.TrimSpace(reason) == "" {
+		return &ValidationError{Message: fmt.Sprintf("从「%s」变更为「%s」必须填写原因", customerStateName(from), customerStateName(to))}
+	}
+	return nil
+}
+
+// loadCustomerStateRules 读取状态流转规则
+func loadCustomerStateRules(tx *gorm.DB) (customerStateRules, error) {
+	var transitions []CustomerStateTransition
+	if err := tx.Find(&transitions).Error; err != nil {
+		return nil, err
+	}
+	rules := make(customerStateRules, len(transitions))
+	for _, t := range transitions {
+		rules[[2]int{t.FromState, t.ToState}] = t.RequireReason
+	}
+	return rules, nil
+}
+
+// validateCustomerStateTransition 读取流转规则并检查状态变更
+func validateCustomerStateTransition(tx *gorm.DB, from, to int, reason string) error {
+	if from == to {
+		return nil
+	}
+	rules, err := loadCustomerStateRules(tx)
+	if err != nil {
+		return err
+	}
+	return checkCustomerStateTransition(rules, from, to, reason)
+}
+
+// recordCustomerStateChange 记录一次状态流转，from 为空表示初始状态
+func recordCustomerStateChange(tx *gorm.DB, customerID uint64, from *int, to int, reason string, source CustomerChangeSource, operatorID uint64, changedAt time.Time) error {
+	if from != nil && *from == to {
+		return nil
+	}
+	return tx.Create(&CustomerStateChange{
+		CustomerID: customerID,
+		FromState:  from,
+		ToState:    to,
+		Reason:     strings.TrimSpace(reason),
+		Source:     source,
+		OperatorID: operatorID,
+		ChangedAt:  changedAt,
+	}).Error
+}
+
+// seedCustomerStateTransitions 流转规则表为空时写入默认规则
+func seedCustomerStateTransitions() {
+	var count int64
+	DB.Model(&CustomerStateTransition{}).Count(&count)
+	if count > 0 {
+		return
+	}
+	transitions := make([]CustomerStateTransition, len(defaultCustomerStateTransitions))
+	copy(transitions, defaultCustomerStateTransitions)
+	if err := DB.Create(&transitions).Error; err != nil {
+		log.Printf("写入默认客户状态流转规则失败: %v", err)
+	}
+}
+
+// backfillCustomerStateChanges 为没有状态记录的历史客户补一条初始状态记录（以创建时间为进入时间）
+func backfillCustomerStateChanges() {
+	result := DB.Exec(`INSERT INTO customer_state_changes (customer_id, from_state, to_state, reason, source, operator_id, changed_at)
+		SELECT c.id, NULL, c.state, '', ?, 0, c.created_at FROM customers c
+		WHERE NOT EXISTS (SELECT 1 FROM customer_state_changes s WHERE s.customer_id = c.id)`, CustomerChangeSystem)
+	if result.Error != nil {
+		log.Printf("补全客户初始状态记录失败: %v", result.Error)
+		return
+	}
+	if result.RowsAffected > 0 {
+		log.Printf("补全客户初始状态记录 %d 条", result.RowsAffected)
+	}
+}
+
+// getCustomerStates 获取客户状态及流转规则
+func getCustomerStates() *CustomerStatesResponse {
+	response := &CustomerStatesResponse{
+		States:      []CustomerStateItem{},
+		Transitions: []CustomerStateTransitionItem{},
+	}
+	for state, name := range CustomerStateNames {
+		response.States = append(response.States, CustomerStateItem{State: state, Name: name})
+	}
+	sort.Slice(response.States, func(i, j int) bool { return response.States[i].State < response.States[j].State })
+
+	var transitions []CustomerStateTransition
+	DB.Order("from_state ASC, to_state ASC").Find(&transitions)
+	for _, t := range transitions {
+		response.Transitions = append(response.Transitions, CustomerStateTransitionItem{
+			FromState:     t.FromState,
+			FromName:      customerStateName(t.FromState),
+			ToState:       t.ToState,
+			ToName:        customerStateName(t.ToState),
+			RequireReason: t.RequireReason,
+		})
+	}
+	return response
+}
+
+// replaceCustomerStateTransitions 整体替换状态流转规则
+func replaceCustomerStateTransitions(items []CustomerStateTransitionItem) (*CustomerStatesResponse, error) {
+	transitions := make([]CustomerStateTransition, 0, len(items))
+	seen := make(map[[2]int]bool)
+	for _, item := range items {
+		if err := validateCustomerState(item.FromState); err != nil {
+			return nil, err
+		}
+		if err := validateCustomerState(item.ToState); err != nil {
+			return nil, err
+		}
+		if item.FromState == item.ToState {
+			return nil, &ValidationError{Message: fmt.Sprintf("状态「%s」不能流转到自身", customerStateName(item.FromState))}
+		}
+		key := [2]int{item.FromState, item.ToState}
+		if seen[key] {
+			return nil, &ValidationError{Message: fmt.Sprintf("流转规则「%s」→「%s」重复", customerStateName(item.FromState), customerStateName(item.ToState))}
+		}
+		seen[key] = true
+		transitions = append(transitions, CustomerStateTransition{
+			FromState:     item.FromState,
+			ToState:       item.ToState,
+			RequireReason: item.RequireReason,
+		})
+	}
+
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("1 = 1").Delete(&CustomerStateTransition{}).Error; err != nil {
+			return err
+		}
+		if len(transitions) == 0 {
+			return nil
+		}
+		return tx.Create(&transitions).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return getCustomerStates(), nil
+}
+
+// changeCustomerState 按流转规则变更客户状态
+func changeCustomerState(id uint64, req CustomerStateChangeRequest) (*CustomerResponse, error) {
+	var customer Customer
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("is_deleted = ?", false).First(&customer, id).Error; err != nil {
+			return err
+		}
+		from := customer.State
+		if from == *req.State {
+			return nil
+		}
+		if err := validateCustomerStateTransition(tx, from, *req.State, req.Reason); err != nil {
+			return err
+		}
+		before := customerSnapshot(&customer)
+		now := time.Now()
+		customer.State = *req.State
+		customer.UpdatedAt = now
+		customer.UpdatedBy = uint(req.OperatorID)
+		if err := tx.Model(&customer).Select("state", "updated_at", "updated_by").Updates(&customer).Error; err != nil {
+			return err
+		}
+		if err := recordCustomerStateChange(tx, id, &from, customer.State, req.Reason, CustomerChangeAPI, req.OperatorID, now); err != nil {
+			return err
+		}
+		return recordCustomerChange(tx, id, before, customerSnapshot(&customer), ActionUpdate, CustomerChangeAPI, req.OperatorID, req.Reason)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return CustomerToResponse(&customer), nil
+}
+
+// getCustomerStateHistory 获取客户的状态流转记录（按时间正序），附带每个状态的停留天数
+func getCustomerStateHistory(customerID uint64) []CustomerStateChangeResponse {
+	var changes []CustomerStateChange
+	DB.Where("customer_id = ?", customerID).Order("changed_at ASC, id ASC").Find(&changes)
+
+	operatorIDs := make([]uint64, len(changes))
+	for i := range changes {
+		operatorIDs[i] = changes[i].OperatorID
+	}
+	operatorNames := userNamesByID(operatorIDs)
+
+	now := time.Now()
+	responses := make([]CustomerStateChangeResponse, len(changes))
+	for i, change := range changes {
+		leftAt := now
+		if i+1 < len(changes) {
+			leftAt = changes[i+1].ChangedAt
+		}
+		responses[i] = CustomerStateChangeResponse{
+			CustomerStateChange: change,
+			ToName:              customerStateName(change.ToState),
+			OperatorName:        operatorNames[change.OperatorID],
+			DurationDays:        math.Round(leftAt.Sub(change.ChangedAt).Hours()/24*100) / 100,
+		}
+		if change.FromState != nil {
+			responses[i].FromName = customerStateName(*change.FromState)
+		}
+	}
+	return responses
+}
+
+// getCustomerStateDurations 统计客户在各状态的停留时长：相邻两条流转记录之间为一次停留，最后一条记录的状态为当前状态
+func getCustomerStateDurations(req CustomerStateDurationRequest) ([]CustomerStateDurationResponse, error) {
+	stays := DB.Table("customer_state_changes AS s").
+		Select("s.customer_id, s.to_state AS state, s.changed_at AS entered_at, " +
+			"LEAD(s.changed_at) OVER (PARTITION BY s.customer_id ORDER BY s.changed_at, s.id) AS left_at").
+		Joins("JOIN customers c ON c.id = s.customer_id AND c.is_deleted = false")
+	if req.SellerID > 0 {
+		stays = stays.Where("? = ANY(c.sellers)", req.SellerID)
+	}
+
+	query := DB.Table("(?) AS stays", stays).
+		Select(`state,
+			COUNT(*) FILTER (WHERE left_at IS NOT NULL) AS exited,
+			COUNT(*) FILTER (WHERE left_at IS NULL) AS current,
+			COALESCE(AVG(EXTRACT(EPOCH FROM left_at - entered_at)) FILTER (WHERE left_at IS NOT NULL), 0) / 86400 AS avg_days,
+			COALESCE(percentile_cont(0.5) WITHIN GROUP (ORDER BY EXTRACT(EPOCH FROM left_at - entered_at)) FILTER (WHERE left_at IS NOT NULL), 0) / 86400 AS median_days,
+			COALESCE(MAX(EXTRACT(EPOCH FROM left_at - entered_at)), 0) / 86400 AS max_days,
+			COALESCE(AVG(EXTRACT(EPOCH FROM NOW() - entered_at)) FILTER (WHERE left_at IS NULL), 0) / 86400 AS current_avg_days`).
+		Group("state").
+		Order("state ASC")
+	if req.Since != nil {
+		query = query.Where("entered_at >= ?", *req.Since)
+	}
+
+	var rows []CustomerStateDurationResponse
+	if err := query.Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	for i := range rows {
+		rows[i].Name = customerStateName(rows[i].State)
+		rows[i].AvgDays = math.Round(rows[i].AvgDays*100) / 100
+		rows[i].MedianDays = math.Round(rows[i].MedianDays*100) / 100
+		rows[i].MaxDays = math.Round(rows[i].MaxDays*100) / 100
+		rows[i].CurrentAvgDays = math.Round(rows[i].CurrentAvgDays*100) / 100
+	}
+	return rows, nil
+}
+
+// ========== 公海相关业务函数 ==========
+
+// customerPoolCondition 公海客户：没有负责的销售员
+const customerPoolCondition = "(sellers IS NULL OR cardinality(sellers) = 0)"
+
+// customerLastActivitySQL 客户最近一次活动时间：跟进记录、通话、拜访、下单、领取中最晚的时间，都没有时为创建时间
+const customerLastActivitySQL = `GREATEST(customers.created_at, customers.last_order_date, customers.last_called, customers.last_visited,
+	(SELECT MAX(f.created_at) FROM follow_up_records f WHERE f.customer_id = customers.id AND f.is_deleted = false),
+	(SELECT MAX(p.created_at) FROM customer_pool_records p WHERE p.customer_id = customers.id AND p.action = 'claim'))`
+
+// customerPoolWarnTitle 回收提醒待办的标题
+const customerPoolWarnTitle = "客户即将回收到公海"
+
+// customerPoolRecycleInterval 公海回收任务的执行间隔
+const customerPoolRecycleInterval = time.Hour
+
+// getCustomerPoolQuota 获取销售员的公海领取额度：个人上限优先于系统默认
+func getCustomerPoolQuota(tx *gorm.DB, sellerID uint64) (*CustomerPoolQuota, error) {
+	var user User
+	if err := tx.Where("is_deleted = ?", false).First(&user, sellerID).Error; err != nil {
+		return nil, err
+	}
+	config := GetCustomerPoolConfig()
+	quota := &CustomerPoolQuota{
+		SellerID:        sellerID,
+		DailyClaimLimit: config.DailyClaimLimit,
+		MaxCustomers:    config.MaxCustomers,
+	}
+	if user.PoolClaimLimit > 0 {
+		quota.DailyClaimLimit = user.PoolClaimLimit
+	}
+
+	var claimed, owned int64
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	if err := tx.Model(&CustomerPoolRecord{}).
+		Where("seller_id = ? AND action = ? AND created_at >= ?", sellerID, CustomerPoolClaim, today).
+		Count(&claimed).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Model(&Customer{}).
+		Where("? = ANY(sellers) AND is_deleted = ?", sellerID, false).
+		Count(&owned).Error; err != nil {
+		return nil, err
+	}
+	quota.ClaimedToday = int(claimed)
+	quota.Owned = int(owned)
+	return quota, nil
+}
+
+// getPoolCustomers 分页获取公海客户（按最近更新倒序，可按名称或联系人搜索）
+func getPoolCustomers(keyword string, page, limit int) ([]*CustomerResponse, int64) {
+	var customers []Customer
+	var total int64
+
+	query := DB.Model(&Customer{}).Where("is_deleted = ?", false).Where(customerPoolCondition)
+	if keyword != "" {
+		like := "%" + escapeLike(keyword) + "%"
+		query = query.Where("name LIKE ? OR contact_name LIKE ?", like, like)
+	}
+	query.Count(&total)
+	query.Order("updated_at DESC, id DESC").Offset((page - 1) * limit).Limit(limit).Find(&customers)
+
+	responses := make([]*CustomerResponse, len(customers))
+	for i := range customers {
+		responses[i] = CustomerToResponse(&customers[i])
+	}
+	return responses, total
+}
+
+// claimPoolCustomers 销售员领取公海客户，超过每日领取上限或负责客户上限的客户领取失败
+func claimPoolCustomers(req CustomerPoolClaimRequest) (*CustomerPoolResponse, error) {
+	response := &CustomerPoolResponse{Results: []CustomerPoolResult{}}
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		// 锁定销售员，避免并发领取突破上限
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("is_deleted = ?", false).
+			First(&User{}, req.SellerID).Error; err != nil {
+			return err
+		}
+		quota, err := getCustomerPoolQuota(tx, req.SellerID)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		for _, id := range uniqueUint64s(req.CustomerIDs) {
+			result := CustomerPoolResult{CustomerID: id}
+			switch {
+			case quota.ClaimedToday >= quota.DailyClaimLimit:
+				result.Message = fmt.Sprintf("超过每日领取上限 %d 个", quota.DailyClaimLimit)
+			case quota.MaxCustomers > 0 && quota.Owned >= quota.MaxCustomers:
+				result.Message = fmt.Sprintf("负责的客户已达上限 %d 个", quota.MaxCustomers)
+			default:
+				var customer Customer
+				err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+					Where("is_deleted = ?", false).First(&customer, id).Error
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					result.Message = "客户不存在"
+					break
+				}
+				if err != nil {
+					return err
+				}
+				if len(customer.Sellers) > 0 {
+					result.Message = "客户不在公海"
+					break
+				}
+				before := customerSnapshot(&customer)
+				customer.Sellers = pq.Int64Array{int64(req.SellerID)}
+				customer.UpdatedAt = now
+				customer.UpdatedBy = uint(req.OperatorID)
+				if err := tx.Model(&customer).Select("sellers", "updated_at", "updated_by").Updates(&customer).Error; err != nil {
+					return err
+				}
+				record := CustomerPoolRecord{CustomerID: id, SellerID: req.SellerID, Action: CustomerPoolClaim, OperatorID: req.OperatorID, CreatedAt: now}
+				if err := tx.Create(&record).Error; err != nil {
+					return err
+				}
+				if err := recordCustomerChange(tx, id, before, customerSnapshot(&customer), ActionUpdate, CustomerChangeAPI, req.OperatorID, "领取公海客户"); err != nil {
+					return err
+				}
+				quota.ClaimedToday++
+				quota.Owned++
+				result.Success = true
+			}
+			addCustomerPoolResult(response, result)
+		}
+		response.Quota = quota
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// releasePoolCustomers 销售员释放负责的客户，客户没有其他负责人时回到公海
+func releasePoolCustomers(req CustomerPoolReleaseRequest) (*CustomerPoolResponse, error) {
+	response := &CustomerPoolResponse{Results: []CustomerPoolResult{}}
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		for _, id := range uniqueUint64s(req.CustomerIDs) {
+			result := CustomerPoolResult{CustomerID: id}
+			var customer Customer
+			err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+				Where("is_deleted = ?", false).First(&customer, id).Error
+			switch {
+			case errors.Is(err, gorm.ErrRecordNotFound):
+				result.Message = "客户不存在"
+			case err != nil:
+				return err
+			case !containsInt64(customer.Sellers, int64(req.SellerID)):
+				result.Message = "该销售员不负责此客户"
+			default:
+				before := customerSnapshot(&customer)
+				customer.Sellers, _ = removeInt64Array(customer.Sellers, int64(req.SellerID))
+				// 回到公海时一并清空销售员姓名
+				if len(customer.Sellers) == 0 {
+					customer.SallerName = ""
+				}
+				customer.UpdatedAt = now
+				customer.UpdatedBy = uint(req.OperatorID)
+				if err := tx.Model(&customer).Select("sellers", "saller_name", "updated_at", "updated_by").Updates(&customer).Error; err != nil {
+					return err
+				}
+				record := CustomerPoolRecord{CustomerID: id, SellerID: req.SellerID, Action: CustomerPoolRelease, Reason: req.Reason, OperatorID: req.OperatorID, CreatedAt: now}
+				if err := tx.Create(&record).Error; err != nil {
+					return err
+				}
+				remark := "释放到公海"
+				if req.Reason != "" {
+					remark += "：" + req.Reason
+				}
+				if err := recordCustomerChange(tx, id, before, customerSnapshot(&customer), ActionUpdate, CustomerChangeAPI, req.OperatorID, remark); err != nil {
+					return err
+				}
+				result.Success = true
+			}
+			addCustomerPoolResult(response, result)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// addCustomerPoolResult 累加领取/释放结果
+func addCustomerPoolResult(response *CustomerPoolResponse, result CustomerPoolResult) {
+	if result.Success {
+		response.Succeeded++
+	} else {
+		response.Failed++
+	}
+	response.Results = append(response.Results, result)
+}
+
+// getCustomerPoolRecords 分页获取公海记录（可按客户、销售员、操作类型筛选）
+func getCustomerPoolRecords(customerID, sellerID uint64, action string, page, pageSize int) ([]CustomerPoolRecordResponse, int64) {
+	var records []CustomerPoolRecord
+	var total int64
+
+	query := DB.Model(&CustomerPoolRecord{})
+	if customerID > 0 {
+		query = query.Where("customer_id = ?", customerID)
+	}
+	if sellerID > 0 {
+		query = query.Where("seller_id = ?", sellerID)
+	}
+	if action != "" {
+		query = query.Where("action = ?", action)
+	}
+	query.Count(&total)
+	query.Order("created_at DESC, id DESC").Offset((page - 1) * pageSize).Limit(pageSize).Find(&records)
+
+	var customerIDs, userIDs []uint64
+	for _, record := range records {
+		if !containsUint64(customerIDs, record.CustomerID) {
+			customerIDs = append(customerIDs, record.CustomerID)
+		}
+		userIDs = append(userIDs, record.SellerID)
+	}
+	customerNames := make(map[uint64]string)
+	if len(customerIDs) > 0 {
+		var customers []Customer
+		DB.Select("id", "name").Where("id IN ?", customerIDs).Find(&customers)
+		for _, customer := range customers {
+			customerNames[uint64(customer.ID)] = customer.Name
+		}
+	}
+	userNames := userNamesByID(userIDs)
+
+	responses := make([]CustomerPoolRecordResponse, len(records))
+	for i, record := range records {
+		responses[i] = CustomerPoolRecordResponse{
+			CustomerPoolRecord: record,
+			CustomerName:       customerNames[record.CustomerID],
+			SellerName:         userNames[record.SellerID],
+		}
+	}
+	return responses, total
+}
+
+// customerPoolActivityRow 有负责人的客户及其最近活动时间
+type customerPoolActivityRow struct {
+	ID             uint64
+	Name           string
+	Sellers        pq.Int64Array `gorm:"type:int4[]"`
+	LastActivityAt time.Time
+}
+
+// findCustomersByLastActivity 查询有负责人、最近活动时间早于 before 的客户
+func findCustomersByLastActivity(before time.Time, sellerID uint64) ([]customerPoolActivityRow, error) {
+	query := DB.Table("customers").
+		Select("customers.id, customers.name, customers.sellers, "+customerLastActivitySQL+" AS last_activity_at").
+		Where("customers.is_deleted = ?", false).
+		Where("NOT " + customerPoolCondition)
+	if sellerID > 0 {
+		query = query.Where("? = ANY(customers.sellers)", sellerID)
+	}
+	query = query.Where(customerLastActivitySQL+" < ?", before)
+	var rows []customerPoolActivityRow
+	err := query.Order("last_activity_at ASC").Scan(&rows).Error
+	return rows, err
+}
+
+// customerPoolWarnedAt 客户在最近一次活动之后收到回收提醒的时间，没有提醒过的客户不在结果中
+func customerPoolWarnedAt(rows []customerPoolActivityRow) (map[uint64]time.Time, error) {
+	warnedAt := make(map[uint64]time.Time)
+	if len(rows) == 0 {
+		return warnedAt, nil
+	}
+	ids := make([]uint64, len(rows))
+	for i, row := range rows {
+		ids[i] = row.ID
+	}
+	var warnings []struct {
+		CustomerID uint64
+		WarnedAt   time.Time
+	}
+	err := DB.Model(&CustomerPoolRecord{}).
+		Select("customer_id, MAX(created_at) AS warned_at").
+		Where("customer_id IN ? AND action = ?", ids, CustomerPoolWarn).
+		Group("customer_id").
+		Scan(&warnings).Error
+	if err != nil {
+		return nil, err
+	}
+	lastActivity := make(map[uint64]time.Time, len(rows))
+	for _, row := range rows {
+		lastActivity[row.ID] = row.LastActivityAt
+	}
+	for _, warning := range warnings {
+		if warning.WarnedAt.After(lastActivity[warning.CustomerID]) {
+			warnedAt[warning.CustomerID] = warning.WarnedAt
+		}
+	}
+	return warnedAt, nil
+}
+
+// customerPoolRecycleAt 客户的回收时间：不活动满 RecycleDays 天，且提醒后至少经过 WarningDays 天；还没有提醒过时按现在提醒计算
+func customerPoolRecycleAt(config CustomerPoolConfig, lastActivityAt time.Time, warnedAt *time.Time, now time.Time) time.Time {
+	recycleAt := lastActivityAt.AddDate(0, 0, config.RecycleDays)
+	warnFrom := now
+	if warnedAt != nil {
+		warnFrom = *warnedAt
+	}
+	if earliest := warnFrom.AddDate(0, 0, config.WarningDays); earliest.After(recycleAt) {
+		recycleAt = earliest
+	}
+	return recycleAt
+}
+
+// getExpiringPoolCustomers 获取即将回收到公海的客户（提醒期内或已到期等待提醒期结束）
+func getExpiringPoolCustomers(sellerID uint64) ([]CustomerPoolExpiringResponse, error) {
+	config := GetCustomerPoolConfig()
+	responses := []CustomerPoolExpiringResponse{}
+	if config.RecycleDays < 0 {
+		return responses, nil
+	}
+	now := time.Now()
+	cutoff := now.AddDate(0, 0, -config.RecycleDays)
+	rows, err := findCustomersByLastActivity(cutoff.AddDate(0, 0, config.WarningDays), sellerID)
+	if err != nil {
+		return nil, err
+	}
+	warnedAt, err := customerPoolWarnedAt(rows)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		var warned *time.Time
+		if t, ok := warnedAt[row.ID]; ok {
+			warned = &t
+		}
+		responses = append(responses, CustomerPoolExpiringResponse{
+			CustomerID:     row.ID,
+			Name:           row.Name,
+			Sellers:        []int64(row.Sellers),
+			LastActivityAt: row.LastActivityAt,
+			RecycleAt:      customerPoolRecycleAt(config, row.LastActivityAt, warned, now),
+		})
+	}
+	return responses, nil
+}
+
+// recycleInactiveCustomers 回收长期没有活动的客户到公海。客户必须先收到回收提醒（给负责人创建待办），
+// 提醒后至少经过 WarningDays 天仍无活动才会回收；首次运行时到期的客户也只提醒并开始倒计时
+func recycleInactiveCustomers(config CustomerPoolConfig) (recycled, warned int, err error) {
+	if config.RecycleDays < 0 {
+		return 0, 0, nil
+	}
+	now := time.Now()
+	cutoff := now.AddDate(0, 0, -config.RecycleDays)
+	reason := fmt.Sprintf("超过%d天未跟进或下单", config.RecycleDays)
+
+	// 已到期和提醒期内的客户
+	rows, err := findCustomersByLastActivity(cutoff.AddDate(0, 0, config.WarningDays), 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	warnedAt, err := customerPoolWarnedAt(rows)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, row := range rows {
+		at, ok := warnedAt[row.ID]
+		if !ok {
+			if err := warnPoolCustomer(row, customerPoolRecycleAt(config, row.LastActivityAt, nil, now), reason, now); err != nil {
+				return recycled, warned, err
+			}
+			warned++
+			continue
+		}
+		if now.Before(customerPoolRecycleAt(config, row.LastActivityAt, &at, now)) {
+			continue
+		}
+		done, err := recyclePoolCustomer(row.ID, cutoff, reason, now)
+		if err != nil {
+			return recycled, warned, err
+		}
+		if done {
+			recycled++
+		}
+	}
+	return recycled, warned, nil
+}
+
+// warnPoolCustomer 给客户的每个负责人创建回收提醒待办，并记录提醒
+func warnPoolCustomer(row customerPoolActivityRow, recycleAt time.Time, reason string, now time.Time) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		for _, sellerID := range row.Sellers {
+			todo := Todo{
+				CustomerID:  row.ID,
+				CreatorID:   uint64(sellerID),
+				ExecutorID:  uint64(sellerID),
+				Title:       customerPoolWarnTitle,
+				Content:     fmt.Sprintf("客户「%s」%s，将于 %s 自动回收到公海，请及时跟进", row.Name, reason, recycleAt.Format("2006-01-02 15:04")),
+				Status:      TodoStatusPending,
+				PlannedTime: recycleAt,
+				Priority:    PriorityHigh,
+			}
+			if err := tx.Create(&todo).Error; err != nil {
+				return err
+			}
+			record := CustomerPoolRecord{CustomerID: row.ID, SellerID: uint64(sellerID), Action: CustomerPoolWarn, Reason: todo.Content, CreatedAt: now}
+			if err := tx.Create(&record).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// recyclePoolCustomer 回收单个客户：加锁后重新确认客户未删除、仍有负责人且仍未活动，避免回收期间刚跟进或已删除的客户
+func recyclePoolCustomer(customerID uint64, cutoff time.Time, reason string, now time.Time) (bool, error) {
+	recycled := false
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var customer Customer
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&customer, customerID).Error; err != nil {
+			return err
+		}
+		if customer.IsDeleted || len(customer.Sellers) == 0 {
+			return nil
+		}
+		var inactive int64
+		err := tx.Table("customers").
+			Where("customers.id = ?", customerID).
+			Where(customerLastActivitySQL+" < ?", cutoff).
+			Count(&inactive).Error
+		if err != nil || inactive == 0 {
+			return err
+		}
+
+		before := customerSnapshot(&customer)
+		sellers := customer.Sellers
+		customer.Sellers = pq.Int64Array{}
+		customer.SallerName = ""
+		customer.UpdatedAt = now
+		if err := tx.Model(&customer).Select("sellers", "saller_name", "updated_at").Updates(&customer).Error; err != nil {
+			return err
+		}
+		for _, sellerID := range sellers {
+			record := CustomerPoolRecord{CustomerID: customerID, SellerID: uint64(sellerID), Action: CustomerPoolRecycle, Reason: reason, CreatedAt: now}
+			if err := tx.Create(&record).Error; err != nil {
+				return err
+			}
+		}
+		// 回收后原负责人的回收提醒不再需要
+		err = tx.Model(&Todo{}).
+			Where("customer_id = ? AND title = ? AND status IN ? AND is_deleted = ?", customerID, customerPoolWarnTitle, openTodoStatuses, false).
+			Update("status", TodoStatusCancelled).Error
+		if err != nil {
+			return err
+		}
+		if err := recordCustomerChange(tx, customerID, before, customerSnapshot(&customer), ActionUpdate, CustomerChangeSystem, 0, "自动回收到公海："+reason); err != nil {
+			return err
+		}
+		recycled = true
+		return nil
+	})
+	return recycled, err
+}
+
+// runCustomerPoolRecycleJob 后台定期回收长期未跟进的客户，服务启动时立即执行一次
+func runCustomerPoolRecycleJob() {
+	for {
+		recycled, warned, err := recycleInactiveCustomers(GetCustomerPoolConfig())
+		if err != nil {
+			log.Printf("公海自动回收失败: %v", err)
+		} else if recycled > 0 || warned > 0 {
+			log.Printf("公海自动回收完成：回收 %d 个客户，提醒 %d 个即将回收的客户", recycled, warned)
+		}
+		time.Sleep(customerPoolRecycleInterval)
+	}
+}
+
+// updateUserPoolClaimLimit 设置销售员每日公海领取上限
+func updateUserPoolClaimLimit(userID uint64, limit int) (*CustomerPoolQuota, error) {
+	result := DB.Model(&User{}).Where("id = ? AND is_deleted = ?", userID, false).Update("pool_claim_limit", limit)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return getCustomerPoolQuota(DB, userID)
+}
+
+// ========== 客户转移相关业务函数 ==========
+
+// customerTransferLimit 单次转移的最大客户数
+const customerTransferLimit = 10000
+
+// validateCustomerTransfer 校验客户转移请求
+func validateCustomerTransfer(req CustomerTransferRequest) error {
+	if req.FromSellerID == req.ToSellerID {
+		return errors.New("原销售员和新销售员不能相同")
+	}
+	if req.All == (len(req.CustomerIDs) > 0) {
+		return errors.New("customer_ids 与 all 需要且只能选择一种")
+	}
+	if len(req.CustomerIDs) > customerTransferLimit {
+		return fmt.Errorf("单次最多转移 %d 个客户", customerTransferLimit)
+	}
+	if strings.TrimSpace(req.Reason) == "" {
+		return errors.New("请填写转移原因")
+	}
+	return nil
+}
+
+// transferCustomers 将客户从原销售员转给新销售员：替换负责销售员和销售员姓名，可同时转移未完成的待办和待发送的提醒
+func transferCustomers(req CustomerTransferRequest) (*CustomerTransferResponse, error) {
+	response := &CustomerTransferResponse{Results: []CustomerTransferResult{}}
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		// 原销售员可能已离职（已删除），新销售员必须在职
+		var fromUser, toUser User
+		if err := tx.First(&fromUser, req.FromSellerID).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("is_deleted = ?", false).First(&toUser, req.ToSellerID).Error; err != nil {
+			return err
+		}
+
+		ids := uniqueUint64s(req.CustomerIDs)
+		if req.All {
+			if err := tx.Model(&Customer{}).
+				Where("? = ANY(sellers) AND is_deleted = ?", req.FromSellerID, false).
+				Order("id ASC").Pluck("id", &ids).Error; err != nil {
+				return err
+			}
+		}
+		var customers []Customer
+		if len(ids) > 0 {
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+				Where("id IN ? AND is_deleted = ?", ids, false).Find(&customers).Error; err != nil {
+				return err
+			}
+		}
+		byID := make(map[uint64]*Customer, len(customers))
+		for i := range customers {
+			byID[uint64(customers[i].ID)] = &customers[i]
+		}
+
+		now := time.Now()
+		remark := fmt.Sprintf("从 %s 转移给 %s：%s", fromUser.Name, toUser.Name, req.Reason)
+		var moved []uint64
+		for _, id := range ids {
+			result := CustomerTransferResult{CustomerID: id}
+			customer, ok := byID[id]
+			switch {
+			case !ok:
+				result.Message = "客户不存在"
+			case !containsInt64(customer.Sellers, int64(req.FromSellerID)):
+				result.Message = "该客户不属于原销售员"
+			default:
+				before := customerSnapshot(customer)
+				customer.Sellers, _ = removeInt64Array(customer.Sellers, int64(req.FromSellerID))
+				customer.Sellers, _ = mergeInt64Array(customer.Sellers, int64(req.ToSellerID))
+				if customer.SallerName == "" || customer.SallerName == fromUser.Name {
+					customer.SallerName = toUser.Name
+				}
+				customer.UpdatedAt = now
+				customer.UpdatedBy = uint(req.OperatorID)
+				if err := tx.Model(customer).Select("sellers", "saller_name", "updated_at", "updated_by").Updates(customer).Error; err != nil {
+					return err
+				}
+				if err := recordCustomerChange(tx, id, before, customerSnapshot(customer), ActionUpdate, CustomerChangeAPI, req.OperatorID, remark); err != nil {
+					return err
+				}
+				moved = append(moved, id)
+				result.Success = true
+			}
+			response.Results = append(response.Results, result)
+		}
+		if len(moved) == 0 {
+			return nil
+		}
+
+		transfer := CustomerTransfer{
+			FromSellerID: req.FromSellerID,
+			ToSellerID:   req.ToSellerID,
+			CustomerIDs:  make(pq.Int64Array, len(moved)),
+			Reason:       strings.TrimSpace(req.Reason),
+			MoveTodos:    req.MoveTodos,
+			TodoIDs:      pq.Int64Array{},
+			ReminderIDs:  pq.Int64Array{},
+			OperatorID:   req.OperatorID,
+			CreatedAt:    now,
+		}
+		for i, id := range moved {
+			transfer.CustomerIDs[i] = int64(id)
+		}
+		if req.MoveTodos {
+			err := tx.Model(&Todo{}).
+				Where("customer_id IN ? AND executor_id = ? AND status IN ? AND is_deleted = ?", moved, req.FromSellerID, openTodoStatuses, false).
+				Pluck("id", &transfer.TodoIDs).Error
+			if err != nil {
+				return err
+			}
+		}
+		if len(transfer.TodoIDs) > 0 {
+			err := tx.Model(&Todo{}).Where("id IN ?", []int64(transfer.TodoIDs)).
+				Updates(map[string]interface{}{"executor_id": req.ToSellerID, "updated_at": now}).Error
+			if err != nil {
+				return err
+			}
+			err = tx.Model(&Todo{}).Where("id IN ? AND reminder_user_id = ?", []int64(transfer.TodoIDs), req.FromSellerID).
+				Update("reminder_user_id", req.ToSellerID).Error
+			if err != nil {
+				return err
+			}
+			err = tx.Model(&Reminder{}).
+				Where("todo_id IN ? AND user_id = ? AND status = ? AND is_deleted = ?", []int64(transfer.TodoIDs), req.FromSellerID, ReminderStatusPending, false).
+				Pluck("id", &transfer.ReminderIDs).Error
+			if err != nil {
+				return err
+			}
+		}
+		if len(transfer.ReminderIDs) > 0 {
+			err := tx.Model(&Reminder{}).Where("id IN ?", []int64(transfer.ReminderIDs)).
+				Updates(map[string]interface{}{"user_id": req.ToSellerID, "updated_at": now}).Error
+			if err != nil {
+				return err
+			}
+		}
+		if err := tx.Create(&transfer).Error; err != nil {
+			return err
+		}
+
+		response.CustomerTransfer = transfer
+		response.FromSellerName = fromUser.Name
+		response.ToSellerName = toUser.Name
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// customerTransfersToResponse 转移记录附带销售员姓名
+func customerTransfersToResponse(transfers []CustomerTransfer) []*CustomerTransferResponse {
+	var userIDs []uint64
+	for _, transfer := range transfers {
+		userIDs = append(userIDs, transfer.FromSellerID, transfer.ToSellerID)
+	}
+	userNames := userNamesByID(userIDs)
+
+	responses := make([]*CustomerTransferResponse, len(transfers))
+	for i, transfer := range transfers {
+		responses[i] = &CustomerTransferResponse{
+			CustomerTransfer: transfer,
+			FromSellerName:   userNames[transfer.FromSellerID],
+			ToSellerName:     userNames[transfer.ToSellerID],
+		}
+	}
+	return responses
+}
+
+// getCustomerTransfers 分页获取客户转移记录，customerID 不为0时只返回包含该客户的记录，sellerID 不为0时只返回转出或转入该销售员的记录
+func getCustomerTransfers(customerID, sellerID uint64, page, pageSize int) ([]*CustomerTransferResponse, int64) {
+	var transfers []CustomerTransfer
+	var total int64
+
+	query := DB.Model(&CustomerTransfer{})
+	if customerID > 0 {
+		query = query.Where("? = ANY(customer_ids)", customerID)
+	}
+	if sellerID > 0 {
+		query = query.Where("from_seller_id = ? OR to_seller_id = ?", sellerID, sellerID)
+	}
+	query.Count(&total)
+	query.Order("created_at DESC, id DESC").Offset((page - 1) * pageSize).Limit(pageSize).Find(&transfers)
+	return customerTransfersToResponse(transfers), total
+}
+
+// getCustomerTransfer 获取单条客户转移记录
+func getCustomerTransfer(id uint64) (*CustomerTransferResponse, error) {
+	var transfer CustomerTransfer
+	if err := DB.First(&transfer, id).Error; err != nil {
+		return nil, err
+	}
+	return customerTransfersToResponse([]CustomerTransfer{transfer})[0], nil
+}
+
+// ========== 客户组相关业务函数 ==========
+
+// errGroupCreatorNotFound 创建客户组时未指定创建人或创建人不存在
+var errGroupCreatorNotFound = errors.New("创建人不存在")
+
+// groupMemberCounts 统计各客户组的成员数量（不含已删除客户）
+func groupMemberCounts(groupIDs []uint64) map[uint64]int64 {
+	counts := make(map[uint64]int64)
+	if len(groupIDs) == 0 {
+		return counts
+	}
+	var rows []struct {
+		GroupID uint64
+		Count   int64
+	}
+	DB.Raw(`SELECT g.group_id, COUNT(*) AS count
+		FROM customers, unnest(customers.group_id) AS g(group_id)
+		WHERE customers.is_deleted = false AND g.group_id IN ?
+		GROUP BY g.group_id`, groupIDs).Scan(&rows)
+	for _, row := range rows {
+		counts[row.GroupID] = row.Count
+	}
+	return counts
+}
+
+// groupsToResponse 客户组附带创建人姓名和成员数量
+func groupsToResponse(groups []Group) []*GroupResponse {
+	var groupIDs, userIDs []uint64
+	for _, group := range groups {
+		groupIDs = append(groupIDs, group.ID)
+		userIDs = append(userIDs, group.CreatedBy)
+	}
+	userNames := userNamesByID(userIDs)
+	counts := groupMemberCounts(groupIDs)
+
+	responses := make([]*GroupResponse, len(groups))
+	for i, group := range groups {
+		responses[i] = &GroupResponse{
+			ID:          group.ID,
+			Name:        group.Name,
+			Description: group.Description,
+			SortOrder:   group.SortOrder,
+			Roles:       group.Roles,
+			CreatedBy:   group.CreatedBy,
+			CreatorName: userNames[group.CreatedBy],
+			MemberCount: counts[group.ID],
+			CreatedAt:   group.CreatedAt,
+			UpdatedAt:   group.UpdatedAt,
+		}
+	}
+	return responses
+}
+
+// getGroups 分页获取客户组，按排序顺序和ID排列
+func getGroups(keyword string, page, pageSize int) ([]*GroupResponse, int64) {
+	var groups []Group
+	var total int64
+
+	query := DB.Model(&Group{}).Where("is_deleted = ?", false)
+	if keyword = strings.TrimSpace(keyword); keyword != "" {
+		query = query.Where("name ILIKE ?", "%"+keyword+"%")
+	}
+	query.Count(&total)
+	query.Order("sort_order ASC, id ASC").Offset((page - 1) * pageSize).Limit(pageSize).Find(&groups)
+	return groupsToResponse(groups), total
+}
+
+// findGroup 查找未删除的客户组
+func findGroup(tx *gorm.DB, id uint64) (*Group, error) {
+	var group Group
+	if err := tx.Where("is_deleted = ?", false).First(&group, id).Error; err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+// getGroup 获取客户组详情
+func getGroup(id uint64) (*GroupResponse, error) {
+	group, err := findGroup(DB, id)
+	if err != nil {
+		return nil, err
+	}
+	return groupsToResponse([]Group{*group})[0], nil
+}
+
+// createGroup 创建客户组，未指定创建人时使用操作人
+func createGroup(req GroupRequest, operatorID uint64) (*GroupResponse, error) {
+	createdBy := req.CreatedBy
+	if createdBy == 0 {
+		createdBy = operatorID
+	}
+	if createdBy == 0 {
+		return nil, errGroupCreatorNotFound
+	}
+	var creator User
+	if err := DB.Where("is_deleted = ?", false).First(&creator, createdBy).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errGroupCreatorNotFound
+		}
+		return nil, err
+	}
+
+	now := time.Now()
+	group := &Group{
+		Name:        strings.TrimSpace(req.Name),
+		Roles:       req.Roles,
+		Description: req.Description,
+		CreatedBy:   createdBy,
+		SortOrder:   req.SortOrder,
+		BaseModel:   BaseModel{CreatedAt: now, UpdatedAt: now},
+	}
+	if err := DB.Omit("Creator").Create(group).Error; err != nil {
+		return nil, err
+	}
+	return groupsToResponse([]Group{*group})[0], nil
+}
+
+// updateGroup 更新客户组名称、描述、排序和组成人员
+func updateGroup(id uint64, req GroupRequest) (*GroupResponse, error) {
+	group, err := findGroup(DB, id)
+	if err != nil {
+		return nil, err
+	}
+	group.Name = strings.TrimSpace(req.Name)
+	group.Description = req.Description
+	group.SortOrder = req.SortOrder
+	group.UpdatedAt = time.Now()
+	columns := []string{"name", "description", "sort_order", "updated_at"}
+	if req.Roles != nil {
+		group.Roles = req.Roles
+		columns = append(columns, "roles")
+	}
+	if err := DB.Model(group).Select(columns).Updates(group).Error; err != nil {
+		return nil, err
+	}
+	return groupsToResponse([]Group{*group})[0], nil
+}
+
+// saveCustomerGroupIDs 保存客户所属客户组并记录变更
+func saveCustomerGroupIDs(tx *gorm.DB, customer *Customer, before JSONB, now time.Time, operatorID uint64, remark string) error {
+	customer.UpdatedAt = now
+	customer.UpdatedBy = uint(operatorID)
+	if err := tx.Model(customer).Select("group_id", "updated_at", "updated_by").Updates(customer).Error; err != nil {
+		return err
+	}
+	return recordCustomerChange(tx, uint64(customer.ID), before, customerSnapshot(customer), ActionUpdate, CustomerChangeAPI, operatorID, remark)
+}
+
+// deleteGroup 软删除客户组，并将其从所有客户的所属客户组中移除
+func deleteGroup(id, operatorID uint64) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		group, err := findGroup(tx.Clauses(clause.Locking{Strength: "UPDATE"}), id)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if err := tx.Model(group).Updates(map[string]interface{}{"is_deleted": true, "deleted_at": now, "updated_at": now}).Error; err != nil {
+			return err
+		}
+
+		var customers []Customer
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("? = ANY(group_id)", id).Order("id ASC").Find(&customers).Error; err != nil {
+			return err
+		}
+		remark := fmt.Sprintf("客户组 %s 已删除", group.Name)
+		for i := range customers {
+			before := customerSnapshot(&customers[i])
+			customers[i].GroupID, _ = removeInt64Array(customers[i].GroupID, int64(id))
+			if err := saveCustomerGroupIDs(tx, &customers[i], before, now, operatorID, remark); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// changeGroupCustomers 将客户加入（add 为 true）或移出客户组，已在组内或不在组内的客户跳过
+func changeGroupCustomers(groupID uint64, req GroupCustomersRequest, add bool) (*GroupCustomersResult, error) {
+	result := &GroupCustomersResult{Changed: []uint64{}, Skipped: []uint64{}, NotFound: []uint64{}}
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		group, err := findGroup(tx, groupID)
+		if err != nil {
+			return err
+		}
+		ids := uniqueUint64s(req.CustomerIDs)
+		var customers []Customer
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id IN ? AND is_deleted = ?", ids, false).Find(&customers).Error; err != nil {
+			return err
+		}
+		byID := make(map[uint64]*Customer, len(customers))
+		for i := range customers {
+			byID[uint64(customers[i].ID)] = &customers[i]
+		}
+
+		remark := fmt.Sprintf("移出客户组 %s", group.Name)
+		if add {
+			remark = fmt.Sprintf("加入客户组 %s", group.Name)
+		}
+		now := time.Now()
+		for _, id := range ids {
+			customer, ok := byID[id]
+			if !ok {
+				result.NotFound = append(result.NotFound, id)
+				continue
+			}
+			before := customerSnapshot(customer)
+			var changed bool
+			if add {
+				customer.GroupID, changed = mergeInt64Array(customer.GroupID, int64(groupID))
+			} else {
+				customer.GroupID, changed = removeInt64Array(customer.GroupID, int64(groupID))
+			}
+			if !changed {
+				result.Skipped = append(result.Skipped, id)
+				continue
+			}
+			if err := saveCustomerGroupIDs(tx, customer, before, now, req.OperatorID, remark); err != nil {
+				return err
+			}
+			result.Changed = append(result.Changed, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// getGroupMembers 分页获取客户组成员及每个成员的订单、跟进数据，并汇总全部成员
+func getGroupMembers(groupID uint64, page, pageSize int) ([]*GroupMemberResponse, int64, *GroupMemberSummary, error) {
+	if _, err := findGroup(DB, groupID); err != nil {
+		return nil, 0, nil, err
+	}
+
+	memberQuery := func() *gorm.DB {
+		return DB.Model(&Customer{}).Where("? = ANY(group_id) AND is_deleted = ?", groupID, false)
+	}
+	var total int64
+	if err := memberQuery().Count(&total).Error; err != nil {
+		return nil, 0, nil, err
+	}
+	var customers []Customer
+	if err := memberQuery().Order("id ASC").Offset((page - 1) * pageSize).Limit(pageSize).Find(&customers).Error; err != nil {
+		return nil, 0, nil, err
+	}
+
+	type followUpStat struct {
+		CustomerID     uint64
+		FollowUpCount  int64
+		LastFollowUpAt *time.Time
+	}
+	stats := make(map[uint64]followUpStat)
+	amounts := make(map[uint64]float64)
+	if len(customers) > 0 {
+		ids := make([]uint64, len(customers))
+		for i, customer := range customers {
+			ids[i] = uint64(customer.ID)
+		}
+		var err error
+		if amounts, err = customerOrderAmounts(DB, ids); err != nil {
+			return nil, 0, nil, err
+		}
+		var rows []followUpStat
+		err = DB.Model(&FollowUpRecord{}).
+			Select("customer_id, COUNT(*) AS follow_up_count, MAX(created_at) AS last_follow_up_at").
+			Where("customer_id IN ? AND is_deleted = ?", ids, false).
+			Group("customer_id").Scan(&rows).Error
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		for _, row := range rows {
+			stats[row.CustomerID] = row
+		}
+	}
+
+	members := make([]*GroupMemberResponse, len(customers))
+	for i, customer := range customers {
+		stat := stats[uint64(customer.ID)]
+		members[i] = &GroupMemberResponse{
+			CustomerID:     uint64(customer.ID),
+			Name:           customer.Name,
+			ContactName:    customer.ContactName,
+			SallerName:     customer.SallerName,
+			Level:          customer.Level,
+			State:          customer.State,
+			OrderCount:     customer.OrderCount,
+			OrderAmount:    amounts[uint64(customer.ID)],
+			CreditSale:     customer.CreditSale,
+			LastOrderDate:  customer.LastOrderDate,
+			FollowUpCount:  stat.FollowUpCount,
+			LastFollowUpAt: stat.LastFollowUpAt,
+		}
+		if len(customer.Phones) > 0 {
+			members[i].Phone = customer.Phones[0]
+		}
+	}
+
+	summary := &GroupMemberSummary{}
+	err := memberQuery().Select(`COUNT(*) AS customer_count,
+		COALESCE(SUM(order_count), 0) AS order_count,
+		COALESCE(SUM(credit_sale), 0) AS credit_sale,
+		MAX(last_order_date) AS last_order_date`).Scan(summary).Error
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	err = countedOrders(DB).Select("COALESCE(ROUND(SUM(total_amount - refund_amount), 2), 0)").
+		Where("customer_id IN (?)", memberQuery().Select("id")).Scan(&summary.OrderAmount).Error
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	var followUps followUpStat
+	err = DB.Model(&FollowUpRecord{}).
+		Select("COUNT(*) AS follow_up_count, MAX(created_at) AS last_follow_up_at").
+		Where("is_deleted = ? AND customer_id IN (?)", false, memberQuery().Select("id")).
+		Scan(&followUps).Error
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	summary.FollowUpCount = followUps.FollowUpCount
+	summary.LastFollowUpAt = followUps.LastFollowUpAt
+	return members, total, summary, nil
+}
+
+// getCustomerGroups 获取客户所属的未删除客户组
+func getCustomerGroups(groupIDs pq.Int64Array) []GroupBrief {
+	groups := []GroupBrief{}
+	if len(groupIDs) == 0 {
+		return groups
+	}
+	DB.Model(&Group{}).Select("id", "name").
+		Where("id IN ? AND is_deleted = ?", []int64(groupIDs), false).
+		Order("sort_order ASC, id ASC").Scan(&groups)
+	return groups
+}
+
+// ========== 客户关系相关业务函数 ==========
+
+const (
+	customerGraphMaxDepth    = 5   // 关系图最大深度
+	customerGraphMaxNodes    = 500 // 关系图最多返回的客户数
+	customerReferralMaxDepth = 10  // 介绍链最多追溯的层数
+)
+
+// customerRelationSingleParent 每个客户只能有一条出边且不能成环的关系类型（只有一个总店、一个介绍人）
+var customerRelationSingleParent = map[CustomerRelationType]bool{
+	CustomerRelationBranchOf:   true,
+	CustomerRelationReferredBy: true,
+}
+
+// errCustomerRelationExists 客户之间已存在相同类型的关系
+var errCustomerRelationExists = errors.New("客户之间已存在该关系")
+
+// getCustomerRelationTypes 获取客户关系类型
+func getCustomerRelationTypes() []CustomerRelationTypeItem {
+	types := []CustomerRelationType{CustomerRelationBranchOf, CustomerRelationRelativeOf, CustomerRelationReferredBy, CustomerRelationSupplierTo}
+	items := make([]CustomerRelationTypeItem, len(types))
+	for i, t := range types {
+		items[i] = CustomerRelationTypeItem{Type: t, Name: CustomerRelationTypeNames[t], SingleParent: customerRelationSingleParent[t]}
+	}
+	return items
+}
+
+// parseCustomerRelationTypes 解析逗号分隔的关系类型，为空时返回 nil 表示全部类型
+func parseCustomerRelationTypes(value string) ([]CustomerRelationType, error) {
+	var types []CustomerRelationType
+	for _, item := range strings.Split(value, ",") {
+		t := CustomerRelationType(strings.TrimSpace(item))
+		if t == "" {
+			continue
+		}
+		if _, ok := CustomerRelationTypeNames[t]; !ok {
+			return nil, &ValidationError{Message: fmt.Sprintf("未知的关系类型: %s", t)}
+		}
+		types = append(types, t)
+	}
+	return types, nil
+}
+
+// customerRelationChain 沿单一出边类型向上追溯，返回依次经过的关系（由近到远），遇到环或超过层数时停止
+func customerRelationChain(tx *gorm.DB, customerID uint64, relationType CustomerRelationType, maxDepth int) ([]CustomerRelation, error) {
+	var chain []CustomerRelation
+	visited := []uint64{customerID}
+	current := customerID
+	for len(chain) < maxDepth {
+		var relations []CustomerRelation
+		err := tx.Where("from_customer_id = ? AND type = ?", current, relationType).
+			Order("id ASC").Limit(1).Find(&relations).Error
+		if err != nil {
+			return nil, err
+		}
+		if len(relations) == 0 || containsUint64(visited, relations[0].ToCustomerID) {
+			break
+		}
+		chain = append(chain, relations[0])
+		current = relations[0].ToCustomerID
+		visited = append(visited, current)
+	}
+	return chain, nil
+}
+
+// customerRelationsToResponse 关系附带类型名称和两端客户名称，customerID 不为0时标注相对方向
+func customerRelationsToResponse(relations []CustomerRelation, customerID uint64) []*CustomerRelationResponse {
+	var ids []uint64
+	for _, relation := range relations {
+		for _, id := range []uint64{relation.FromCustomerID, relation.ToCustomerID} {
+			if !containsUint64(ids, id) {
+				ids = append(ids, id)
+			}
+		}
+	}
+	names := make(map[uint64]string)
+	if len(ids) > 0 {
+		var customers []Customer
+		DB.Select("id", "name").Where("id IN ?", ids).Find(&customers)
+		for _, customer := range customers {
+			names[uint64(customer.ID)] = customer.Name
+		}
+	}
+
+	responses := make([]*CustomerRelationResponse, len(relations))
+	for i, relation := range relations {
+		responses[i] = &CustomerRelationResponse{
+			CustomerRelation: relation,
+			TypeName:         CustomerRelationTypeNames[relation.Type],
+			FromCustomerName: names[relation.FromCustomerID],
+			ToCustomerName:   names[relation.ToCustomerID],
+		}
+		switch customerID {
+		case relation.FromCustomerID:
+			responses[i].Direction = "out"
+		case relation.ToCustomerID:
+			responses[i].Direction = "in"
+		}
+	}
+	return responses
+}
+
+// createCustomerRelation 创建客户关系：两端客户必须存在，亲属关系不区分方向，分店和介绍关系每个客户只能有一个且不能成环
+func createCustomerRelation(fromID uint64, req CustomerRelationRequest) (*CustomerRelationResponse, error) {
+	if _, ok := CustomerRelationTypeNames[req.Type]; !ok {
+		return nil, &ValidationError{Message: fmt.Sprintf("未知的关系类型: %s", req.Type)}
+	}
+	if fromID == req.ToCustomerID {
+		return nil, &ValidationError{Message: "不能与自己建立关系"}
+	}
+
+	relation := CustomerRelation{
+		FromCustomerID: fromID,
+		ToCustomerID:   req.ToCustomerID,
+		Type:           req.Type,
+		Remark:         strings.TrimSpace(req.Remark),
+		CreatedBy:      req.OperatorID,
+		CreatedAt:      time.Now(),
+	}
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&Customer{}).Where("id IN ? AND is_deleted = ?", []uint64{fromID, req.ToCustomerID}, false).Count(&count).Error; err != nil {
+			return err
+		}
+		if count != 2 {
+			return gorm.ErrRecordNotFound
+		}
+
+		existing := tx.Model(&CustomerRelation{}).Where("type = ?", req.Type)
+		if req.Type == CustomerRelationRelativeOf {
+			existing = existing.Where("(from_customer_id = ? AND to_customer_id = ?) OR (from_customer_id = ? AND to_customer_id = ?)",
+				fromID, req.ToCustomerID, req.ToCustomerID, fromID)
+		} else {
+			existing = existing.Where("from_customer_id = ? AND to_customer_id = ?", fromID, req.ToCustomerID)
+		}
+		if err := existing.Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return errCustomerRelationExists
+		}
+
+		if customerRelationSingleParent[req.Type] {
+			if err := tx.Model(&CustomerRelation{}).Where("from_customer_id = ? AND type = ?", fromID, req.Type).Count(&count).Error; err != nil {
+				return err
+			}
+			if count > 0 {
+				return &ValidationError{Message: fmt.Sprintf("该客户已有%s关系，请先删除原关系", CustomerRelationTypeNames[req.Type])}
+			}
+			chain, err := customerRelationChain(tx, req.ToCustomerID, req.Type, customerReferralMaxDepth*10)
+			if err != nil {
+				return err
+			}
+			for _, parent := range chain {
+				if parent.ToCustomerID == fromID {
+					return &ValidationError{Message: fmt.Sprintf("%s关系不能成环", CustomerRelationTypeNames[req.Type])}
+				}
+			}
+		}
+		return tx.Create(&relation).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return customerRelationsToResponse([]CustomerRelation{relation}, fromID)[0], nil
+}
+
+// getCustomerRelations 获取客户的直接关系（出边和入边），relationType 为空时返回全部类型
+func getCustomerRelations(customerID uint64, relationType CustomerRelationType) []*CustomerRelationResponse {
+	var relations []CustomerRelation
+	query := DB.Where("from_customer_id = ? OR to_customer_id = ?", customerID, customerID)
+	if relationType != "" {
+		query = query.Where("type = ?", relationType)
+	}
+	query.Where("from_customer_id IN (?) AND to_customer_id IN (?)", activeCustomerIDs(), activeCustomerIDs()).
+		Order("created_at ASC, id ASC").Find(&relations)
+	return customerRelationsToResponse(relations, customerID)
+}
+
+// activeCustomerIDs 未删除客户ID子查询
+func activeCustomerIDs() *gorm.DB {
+	return DB.Model(&Customer{}).Select("id").Where("is_deleted = ?", false)
+}
+
+// deleteCustomerRelation 删除客户关系，关系必须与该客户相关
+func deleteCustomerRelation(customerID, relationID uint64) error {
+	result := DB.Where("id = ? AND (from_customer_id = ? OR to_customer_id = ?)", relationID, customerID, customerID).
+		Delete(&CustomerRelation{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// getCustomerRelationGraph 以客户为中心按广度优先展开关系图，已删除客户及其关系不出现在图中
+func getCustomerRelationGraph(customerID uint64, depth int, types []CustomerRelationType) (*CustomerGraphResponse, error) {
+	if depth < 1 {
+		depth = 1
+	}
+	if depth > customerGraphMaxDepth {
+		depth = customerGraphMaxDepth
+	}
+
+	var root Customer
+	if err := DB.Where("is_deleted = ?", false).First(&root, customerID).Error; err != nil {
+		return nil, err
+	}
+	graph := &CustomerGraphResponse{Root: customerID, Depth: depth, Nodes: []CustomerGraphNode{}, Edges: []CustomerGraphEdge{}}
+	addNode := func(customer *Customer, d int) {
+		graph.Nodes = append(graph.Nodes, CustomerGraphNode{
+			ID:         uint64(customer.ID),
+			Name:       customer.Name,
+			SallerName: customer.SallerName,
+			Level:      customer.Level,
+			State:      customer.State,
+			Depth:      d,
+		})
+	}
+	addNode(&root, 0)
+
+	visited := map[uint64]bool{customerID: true}
+	seenEdges := make(map[uint64]bool)
+	frontier := []uint64{customerID}
+	// 最后一层只补充已访问客户之间的边，不再展开新客户
+	for d := 0; d <= depth && len(frontier) > 0; d++ {
+		var relations []CustomerRelation
+		query := DB.Where("from_customer_id IN ? OR to_customer_id IN ?", frontier, frontier)
+		if len(types) > 0 {
+			query = query.Where("type IN ?", types)
+		}
+		if err := query.Order("id ASC").Find(&relations).Error; err != nil {
+			return nil, err
+		}
+
+		var candidates []uint64
+		for _, relation := range relations {
+			for _, id := range []uint64{relation.FromCustomerID, relation.ToCustomerID} {
+				if !visited[id] && !containsUint64(candidates, id) {
+					candidates = append(candidates, id)
+				}
+			}
+		}
+		var next []uint64
+		if d < depth && len(candidates) > 0 {
+			var customers []Customer
+			err := DB.Where("id IN ? AND is_deleted = ?", candidates, false).Order("id ASC").Find(&customers).Error
+			if err != nil {
+				return nil, err
+			}
+			for i := range customers {
+				if len(graph.Nodes) >= customerGraphMaxNodes {
+					graph.Truncated = true
+					break
+				}
+				id := uint64(customers[i].ID)
+				visited[id] = true
+				next = append(next, id)
+				addNode(&customers[i], d+1)
+			}
+		}
+
+		for _, relation := range relations {
+			if seenEdges[relation.ID] || !visited[relation.FromCustomerID] || !visited[relation.ToCustomerID] {
+				continue
+			}
+			seenEdges[relation.ID] = true
+			graph.Edges = append(graph.Edges, CustomerGraphEdge{
+				ID:       relation.ID,
+				From:     relation.FromCustomerID,
+				To:       relation.ToCustomerID,
+				Type:     relation.Type,
+				TypeName: CustomerRelationTypeNames[relation.Type],
+			})
+		}
+		frontier = next
+	}
+	return graph, nil
+}
+
+// getCustomerReferrals 获取客户的介绍链：向上追溯介绍人，向下列出直接和间接介绍的客户及其下单情况
+func getCustomerReferrals(customerID uint64, depth int) (*CustomerReferralResponse, error) {
+	if depth < 1 || depth > customerReferralMaxDepth {
+		depth = customerReferralMaxDepth
+	}
+	if err := DB.Where("is_deleted = ?", false).First(&Customer{}, customerID).Error; err != nil {
+		return nil, err
+	}
+	response := &CustomerReferralResponse{CustomerID: customerID, Referrers: []CustomerReferralNode{}, Referrals: []CustomerReferralNode{}}
+
+	chain, err := customerRelationChain(DB, customerID, CustomerRelationReferredBy, depth)
+	if err != nil {
+		return nil, err
+	}
+	referrers := make(map[uint64]*Customer)
+	amounts := make(map[uint64]float64)
+	if len(chain) > 0 {
+		ids := make([]uint64, len(chain))
+		for i, relation := range chain {
+			ids[i] = relation.ToCustomerID
+		}
+		var customers []Customer
+		if err := DB.Where("id IN ? AND is_deleted = ?", ids, false).Find(&customers).Error; err != nil {
+			return nil, err
+		}
+		if amounts, err = customerOrderAmounts(DB, ids); err != nil {
+			return nil, err
+		}
+		for i := range customers {
+			referrers[uint64(customers[i].ID)] = &customers[i]
+		}
+	}
+	// 介绍人已删除时链条在此中断
+	for i, relation := range chain {
+		referrer, ok := referrers[relation.ToCustomerID]
+		if !ok {
+			break
+		}
+		node := CustomerReferralNode{
+			CustomerID:    relation.ToCustomerID,
+			Name:          referrer.Name,
+			Level:         i + 1,
+			OrderCount:    referrer.OrderCount,
+			OrderAmount:   amounts[relation.ToCustomerID],
+			LastOrderDate: referrer.LastOrderDate,
+		}
+		if i+1 < len(chain) {
+			node.ReferrerID = chain[i+1].ToCustomerID
+			node.ReferredAt = &chain[i+1].CreatedAt
+		}
+		response.Referrers = append(response.Referrers, node)
+	}
+
+	var rows []struct {
+		CustomerID    uint64
+		ReferrerID    uint64
+		Level         int
+		ReferredAt    time.Time
+		Name          string
+		OrderCount    int
+		OrderAmount   float64
+		LastOrderDate *time.Time
+	}
+	err = DB.Raw(`WITH RECURSIVE tree AS (
+			SELECT from_customer_id AS customer_id, to_customer_id AS referrer_id, 1 AS level,
+				created_at AS referred_at, ARRAY[to_customer_id, from_customer_id] AS path
+			FROM customer_relations
+			WHERE type = @type AND to_customer_id = @id
+			UNION ALL
+			SELECT r.from_customer_id, r.to_customer_id, t.level + 1, r.created_at, t.path || r.from_customer_id
+			FROM customer_relations r JOIN tree t ON r.to_customer_id = t.customer_id
+			WHERE r.type = @type AND t.level < @depth AND NOT r.from_customer_id = ANY(t.path)
+		)
+		SELECT tree.customer_id, tree.referrer_id, tree.level, tree.referred_at,
+			c.name, c.order_count, `+customerOrderAmountSQL("c.id")+` AS order_amount, c.last_order_date
+		FROM tree JOIN customers c ON c.id = tree.customer_id AND c.is_deleted = false
+		ORDER BY tree.level ASC, tree.referred_at ASC, tree.customer_id ASC`,
+		map[string]interface{}{"type": CustomerRelationReferredBy, "id": customerID, "depth": depth}).Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	for i := range rows {
+		row := &rows[i]
+		node := CustomerReferralNode{
+			CustomerID:    row.CustomerID,
+			Name:          row.Name,
+			ReferrerID:    row.ReferrerID,
+			Level:         row.Level,
+			OrderCount:    row.OrderCount,
+			OrderAmount:   row.OrderAmount,
+			LastOrderDate: row.LastOrderDate,
+			ReferredAt:    &row.ReferredAt,
+		}
+		response.Referrals = append(response.Referrals, node)
+		addCustomerReferralNode(response, node)
+	}
+	return response, nil
+}
+
+// addCustomerReferralNode 将被介绍客户计入介绍链汇总
+func addCustomerReferralNode(response *CustomerReferralResponse, node CustomerReferralNode) {
+	if node.Level == 1 {
+		response.DirectCount++
+	}
+	response.TotalCount++
+	response.OrderCount += node.OrderCount
+	response.OrderAmount = math.Round((response.OrderAmount+node.OrderAmount)*100) / 100
+}
+
+// getCustomerReferralRanking 按直接介绍的客户数排行，用于给带来新客户的老客户记功
+func getCustomerReferralRanking(req CustomerReferralRankingRequest) ([]CustomerReferralRankItem, error) {
+	limit := req.Limit
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+	items := []CustomerReferralRankItem{}
+	query := DB.Table("customer_relations r").
+		Select(`r.to_customer_id AS customer_id, c.name, COUNT(*) AS direct_count,
+			COALESCE(SUM(rc.order_count), 0) AS order_count,
+			COALESCE(SUM(`+customerOrderAmountSQL("rc.id")+`), 0) AS order_amount`).
+		Joins("JOIN customers c ON c.id = r.to_customer_id AND c.is_deleted = false").
+		Joins("JOIN customers rc ON rc.id = r.from_customer_id AND rc.is_deleted = false").
+		Where("r.type = ?", CustomerRelationReferredBy)
+	if req.Since != nil {
+		query = query.Where("r.created_at >= ?", *req.Since)
+	}
+	err := query.Group("r.to_customer_id, c.name").
+		Order("direct_count DESC, order_amount DESC, r.to_customer_id ASC").
+		Limit(limit).Scan(&items).Error
+	return items, err
+}
+
+// ========== 订单相关业务函数 ==========
+
+// errOrderNoExists 销售单号重复
+var errOrderNoExists = errors.New("销售单号已存在")
+
+// documentNoRetries 自动生成的单号与并发创建的单号冲突时最多重新生成的次数
+const documentNoRetries = 5
+
+// generateOrderNo 生成销售单号：SO + 年月日时分秒 + 毫秒
+func generateOrderNo(now time.Time) string {
+	return fmt.Sprintf("SO%s%03d", now.Format("20060102150405"), now.Nanosecond()/int(time.Millisecond))
+}
+
+// isDuplicateKeyError 判断是否为唯一索引冲突
+func isDuplicateKeyError(err error) bool {
+	return errors.Is(err, gorm.ErrDuplicatedKey) || errors.Is(postgres.Dialector{}.Translate(err), gorm.ErrDuplicatedKey)
+}
+
+// createWithDocumentNo 在保存点中插入带单号的记录，唯一索引冲突不会中止外层事务；
+// 单号为自动生成时调用 regenerate 重新生成后重试，手工填写的单号冲突时返回 errExists
+func createWithDocumentNo(tx *gorm.DB, create func(tx *gorm.DB) error, generated bool, regenerate func(), errExists error) error {
+	for attempt := 0; ; attempt++ {
+		err := tx.Transaction(create)
+		if err == nil || !isDuplicateKeyError(err) {
+			return err
+		}
+		if !generated || attempt >= documentNoRetries {
+			return errExists
+		}
+		regenerate()
+	}
+}
+
+// buildOrderItems 按请求生成订单明细并汇总商品金额、折扣和订单金额
+// existing 为订单已有明细，请求中带 id 的明细更新对应的已有明细（保留已退货数量和金额），未出现在请求中的已有明细返回为待删除
+// 已有退货的明细不能删除，数量和销售金额不能少于已退货的部分
+func buildOrderItems(order *Order, items []OrderItemRequest, existing []OrderItem, now time.Time) ([]OrderItem, []uint64, error) {
+	byID := make(map[uint64]OrderItem, len(existing))
+	for _, item := range existing {
+		byID[item.ID] = item
+	}
+
+	result := make([]OrderItem, 0, len(items))
+	kept := make(map[uint64]bool)
+	order.ItemAmount, order.DiscountAmount = 0, 0
+	for i, req := range items {
+		item := OrderItem{OrderID: order.ID, CreatedAt: now}
+		if req.ID > 0 {
+			old, ok := byID[req.ID]
+			if !ok || kept[req.ID] {
+				return nil, nil, &ValidationError{Message: fmt.Sprintf("第%d条明细的 id %d 不属于该订单或重复", i+1, req.ID)}
+			}
+			kept[req.ID] = true
+			item.ID, item.CreatedAt = old.ID, old.CreatedAt
+			item.ReturnedQty, item.RefundedAmount = old.ReturnedQty, old.RefundedAmount
+		}
+		gross := roundMoney(req.Quantity * req.UnitPrice)
+		if req.Discount > gross {
+			return nil, nil, &ValidationError{Message: fmt.Sprintf("第%d条明细的折扣金额不能超过商品金额 %.2f", i+1, gross)}
+		}
+		if req.Quantity < item.ReturnedQty || gross-req.Discount < item.RefundedAmount {
+			return nil, nil, &ValidationError{Message: fmt.Sprintf("第%d条明细已退货 %g，已退款 %.2f，数量和金额不能少于已退部分", i+1, item.ReturnedQty, item.RefundedAmount)}
+		}
+		item.ProductCode = strings.TrimSpace(req.ProductCode)
+		item.ProductName = strings.TrimSpace(req.ProductName)
+		item.Unit = strings.TrimSpace(req.Unit)
+		item.Quantity = req.Quantity
+		item.UnitPrice = req.UnitPrice
+		item.Discount = req.Discount
+		item.Amount = roundMoney(gross - req.Discount)
+		item.SortOrder = i
+		item.UpdatedAt = now
+		result = append(result, item)
+
+		order.ItemAmount = roundMoney(order.ItemAmount + gross)
+		order.DiscountAmount = roundMoney(order.DiscountAmount + req.Discount)
+	}
+	order.TotalAmount = roundMoney(order.ItemAmount - order.DiscountAmount + order.ShippingFee)
+
+	var removed []uint64
+	for _, item := range existing {
+		if kept[item.ID] {
+			continue
+		}
+		if item.ReturnedQty > 0 {
+			return nil, nil, &ValidationError{Message: fmt.Sprintf("明细 %s 已有退货，不能删除", item.ProductName)}
+		}
+		removed = append(removed, item.ID)
+	}
+	return result, removed, nil
+}
+
+// applyOrderPayment 设置收款信息：未指定收款状态时按收款金额判断，标记为已收款且未填金额时按订单金额收款
+func applyOrderPayment(order *Order, req OrderRequest, now time.Time) error {
+	status := req.PaymentStatus
+	paid := roundMoney(req.PaidAmount)
+	switch status {
+	case "":
+		switch {
+		case paid <= 0:
+			status = OrderUnpaid
+		case paid >= order.TotalAmount:
+			status = OrderPaid
+		default:
+			status = OrderPartialPaid
+		}
+	case OrderUnpaid:
+		if paid > 0 {
+			return &ValidationError{Message: "未收款的订单收款金额应为0"}
+		}
+	case OrderPartialPaid:
+		if paid <= 0 || paid >= order.TotalAmount {
+			return &ValidationError{Message: "部分收款的收款金额应大于0且小于订单金额"}
+		}
+	case OrderPaid:
+		if paid == 0 {
+			paid = order.TotalAmount
+		}
+		if paid < order.TotalAmount {
+			return &ValidationError{Message: "已收款的收款金额应等于订单金额"}
+		}
+	default:
+		return &ValidationError{Message: fmt.Sprintf("收款状态只能为 %s、%s 或 %s", OrderUnpaid, OrderPartialPaid, OrderPaid)}
+	}
+	if paid > order.TotalAmount {
+		return &ValidationError{Message: fmt.Sprintf("收款金额不能超过订单金额 %.2f", order.TotalAmount)}
+	}
+
+	order.PaymentStatus = status
+	order.PaidAmount = paid
+	switch {
+	case paid == 0:
+		order.PaidAt = nil
+	case req.PaidAt != nil:
+		order.PaidAt = req.PaidAt
+	case order.PaidAt == nil:
+		order.PaidAt = &now
+	}
+	return nil
+}
+
+// refreshCustomerOrderStats 按未删除的订单重新计算客户的订单数量、平均订单金额和最后下单时间
+// 订单金额扣除退款后计算平均值，全部退款的订单不计入；这些字段由订单维护，不记入客户变更历史
+func refreshCustomerOrderStats(tx *gorm.DB, customerID uint64) error {
+	var stats struct {
+		OrderCount    int
+		AvgOrderValue *float64
+		LastOrderDate *time.Time
+	}
+	err := tx.Model(&Order{}).
+		Select("COUNT(*) AS order_count, ROUND(AVG(total_amount - refund_amount), 2) AS avg_order_value, MAX(order_date) AS last_order_date").
+		Where("customer_id = ? AND is_deleted = ? AND total_amount > refund_amount", customerID, false).
+		Scan(&stats).Error
+	if err != nil {
+		return err
+	}
+	return tx.Model(&Customer{}).Where("id = ?", customerID).UpdateColumns(map[string]interface{}{
+		"order_count":     stats.OrderCount,
+		"avg_order_value": stats.AvgOrderValue,
+		"last_order_date": stats.LastOrderDate,
+	}).Error
+}
+
+// countedOrders 计入客户订单统计的订单：未删除且未全部退款，与 refreshCustomerOrderStats 的统计范围一致
+func countedOrders(tx *gorm.DB) *gorm.DB {
+	return tx.Model(&Order{}).Where("is_deleted = ? AND total_amount > refund_amount", false)
+}
+
+// customerOrderAmountSQL 客户累计下单金额（订单金额扣除退款）的关联子查询，column 为外层的客户ID列
+func customerOrderAmountSQL(column string) string {
+	return `(SELECT COALESCE(ROUND(SUM(o.total_amount - o.refund_amount), 2), 0) FROM orders o
+		WHERE o.customer_id = ` + column + ` AND o.is_deleted = false AND o.total_amount > o.refund_amount)`
+}
+
+// customerOrderAmounts 按订单汇总客户累计下单金额（订单金额扣除退款），没有订单的客户不在结果中
+func customerOrderAmounts(tx *gorm.DB, customerIDs []uint64) (map[uint64]float64, error) {
+	var rows []struct {
+		CustomerID  uint64
+		OrderAmount float64
+	}
+	err := countedOrders(tx).Select("customer_id, ROUND(SUM(total_amount - refund_amount), 2) AS order_amount").
+		Where("customer_id IN ?", customerIDs).Group("customer_id").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	amounts := make(map[uint64]float64, len(rows))
+	for _, row := range rows {
+		amounts[row.CustomerID] = row.OrderAmount
+	}
+	return amounts, nil
+}
+
+// prepareOrder 校验客户、销售单号和销售员，并按请求写入订单字段
+func prepareOrder(tx *gorm.DB, order *Order, req OrderRequest, now time.Time) error {
+	if err := tx.Where("is_deleted = ?", false).First(&Customer{}, req.CustomerID).Error; err != nil {
+		return err
+	}
+
+	// 自动生成的单号不预先检查，插入冲突时由 createWithDocumentNo 重新生成
+	orderNo := strings.TrimSpace(req.OrderNo)
+	if orderNo == "" {
+		orderNo = order.OrderNo
+	}
+	if orderNo == "" {
+		orderNo = generateOrderNo(now)
+	} else {
+		var count int64
+		if err := tx.Model(&Order{}).Where("order_no = ? AND id <> ?", orderNo, order.ID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return errOrderNoExists
+		}
+	}
+
+	sellerName := strings.TrimSpace(req.SellerName)
+	if req.SellerID > 0 && sellerName == "" {
+		var seller User
+		if err := tx.Select("id", "name").First(&seller, req.SellerID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return &ValidationError{Message: "销售员不存在"}
+			}
+			return err
+		}
+		sellerName = seller.Name
+	}
+
+	order.OrderNo = orderNo
+	order.CustomerID = req.CustomerID
+	order.OrderDate = req.OrderDate
+	order.SellerID = req.SellerID
+	order.SellerName = sellerName
+	order.Warehouse = strings.TrimSpace(req.Warehouse)
+	order.ShippingFee = roundMoney(req.ShippingFee)
+	order.Remark = req.Remark
+	order.UpdatedBy = req.OperatorID
+	order.UpdatedAt = now
+	return nil
+}
+
+// createOrder 创建订单及明细，并更新客户的订单统计
+func createOrder(req OrderRequest) (*OrderResponse, error) {
+	now := time.Now()
+	order := &Order{CreatedBy: req.OperatorID, BaseModel: BaseModel{CreatedAt: now}}
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := prepareOrder(tx, order, req, now); err != nil {
+			return err
+		}
+		items, _, err := buildOrderItems(order, req.Items, nil, now)
+		if err != nil {
+			return err
+		}
+		if err := applyOrderPayment(order, req, now); err != nil {
+			return err
+		}
+		create := func(tx *gorm.DB) error { return tx.Omit("Items").Create(order).Error }
+		regenerate := func() { order.OrderNo = generateOrderNo(time.Now()) }
+		if err := createWithDocumentNo(tx, create, strings.TrimSpace(req.OrderNo) == "", regenerate, errOrderNoExists); err != nil {
+			return err
+		}
+		for i := range items {
+			items[i].OrderID = order.ID
+		}
+		if err := tx.Create(&items).Error; err != nil {
+			return err
+		}
+		return refreshCustomerOrderStats(tx, order.CustomerID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return getOrder(order.ID)
+}
+
+// updateOrder 更新订单及明细，客户变化时同时更新原客户和新客户的订单统计
+func updateOrder(id uint64, req OrderRequest) (*OrderResponse, error) {
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var order Order
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("is_deleted = ?", false).First(&order, id).Error; err != nil {
+			return err
+		}
+		var existing []OrderItem
+		if err := tx.Where("order_id = ?", id).Find(&existing).Error; err != nil {
+			return err
+		}
+
+		now := time.Now()
+		previousCustomerID := order.CustomerID
+		if err := prepareOrder(tx, &order, req, now); err != nil {
+			return err
+		}
+		items, removed, err := buildOrderItems(&order, req.Items, existing, now)
+		if err != nil {
+			return err
+		}
+		if err := applyOrderPayment(&order, req, now); err != nil {
+			return err
+		}
+		if err := tx.Omit("Items").Save(&order).Error; err != nil {
+			if isDuplicateKeyError(err) {
+				return errOrderNoExists
+			}
+			return err
+		}
+		if len(removed) > 0 {
+			if err := tx.Where("id IN ?", removed).Delete(&OrderItem{}).Error; err != nil {
+				return err
+			}
+		}
+		for i := range items {
+			if err := tx.Save(&items[i]).Error; err != nil {
+				return err
+			}
+		}
+
+		// 退货单的客户和销售员跟随订单
+		err = tx.Model(&OrderReturn{}).Where("order_id = ?", order.ID).
+			Updates(map[string]interface{}{"customer_id": order.CustomerID, "seller_id": order.SellerID}).Error
+		if err != nil {
+			return err
+		}
+
+		if err := refreshCustomerOrderStats(tx, order.CustomerID); err != nil {
+			return err
+		}
+		if previousCustomerID != order.CustomerID {
+			return refreshCustomerOrderStats(tx, previousCustomerID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return getOrder(id)
+}
+
+// deleteOrder 软删除订单，并更新客户的订单统计；有退货单的订单需先删除退货单
+func deleteOrder(id, operatorID uint64) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		var order Order
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("is_deleted = ?", false).First(&order, id).Error; err != nil {
+			return err
+		}
+		var returns int64
+		if err := tx.Model(&OrderReturn{}).Where("order_id = ? AND is_deleted = ?", id, false).Count(&returns).Error; err != nil {
+			return err
+		}
+		if returns > 0 {
+			return &ValidationError{Message: "订单有退货单，请先删除退货单"}
+		}
+		now := time.Now()
+		err := tx.Model(&order).Updates(map[string]interface{}{
+			"is_deleted": true, "deleted_at": now, "updated_at": now, "updated_by": operatorID,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return refreshCustomerOrderStats(tx, order.CustomerID)
+	})
+}
+
+// ordersToResponse 订单附带客户名称
+func ordersToResponse(orders []Order) []*OrderResponse {
+	var customerIDs []uint64
+	for _, order := range orders {
+		if !containsUint64(customerIDs, order.CustomerID) {
+			customerIDs = append(customerIDs, order.CustomerID)
+		}
+	}
+	names := make(map[uint64]string)
+	if len(customerIDs) > 0 {
+		var customers []Customer
+		DB.Select("id", "name").Where("id IN ?", customerIDs).Find(&customers)
+		for _, customer := range customers {
+			names[uint64(customer.ID)] = customer.Name
+		}
+	}
+
+	responses := make([]*OrderResponse, len(orders))
+	for i, order := range orders {
+		responses[i] = &OrderResponse{Order: order, CustomerName: names[order.CustomerID]}
+	}
+	return responses
+}
+
+// preloadOrderItems 按明细顺序加载订单明细
+func preloadOrderItems(db *gorm.DB) *gorm.DB {
+	return db.Order("sort_order ASC, id ASC")
+}
+
+// getOrder 获取订单详情
+func getOrder(id uint64) (*OrderResponse, error) {
+	var order Order
+	if err := DB.Preload("Items", preloadOrderItems).Where("is_deleted = ?", false).First(&order, id).Error; err != nil {
+		return nil, err
+	}
+	return ordersToResponse([]Order{order})[0], nil
+}
+
+// getOrders 分页获取订单，按销售单日期倒序
+func getOrders(query OrderQuery) ([]*OrderResponse, int64) {
+	if query.Page < 1 {
+		query.Page = 1
+	}
+	if query.PageSize < 1 || query.PageSize > 200 {
+		query.PageSize = 20
+	}
+
+	db := DB.Model(&Order{}).Where("is_deleted = ?", false)
+	if query.CustomerID > 0 {
+		db = db.Where("customer_id = ?", query.CustomerID)
+	}
+	if query.SellerID > 0 {
+		db = db.Where("seller_id = ?", query.SellerID)
+	}
+	if query.PaymentStatus != "" {
+		db = db.Where("payment_status = ?", query.PaymentStatus)
+	}
+	if query.Warehouse != "" {
+		db = db.Where("warehouse = ?", query.Warehouse)
+	}
+	if keyword := strings.TrimSpace(query.Keyword); keyword != "" {
+		like := "%" + escapeLike(keyword) + "%"
+		db = db.Where("order_no ILIKE ? OR id IN (?)", like,
+			DB.Model(&OrderItem{}).Select("order_id").Where("product_name ILIKE ?", like))
+	}
+	if query.StartDate != nil {
+		db = db.Where("order_date >= ?", *query.StartDate)
+	}
+	if query.EndDate != nil {
+		db = db.Where("order_date < ?", query.EndDate.AddDate(0, 0, 1))
+	}
+
+	var total int64
+	db.Count(&total)
+	var orders []Order
+	db.Preload("Items", preloadOrderItems).
+		Order("order_date DESC, id DESC").
+		Offset((query.Page - 1) * query.PageSize).Limit(query.PageSize).Find(&orders)
+	return ordersToResponse(orders), total
+}
+
+// ========== 退货相关业务函数 ==========
+
+// errReturnNoExists 退货单号重复
+var errReturnNoExists = errors.New("退货单号已存在")
+
+// generateReturnNo 生成退货单号：RT + 年月日时分秒 + 毫秒
+func generateReturnNo(now time.Time) string {
+	return fmt.Sprintf("RT%s%03d", now.Format("20060102150405"), now.Nanosecond()/int(time.Millisecond))
+}
+
+// buildOrderReturnItems 按请求生成退货明细：退货数量不能超过明细的剩余可退数量，退款金额不传时按明细销售金额折算，
+// 退完剩余数量时退还剩余金额，退款不能超过剩余可退金额；返回退货明细和退款合计
+func buildOrderReturnItems(orderItems map[uint64]*OrderItem, reqs []OrderReturnItemRequest, now time.Time) ([]OrderReturnItem, float64, error) {
+	items := make([]OrderReturnItem, 0, len(reqs))
+	seen := make(map[uint64]bool)
+	total := 0.0
+	for i, req := range reqs {
+		orderItem, ok := orderItems[req.OrderItemID]
+		if !ok || seen[req.OrderItemID] {
+			return nil, 0, &ValidationError{Message: fmt.Sprintf("第%d条退货明细的 order_item_id %d 不属于该订单或重复", i+1, req.OrderItemID)}
+		}
+		seen[req.OrderItemID] = true
+
+		remainingQty := orderItem.Quantity - orderItem.ReturnedQty
+		remainingAmount := roundMoney(orderItem.Amount - orderItem.RefundedAmount)
+		if req.Quantity > remainingQty+1e-9 {
+			return nil, 0, &ValidationError{Message: fmt.Sprintf("%s 最多还能退 %g", orderItem.ProductName, remainingQty)}
+		}
+		refund := remainingAmount
+		if req.RefundAmount != nil {
+			refund = roundMoney(*req.RefundAmount)
+		} else if req.Quantity < remainingQty-1e-9 {
+			refund = roundMoney(orderItem.Amount * req.Quantity / orderItem.Quantity)
+		}
+		if refund > remainingAmount {
+			return nil, 0, &ValidationError{Message: fmt.Sprintf("%s 最多还能退款 %.2f", orderItem.ProductName, remainingAmount)}
+		}
+
+		items = append(items, OrderReturnItem{
+			OrderItemID:  orderItem.ID,
+			ProductCode:  orderItem.ProductCode,
+			ProductName:  orderItem.ProductName,
+			Quantity:     req.Quantity,
+			RefundAmount: refund,
+			CreatedAt:    now,
+		})
+		total = roundMoney(total + refund)
+	}
+	return items, total, nil
+}
+
+// adjustOrderReturned 将退货数量和退款计入（sign 为 1）或移出（sign 为 -1）订单明细和订单
+func adjustOrderReturned(tx *gorm.DB, orderID uint64, items []OrderReturnItem, refund float64, sign float64) error {
+	for _, item := range items {
+		err := tx.Model(&OrderItem{}).Where("id = ?", item.OrderItemID).UpdateColumns(map[string]interface{}{
+			"returned_qty":    gorm.Expr("returned_qty + ?", sign*item.Quantity),
+			"refunded_amount": gorm.Expr("refunded_amount + ?", sign*item.RefundAmount),
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Model(&Order{}).Where("id = ?", orderID).
+		UpdateColumn("refund_amount", gorm.Expr("refund_amount + ?", sign*refund)).Error
+}
+
+// createOrderReturn 创建退货单，更新订单明细的已退数量和金额，并重新计算客户的订单统计
+func createOrderReturn(req OrderReturnRequest) (*OrderReturnResponse, error) {
+	now := time.Now()
+	orderReturn := &OrderReturn{
+		OrderID:    req.OrderID,
+		ReturnDate: req.ReturnDate,
+		Reason:     strings.TrimSpace(req.Reason),
+		Remark:     req.Remark,
+		CreatedBy:  req.OperatorID,
+		BaseModel:  BaseModel{CreatedAt: now, UpdatedAt: now},
+	}
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var order Order
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("is_deleted = ?", false).First(&order, req.OrderID).Error; err != nil {
+			return err
+		}
+		if req.ReturnDate.Before(order.OrderDate) {
+			return &ValidationError{Message: "退货单日期不能早于销售单日期"}
+		}
+		var orderItems []OrderItem
+		if err := tx.Where("order_id = ?", order.ID).Find(&orderItems).Error; err != nil {
+			return err
+		}
+		byID := make(map[uint64]*OrderItem, len(orderItems))
+		for i := range orderItems {
+			byID[orderItems[i].ID] = &orderItems[i]
+		}
+
+		// 自动生成的单号不预先检查，插入冲突时由 createWithDocumentNo 重新生成
+		returnNo := strings.TrimSpace(req.ReturnNo)
+		generated := returnNo == ""
+		if generated {
+			returnNo = generateReturnNo(now)
+		} else {
+			var count int64
+			if err := tx.Model(&OrderReturn{}).Where("return_no = ?", returnNo).Count(&count).Error; err != nil {
+				return err
+			}
+			if count > 0 {
+				return errReturnNoExists
+			}
+		}
+
+		items, refund, err := buildOrderReturnItems(byID, req.Items, now)
+		if err != nil {
+			return err
+		}
+		orderReturn.ReturnNo = returnNo
+		orderReturn.CustomerID = order.CustomerID
+		orderReturn.SellerID = order.SellerID
+		orderReturn.RefundAmount = refund
+		create := func(tx *gorm.DB) error { return tx.Omit("Items").Create(orderReturn).Error }
+		regenerate := func() { orderReturn.ReturnNo = generateReturnNo(time.Now()) }
+		if err := createWithDocumentNo(tx, create, generated, regenerate, errReturnNoExists); err != nil {
+			return err
+		}
+		for i := range items {
+			items[i].ReturnID = orderReturn.ID
+		}
+		if err := tx.Create(&items).Error; err != nil {
+			return err
+		}
+		if err := adjustOrderReturned(tx, order.ID, items, refund, 1); err != nil {
+			return err
+		}
+		return refreshCustomerOrderStats(tx, order.CustomerID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return getOrderReturn(orderReturn.ID)
+}
+
+// deleteOrderReturn 软删除退货单，退货数量和退款从订单中扣回
+func deleteOrderReturn(id, operatorID uint64) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		var orderReturn OrderReturn
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Preload("Items").
+			Where("is_deleted = ?", false).First(&orderReturn, id).Error; err != nil {
+			return err
+		}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&Order{}, orderReturn.OrderID).Error; err != nil {
+			return err
+		}
+		now := time.Now()
+		err := tx.Model(&orderReturn).Updates(map[string]interface{}{"is_deleted": true, "deleted_at": now, "updated_at": now}).Error
+		if err != nil {
+			return err
+		}
+		if err := adjustOrderReturned(tx, orderReturn.OrderID, orderReturn.Items, orderReturn.RefundAmount, -1); err != nil {
+			return err
+		}
+		return refreshCustomerOrderStats(tx, orderReturn.CustomerID)
+	})
+}
+
+// orderReturnsToResponse 退货单附带销售单号和客户名称
+func orderReturnsToResponse(returns []OrderReturn) []*OrderReturnResponse {
+	var orderIDs, customerIDs []uint64
+	for _, orderReturn := range returns {
+		if !containsUint64(orderIDs, orderReturn.OrderID) {
+			orderIDs = append(orderIDs, orderReturn.OrderID)
+		}
+		if !containsUint64(customerIDs, orderReturn.CustomerID) {
+			customerIDs = append(customerIDs, orderReturn.CustomerID)
+		}
+	}
+	orderNos := make(map[uint64]string)
+	if len(orderIDs) > 0 {
+		var orders []Order
+		DB.Select("id", "order_no").Where("id IN ?", orderIDs).Find(&orders)
+		for _, order := range orders {
+			orderNos[order.ID] = order.OrderNo
+		}
+	}
+	names := make(map[uint64]string)
+	if len(customerIDs) > 0 {
+		var customers []Customer
+		DB.Select("id", "name").Where("id IN ?", customerIDs).Find(&customers)
+		for _, customer := range customers {
+			names[uint64(customer.ID)] = customer.Name
+		}
+	}
+
+	responses := make([]*OrderReturnResponse, len(returns))
+	for i, orderReturn := range returns {
+		responses[i] = &OrderReturnResponse{
+			OrderReturn:  orderReturn,
+			OrderNo:      orderNos[orderReturn.OrderID],
+			CustomerName: names[orderReturn.CustomerID],
+		}
+	}
+	return responses
+}
+
+// getOrderReturn 获取退货单详情
+func getOrderReturn(id uint64) (*OrderReturnResponse, error) {
+	var orderReturn OrderReturn
+	if err := DB.Preload("Items").Where("is_deleted = ?", false).First(&orderReturn, id).Error; err != nil {
+		return nil, err
+	}
+	return orderReturnsToResponse([]OrderReturn{orderReturn})[0], nil
+}
+
+// getOrderReturns 分页获取退货单，按退货单日期倒序
+func getOrderReturns(query OrderReturnQuery) ([]*OrderReturnResponse, int64) {
+	if query.Page < 1 {
+		query.Page = 1
+	}
+	if query.PageSize < 1 || query.PageSize > 200 {
+		query.PageSize = 20
+	}
+
+	db := DB.Model(&OrderReturn{}).Where("is_deleted = ?", false)
+	if query.OrderID > 0 {
+		db = db.Where("order_id = ?", query.OrderID)
+	}
+	if query.CustomerID > 0 {
+		db = db.Where("customer_id = ?", query.CustomerID)
+	}
+	if query.SellerID > 0 {
+		db = db.Where("seller_id = ?", query.SellerID)
+	}
+	if query.StartDate != nil {
+		db = db.Where("return_date >= ?", *query.StartDate)
+	}
+	if query.EndDate != nil {
+		db = db.Where("return_date < ?", query.EndDate.AddDate(0, 0, 1))
+	}
+
+	var total int64
+	db.Count(&total)
+	var returns []OrderReturn
+	db.Preload("Items").Order("return_date DESC, id DESC").
+		Offset((query.Page - 1) * query.PageSize).Limit(query.PageSize).Find(&returns)
+	return orderReturnsToResponse(returns), total
+}
+
+// salesReportLimit 报表返回的最大行数
+func salesReportLimit(limit int) int {
+	if limit <= 0 {
+		return 50
+	}
+	if limit > 500 {
+		return 500
+	}
+	return limit
+}
+
+// returnRate 计算退货率（保留四位小数），分母为0时返回0
+func returnRate(returned, sold float64) float64 {
+	if sold <= 0 {
+		return 0
+	}
+	return math.Round(returned/sold*10000) / 10000
+}
+
+// applySalesReportOrderScope 按销售单日期和销售员筛选订单（表别名 o）
+func applySalesReportOrderScope(db *gorm.DB, query SalesReportQuery) *gorm.DB {
+	db = db.Where("o.is_deleted = ?", false)
+	if query.StartDate != nil {
+		db = db.Where("o.order_date >= ?", *query.StartDate)
+	}
+	if query.EndDate != nil {
+		db = db.Where("o.order_date < ?", query.EndDate.AddDate(0, 0, 1))
+	}
+	if query.SellerID > 0 {
+		db = db.Where("o.seller_id = ?", query.SellerID)
+	}
+	return db
+}
+
+// getCustomerReturnRates 客户退货率报表：统计期内下单的订单及其退货，只列出有退款的客户，按退款金额倒序
+func getCustomerReturnRates(query SalesReportQuery) ([]CustomerReturnRateItem, error) {
+	items := []CustomerReturnRateItem{}
+	db := DB.Table("orders o").
+		Select(`o.customer_id, c.name, COUNT(*) AS order_count,
+			COALESCE(SUM(o.total_amount), 0) AS sales_amount,
+			COALESCE(SUM(o.refund_amount), 0) AS refund_amount,
+			COALESCE(SUM(rc.return_count), 0) AS return_count`).
+		Joins("JOIN customers c ON c.id = o.customer_id AND c.is_deleted = false").
+		Joins("LEFT JOIN (SELECT order_id, COUNT(*) AS return_count FROM order_returns WHERE is_deleted = false GROUP BY order_id) rc ON rc.order_id = o.id")
+	err := applySalesReportOrderScope(db, query).
+		Group("o.customer_id, c.name").
+		Having("SUM(o.refund_amount) > 0").
+		Order("refund_amount DESC, o.customer_id ASC").
+		Limit(salesReportLimit(query.Limit)).Scan(&items).Error
+	for i := range items {
+		items[i].ReturnRate = returnRate(items[i].RefundAmount, items[i].SalesAmount)
+	}
+	return items, err
+}
+
+// getProductReturnRates 商品退货率报表：统计期内下单的订单明细按商品编码（无编码时按名称）汇总，按退货率倒序
+func getProductReturnRates(query SalesReportQuery) ([]ProductReturnRateItem, error) {
+	items := []ProductReturnRateItem{}
+	db := DB.Table("order_items i").
+		Select(`i.product_code, MAX(i.product_name) AS product_name,
+			SUM(i.quantity) AS sold_qty, SUM(i.returned_qty) AS returned_qty,
+			COALESCE(SUM(i.amount), 0) AS sales_amount, COALESCE(SUM(i.refunded_amount), 0) AS refund_amount`).
+		Joins("JOIN orders o ON o.id = i.order_id")
+	err := applySalesReportOrderScope(db, query).
+		Group("i.product_code, CASE WHEN i.product_code = '' THEN i.product_name ELSE '' END").
+		Having("SUM(i.returned_qty) > 0").
+		Order("SUM(i.returned_qty) / NULLIF(SUM(i.quantity), 0) DESC, returned_qty DESC").
+		Limit(salesReportLimit(query.Limit)).Scan(&items).Error
+	for i := range items {
+		items[i].ReturnRate = returnRate(items[i].ReturnedQty, items[i].SoldQty)
+	}
+	return items, err
+}
+
+// mergeSellerRevenue 合并按销售员汇总的销售额和退款，计算净销售额并按净销售额倒序
+func mergeSellerRevenue(sales, refunds []SellerRevenueItem) []SellerRevenueItem {
+	bySeller := make(map[uint64]*SellerRevenueItem)
+	var order []uint64
+	get := func(sellerID uint64) *SellerRevenueItem {
+		if item, ok := bySeller[sellerID]; ok {
+			return item
+		}
+		bySeller[sellerID] = &SellerRevenueItem{SellerID: sellerID}
+		order = append(order, sellerID)
+		return bySeller[sellerID]
+	}
+	for _, sale := range sales {
+		item := get(sale.SellerID)
+		item.SellerName = sale.SellerName
+		item.OrderCount = sale.OrderCount
+		item.SalesAmount = sale.SalesAmount
+	}
+	for _, refund := range refunds {
+		item := get(refund.SellerID)
+		if item.SellerName == "" {
+			item.SellerName = refund.SellerName
+		}
+		item.ReturnCount = refund.ReturnCount
+		item.RefundAmount = refund.RefundAmount
+	}
+
+	items := make([]SellerRevenueItem, len(order))
+	for i, sellerID := range order {
+		items[i] = *bySeller[sellerID]
+		items[i].NetRevenue = roundMoney(items[i].SalesAmount - items[i].RefundAmount)
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].NetRevenue > items[j].NetRevenue
+	})
+	return items
+}
+
+// getSellerRevenue 销售员业绩：统计期内下单的订单金额减去统计期内发生的退款
+func getSellerRevenue(query SalesReportQuery) ([]SellerRevenueItem, error) {
+	var sales []SellerRevenueItem
+	err := applySalesReportOrderScope(DB.Table("orders o"), query).
+		Select("o.seller_id, MAX(o.seller_name) AS seller_name, COUNT(*) AS order_count, COALESCE(SUM(o.total_amount), 0) AS sales_amount").
+		Group("o.seller_id").Scan(&sales).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var refunds []SellerRevenueItem
+	db := DB.Table("order_returns r").
+		Select("r.seller_id, MAX(o.seller_name) AS seller_name, COUNT(*) AS return_count, COALESCE(SUM(r.refund_amount), 0) AS refund_amount").
+		Joins("JOIN orders o ON o.id = r.order_id").
+		Where("r.is_deleted = ?", false)
+	if query.StartDate != nil {
+		db = db.Where("r.return_date >= ?", *query.StartDate)
+	}
+	if query.EndDate != nil {
+		db = db.Where("r.return_date < ?", query.EndDate.AddDate(0, 0, 1))
+	}
+	if query.SellerID > 0 {
+		db = db.Where("r.seller_id = ?", query.SellerID)
+	}
+	if err := db.Group("r.seller_id").Scan(&refunds).Error; err != nil {
+		return nil, err
+	}
+
+	items := mergeSellerRevenue(sales, refunds)
+	if limit := salesReportLimit(query.Limit); len(items) > limit {
+		items = items[:limit]
+	}
+	return items, nil
+}
+
+// ========== 商品目录相关业务函数 ==========
+
+// productCategoryMaxLevel 商品分类最多四级，对应导入文件的商品分类一至四
+const productCategoryMaxLevel = 4
+
+const (
+	productSearchLimit             = 20  // 商品搜索默认返回条数
+	productSearchCandidates        = 200 // 商品搜索参与打分的最大候选数
+	productSuggestionLimit         = 3   // 每个自由文本最多给出的候选商品数
+	productSuggestionMinSimilarity = 0.5 // 候选商品的最低相似度
+)
+
+// errProductExists 商品编码、名称或别名已被其他商品使用
+var errProductExists = errors.New("商品已存在")
+
+// errProductCategoryExists 同一上级分类下分类名称重复
+var errProductCategoryExists = errors.New("同级分类已存在")
+
+// productTextKey 商品编码、名称和别名的比较键：去掉首尾空白并忽略大小写
+func productTextKey(s string) string {
+	return strings.ToLower(strings.TrimSpace(s))
+}
+
+// loadProductCategories 加载全部商品分类并按 ID 索引（分类数量有限，直接在内存中组织）
+func loadProductCategories(tx *gorm.DB) (map[uint64]*ProductCategory, error) {
+	var categories []ProductCategory
+	if err := tx.Find(&categories).Error; err != nil {
+		return nil, err
+	}
+	result := make(map[uint64]*ProductCategory, len(categories))
+	for i := range categories {
+		result[categories[i].ID] = &categories[i]
+	}
+	return result, nil
+}
+
+// productCategoryPath 返回分类从一级到本级的名称
+func productCategoryPath(categories map[uint64]*ProductCategory, id uint64) []string {
+	path := []string{}
+	for depth := 0; id > 0 && depth < productCategoryMaxLevel; depth++ {
+		category, ok := categories[id]
+		if !ok {
+			break
+		}
+		path = append([]string{category.Name}, path...)
+		id = category.ParentID
+	}
+	return path
+}
+
+// productCategoryDescendants 返回分类及其全部下级分类的 ID
+func productCategoryDescendants(categories map[uint64]*ProductCategory, id uint64) []uint64 {
+	ids := []uint64{id}
+	for i := 0; i < len(ids); i++ {
+		for _, category := range categories {
+			if category.ParentID == ids[i] && !containsUint64(ids, category.ID) {
+				ids = append(ids, category.ID)
+			}
+		}
+	}
+	return ids
+}
+
+// buildProductCategoryTree 按上下级组织分类树，同级按排序顺序和 ID 排列
+// counts 为各分类直接挂载的商品数，节点的商品数包含全部下级分类；上级分类不存在的分类作为一级节点
+func buildProductCategoryTree(categories []ProductCategory, counts map[uint64]int64) []*ProductCategoryNode {
+	sort.SliceStable(categories, func(i, j int) bool {
+		if categories[i].SortOrder != categories[j].SortOrder {
+			return categories[i].SortOrder < categories[j].SortOrder
+		}
+		return categories[i].ID < categories[j].ID
+	})
+
+	nodes := make(map[uint64]*ProductCategoryNode, len(categories))
+	for _, category := range categories {
+		nodes[category.ID] = &ProductCategoryNode{
+			ProductCategory: category,
+			ProductCount:    counts[category.ID],
+			Children:        []*ProductCategoryNode{},
+		}
+	}
+	roots := []*ProductCategoryNode{}
+	for _, category := range categories {
+		node := nodes[category.ID]
+		if parent, ok := nodes[category.ParentID]; ok && category.ParentID != category.ID {
+			parent.Children = append(parent.Children, node)
+		} else {
+			roots = append(roots, node)
+		}
+	}
+
+	var sum func(node *ProductCategoryNode) int64
+	sum = func(node *ProductCategoryNode) int64 {
+		for _, child := range node.Children {
+			node.ProductCount += sum(child)
+		}
+		return node.ProductCount
+	}
+	for _, root := range roots {
+		sum(root)
+	}
+	return roots
+}
+
+// getProductCategoryTree 获取商品分类树及各分类的商品数
+func getProductCategoryTree() ([]*ProductCategoryNode, error) {
+	var categories []ProductCategory
+	if err := DB.Find(&categories).Error; err != nil {
+		return nil, err
+	}
+
+	var rows []struct {
+		CategoryID uint64
+		Count      int64
+	}
+	err := DB.Model(&Product{}).Select("category_id, COUNT(*) AS count").
+		Where("is_deleted = ? AND category_id > 0", false).
+		Group("category_id").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[uint64]int64, len(rows))
+	for _, row := range rows {
+		counts[row.CategoryID] = row.Count
+	}
+	return buildProductCategoryTree(categories, counts), nil
+}
+
+// checkProductCategoryName 检查同一上级分类下是否已有同名分类
+func checkProductCategoryName(tx *gorm.DB, parentID uint64, name string, excludeID uint64) error {
+	var count int64
+	err := tx.Model(&ProductCategory{}).
+		Where("parent_id = ? AND name = ? AND id <> ?", parentID, name, excludeID).
+		Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("%w：%s", errProductCategoryExists, name)
+	}
+	return nil
+}
+
+// createProductCategory 创建商品分类，层级为上级分类层级加一，最多四级
+func createProductCategory(req ProductCategoryRequest) (*ProductCategory, error) {
+	category := &ProductCategory{ParentID: req.ParentID, Level: 1, Name: strings.TrimSpace(req.Name), SortOrder: req.SortOrder}
+	if category.Name == "" {
+		return nil, &ValidationError{Message: "分类名称不能为空"}
+	}
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if req.ParentID > 0 {
+			var parent ProductCategory
+			if err := tx.First(&parent, req.ParentID).Error; err != nil {
+				return err
+			}
+			if parent.Level >= productCategoryMaxLevel {
+				return &ValidationError{Message: fmt.Sprintf("商品分类最多%d级", productCategoryMaxLevel)}
+			}
+			category.Level = parent.Level + 1
+		}
+		if err := checkProductCategoryName(tx, category.ParentID, category.Name, 0); err != nil {
+			return err
+		}
+		return tx.Create(category).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return category, nil
+}
+
+// updateProductCategory 修改商品分类的名称和排序，不支持调整上级分类
+func updateProductCategory(id uint64, req ProductCategoryRequest) (*ProductCategory, error) {
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		return nil, &ValidationError{Message: "分类名称不能为空"}
+	}
+	var category ProductCategory
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&category, id).Error; err != nil {
+			return err
+		}
+		if err := checkProductCategoryName(tx, category.ParentID, name, id); err != nil {
+			return err
+		}
+		category.Name = name
+		category.SortOrder = req.SortOrder
+		return tx.Select("name", "sort_order", "updated_at").Save(&category).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &category, nil
+}
+
+// deleteProductCategory 删除商品分类，有下级分类或商品的分类不能删除
+func deleteProductCategory(id uint64) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		var category ProductCategory
+		if err := tx.First(&category, id).Error; err != nil {
+			return err
+		}
+		var children int64
+		if err := tx.Model(&ProductCategory{}).Where("parent_id = ?", id).Count(&children).Error; err != nil {
+			return err
+		}
+		if children > 0 {
+			return &ValidationError{Message: "分类下还有下级分类，不能删除"}
+		}
+		var products int64
+		if err := tx.Model(&Product{}).Where("category_id = ? AND is_deleted = ?", id, false).Count(&products).Error; err != nil {
+			return err
+		}
+		if products > 0 {
+			return &ValidationError{Message: fmt.Sprintf("分类下还有 %d 个商品，不能删除", products)}
+		}
+		return tx.Delete(&category).Error
+	})
+}
+
+// ensureProductCategoryPath 按各级分类名称逐级查找分类，不存在的自动创建，返回末级分类 ID
+// 空名称的级别被跳过（导入文件常只填前几级），全部为空时返回 0
+func ensureProductCategoryPath(tx *gorm.DB, names []string) (uint64, error) {
+	var parentID uint64
+	level := 0
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		level++
+		if level > productCategoryMaxLevel {
+			return 0, &ValidationError{Message: fmt.Sprintf("商品分类最多%d级", productCategoryMaxLevel)}
+		}
+		category := ProductCategory{ParentID: parentID, Level: level, Name: name}
+		if err := tx.Where("parent_id = ? AND name = ?", parentID, name).FirstOrCreate(&category).Error; err != nil {
+			return 0, err
+		}
+		parentID = category.ID
+	}
+	return parentID, nil
+}
+
+// normalizeProductAliases 整理商品别名：去掉首尾空白、空值、重复值以及与商品名称相同的别名
+func normalizeProductAliases(name string, aliases []string) pq.StringArray {
+	seen := map[string]bool{productTextKey(name): true}
+	result := pq.StringArray{}
+	for _, alias := range aliases {
+		alias = strings.TrimSpace(alias)
+		key := productTextKey(alias)
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		result = append(result, alias)
+	}
+	return result
+}
+
+// findProductsByTexts 查找编码、名称或别名与文本一致（忽略大小写和首尾空白）的商品，按 productTextKey 索引
+// 同一文本对应多个商品时，名称一致优先于别名一致，别名一致优先于编码一致
+func findProductsByTexts(tx *gorm.DB, texts []string, excludeID uint64) (map[string]*Product, error) {
+	wanted := make(map[string]bool)
+	keys := []string{}
+	for _, text := range texts {
+		if key := productTextKey(text); key != "" && !wanted[key] {
+			wanted[key] = true
+			keys = append(keys, key)
+		}
+	}
+	result := make(map[string]*Product)
+	if len(keys) == 0 {
+		return result, nil
+	}
+
+	var products []Product
+	err := tx.Where("is_deleted = ? AND id <> ?", false, excludeID).
+		Where("lower(code) IN ? OR lower(name) IN ? OR EXISTS (SELECT 1 FROM unnest(aliases) AS alias WHERE lower(alias) IN ?)", keys, keys, keys).
+		Order("id ASC").Find(&products).Error
+	if err != nil {
+		return nil, err
+	}
+
+	assign := func(text string, product *Product) {
+		if key := productTextKey(text); wanted[key] {
+			result[key] = product
+		}
+	}
+	for i := range products {
+		assign(products[i].Code, &products[i])
+	}
+	for i := range products {
+		for _, alias := range products[i].Aliases {
+			assign(alias, &products[i])
+		}
+	}
+	for i := range products {
+		assign(products[i].Name, &products[i])
+	}
+	return result, nil
+}
+
+// canonicalizeProductNames 将能对应到商品的产品名称替换为商品名称，并去掉替换后重复的名称
+func canonicalizeProductNames(names []string, matched map[string]*Product) []string {
+	if names == nil {
+		return nil
+	}
+	result := make([]string, 0, len(names))
+	for _, name := range names {
+		if product, ok := matched[productTextKey(name)]; ok {
+			name = product.Name
+		}
+		if !containsString(result, name) {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+// canonicalProductNames 将客户产品名称统一为商品目录中的名称，查询失败时保留原名称
+func canonicalProductNames(tx *gorm.DB, names []string) []string {
+	if len(names) == 0 {
+		return names
+	}
+	matched, err := findProductsByTexts(tx, names, 0)
+	if err != nil {
+		return names
+	}
+	return canonicalizeProductNames(names, matched)
+}
+
+// isProductPreference 分类包含“产品”或“商品”的偏好视为产品偏好
+func isProductPreference(category string) bool {
+	return strings.Contains(category, "产品") || strings.Contains(category, "商品")
+}
+
+// linkPreferenceProduct 产品偏好的名称能对应到商品时，名称统一为商品名称并记录商品ID，对应不到时清除原有关联
+func linkPreferenceProduct(tx *gorm.DB, preference map[string]interface{}) {
+	if !isProductPreference(getStringFromMap(preference, "category")) {
+		delete(preference, "product_id")
+		return
+	}
+	name := getStringFromMap(preference, "name")
+	matched, err := findProductsByTexts(tx, []string{name}, 0)
+	if err != nil {
+		return
+	}
+	if product, ok := matched[productTextKey(name)]; ok {
+		preference["name"] = product.Name
+		preference["product_id"] = product.ID
+	} else {
+		delete(preference, "product_id")
+	}
+}
+
+// checkProductConflicts 检查商品编码以及名称、别名是否已被其他商品使用
+func checkProductConflicts(tx *gorm.DB, product *Product) error {
+	var count int64
+	err := tx.Model(&Product{}).
+		Where("is_deleted = ? AND id <> ? AND lower(code) = ?", false, product.ID, productTextKey(product.Code)).
+		Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("%w：编码 %s 已被使用", errProductExists, product.Code)
+	}
+
+	texts := append([]string{product.Name}, product.Aliases...)
+	matched, err := findProductsByTexts(tx, texts, product.ID)
+	if err != nil {
+		return err
+	}
+	for _, text := range texts {
+		if other, ok := matched[productTextKey(text)]; ok {
+			return fmt.Errorf("%w：%s 已对应商品「%s」（%s）", errProductExists, text, other.Name, other.Code)
+		}
+	}
+	return nil
+}
+
+// applyProductRequest 将请求写入商品，分类路径优先于分类ID
+func applyProductRequest(tx *gorm.DB, product *Product, req ProductRequest) error {
+	product.Code = strings.TrimSpace(req.Code)
+	product.Name = strings.TrimSpace(req.Name)
+	if product.Code == "" || product.Name == "" {
+		return &ValidationError{Message: "商品编码和名称不能为空"}
+	}
+	product.Aliases = normalizeProductAliases(product.Name, req.Aliases)
+	product.Unit = strings.TrimSpace(req.Unit)
+	product.UnitWeight = req.UnitWeight
+	product.PurchasePrice = req.PurchasePrice
+	product.ReferencePrice = req.ReferencePrice
+	product.Remark = req.Remark
+
+	switch {
+	case len(req.CategoryPath) > 0:
+		categoryID, err := ensureProductCategoryPath(tx, req.CategoryPath)
+		if err != nil {
+			return err
+		}
+		product.CategoryID = categoryID
+	case req.CategoryID > 0:
+		var category ProductCategory
+		if err := tx.First(&category, req.CategoryID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return &ValidationError{Message: "商品分类不存在"}
+			}
+			return err
+		}
+		product.CategoryID = req.CategoryID
+	default:
+		product.CategoryID = 0
+	}
+	return checkProductConflicts(tx, product)
+}
+
+// createProduct 创建商品
+func createProduct(req ProductRequest) (*ProductResponse, error) {
+	now := time.Now()
+	product := &Product{BaseModel: BaseModel{CreatedAt: now, UpdatedAt: now}}
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := applyProductRequest(tx, product, req); err != nil {
+			return err
+		}
+		return tx.Create(product).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return getProduct(product.ID)
+}
+
+// updateProduct 修改商品
+func updateProduct(id uint64, req ProductRequest) (*ProductResponse, error) {
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var product Product
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("is_deleted = ?", false).First(&product, id).Error; err != nil {
+			return err
+		}
+		if err := applyProductRequest(tx, &product, req); err != nil {
+			return err
+		}
+		product.UpdatedAt = time.Now()
+		return tx.Save(&product).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return getProduct(id)
+}
+
+// deleteProduct 软删除商品，编码可被新商品重新使用
+func deleteProduct(id uint64) error {
+	var product Product
+	if err := DB.Where("is_deleted = ?", false).First(&product, id).Error; err != nil {
+		return err
+	}
+	now := time.Now()
+	return DB.Model(&product).Updates(map[string]interface{}{"is_deleted": true, "deleted_at": now, "updated_at": now}).Error
+}
+
+// productsToResponse 商品附带分类路径
+func productsToResponse(products []Product) []*ProductResponse {
+	categories, _ := loadProductCategories(DB)
+	responses := make([]*ProductResponse, len(products))
+	for i, product := range products {
+		responses[i] = &ProductResponse{Product: product, CategoryPath: productCategoryPath(categories, product.CategoryID)}
+	}
+	return responses
+}
+
+// getProduct 获取商品详情
+func getProduct(id uint64) (*ProductResponse, error) {
+	var product Product
+	if err := DB.Where("is_deleted = ?", false).First(&product, id).Error; err != nil {
+		return nil, err
+	}
+	return productsToResponse([]Product{product})[0], nil
+}
+
+// getProducts 分页获取商品，按分类筛选时包含下级分类
+func getProducts(query ProductQuery) ([]*ProductResponse, int64, error) {
+	if query.Page < 1 {
+		query.Page = 1
+	}
+	if query.PageSize < 1 || query.PageSize > 200 {
+		query.PageSize = 20
+	}
+
+	db := DB.Model(&Product{}).Where("is_deleted = ?", false)
+	if keyword := strings.TrimSpace(query.Keyword); keyword != "" {
+		like := "%" + escapeLike(keyword) + "%"
+		db = db.Where("code ILIKE ? OR name ILIKE ? OR EXISTS (SELECT 1 FROM unnest(aliases) AS alias WHERE alias ILIKE ?)", like, like, like)
+	}
+	if query.CategoryID > 0 {
+		categories, err := loadProductCategories(DB)
+		if err != nil {
+			return nil, 0, err
+		}
+		db = db.Where("category_id IN ?", productCategoryDescendants(categories, query.CategoryID))
+	}
+
+	var total int64
+	if err := db.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var products []Product
+	err := db.Order("code ASC, id ASC").Offset((query.Page - 1) * query.PageSize).Limit(query.PageSize).Find(&products).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return productsToResponse(products), total, nil
+}
+
+// productMatchScore 计算商品与搜索词的匹配分数及匹配方式（code/name/alias），不匹配时分数为 0
+// 编码一致 100，名称一致 90，别名一致 80，名称包含搜索词 60，别名包含搜索词 50，搜索词包含名称 40，搜索词包含别名 30，编码包含搜索词 20
+func productMatchScore(product *Product, keyword string) (int, string) {
+	key := normalizeText(keyword)
+	if key == "" {
+		return 0, ""
+	}
+	if productTextKey(product.Code) == productTextKey(keyword) {
+		return 100, "code"
+	}
+
+	name := normalizeText(product.Name)
+	aliases := make([]string, 0, len(product.Aliases))
+	for _, alias := range product.Aliases {
+		if alias = normalizeText(alias); alias != "" {
+			aliases = append(aliases, alias)
+		}
+	}
+
+	if name == key {
+		return 90, "name"
+	}
+	for _, alias := range aliases {
+		if alias == key {
+			return 80, "alias"
+		}
+	}
+	if strings.Contains(name, key) {
+		return 60, "name"
+	}
+	for _, alias := range aliases {
+		if strings.Contains(alias, key) {
+			return 50, "alias"
+		}
+	}
+	if name != "" && strings.Contains(key, name) {
+		return 40, "name"
+	}
+	for _, alias := range aliases {
+		if strings.Contains(key, alias) {
+			return 30, "alias"
+		}
+	}
+	if strings.Contains(productTextKey(product.Code), productTextKey(keyword)) {
+		return 20, "code"
+	}
+	return 0, ""
+}
+
+// searchProducts 按编码、名称和别名搜索商品，按匹配分数排序；搜索词包含商品名称（如“信阳毛尖”包含“毛尖”）时也会命中
+func searchProducts(keyword string, limit int) ([]ProductSearchResult, error) {
+	keyword = strings.TrimSpace(keyword)
+	if keyword == "" {
+		return []ProductSearchResult{}, nil
+	}
+	if limit < 1 || limit > 100 {
+		limit = productSearchLimit
+	}
+
+	like := "%" + escapeLike(keyword) + "%"
+	var products []Product
+	err := DB.Where("is_deleted = ?", false).
+		Where("code ILIKE ? OR name ILIKE ? OR strpos(lower(?), lower(name)) > 0 OR EXISTS (SELECT 1 FROM unnest(aliases) AS alias WHERE alias ILIKE ? OR strpos(lower(?), lower(alias)) > 0)",
+			like, like, keyword, like, keyword).
+		Limit(productSearchCandidates).Find(&products).Error
+	if err != nil {
+		return nil, err
+	}
+
+	responses := productsToResponse(products)
+	results := make([]ProductSearchResult, 0, len(responses))
+	for _, response := range responses {
+		if score, matchedBy := productMatchScore(&response.Product, keyword); score > 0 {
+			results = append(results, ProductSearchResult{ProductResponse: response, Score: score, MatchedBy: matchedBy})
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		if len([]rune(results[i].Name)) != len([]rune(results[j].Name)) {
+			return len([]rune(results[i].Name)) < len([]rune(results[j].Name))
+		}
+		return results[i].ID < results[j].ID
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// productSuggestions 按名称和别名的文本相似度为自由文本推荐商品，相似度从高到低
+func productSuggestions(text string, products []Product, limit int) []ProductSuggestion {
+	suggestions := []ProductSuggestion{}
+	for _, product := range products {
+		best := textSimilarity(text, product.Name)
+		for _, alias := range product.Aliases {
+			if similarity := textSimilarity(text, alias); similarity > best {
+				best = similarity
+			}
+		}
+		if best >= productSuggestionMinSimilarity {
+			suggestions = append(suggestions, ProductSuggestion{ID: product.ID, Code: product.Code, Name: product.Name, Similarity: math.Round(best*100) / 100})
+		}
+	}
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		if suggestions[i].Similarity != suggestions[j].Similarity {
+			return suggestions[i].Similarity > suggestions[j].Similarity
+		}
+		return suggestions[i].ID < suggestions[j].ID
+	})
+	if len(suggestions) > limit {
+		suggestions = suggestions[:limit]
+	}
+	return suggestions
+}
+
+// productPreferenceNames 返回客户偏好中产品偏好的名称（去重）
+func productPreferenceNames(favors JSONB) []string {
+	var names []string
+	for _, favor := range favors {
+		preference, ok := favor.(map[string]interface{})
+		if !ok || !isProductPreference(getStringFromMap(preference, "category")) {
+			continue
+		}
+		if name := strings.TrimSpace(getStringFromMap(preference, "name")); name != "" && !containsString(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// collectProductTexts 统计客户产品字段和产品偏好名称中的自由文本及涉及的客户数
+func collectProductTexts() ([]ProductTextItem, error) {
+	var rows []struct {
+		Text          string
+		CustomerCount int64
+	}
+	err := DB.Table("customers, unnest(customers.products) AS product").
+		Select("product AS text, COUNT(DISTINCT customers.id) AS customer_count").
+		Where("customers.is_deleted = ? AND product <> ''", false).
+		Group("product").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	items := make([]ProductTextItem, 0, len(rows))
+	for _, row := range rows {
+		items = append(items, ProductTextItem{Text: row.Text, Source: "products", CustomerCount: row.CustomerCount})
+	}
+
+	// 偏好存放在 JSONB 中，逐个客户解析
+	var customers []Customer
+	if err := DB.Select("id", "favors").Where("is_deleted = ? AND favors IS NOT NULL", false).Find(&customers).Error; err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int64)
+	var names []string
+	for _, customer := range customers {
+		for _, name := range productPreferenceNames(customer.Favors) {
+			if counts[name] == 0 {
+				names = append(names, name)
+			}
+			counts[name]++
+		}
+	}
+	for _, name := range names {
+		items = append(items, ProductTextItem{Text: name, Source: "preferences", CustomerCount: counts[name]})
+	}
+	return items, nil
+}
+
+// getUnmappedProductTexts 获取尚未统一为商品名称的客户产品和产品偏好文本，按涉及客户数倒序
+// 编码、名称或别名一致的给出对应商品，可直接自动映射；其余按相似度给出候选商品
+func getUnmappedProductTexts() ([]ProductTextItem, error) {
+	items, err := collectProductTexts()
+	if err != nil {
+		return nil, err
+	}
+	texts := make([]string, len(items))
+	for i, item := range items {
+		texts[i] = item.Text
+	}
+	matched, err := findProductsByTexts(DB, texts, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var products []Product
+	if err := DB.Select("id", "code", "name", "aliases").Where("is_deleted = ?", false).Find(&products).Error; err != nil {
+		return nil, err
+	}
+
+	result := make([]ProductTextItem, 0, len(items))
+	for _, item := range items {
+		product, ok := matched[productTextKey(item.Text)]
+		if ok && product.Name == item.Text {
+			continue
+		}
+		if ok {
+			item.Product = &ProductSuggestion{ID: product.ID, Code: product.Code, Name: product.Name, Similarity: 1}
+			item.Suggestions = []ProductSuggestion{}
+		} else {
+			item.Suggestions = productSuggestions(item.Text, products, productSuggestionLimit)
+		}
+		result = append(result, item)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].CustomerCount != result[j].CustomerCount {
+			return result[i].CustomerCount > result[j].CustomerCount
+		}
+		return result[i].Text < result[j].Text
+	})
+	return result, nil
+}
+
+// replaceProductText 将产品列表中与文本一致的名称替换为商品名称并去重，返回是否有变化
+func replaceProductText(products pq.StringArray, text, productName string) (pq.StringArray, bool) {
+	key := productTextKey(text)
+	result := pq.StringArray{}
+	changed := false
+	for _, name := range products {
+		if productTextKey(name) == key && name != productName {
+			name = productName
+			changed = true
+		}
+		if containsString(result, name) {
+			changed = true
+			continue
+		}
+		result = append(result, name)
+	}
+	return result, changed
+}
+
+// linkProductPreferences 将名称与文本一致的产品偏好关联到商品，返回被修改的偏好数
+func linkProductPreferences(favors JSONB, text string, product *Product, now time.Time) int {
+	key := productTextKey(text)
+	linked := 0
+	for _, favor := range favors {
+		preference, ok := favor.(map[string]interface{})
+		if !ok || !isProductPreference(getStringFromMap(preference, "category")) ||
+			productTextKey(getStringFromMap(preference, "name")) != key {
+			continue
+		}
+		if getStringFromMap(preference, "name") == product.Name && getUint64FromMap(preference, "product_id") == product.ID {
+			continue
+		}
+		preference["name"] = product.Name
+		preference["product_id"] = product.ID
+		preference["updated_at"] = now
+		linked++
+	}
+	return linked
+}
+
+// applyProductMapping 将自由文本映射到商品：文本默认加入商品别名，客户产品中的该文本改为商品名称，同名产品偏好关联到商品
+func applyProductMapping(req ProductMappingRequest) (*ProductMappingResult, error) {
+	text := strings.TrimSpace(req.Text)
+	if text == "" {
+		return nil, &ValidationError{Message: "映射文本不能为空"}
+	}
+	addAlias := req.AddAlias == nil || *req.AddAlias
+	result := &ProductMappingResult{Text: text, ProductID: req.ProductID}
+
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var product Product
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("is_deleted = ?", false).First(&product, req.ProductID).Error; err != nil {
+			return err
+		}
+		result.ProductName = product.Name
+		now := time.Now()
+
+		key := productTextKey(text)
+		known := key == productTextKey(product.Name) || key == productTextKey(product.Code)
+		for _, alias := range product.Aliases {
+			known = known || key == productTextKey(alias)
+		}
+		if !known {
+			matched, err := findProductsByTexts(tx, []string{text}, product.ID)
+			if err != nil {
+				return err
+			}
+			if other, ok := matched[key]; ok {
+				return fmt.Errorf("%w：%s 已对应商品「%s」（%s）", errProductExists, text, other.Name, other.Code)
+			}
+			if addAlias {
+				product.Aliases = append(product.Aliases, text)
+				if err := tx.Model(&product).Updates(map[string]interface{}{"aliases": product.Aliases, "updated_at": now}).Error; err != nil {
+					return err
+				}
+				result.AliasAdded = true
+			}
+		}
+
+		var customers []Customer
+		err := tx.Where("is_deleted = ?", false).
+			Where("EXISTS (SELECT 1 FROM unnest(products) AS product WHERE lower(product) = ?) OR (favors IS NOT NULL AND favors::text ILIKE ?)",
+				key, "%"+escapeLike(text)+"%").
+			Find(&customers).Error
+		if err != nil {
+			return err
+		}
+		remark := fmt.Sprintf("商品映射：%s → %s", text, product.Name)
+		for i := range customers {
+			customer := &customers[i]
+			before := customerSnapshot(customer)
+			var columns []string
+			var changed bool
+			if customer.Products, changed = replaceProductText(customer.Products, text, product.Name); changed {
+				columns = append(columns, "products")
+				result.Customers++
+			}
+			if linked := linkProductPreferences(customer.Favors, text, &product, now); linked > 0 {
+				columns = append(columns, "favors")
+				result.Preferences += linked
+			}
+			if len(columns) == 0 {
+				continue
+			}
+			customer.UpdatedAt = now
+			customer.UpdatedBy = uint(req.OperatorID)
+			if err := tx.Model(customer).Select(append(columns, "updated_at", "updated_by")).Updates(customer).Error; err != nil {
+				return err
+			}
+			if err := recordCustomerChange(tx, uint64(customer.ID), before, customerSnapshot(customer), ActionUpdate, CustomerChangeAPI, req.OperatorID, remark); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// autoMapProductTexts 将编码、名称或别名与商品一致的自由文本全部映射到对应商品
+func autoMapProductTexts(operatorID uint64) ([]*ProductMappingResult, error) {
+	items, err := getUnmappedProductTexts()
+	if err != nil {
+		return nil, err
+	}
+	addAlias := false
+	results := []*ProductMappingResult{}
+	mapped := make(map[string]bool)
+	for _, item := range items {
+		if item.Product == nil || mapped[item.Text] {
+			continue
+		}
+		mapped[item.Text] = true
+		result, err := applyProductMapping(ProductMappingRequest{Text: item.Text, ProductID: item.Product.ID, AddAlias: &addAlias, OperatorID: operatorID})
+		if err != nil {
+			return results, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// importCatalogProduct 将导入行中的商品登记到商品目录，返回目录中的商品名称作为客户产品
+// 登记在单独的保存点中进行，失败时回滚登记的改动且不影响客户导入，此时保留原商品名称
+func importCatalogProduct(tx *gorm.DB, row CustomerImportRow) string {
+	name := strings.TrimSpace(row.ProductName)
+	catalogName := name
+	err := tx.Transaction(func(sp *gorm.DB) error {
+		var err error
+		catalogName, err = registerImportProduct(sp, row)
+		return err
+	})
+	if err != nil {
+		return name
+	}
+	return catalogName
+}
+
+// registerImportProduct 按编码查找商品，找不到时按名称或别名查找，仍找不到则按导入行新建；导入行的商品名称与目录不同时加入别名
+// 分类层级超出限制时新建的商品不设分类，数据库错误直接返回
+func registerImportProduct(tx *gorm.DB, row CustomerImportRow) (string, error) {
+	name := strings.TrimSpace(row.ProductName)
+	code := strings.TrimSpace(row.ProductCode)
+	if name == "" {
+		return name, nil
+	}
+
+	var product Product
+	if code != "" {
+		err := tx.Where("code = ? AND is_deleted = ?", code, false).First(&product).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return name, err
+		}
+	}
+	if product.ID > 0 {
+		if productTextKey(name) == productTextKey(product.Name) {
+			return product.Name, nil
+		}
+		aliases := normalizeProductAliases(product.Name, append(append([]string{}, product.Aliases...), name))
+		if len(aliases) > len(product.Aliases) {
+			matched, err := findProductsByTexts(tx, []string{name}, product.ID)
+			if err != nil {
+				return name, err
+			}
+			if matched[productTextKey(name)] == nil {
+				if err := tx.Model(&product).Updates(map[string]interface{}{"aliases": aliases, "updated_at": time.Now()}).Error; err != nil {
+					return name, err
+				}
+			}
+		}
+		return product.Name, nil
+	}
+
+	matched, err := findProductsByTexts(tx, []string{name}, 0)
+	if err != nil {
+		return name, err
+	}
+	if existing, ok := matched[productTextKey(name)]; ok {
+		return existing.Name, nil
+	}
+	if code == "" {
+		return name, nil
+	}
+
+	// 别名已属于其他商品时不再加入
+	aliases := normalizeProductAliases(name, splitMultiValue(row.ProductAliases))
+	taken, err := findProductsByTexts(tx, aliases, 0)
+	if err != nil {
+		return name, err
+	}
+	kept := pq.StringArray{}
+	for _, alias := range aliases {
+		if taken[productTextKey(alias)] == nil {
+			kept = append(kept, alias)
+		}
+	}
+	now := time.Now()
+	product = Product{Code: code, Name: name, Aliases: kept, Unit: row.ProductUnit, BaseModel: BaseModel{CreatedAt: now, UpdatedAt: now}}
+	if weight, err := strconv.ParseFloat(row.ProductUnitWeight, 64); err == nil && weight >= 0 {
+		product.UnitWeight = &weight
+	}
+	if price, err := strconv.ParseFloat(row.ProductPurchasePrice, 64); err == nil && price >= 0 {
+		product.PurchasePrice = &price
+	}
+	// 分类路径也在保存点中创建，层级超出限制时不留下部分创建的分类
+	err = tx.Transaction(func(sp *gorm.DB) error {
+		categoryID, err := ensureProductCategoryPath(sp, row.ProductCategories)
+		product.CategoryID = categoryID
+		return err
+	})
+	var validationErr *ValidationError
+	if err != nil && !errors.As(err, &validationErr) {
+		return name, err
+	}
+	if err := tx.Create(&product).Error; err != nil {
+		return name, err
 	}
+	return product.Name, nil
 }
@@ -2,46 +2,75 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
-	"strings"
+	"net/url"
+	"os"
 	"testing"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
-	"gorm.io/driver/sqlite"
+	"github.com/xuri/excelize/v2"
+	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
-// 测试数据库设置
-func setupTestDB() *gorm.DB {
-	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+// 测试数据库设置：模型使用 PostgreSQL 的数组和 JSONB 类型，需要通过 CRM_TEST_DSN 指定测试库，未指定时跳过
+func setupTestDB(t *testing.T) {
+	dsn := os.Getenv("CRM_TEST_DSN")
+	if dsn == "" {
+		t.Skip("未设置 CRM_TEST_DSN，跳过需要 PostgreSQL 的测试")
+	}
+	// 测试只迁移用到的表，不创建指向未迁移表的外键
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{DisableForeignKeyConstraintWhenMigrating: true})
 	if err != nil {
-		panic("failed to connect database")
+		t.Fatalf("failed to connect database: %v", err)
 	}
 
 	// 自动迁移
-	db.AutoMigrate(&Customer{})
+	if err := db.AutoMigrate(&Customer{}, &CustomerChangeLog{}, &CustomerStateChange{}, &Product{}); err != nil {
+		t.Fatalf("failed to migrate database: %v", err)
+	}
 
-	return db
+	originalDB := DB
+	DB = db
+	t.Cleanup(func() { DB = originalDB })
 }
 
-// 创建测试客户
-func createTestCustomer(db *gorm.DB) *Customer {
+// 创建测试客户，测试结束后删除
+func createTestCustomer(t *testing.T, favors JSONB) *Customer {
 	customer := &Customer{
-		BaseModel: BaseModel{ID: 1},
 		Name:      "测试客户",
-		Phone:     "13800138000",
-		Email:     "test@example.com",
-		Favors:    JSONB{},
+		Phones:    pq.StringArray{"13800138000"},
+		Favors:    favors,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
 	}
-	db.Create(customer)
+	if err := DB.Create(customer).Error; err != nil {
+		t.Fatalf("failed to create customer: %v", err)
+	}
+	t.Cleanup(func() {
+		DB.Where("customer_id = ?", customer.ID).Delete(&CustomerChangeLog{})
+		DB.Delete(&Customer{}, customer.ID)
+	})
 	return customer
 }
 
+// 测试偏好数据
+func testPreferences() JSONB {
+	now := time.Now().Format(time.RFC3339)
+	return JSONB{
+		"pref_1": map[string]interface{}{"category": "产品偏好", "name": "高端产品", "value": "喜欢高端产品", "created_at": now, "updated_at": now},
+		"pref_2": map[string]interface{}{"category": "服务偏好", "name": "上门服务", "value": "偏好上门服务", "created_at": now, "updated_at": now},
+	}
+}
+
 // 设置测试路由
 func setupTestRouter() *gin.Engine {
 	gin.SetMode(gin.TestMode)
@@ -50,66 +79,65 @@ func setupTestRouter() *gin.Engine {
 	return router
 }
 
+// 不存在的客户ID
+const missingCustomerID = 999999999
+
+// 执行请求并解析 data 字段
+func performRequest(router *gin.Engine, method, path string, body interface{}, data interface{}) *httptest.ResponseRecorder {
+	var reader *bytes.Reader
+	switch b := body.(type) {
+	case nil:
+		reader = bytes.NewReader(nil)
+	case string:
+		reader = bytes.NewReader([]byte(b))
+	default:
+		encoded, _ := json.Marshal(b)
+		reader = bytes.NewReader(encoded)
+	}
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	if data != nil {
+		json.Unmarshal(w.Body.Bytes(), &struct {
+			Data interface{} `json:"data"`
+		}{Data: data})
+	}
+	return w
+}
+
 // TestGetCustomerPreferences 测试获取客户偏好列表
 func TestGetCustomerPreferences(t *testing.T) {
 	// 设置测试数据库
-	originalDB := db
-	db = setupTestDB()
-	defer func() { db = originalDB }()
+	setupTestDB(t)
 
-	// 创建测试客户
-	customer := createTestCustomer(db)
-
-	// 添加测试偏好数据
-	preferences := []map[string]interface{}{
-		{
-			"id":          "pref_1",
-			"type":        "product",
-			"content":     "喜欢高端产品",
-			"created_at":  time.Now().Format(time.RFC3339),
-		},
-		{
-			"id":          "pref_2",
-			"type":        "service",
-			"content":     "偏好上门服务",
-			"created_at":  time.Now().Format(time.RFC3339),
-		},
-	}
-	preferencesJSON, _ := json.Marshal(preferences)
-	customer.Favors = JSONB(preferencesJSON)
-	db.Save(customer)
+	// 创建带偏好的测试客户
+	customer := createTestCustomer(t, testPreferences())
 
 	// 设置路由
 	router := setupTestRouter()
 
 	t.Run("成功获取偏好列表", func(t *testing.T) {
-		w := httptest.NewRecorder()
-		req, _ := http.NewRequest("GET", "/api/v1/customers/1/preferences", nil)
-		router.ServeHTTP(w, req)
+		var response CustomerPreferenceListResponse
+		w := performRequest(router, "GET", fmt.Sprintf("/api/v1/customers/%d/preferences", customer.ID), nil, &response)
 
 		assert.Equal(t, http.StatusOK, w.Code)
-
-		var response CustomerPreferenceListResponse
-		err := json.Unmarshal(w.Body.Bytes(), &response)
-		assert.NoError(t, err)
 		assert.Equal(t, 2, len(response.Preferences))
-		assert.Equal(t, "pref_1", response.Preferences[0].ID)
-		assert.Equal(t, "product", response.Preferences[0].Type)
+		byID := make(map[string]CustomerPreferenceItem)
+		for _, item := range response.Preferences {
+			byID[item.ID] = item
+		}
+		assert.Equal(t, "产品偏好", byID["pref_1"].Category)
+		assert.Equal(t, "偏好上门服务", byID["pref_2"].Value)
 	})
 
 	t.Run("客户不存在", func(t *testing.T) {
-		w := httptest.NewRecorder()
-		req, _ := http.NewRequest("GET", "/api/v1/customers/999/preferences", nil)
-		router.ServeHTTP(w, req)
-
+		w := performRequest(router, "GET", fmt.Sprintf("/api/v1/customers/%d/preferences", missingCustomerID), nil, nil)
 		assert.Equal(t, http.StatusNotFound, w.Code)
 	})
 
 	t.Run("无效的客户ID", func(t *testing.T) {
-		w := httptest.NewRecorder()
-		req, _ := http.NewRequest("GET", "/api/v1/customers/invalid/preferences", nil)
-		router.ServeHTTP(w, req)
-
+		w := performRequest(router, "GET", "/api/v1/customers/invalid/preferences", nil, nil)
 		assert.Equal(t, http.StatusBadRequest, w.Code)
 	})
 }
@@ -117,82 +145,49 @@ func TestGetCustomerPreferences(t *testing.T) {
 // TestCreateCustomerPreference 测试创建客户偏好
 func TestCreateCustomerPreference(t *testing.T) {
 	// 设置测试数据库
-	originalDB := db
-	db = setupTestDB()
-	defer func() { db = originalDB }()
+	setupTestDB(t)
 
 	// 创建测试客户
-	customer := createTestCustomer(db)
+	customer := createTestCustomer(t, nil)
 
 	// 设置路由
 	router := setupTestRouter()
+	path := fmt.Sprintf("/api/v1/customers/%d/preferences", customer.ID)
 
 	t.Run("成功创建偏好", func(t *testing.T) {
-		request := CustomerPreferenceCreateRequest{
-			Type:    "product",
-			Content: "喜欢智能家居产品",
-		}
-		requestJSON, _ := json.Marshal(request)
-
-		w := httptest.NewRecorder()
-		req, _ := http.NewRequest("POST", "/api/v1/customers/1/preferences", bytes.NewBuffer(requestJSON))
-		req.Header.Set("Content-Type", "application/json")
-		router.ServeHTTP(w, req)
-
-		assert.Equal(t, http.StatusCreated, w.Code)
-
+		request := CustomerPreferenceCreateRequest{Category: "产品偏好", Name: "智能家居", Value: "喜欢智能家居产品"}
 		var response CustomerPreferenceResponse
-		err := json.Unmarshal(w.Body.Bytes(), &response)
-		assert.NoError(t, err)
-		assert.NotEmpty(t, response.Preference.ID)
-		assert.Equal(t, "product", response.Preference.Type)
-		assert.Equal(t, "喜欢智能家居产品", response.Preference.Content)
-		assert.NotEmpty(t, response.Preference.CreatedAt)
+		w := performRequest(router, "POST", path, request, &response)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NotEmpty(t, response.ID)
+		assert.Equal(t, "产品偏好", response.Category)
+		assert.Equal(t, "喜欢智能家居产品", response.Value)
+		assert.False(t, response.CreatedAt.IsZero())
 
 		// 验证数据库中的数据
 		var updatedCustomer Customer
-		db.First(&updatedCustomer, customer.ID)
-		var preferences []map[string]interface{}
-		json.Unmarshal([]byte(updatedCustomer.Favors), &preferences)
-		assert.Equal(t, 1, len(preferences))
+		DB.First(&updatedCustomer, customer.ID)
+		assert.Equal(t, 1, len(updatedCustomer.Favors))
 	})
 
 	t.Run("缺少必填字段", func(t *testing.T) {
 		request := CustomerPreferenceCreateRequest{
-			Type: "product",
-			// Content 缺失
+			Category: "产品偏好",
+			// Name 和 Value 缺失
 		}
-		requestJSON, _ := json.Marshal(request)
-
-		w := httptest.NewRecorder()
-		req, _ := http.NewRequest("POST", "/api/v1/customers/1/preferences", bytes.NewBuffer(requestJSON))
-		req.Header.Set("Content-Type", "application/json")
-		router.ServeHTTP(w, req)
-
+		w := performRequest(router, "POST", path, request, nil)
 		assert.Equal(t, http.StatusBadRequest, w.Code)
 	})
 
 	t.Run("客户不存在", func(t *testing.T) {
-		request := CustomerPreferenceCreateRequest{
-			Type:    "product",
-			Content: "喜欢智能家居产品",
-		}
-		requestJSON, _ := json.Marshal(request)
-
-		w := httptest.NewRecorder()
-		req, _ := http.NewRequest("POST", "/api/v1/customers/999/preferences", bytes.NewBuffer(requestJSON))
-		req.Header.Set("Content-Type", "application/json")
-		router.ServeHTTP(w, req)
-
+		request := CustomerPreferenceCreateRequest{Category: "产品偏好", Name: "智能家居", Value: "喜欢智能家居产品"}
+		w := performRequest(router, "POST", fmt.Sprintf("/api/v1/customers/%d/preferences", missingCustomerID), request, nil)
 		assert.Equal(t, http.StatusNotFound, w.Code)
 	})
 
 	t.Run("无效的JSON格式", func(t *testing.T) {
-		w := httptest.NewRecorder()
-		req, _ := http.NewRequest("POST", "/api/v1/customers/1/preferences", strings.NewReader("invalid json"))
-		req.Header.Set("Content-Type", "application/json")
-		router.ServeHTTP(w, req)
-
+		w := performRequest(router, "POST", path, "invalid json", nil)
 		assert.Equal(t, http.StatusBadRequest, w.Code)
 	})
 }
@@ -200,78 +195,34 @@ func TestCreateCustomerPreference(t *testing.T) {
 // TestUpdateCustomerPreference 测试更新客户偏好
 func TestUpdateCustomerPreference(t *testing.T) {
 	// 设置测试数据库
-	originalDB := db
-	db = setupTestDB()
-	defer func() { db = originalDB }()
+	setupTestDB(t)
 
-	// 创建测试客户
-	customer := createTestCustomer(db)
-
-	// 添加测试偏好数据
-	preferences := []map[string]interface{}{
-		{
-			"id":          "pref_1",
-			"type":        "product",
-			"content":     "喜欢高端产品",
-			"created_at":  time.Now().Format(time.RFC3339),
-		},
-	}
-	preferencesJSON, _ := json.Marshal(preferences)
-	customer.Favors = JSONB(preferencesJSON)
-	db.Save(customer)
+	// 创建带偏好的测试客户
+	customer := createTestCustomer(t, testPreferences())
 
 	// 设置路由
 	router := setupTestRouter()
 
-	t.Run("成功更新偏好", func(t *testing.T) {
-		request := CustomerPreferenceUpdateRequest{
-			Type:    "product",
-			Content: "更喜欢超高端产品",
-		}
-		requestJSON, _ := json.Marshal(request)
+	value := "更喜欢超高端产品"
+	request := map[string]interface{}{"value": value}
 
-		w := httptest.NewRecorder()
-		req, _ := http.NewRequest("PUT", "/api/v1/customers/1/preferences/pref_1", bytes.NewBuffer(requestJSON))
-		req.Header.Set("Content-Type", "application/json")
-		router.ServeHTTP(w, req)
+	t.Run("成功更新偏好", func(t *testing.T) {
+		var response CustomerPreferenceResponse
+		w := performRequest(router, "PUT", fmt.Sprintf("/api/v1/customers/%d/preferences/pref_1", customer.ID), request, &response)
 
 		assert.Equal(t, http.StatusOK, w.Code)
-
-		var response CustomerPreferenceResponse
-		err := json.Unmarshal(w.Body.Bytes(), &response)
-		assert.NoError(t, err)
-		assert.Equal(t, "pref_1", response.Preference.ID)
-		assert.Equal(t, "product", response.Preference.Type)
-		assert.Equal(t, "更喜欢超高端产品", response.Preference.Content)
+		assert.Equal(t, "pref_1", response.ID)
+		assert.Equal(t, "产品偏好", response.Category)
+		assert.Equal(t, value, response.Value)
 	})
 
 	t.Run("偏好不存在", func(t *testing.T) {
-		request := CustomerPreferenceUpdateRequest{
-			Type:    "product",
-			Content: "更喜欢超高端产品",
-		}
-		requestJSON, _ := json.Marshal(request)
-
-		w := httptest.NewRecorder()
-		req, _ := http.NewRequest("PUT", "/api/v1/customers/1/preferences/nonexistent", bytes.NewBuffer(requestJSON))
-		req.Header.Set("Content-Type", "application/json")
-		router.ServeHTTP(w, req)
-
+		w := performRequest(router, "PUT", fmt.Sprintf("/api/v1/customers/%d/preferences/nonexistent", customer.ID), request, nil)
 		assert.Equal(t, http.StatusNotFound, w.Code)
 	})
 
 	t.Run("客户不存在", func(t *testing.T) {
-		request := CustomerPreferenceUpdateRequest{
-			Type:    "product",
-			Content: "更喜欢超高端产品",
-		}
-		requestJSON, _ := json.Marshal(request)
-
-		w := httptest.NewRecorder()
-		req, _ := http.NewRequest("PUT", "/api/v1/customers/999/preferences/pref_1", bytes.NewBuffer(requestJSON))
-		req.Header.Set("Content-Type", "application/json")
-		router.ServeHTTP(w, req)
-
+		w := performRequest(router, "PUT", fmt.Sprintf("/api/v1/customers/%d/preferences/pref_1", missingCustomerID), request, nil)
 		assert.Equal(t, http.StatusNotFound, w.Code)
 	})
 }
@@ -279,64 +230,32 @@ func TestUpdateCustomerPreference(t *testing.T) {
 // TestDeleteCustomerPreference 测试删除客户偏好
 func TestDeleteCustomerPreference(t *testing.T) {
 	// 设置测试数据库
-	originalDB := db
-	db = setupTestDB()
-	defer func() { db = originalDB }()
-
-	// 创建测试客户
-	customer := createTestCustomer(db)
+	setupTestDB(t)
 
-	// 添加测试偏好数据
-	preferences := []map[string]interface{}{
-		{
-			"id":          "pref_1",
-			"type":        "product",
-			"content":     "喜欢高端产品",
-			"created_at":  time.Now().Format(time.RFC3339),
-		},
-		{
-			"id":          "pref_2",
-			"type":        "service",
-			"content":     "偏好上门服务",
-			"created_at":  time.Now().Format(time.RFC3339),
-		},
-	}
-	preferencesJSON, _ := json.Marshal(preferences)
-	customer.Favors = JSONB(preferencesJSON)
-	db.Save(customer)
+	// 创建带偏好的测试客户
+	customer := createTestCustomer(t, testPreferences())
 
 	// 设置路由
 	router := setupTestRouter()
 
 	t.Run("成功删除偏好", func(t *testing.T) {
-		w := httptest.NewRecorder()
-		req, _ := http.NewRequest("DELETE", "/api/v1/customers/1/preferences/pref_1", nil)
-		router.ServeHTTP(w, req)
-
+		w := performRequest(router, "DELETE", fmt.Sprintf("/api/v1/customers/%d/preferences/pref_1", customer.ID), nil, nil)
 		assert.Equal(t, http.StatusOK, w.Code)
 
 		// 验证数据库中的数据
 		var updatedCustomer Customer
-		db.First(&updatedCustomer, customer.ID)
-		var remainingPreferences []map[string]interface{}
-		json.Unmarshal([]byte(updatedCustomer.Favors), &remainingPreferences)
-		assert.Equal(t, 1, len(remainingPreferences))
-		assert.Equal(t, "pref_2", remainingPreferences[0]["id"])
+		DB.First(&updatedCustomer, customer.ID)
+		assert.Equal(t, 1, len(updatedCustomer.Favors))
+		assert.NotNil(t, updatedCustomer.Favors["pref_2"])
 	})
 
 	t.Run("偏好不存在", func(t *testing.T) {
-		w := httptest.NewRecorder()
-		req, _ := http.NewRequest("DELETE", "/api/v1/customers/1/preferences/nonexistent", nil)
-		router.ServeHTTP(w, req)
-
+		w := performRequest(router, "DELETE", fmt.Sprintf("/api/v1/customers/%d/preferences/nonexistent", customer.ID), nil, nil)
 		assert.Equal(t, http.StatusNotFound, w.Code)
 	})
 
 	t.Run("客户不存在", func(t *testing.T) {
-		w := httptest.NewRecorder()
-		req, _ := http.NewRequest("DELETE", "/api/v1/customers/999/preferences/pref_1", nil)
-		router.ServeHTTP(w, req)
-
+		w := performRequest(router, "DELETE", fmt.Sprintf("/api/v1/customers/%d/preferences/pref_1", missingCustomerID), nil, nil)
 		assert.Equal(t, http.StatusNotFound, w.Code)
 	})
 }
@@ -344,98 +263,2016 @@ func TestDeleteCustomerPreference(t *testing.T) {
 // TestPreferenceIntegration 集成测试：完整的偏好管理流程
 func TestPreferenceIntegration(t *testing.T) {
 	// 设置测试数据库
-	originalDB := db
-	db = setupTestDB()
-	defer func() { db = originalDB }()
+	setupTestDB(t)
 
 	// 创建测试客户
-	customer := createTestCustomer(db)
+	customer := createTestCustomer(t, nil)
 
 	// 设置路由
 	router := setupTestRouter()
+	path := fmt.Sprintf("/api/v1/customers/%d/preferences", customer.ID)
 
 	t.Run("完整的偏好管理流程", func(t *testing.T) {
 		// 1. 初始状态：获取空的偏好列表
-		w := httptest.NewRecorder()
-		req, _ := http.NewRequest("GET", "/api/v1/customers/1/preferences", nil)
-		router.ServeHTTP(w, req)
-		assert.Equal(t, http.StatusOK, w.Code)
-
 		var listResponse CustomerPreferenceListResponse
-		json.Unmarshal(w.Body.Bytes(), &listResponse)
+		w := performRequest(router, "GET", path, nil, &listResponse)
+		assert.Equal(t, http.StatusOK, w.Code)
 		assert.Equal(t, 0, len(listResponse.Preferences))
 
 		// 2. 创建第一个偏好
-		createRequest1 := CustomerPreferenceCreateRequest{
-			Type:    "product",
-			Content: "喜欢智能手机",
-		}
-		createJSON1, _ := json.Marshal(createRequest1)
-
-		w = httptest.NewRecorder()
-		req, _ = http.NewRequest("POST", "/api/v1/customers/1/preferences", bytes.NewBuffer(createJSON1))
-		req.Header.Set("Content-Type", "application/json")
-		router.ServeHTTP(w, req)
-		assert.Equal(t, http.StatusCreated, w.Code)
-
 		var createResponse1 CustomerPreferenceResponse
-		json.Unmarshal(w.Body.Bytes(), &createResponse1)
-		preferenceID1 := createResponse1.Preference.ID
+		w = performRequest(router, "POST", path, CustomerPreferenceCreateRequest{Category: "产品偏好", Name: "手机", Value: "喜欢智能手机"}, &createResponse1)
+		assert.Equal(t, http.StatusOK, w.Code)
+		preferenceID1 := createResponse1.ID
 
 		// 3. 创建第二个偏好
-		createRequest2 := CustomerPreferenceCreateRequest{
-			Type:    "service",
-			Content: "偏好线上咨询",
-		}
-		createJSON2, _ := json.Marshal(createRequest2)
-
-		w = httptest.NewRecorder()
-		req, _ = http.NewRequest("POST", "/api/v1/customers/1/preferences", bytes.NewBuffer(createJSON2))
-		req.Header.Set("Content-Type", "application/json")
-		router.ServeHTTP(w, req)
-		assert.Equal(t, http.StatusCreated, w.Code)
+		w = performRequest(router, "POST", path, CustomerPreferenceCreateRequest{Category: "服务偏好", Name: "咨询方式", Value: "偏好线上咨询"}, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
 
 		// 4. 获取偏好列表，应该有2个偏好
-		w = httptest.NewRecorder()
-		req, _ = http.NewRequest("GET", "/api/v1/customers/1/preferences", nil)
-		router.ServeHTTP(w, req)
+		listResponse = CustomerPreferenceListResponse{}
+		w = performRequest(router, "GET", path, nil, &listResponse)
 		assert.Equal(t, http.StatusOK, w.Code)
-
-		json.Unmarshal(w.Body.Bytes(), &listResponse)
 		assert.Equal(t, 2, len(listResponse.Preferences))
 
 		// 5. 更新第一个偏好
-		updateRequest := CustomerPreferenceUpdateRequest{
-			Type:    "product",
-			Content: "更喜欢iPhone",
-		}
-		updateJSON, _ := json.Marshal(updateRequest)
-
-		w = httptest.NewRecorder()
-		req, _ = http.NewRequest("PUT", fmt.Sprintf("/api/v1/customers/1/preferences/%s", preferenceID1), bytes.NewBuffer(updateJSON))
-		req.Header.Set("Content-Type", "application/json")
-		router.ServeHTTP(w, req)
-		assert.Equal(t, http.StatusOK, w.Code)
-
 		var updateResponse CustomerPreferenceResponse
-		json.Unmarshal(w.Body.Bytes(), &updateResponse)
-		assert.Equal(t, "更喜欢iPhone", updateResponse.Preference.Content)
+		w = performRequest(router, "PUT", path+"/"+preferenceID1, map[string]interface{}{"value": "更喜欢iPhone"}, &updateResponse)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "更喜欢iPhone", updateResponse.Value)
 
 		// 6. 删除第一个偏好
-		w = httptest.NewRecorder()
-		req, _ = http.NewRequest("DELETE", fmt.Sprintf("/api/v1/customers/1/preferences/%s", preferenceID1), nil)
-		router.ServeHTTP(w, req)
+		w = performRequest(router, "DELETE", path+"/"+preferenceID1, nil, nil)
 		assert.Equal(t, http.StatusOK, w.Code)
 
 		// 7. 最终检查：应该只剩1个偏好
-		w = httptest.NewRecorder()
-		req, _ = http.NewRequest("GET", "/api/v1/customers/1/preferences", nil)
-		router.ServeHTTP(w, req)
+		listResponse = CustomerPreferenceListResponse{}
+		w = performRequest(router, "GET", path, nil, &listResponse)
 		assert.Equal(t, http.StatusOK, w.Code)
-
-		json.Unmarshal(w.Body.Bytes(), &listResponse)
 		assert.Equal(t, 1, len(listResponse.Preferences))
-		assert.Equal(t, "service", listResponse.Preferences[0].Type)
-		assert.Equal(t, "偏好线上咨询", listResponse.Preferences[0].Content)
+		assert.Equal(t, "服务偏好", listResponse.Preferences[0].Category)
+		assert.Equal(t, "偏好线上咨询", listResponse.Preferences[0].Value)
+	})
+}
+
+// TestCreateCustomerDuplicates 测试创建客户时的疑似重复提示和 force 强制创建
+func TestCreateCustomerDuplicates(t *testing.T) {
+	setupTestDB(t)
+	router := setupTestRouter()
+
+	existing := &Customer{
+		Name:      "查重测试客户",
+		WorkPhone: pq.StringArray{"13912345678"},
+		Wechats:   pq.StringArray{" Dup_Wechat_Test "},
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	if err := DB.Create(existing).Error; err != nil {
+		t.Fatalf("failed to create customer: %v", err)
+	}
+	var createdIDs []uint
+	t.Cleanup(func() {
+		ids := append(createdIDs, existing.ID)
+		DB.Where("customer_id IN ?", ids).Delete(&CustomerChangeLog{})
+		DB.Where("customer_id IN ?", ids).Delete(&CustomerStateChange{})
+		DB.Delete(&Customer{}, ids)
+	})
+
+	decode := func(w *httptest.ResponseRecorder) []CustomerDuplicateMatch {
+		var body struct {
+			Duplicates []CustomerDuplicateMatch `json:"duplicates"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return body.Duplicates
+	}
+
+	// 电话按规范化后的号码与已有电话、工作电话比对
+	w := performRequest(router, "POST", "/api/v1/customers", CustomerRequest{Name: "新客户甲", Phones: []string{"+86 139-1234-5678"}}, nil)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	duplicates := decode(w)
+	if assert.Len(t, duplicates, 1) {
+		assert.Equal(t, existing.ID, duplicates[0].ID)
+		assert.Equal(t, []string{"电话 13912345678"}, duplicates[0].MatchedBy)
+	}
+
+	// 微信忽略大小写和首尾空格
+	w = performRequest(router, "POST", "/api/v1/customers", CustomerRequest{Name: "新客户乙", Wechats: []string{"dup_wechat_test"}}, nil)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	duplicates = decode(w)
+	if assert.Len(t, duplicates, 1) {
+		assert.Equal(t, []string{"微信 dup_wechat_test"}, duplicates[0].MatchedBy)
+	}
+
+	// force=true 时忽略提示直接创建
+	var created CustomerResponse
+	w = performRequest(router, "POST", "/api/v1/customers", CustomerRequest{Name: "新客户甲", Phones: []string{"13912345678"}, Force: true}, &created)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotZero(t, created.ID)
+	createdIDs = append(createdIDs, created.ID)
+}
+
+// TestParseCustomerImportRows 测试销售记录导入行解析
+func TestParseCustomerImportRows(t *testing.T) {
+	t.Run("按表头定位列", func(t *testing.T) {
+		records := [][]string{
+			{"客户", "客户电话", "收货人", "收货地址", "销售员ID"},
+			{"阿亮烟酒茶", "13800138000", "李雨亮", "湖北省孝感市孝南区", "3"},
+			{"", "", "", "", ""},
+		}
+		rows := parseCustomerImportRows(records)
+		assert.Equal(t, 1, len(rows))
+		assert.Equal(t, 2, rows[0].RowNumber)
+		assert.Equal(t, "阿亮烟酒茶", rows[0].CustomerName)
+		assert.Equal(t, "13800138000", rows[0].CustomerPhone)
+		assert.Equal(t, "李雨亮", rows[0].Receiver)
+		assert.Equal(t, "3", rows[0].SellerID)
+	})
+
+	t.Run("无表头按标准列顺序", func(t *testing.T) {
+		record := make([]string, len(customerImportColumns))
+		record[10] = "C001"
+		record[11] = "阿亮烟酒茶"
+		record[44] = "13800138000"
+		record[49] = "13900139000"
+		rows := parseCustomerImportRows([][]string{record})
+		assert.Equal(t, 1, len(rows))
+		assert.Equal(t, 1, rows[0].RowNumber)
+		assert.Equal(t, "C001", rows[0].OriginalCustomerID)
+		assert.Equal(t, "13900139000", rows[0].ReceiverPhone)
+	})
+}
+
+// TestApplyImportRow 测试导入行合并到已有客户
+func TestApplyImportRow(t *testing.T) {
+	customer := &Customer{
+		Name:    "阿亮烟酒茶",
+		Phones:  []string{"13800138000"},
+		Sellers: []int64{3},
+		Address: "原地址",
+	}
+	row := CustomerImportRow{
+		CustomerName:    "阿亮茶行",
+		Receiver:        "李雨亮",
+		ReceiverAddress: "新地址",
+		SellerID:        "3/5",
+		ProductName:     "信阳毛尖",
+	}
+
+	changed := applyImportRow(customer, row, []string{"13800138000", "13900139000"}, "销售记录.xlsx")
+	assert.True(t, changed)
+	assert.Equal(t, "阿亮烟酒茶", customer.Name)
+	assert.Equal(t, "原地址", customer.Address)
+	assert.Equal(t, "李雨亮", customer.ContactName)
+	assert.Equal(t, []string{"13800138000", "13900139000"}, []string(customer.Phones))
+	assert.Equal(t, []int64{3, 5}, []int64(customer.Sellers))
+	assert.Equal(t, []string{"信阳毛尖"}, []string(customer.Products))
+	assert.Equal(t, "销售记录.xlsx", customer.ImportSource)
+
+	assert.False(t, applyImportRow(customer, row, []string{"13800138000"}, "销售记录.xlsx"))
+}
+
+// TestProcessImportJobRows 测试导入任务的进度累计、分批保存和取消
+func TestProcessImportJobRows(t *testing.T) {
+	statuses := []ImportRowStatus{ImportRowCreated, ImportRowUpdated, ImportRowSkipped, ImportRowFailed}
+	newRows := func(n int) ([]CustomerImportRow, [][]string) {
+		rows := make([]CustomerImportRow, n)
+		records := make([][]string, n+1)
+		records[0] = []string{"客户", "客户电话"}
+		for i := range rows {
+			rows[i] = CustomerImportRow{RowNumber: i + 2, CustomerName: fmt.Sprintf("客户%d", i)}
+			records[i+1] = []string{rows[i].CustomerName, "13800138000"}
+		}
+		return rows, records
+	}
+	importRow := func(row CustomerImportRow) CustomerImportRowResult {
+		return CustomerImportRowResult{Row: row.RowNumber, Status: statuses[(row.RowNumber-2)%len(statuses)]}
+	}
+
+	t.Run("分批保存进度", func(t *testing.T) {
+		rows, records := newRows(450)
+		job := &ImportJob{ID: 7, TotalRows: len(rows)}
+		var batches []int
+		var saved []ImportJobRow
+		status := processImportJobRows(context.Background(), job, rows, records, importRow, func(batch []ImportJobRow) {
+			batches = append(batches, len(batch))
+			saved = append(saved, batch...)
+		})
+
+		assert.Equal(t, ImportJobCompleted, status)
+		assert.Equal(t, []int{200, 200, 50}, batches)
+		assert.Equal(t, 450, job.ProcessedRows)
+		assert.Equal(t, 113, job.CreatedRows)
+		assert.Equal(t, 113, job.UpdatedRows)
+		assert.Equal(t, 112, job.SkippedRows)
+		assert.Equal(t, 112, job.FailedRows)
+		assert.Equal(t, uint64(7), saved[0].JobID)
+		assert.Equal(t, 2, saved[0].RowNumber)
+		assert.Equal(t, []string{"客户0", "13800138000"}, []string(saved[0].RawData))
+		assert.Equal(t, 100, importJobToResponse(&ImportJob{Status: ImportJobCompleted}).Progress)
+	})
+
+	t.Run("取消后停止处理", func(t *testing.T) {
+		rows, records := newRows(10)
+		job := &ImportJob{TotalRows: len(rows)}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var saved []ImportJobRow
+		status := processImportJobRows(ctx, job, rows, records, func(row CustomerImportRow) CustomerImportRowResult {
+			if row.RowNumber == 5 {
+				cancel()
+			}
+			return importRow(row)
+		}, func(batch []ImportJobRow) { saved = append(saved, batch...) })
+
+		assert.Equal(t, ImportJobCancelled, status)
+		assert.Equal(t, 4, job.ProcessedRows)
+		assert.Len(t, saved, 4)
+		job.Status = ImportJobCancelled
+		assert.Equal(t, 40, importJobToResponse(job).Progress)
 	})
-}
\ No newline at end of file
+}
+
+// TestParseChineseAddress 测试中文地址解析
+func TestParseChineseAddress(t *testing.T) {
+	tests := []struct {
+		name     string
+		address  string
+		expected ParsedAddress
+	}{
+		{
+			name:    "完整地址",
+			address: "湖北省孝感市孝南区丹阳街道八里街214号",
+			expected: ParsedAddress{
+				Province: "湖北省", City: "孝感市", District: "孝南区", DistrictID: 420902,
+				Street: "丹阳街道", Detail: "八里街214号",
+			},
+		},
+		{
+			name:    "省市简称",
+			address: "河南 信阳 浉河区 董家河镇车云山村",
+			expected: ParsedAddress{
+				Province: "河南省", City: "信阳市", District: "浉河区", DistrictID: 411502,
+				Street: "董家河镇", Detail: "车云山村",
+			},
+		},
+		{
+			name:    "直辖市",
+			address: "北京市朝阳区望京街道阜通东大街6号",
+			expected: ParsedAddress{
+				Province: "北京市", City: "北京市", District: "朝阳区", DistrictID: 110105,
+				Street: "望京街道", Detail: "阜通东大街6号",
+			},
+		},
+		{
+			name:    "缺少省份",
+			address: "孝感市汉川市马口镇",
+			expected: ParsedAddress{
+				Province: "湖北省", City: "孝感市", District: "汉川市", DistrictID: 420984,
+				Street: "马口镇",
+			},
+		},
+		{
+			name:    "省直辖县级市",
+			address: "湖北省仙桃市沙嘴街道",
+			expected: ParsedAddress{
+				Province: "湖北省", City: "仙桃市", District: "仙桃市", DistrictID: 429004,
+				Street: "沙嘴街道",
+			},
+		},
+		{
+			name:    "自治州简称",
+			address: "湖北恩施利川市",
+			expected: ParsedAddress{
+				Province: "湖北省", City: "恩施土家族苗族自治州", District: "利川市", DistrictID: 422802,
+			},
+		},
+		{
+			name:     "无法识别",
+			address:  "阿亮烟酒茶",
+			expected: ParsedAddress{Detail: "阿亮烟酒茶"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, parseChineseAddress(tt.address))
+		})
+	}
+}
+
+// TestApplyParsedAddress 测试客户地址补全只填充空缺字段
+func TestApplyParsedAddress(t *testing.T) {
+	customer := &Customer{
+		City:    "孝感",
+		Address: "湖北省孝感市孝南区丹阳街道八里街214号",
+	}
+	assert.True(t, applyParsedAddress(customer))
+	assert.Equal(t, "湖北省", customer.Province)
+	assert.Equal(t, "孝感", customer.City)
+	assert.Equal(t, "孝南区", customer.District)
+	assert.Equal(t, "丹阳街道", customer.Street)
+	assert.Equal(t, 420902, customer.DistrictID)
+
+	assert.False(t, applyParsedAddress(customer))
+}
+
+// TestAddressUnresolvedReason 测试地址回填无法确定区县编码时的原因
+func TestAddressUnresolvedReason(t *testing.T) {
+	customer := &Customer{Address: "河北省石家庄市长安区建设北大街"}
+	applyParsedAddress(customer)
+	assert.Equal(t, 0, customer.DistrictID)
+	assert.Equal(t, "行政区划字典未收录该城市的区县", addressUnresolvedReason(customer))
+
+	customer = &Customer{Address: "湖北省孝感市某某路"}
+	applyParsedAddress(customer)
+	assert.Equal(t, "地址中未识别到区县", addressUnresolvedReason(customer))
+
+	customer = &Customer{Address: "八里街214号"}
+	applyParsedAddress(customer)
+	assert.Equal(t, "地址中未识别到城市", addressUnresolvedReason(customer))
+}
+
+// TestRegionDictionary 测试行政区划查询、模糊匹配和编码校验
+func TestRegionDictionary(t *testing.T) {
+	t.Run("代码规范化", func(t *testing.T) {
+		assert.Equal(t, "42", normalizeRegionCode("420000"))
+		assert.Equal(t, "4209", normalizeRegionCode("420900"))
+		assert.Equal(t, "420902", normalizeRegionCode("420902000000"))
+	})
+
+	t.Run("下级区划", func(t *testing.T) {
+		provinces, err := getRegionChildren("")
+		assert.NoError(t, err)
+		assert.Len(t, provinces, 34)
+
+		districts, err := getRegionChildren("420900")
+		assert.NoError(t, err)
+		assert.Equal(t, "孝南区", districts[0].Name)
+		assert.Equal(t, "湖北省孝感市孝南区", districts[0].FullName)
+
+		_, err = getRegionChildren("999999")
+		assert.ErrorIs(t, err, errRegionNotFound)
+	})
+
+	t.Run("按代码查询", func(t *testing.T) {
+		detail, err := getRegionDetail("420902000000")
+		assert.NoError(t, err)
+		assert.Equal(t, "孝南区", detail.Name)
+		assert.Equal(t, 3, detail.Level)
+		assert.Len(t, detail.Ancestors, 2)
+		assert.Equal(t, "湖北省", detail.Ancestors[0].Name)
+	})
+
+	t.Run("模糊匹配", func(t *testing.T) {
+		regions, err := searchRegions("孝感", 0, "", 10)
+		assert.NoError(t, err)
+		assert.Equal(t, "孝感市", regions[0].Name)
+
+		regions, err = searchRegions("恩施", 2, "", 10)
+		assert.NoError(t, err)
+		assert.Len(t, regions, 1)
+		assert.Equal(t, "4228", regions[0].Code)
+	})
+
+	t.Run("编码校验", func(t *testing.T) {
+		_, err := validateDistrictID(420902)
+		assert.NoError(t, err)
+		_, err = validateDistrictID(420900)
+		assert.Error(t, err)
+
+		errs := validateShippingInfos([]JSONB{
+			{"districtId": float64(420902000000), "province": "湖北省", "city": "孝感市", "district": "孝南区"},
+			{"districtId": float64(110105), "city": "北京市", "district": "朝阳区"},
+			{"districtId": float64(420902), "city": "武汉市"},
+			{"districtId": "123456"},
+		})
+		assert.Len(t, errs, 2)
+		assert.Contains(t, errs[0], "第3条")
+		assert.Contains(t, errs[1], "第4条")
+
+		// 字典未收录的区县编码不能保存
+		_, err = validateDistrictID(130102)
+		assert.Error(t, err)
+		req := CustomerRequest{DistrictID: 130102, Province: "河北省"}
+		assert.Error(t, validateCustomerRegion(&req))
+
+		req = CustomerRequest{DistrictID: 420902000000}
+		assert.NoError(t, validateCustomerRegion(&req))
+		assert.Equal(t, "湖北省", req.Province)
+		assert.Equal(t, "孝感市", req.City)
+		assert.Equal(t, "孝南区", req.District)
+		assert.Equal(t, int64(420902), req.DistrictID)
+	})
+}
+
+// TestApplyRegionFilter 测试行政区划筛选按区县编码范围或省市区名称匹配
+func TestApplyRegionFilter(t *testing.T) {
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=localhost"}), &gorm.Config{DryRun: true, DisableAutomaticPing: true})
+	if err != nil {
+		t.Fatalf("failed to open dry run database: %v", err)
+	}
+	toSQL := func(code string) (string, []interface{}) {
+		stmt := applyRegionFilter(db.Model(&Customer{}), code).Find(&[]Customer{}).Statement
+		return stmt.SQL.String(), stmt.Vars
+	}
+
+	sql, vars := toSQL("420902")
+	assert.Contains(t, sql, "(district_id BETWEEN $1 AND $2 OR (district IN ($3,$4) AND city IN ($5,$6) AND province IN ($7,$8)))")
+	assert.Equal(t, 420902, vars[0])
+	assert.Equal(t, 420902, vars[1])
+
+	sql, vars = toSQL("42")
+	assert.Contains(t, sql, "(district_id BETWEEN $1 AND $2 OR (province IN ($3,$4)))")
+	assert.Equal(t, 420000, vars[0])
+	assert.Equal(t, 429999, vars[1])
+
+	// 字典未收录的代码不匹配任何客户
+	for _, code := range []string{"130102", "999999"} {
+		sql, _ = toSQL(code)
+		assert.Contains(t, sql, "1 = 0")
+		assert.NotContains(t, sql, "district_id")
+	}
+}
+
+// TestGeoDistance 测试球面距离和外接矩形计算
+func TestGeoDistance(t *testing.T) {
+	// 孝感市政府 -> 武汉市政府，直线距离约 52 千米
+	distance := haversineKm(30.9246, 113.9169, 30.5928, 114.3055)
+	assert.InDelta(t, 52.3, distance, 0.1)
+	assert.Equal(t, 0.0, haversineKm(30.9246, 113.9169, 30.9246, 113.9169))
+
+	minLat, minLon, maxLat, maxLon := geoBoundingBox(30.9246, 113.9169, 10)
+	assert.InDelta(t, 30.9246-0.0899, minLat, 0.001)
+	assert.InDelta(t, 30.9246+0.0899, maxLat, 0.001)
+	assert.Less(t, minLon, 113.9169-0.0899)
+	assert.Greater(t, maxLon, 113.9169+0.0899)
+
+	// 矩形四边中点到中心的距离应等于半径
+	assert.InDelta(t, 10.0, haversineKm(30.9246, 113.9169, maxLat, 113.9169), 0.01)
+	assert.InDelta(t, 10.0, haversineKm(30.9246, 113.9169, 30.9246, maxLon), 0.05)
+}
+
+// TestGeoRequestBinding 测试经纬度为0时仍能通过必填校验
+func TestGeoRequestBinding(t *testing.T) {
+	bind := func(query string, obj interface{}) error {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/?"+query, nil)
+		return c.ShouldBindQuery(obj)
+	}
+
+	var nearby NearbyCustomerRequest
+	assert.NoError(t, bind("lat=0&lon=0", &nearby))
+	assert.Equal(t, 0.0, *nearby.Lat)
+	assert.Error(t, bind("lat=0", &NearbyCustomerRequest{}))
+
+	var box BoundingBoxCustomerRequest
+	assert.NoError(t, bind("min_lat=-1&min_lon=-1&max_lat=0&max_lon=0", &box))
+	assert.Error(t, bind("min_lat=1&min_lon=-1&max_lat=0&max_lon=0", &BoundingBoxCustomerRequest{}))
+
+	var plan VisitRoutePlanRequest
+	assert.NoError(t, bind("date=2024-05-01&start_lat=0&start_lon=0", &plan))
+	assert.Equal(t, 0.0, *plan.StartLon)
+}
+
+// TestPlanVisitOrder 测试拜访顺序规划（最近邻 + 2-opt）
+func TestPlanVisitOrder(t *testing.T) {
+	t.Run("无拜访点", func(t *testing.T) {
+		assert.Empty(t, planVisitOrder(30.9, 113.9, nil, false))
+	})
+
+	t.Run("同一方向依次拜访", func(t *testing.T) {
+		points := [][2]float64{{30.93, 113.9}, {30.91, 113.9}, {30.94, 113.9}, {30.92, 113.9}}
+		assert.Equal(t, []int{1, 3, 0, 2}, planVisitOrder(30.9, 113.9, points, false))
+	})
+
+	t.Run("2-opt 消除交叉", func(t *testing.T) {
+		// 最近邻路线为 0->1->3->2 来回折返，2-opt 后应先走完一侧再去另一侧
+		points := [][2]float64{{30.90, 113.91}, {30.90, 113.89}, {30.90, 113.95}, {30.90, 113.84}}
+		order := planVisitOrder(30.9, 113.9, points, false)
+		assert.Len(t, order, 4)
+
+		length := func(order []int) float64 {
+			total, lat, lon := 0.0, 30.9, 113.9
+			for _, i := range order {
+				total += haversineKm(lat, lon, points[i][0], points[i][1])
+				lat, lon = points[i][0], points[i][1]
+			}
+			return total
+		}
+		assert.LessOrEqual(t, length(order), length([]int{0, 1, 2, 3}))
+		assert.LessOrEqual(t, length(order), length([]int{1, 0, 2, 3}))
+		assert.InDelta(t, length([]int{0, 2, 1, 3}), length(order), 0.001)
+	})
+}
+
+// TestCustomerGeoJSON 测试客户 GeoJSON 要素和聚合网格大小
+func TestCustomerGeoJSON(t *testing.T) {
+	assert.Equal(t, 90.0, clusterCellSize(0))
+	assert.InDelta(t, 0.0879, clusterCellSize(10), 0.0001)
+	assert.Equal(t, clusterCellSize(10)/2, clusterCellSize(11))
+
+	lastOrder := time.Date(2025, 3, 8, 10, 0, 0, 0, time.Local)
+	feature := customerToGeoJSONFeature(&Customer{
+		ID:            7,
+		Name:          "阿亮烟酒茶",
+		Level:         2,
+		State:         1,
+		Sellers:       []int64{3},
+		Lat:           30.92,
+		Lon:           113.91,
+		LastOrderDate: &lastOrder,
+	})
+	assert.Equal(t, "Feature", feature.Type)
+	assert.Equal(t, "Point", feature.Geometry.Type)
+	assert.Equal(t, []float64{113.91, 30.92}, feature.Geometry.Coordinates)
+	assert.Equal(t, "阿亮烟酒茶", feature.Properties["name"])
+	assert.Equal(t, []int64{3}, feature.Properties["sellers"])
+	assert.Equal(t, "2025-03-08", feature.Properties["last_order_date"])
+
+	feature = customerToGeoJSONFeature(&Customer{ID: 8})
+	assert.Nil(t, feature.Properties["last_order_date"])
+}
+
+// TestFindDuplicateGroups 测试疑似重复客户分组
+func TestFindDuplicateGroups(t *testing.T) {
+	assert.Equal(t, "13800138000", normalizePhone("+86 138-0013-8000"))
+	assert.Equal(t, "13800138000", normalizePhone("0086 13800138000"))
+	assert.Equal(t, "02788886666", normalizePhone("027-8888 6666"))
+	assert.Equal(t, 1.0, textSimilarity("阿亮 烟酒茶", "阿亮烟酒茶！"))
+	assert.InDelta(t, 0.857, textSimilarity("阿亮烟酒茶", "阿亮烟酒"), 0.001)
+
+	customers := []Customer{
+		{ID: 1, Name: "阿亮烟酒茶", Phones: []string{"13800138000"}, City: "孝感市"},
+		{ID: 2, Name: "亮哥茶行", WorkPhone: []string{"+86 138 0013 8000"}, City: "孝感市"},
+		{ID: 3, Name: "莉姐茶庄", Wechats: []string{"lijie888"}, City: "武汉市"},
+		{ID: 4, Name: "莉姐商行", Wechats: []string{"LiJie888"}, City: "武汉市"},
+		{ID: 5, Name: "信阳毛尖专卖店", City: "孝感市", Address: "孝南区丹阳街道八里街214号"},
+		{ID: 6, Name: "信阳毛尖专卖", City: "孝感市", Address: "孝南区丹阳街道八里街214号"},
+		{ID: 7, Name: "信阳毛尖专卖店", City: "信阳市", Address: "浉河区"},
+		{ID: 8, Name: "其他客户", Phones: []string{"13900139000"}, City: "孝感市"},
+	}
+
+	groups := findDuplicateGroups(customers, 0.8)
+	assert.Len(t, groups, 3)
+
+	byFirst := make(map[uint][]uint)
+	for _, group := range groups {
+		var ids []uint
+		for _, member := range group.members {
+			ids = append(ids, customers[member].ID)
+		}
+		byFirst[ids[0]] = ids
+	}
+	assert.Equal(t, []uint{1, 2}, byFirst[1])
+	assert.Equal(t, []uint{3, 4}, byFirst[3])
+	assert.Equal(t, []uint{5, 6}, byFirst[5])
+
+	for _, group := range groups {
+		if customers[group.members[0]].ID == 1 {
+			assert.Equal(t, []string{"电话 13800138000 重合"}, group.reasons)
+			assert.Equal(t, 1.0, group.score)
+		}
+		if customers[group.members[0]].ID == 5 {
+			assert.Less(t, group.score, 1.0)
+			assert.Contains(t, group.reasons[0], "名称地址相似度")
+		}
+	}
+}
+
+// TestMergeCustomerFields 测试合并客户时的字段合并规则
+func TestMergeCustomerFields(t *testing.T) {
+	avg1, avg2 := 100.0, 400.0
+	visited := time.Date(2025, 5, 1, 0, 0, 0, 0, time.Local)
+	survivor := &Customer{
+		ID:            1,
+		Name:          "阿亮烟酒茶",
+		Phones:        []string{"13800138000"},
+		Sellers:       []int64{3},
+		Remark:        "老客户",
+		OrderCount:    3,
+		AvgOrderValue: &avg1,
+		Favors:        JSONB{"p1": map[string]interface{}{"name": "毛尖"}},
+	}
+	other := &Customer{
+		ID:            2,
+		Name:          "亮哥茶行",
+		Phones:        []string{"13800138000", "13900139000"},
+		Sellers:       []int64{5},
+		Address:       "孝感市孝南区",
+		Remark:        "爱喝红茶",
+		OrderCount:    1,
+		AvgOrderValue: &avg2,
+		LastVisited:   &visited,
+		Favors:        JSONB{"p1": "冲突", "p2": map[string]interface{}{"name": "红茶"}},
+	}
+
+	mergeCustomerFields(survivor, other)
+	assert.Equal(t, "阿亮烟酒茶", survivor.Name)
+	assert.Equal(t, []string{"13800138000", "13900139000"}, []string(survivor.Phones))
+	assert.Equal(t, []int64{3, 5}, []int64(survivor.Sellers))
+	assert.Equal(t, "孝感市孝南区", survivor.Address)
+	assert.Equal(t, "老客户；爱喝红茶", survivor.Remark)
+	// 订单统计不在字段合并中累加，由订单改挂后重新统计
+	assert.Equal(t, 3, survivor.OrderCount)
+	assert.Equal(t, avg1, *survivor.AvgOrderValue)
+	assert.Equal(t, &visited, survivor.LastVisited)
+	assert.Len(t, survivor.Favors, 2)
+	assert.Equal(t, map[string]interface{}{"name": "毛尖"}, survivor.Favors["p1"])
+}
+
+// TestValidatePhone 测试电话号码规范化和格式校验
+func TestValidatePhone(t *testing.T) {
+	valid := map[string]string{
+		"138-0013-8000":     "13800138000",
+		"+86 138 0013 8000": "13800138000",
+		"0086 13800138000":  "13800138000",
+		"010-12345678":      "01012345678",
+		"(0755) 8765 4321":  "075587654321",
+		"0731-1234567":      "07311234567",
+		"400-123-4567":      "4001234567",
+	}
+	for input, expected := range valid {
+		got, err := validatePhone(input)
+		assert.NoError(t, err, input)
+		assert.Equal(t, expected, got, input)
+	}
+
+	for _, input := range []string{"", "12345678", "1380013800", "23800138000", "010-1234567", "138001380001"} {
+		_, err := validatePhone(input)
+		assert.Error(t, err, input)
+	}
+
+	phones, err := normalizePhones([]string{"138-0013-8000", " ", "13800138000", "010-12345678"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"13800138000", "01012345678"}, []string(phones))
+	_, err = normalizePhones([]string{"13800138000", "12345"})
+	assert.Error(t, err)
+
+	stored, invalid := normalizeStoredPhones([]string{"138 0013 8000", "分机 8001", "13800138000"})
+	assert.Equal(t, []string{"13800138000", "分机 8001"}, []string(stored))
+	assert.Equal(t, 1, invalid)
+}
+
+// TestValidateCustomerPhones 测试客户请求的电话、工作电话和微信号在写入前规范化
+func TestValidateCustomerPhones(t *testing.T) {
+	req := CustomerRequest{
+		Phones:    []string{"+86 138-0013-8000"},
+		WorkPhone: []string{"010-12345678", "(010)12345678"},
+		Wechats:   []string{" WeChat_A ", "wechat_a", ""},
+	}
+	assert.NoError(t, validateCustomerPhones(&req))
+	assert.Equal(t, []string{"13800138000"}, req.Phones)
+	assert.Equal(t, []string{"01012345678"}, req.WorkPhone)
+	assert.Equal(t, []string{"wechat_a"}, req.Wechats)
+
+	// 未传工作电话时保持 nil，更新时不覆盖已有工作电话
+	req = CustomerRequest{Phones: []string{"13800138000"}}
+	assert.NoError(t, validateCustomerPhones(&req))
+	assert.Nil(t, req.WorkPhone)
+
+	req = CustomerRequest{WorkPhone: []string{"12345"}}
+	assert.Error(t, validateCustomerPhones(&req))
+}
+
+// TestCustomerExportColumns 测试导出列解析和导出行内容
+func TestCustomerExportColumns(t *testing.T) {
+	columns, err := resolveCustomerExportColumns("")
+	assert.NoError(t, err)
+	for _, column := range columns {
+		assert.True(t, column.Default, column.Key)
+	}
+
+	columns, err = resolveCustomerExportColumns("name, phones,system_tags,sellers,seller_names,name,last_order_date")
+	assert.NoError(t, err)
+	keys := make([]string, len(columns))
+	for i, column := range columns {
+		keys[i] = column.Key
+	}
+	assert.Equal(t, []string{"name", "phones", "system_tags", "sellers", "seller_names", "last_order_date"}, keys)
+
+	_, err = resolveCustomerExportColumns("name,password")
+	assert.Error(t, err)
+
+	customer := &Customer{
+		Name:       "张三商行",
+		Phones:     []string{"13800138000", "01012345678"},
+		SystemTags: []int64{1, 3},
+		Sellers:    []int64{7, 8},
+	}
+	ctx := &customerExportContext{
+		tagNames:  map[int64]string{1: "大客户"},
+		userNames: map[int64]string{7: "李四", 8: "王五"},
+	}
+	record := customerExportRecord(customer, columns, ctx)
+	assert.Equal(t, []interface{}{"张三商行", "13800138000,01012345678", "大客户,3", "7,8", "李四,王五", ""}, record)
+}
+
+// TestExportCustomersXLSX 测试 XLSX 导出经流式写入器逐批写出，生成的工作簿可被正常读取
+func TestExportCustomersXLSX(t *testing.T) {
+	setupTestDB(t)
+
+	var ids []uint
+	for i := 0; i < 3; i++ {
+		customer := &Customer{Name: fmt.Sprintf("导出测试客户%d", i), Phones: pq.StringArray{fmt.Sprintf("1370000000%d", i)}, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+		if err := DB.Create(customer).Error; err != nil {
+			t.Fatalf("failed to create customer: %v", err)
+		}
+		ids = append(ids, customer.ID)
+	}
+	t.Cleanup(func() { DB.Delete(&Customer{}, ids) })
+
+	columns, err := resolveCustomerExportColumns("name,phones")
+	assert.NoError(t, err)
+	var buf bytes.Buffer
+	query := DB.Model(&Customer{}).Where("id IN ?", ids)
+	assert.NoError(t, exportCustomers(&buf, query, nil, "xlsx", columns))
+
+	f, err := excelize.OpenReader(&buf)
+	if err != nil {
+		t.Fatalf("failed to open exported workbook: %v", err)
+	}
+	defer f.Close()
+	rows, err := f.GetRows(f.GetSheetName(0))
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"客户名称", "电话"},
+		{"导出测试客户0", "13700000000"},
+		{"导出测试客户1", "13700000001"},
+		{"导出测试客户2", "13700000002"},
+	}, rows)
+}
+
+// TestCustomerFilterClause 测试结构化筛选条件生成的 SQL 片段和参数
+func TestCustomerFilterClause(t *testing.T) {
+	clause, args, err := customerFilterClause(CustomerFilterCondition{Field: "level", Op: "in", Value: "1,2"})
+	assert.NoError(t, err)
+	assert.Equal(t, "level IN ?", clause)
+	assert.Equal(t, []interface{}{[]interface{}{int64(1), int64(2)}}, args)
+
+	clause, args, err = customerFilterClause(CustomerFilterCondition{Field: "credit_sale", Op: "between", Value: []interface{}{100.0, 500.5}})
+	assert.NoError(t, err)
+	assert.Equal(t, "credit_sale BETWEEN ? AND ?", clause)
+	assert.Equal(t, []interface{}{100.0, 500.5}, args)
+
+	clause, args, err = customerFilterClause(CustomerFilterCondition{Field: "sellers", Op: "any", Value: []interface{}{3.0, 5.0}})
+	assert.NoError(t, err)
+	assert.Equal(t, "sellers && ?", clause)
+	assert.Equal(t, []interface{}{pq.Int64Array{3, 5}}, args)
+
+	clause, args, err = customerFilterClause(CustomerFilterCondition{Field: "tags", Op: "none", Value: "黑名单"})
+	assert.NoError(t, err)
+	assert.Equal(t, "(tags IS NULL OR NOT tags && ?)", clause)
+	assert.Equal(t, []interface{}{pq.StringArray{"黑名单"}}, args)
+
+	clause, _, err = customerFilterClause(CustomerFilterCondition{Field: "last_visited", Op: "is_null"})
+	assert.NoError(t, err)
+	assert.Equal(t, "last_visited IS NULL", clause)
+
+	clause, args, err = customerFilterClause(CustomerFilterCondition{Field: "category", Op: "contains", Value: "100%"})
+	assert.NoError(t, err)
+	assert.Equal(t, "category ILIKE ?", clause)
+	assert.Equal(t, []interface{}{`%100\%%`}, args)
+
+	clause, args, err = customerFilterClause(CustomerFilterCondition{Field: "last_order_date", Op: "lt", Value: "-90d"})
+	assert.NoError(t, err)
+	assert.Equal(t, "last_order_date < ?", clause)
+	assert.WithinDuration(t, time.Now().AddDate(0, 0, -90), args[0].(time.Time), time.Minute)
+
+	invalid := []CustomerFilterCondition{
+		{Field: "password", Op: "eq", Value: "x"},
+		{Field: "level", Op: "contains", Value: "1"},
+		{Field: "level", Op: "eq", Value: "abc"},
+		{Field: "credit_sale", Op: "between", Value: "100"},
+		{Field: "added_wechat", Op: "eq", Value: "maybe"},
+		{Field: "created_at", Op: "gte", Value: "yesterday"},
+		{Field: "sellers", Op: "any"},
+	}
+	for _, cond := range invalid {
+		_, _, err := customerFilterClause(cond)
+		assert.Error(t, err, cond.Field+" "+cond.Op)
+	}
+}
+
+// TestParseCustomerFilterQuery 测试从查询参数解析筛选和排序条件
+func TestParseCustomerFilterQuery(t *testing.T) {
+	values := url.Values{
+		"search":      {"商行"},
+		"region_code": {"42"},
+		"filter":      {"level:in:1,2", "last_visited:is_null"},
+		"sort":        {"-last_order_date:nulls_last,name"},
+	}
+	filter, err := parseCustomerFilterQuery(values)
+	assert.NoError(t, err)
+	assert.Equal(t, "商行", filter.Search)
+	assert.Equal(t, "42", filter.RegionCode)
+	assert.Equal(t, []CustomerFilterCondition{
+		{Field: "level", Op: "in", Value: "1,2"},
+		{Field: "last_visited", Op: "is_null"},
+	}, filter.Conditions)
+	assert.Equal(t, []CustomerSortField{
+		{Field: "last_order_date", Desc: true, Nulls: "last"},
+		{Field: "name"},
+	}, filter.Sort)
+
+	clause, err := customerSortClause(filter.Sort[0])
+	assert.NoError(t, err)
+	assert.Equal(t, "last_order_date DESC NULLS LAST", clause)
+	_, err = customerSortClause(CustomerSortField{Field: "tags"})
+	assert.Error(t, err)
+	_, err = customerSortClause(CustomerSortField{Field: "name", Nulls: "middle"})
+	assert.Error(t, err)
+
+	_, err = parseCustomerFilterQuery(url.Values{"filter": {"level"}})
+	assert.Error(t, err)
+	_, err = parseCustomerFilterQuery(url.Values{"sort": {"name:first"}})
+	assert.Error(t, err)
+}
+
+// TestCustomerKeysetAfter 测试导出键集分页条件按排序方向和空值位置生成，并在末尾补 id
+func TestCustomerKeysetAfter(t *testing.T) {
+	const lastLevel = "(SELECT k.level FROM customers k WHERE k.id = ?)"
+
+	clause, args, err := customerKeysetAfter(nil, 7)
+	assert.NoError(t, err)
+	assert.Equal(t, "((id > ?))", clause)
+	assert.Equal(t, []interface{}{uint(7)}, args)
+
+	clause, args, err = customerKeysetAfter([]CustomerSortField{{Field: "level", Desc: true}}, 7)
+	assert.NoError(t, err)
+	assert.Equal(t, "(((("+lastLevel+" IS NULL AND level IS NOT NULL) OR level < "+lastLevel+"))"+
+		" OR (level IS NOT DISTINCT FROM "+lastLevel+" AND id > ?))", clause)
+	assert.Len(t, args, 4)
+
+	clause, _, err = customerKeysetAfter([]CustomerSortField{{Field: "level", Desc: true, Nulls: "last"}}, 7)
+	assert.NoError(t, err)
+	assert.Contains(t, clause, "("+lastLevel+" IS NOT NULL AND (level < "+lastLevel+" OR level IS NULL))")
+
+	_, _, err = customerKeysetAfter([]CustomerSortField{{Field: "phones"}}, 7)
+	assert.Error(t, err)
+}
+
+// TestCustomerSegmentFilterRoundTrip 测试分群筛选条件的序列化与还原
+func TestCustomerSegmentFilterRoundTrip(t *testing.T) {
+	filter := CustomerFilter{
+		RegionCode: "42",
+		Conditions: []CustomerFilterCondition{
+			{Field: "level", Op: "eq", Value: 1},
+			{Field: "sellers", Op: "any", Value: []int64{3, 1000000}},
+			{Field: "last_order_date", Op: "lt", Value: "-90d"},
+		},
+		Sort: []CustomerSortField{{Field: "last_order_date", Desc: true, Nulls: "last"}},
+	}
+	stored, err := toJSONB(filter)
+	assert.NoError(t, err)
+
+	restored := segmentFilter(&CustomerSegment{Filter: stored})
+	assert.Equal(t, "42", restored.RegionCode)
+	assert.Equal(t, filter.Sort, restored.Sort)
+	assert.Len(t, restored.Conditions, 3)
+
+	_, args, err := customerFilterClause(restored.Conditions[0])
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{int64(1)}, args)
+
+	_, args, err = customerFilterClause(restored.Conditions[1])
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{pq.Int64Array{3, 1000000}}, args)
+
+	// 相对时间在每次计算分群时重新求值
+	_, args, err = customerFilterClause(restored.Conditions[2])
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().AddDate(0, 0, -90), args[0].(time.Time), time.Minute)
+}
+
+// TestCustomerBulkActions 测试批量操作的参数校验和字段修改
+func TestCustomerBulkActions(t *testing.T) {
+	level := 2
+	category := "烟酒店"
+	assert.Error(t, validateCustomerBulkActions(CustomerBulkActions{}))
+	assert.Error(t, validateCustomerBulkActions(CustomerBulkActions{Delete: true, SetLevel: &level}))
+	assert.Error(t, validateCustomerBulkActions(CustomerBulkActions{AddTags: []string{"A"}, RemoveTags: []string{"A"}}))
+	assert.NoError(t, validateCustomerBulkActions(CustomerBulkActions{Delete: true}))
+
+	now := time.Now()
+	customer := &Customer{
+		Tags:       []string{"老客户", "团购"},
+		SystemTags: []int64{1},
+		Sellers:    []int64{3, 5},
+		Level:      1,
+		Category:   category,
+	}
+	actions := CustomerBulkActions{
+		AddTags:       []string{"重点", "老客户"},
+		RemoveTags:    []string{"团购"},
+		AddSystemTags: []int64{1},
+		SetLevel:      &level,
+		SetCategory:   &category,
+		AddSellers:    []int64{7},
+		RemoveSellers: []int64{3},
+	}
+	changes, columns := applyCustomerBulkActions(customer, actions, now)
+	assert.ElementsMatch(t, []string{"tags", "sellers", "level"}, columns)
+	assert.Equal(t, []string{"老客户", "重点"}, []string(customer.Tags))
+	assert.Equal(t, []int64{5, 7}, []int64(customer.Sellers))
+	assert.Equal(t, 2, customer.Level)
+	assert.Equal(t, map[string]interface{}{"old": []string{"老客户", "团购"}, "new": []string{"老客户", "重点"}}, changes["tags"])
+	assert.Equal(t, map[string]interface{}{"old": 1, "new": 2}, changes["level"])
+
+	// 再次执行没有变化
+	_, columns = applyCustomerBulkActions(customer, actions, now)
+	assert.Empty(t, columns)
+
+	changes, columns = applyCustomerBulkActions(customer, CustomerBulkActions{Delete: true}, now)
+	assert.Equal(t, []string{"is_deleted", "deleted_at"}, columns)
+	assert.True(t, customer.IsDeleted)
+	assert.Equal(t, &now, customer.DeletedAt)
+	assert.Contains(t, changes, "is_deleted")
+}
+
+// TestCustomerPatch 测试部分更新的字段校验和应用
+func TestCustomerPatch(t *testing.T) {
+	level := 2
+	empty := ""
+	badGender := 5
+	bad := CustomerPatchRequest{
+		Name:      &empty,
+		Gender:    &badGender,
+		Phones:    &[]string{"12345"},
+		WorkPhone: &[]string{"12345"},
+		Tags:      &[]string{"A"},
+		Douyins:   &[]string{"dy"},
+		ExtraInfo: json.RawMessage(`[1]`),
+		Add:       &CustomerArrayOps{Tags: []string{"B"}, Douyins: []string{"dy2"}},
+	}
+	errs := validateCustomerPatch(&bad)
+	assert.Contains(t, errs, "name")
+	assert.Contains(t, errs, "gender")
+	assert.Contains(t, errs, "phones")
+	assert.Contains(t, errs, "work_phone")
+	assert.Contains(t, errs, "tags")
+	assert.Contains(t, errs, "douyins")
+	assert.Contains(t, errs, "extra_info")
+
+	// 状态只能是状态机中定义的状态，流转规则在读取客户后检查
+	undefined := 9
+	errs = validateCustomerPatch(&CustomerPatchRequest{State: &undefined})
+	assert.Contains(t, errs, "state")
+
+	customer := &Customer{
+		Name:      "阿亮烟酒茶",
+		Phones:    []string{"13800138000"},
+		Address:   "湖北省孝感市孝南区书院街道槐荫大道1号",
+		Province:  "湖北省",
+		City:      "孝感市",
+		District:  "孝南区",
+		Tags:      []string{"老客户", "团购"},
+		Sellers:   []int64{3},
+		Level:     1,
+		ExtraInfo: JSONB{"a": 1.0, "nested": map[string]interface{}{"x": 1.0, "y": 2.0}},
+	}
+	req := CustomerPatchRequest{
+		Level:     &level,
+		ExtraInfo: json.RawMessage(`{"a": null, "b": "new", "nested": {"y": null}}`),
+		Wechats:   &[]string{" WeChat_A ", "wechat_a"},
+		Add:       &CustomerArrayOps{Phones: []string{"010-12345678"}, WorkPhone: []string{"+86 139-1234-5678"}, Kwais: []string{"ks1"}, Sellers: []int64{5}},
+		Remove:    &CustomerArrayOps{Tags: []string{"团购"}},
+	}
+	assert.Empty(t, validateCustomerPatch(&req))
+	columns, errs := applyCustomerPatch(customer, req)
+	assert.Empty(t, errs)
+	assert.ElementsMatch(t, []string{"level", "extra_info", "wechats", "phones", "work_phone", "kwais", "sellers", "tags"}, columns)
+	assert.Equal(t, []string{"wechat_a"}, []string(customer.Wechats))
+	assert.Equal(t, []string{"13912345678"}, []string(customer.WorkPhone))
+	assert.Equal(t, []string{"ks1"}, []string(customer.Kwais))
+	assert.Equal(t, "阿亮烟酒茶", customer.Name)
+	assert.Equal(t, []string{"13800138000", "01012345678"}, []string(customer.Phones))
+	assert.Equal(t, []string{"老客户"}, []string(customer.Tags))
+	assert.Equal(t, []int64{3, 5}, []int64(customer.Sellers))
+	assert.Equal(t, JSONB{"b": "new", "nested": map[string]interface{}{"x": 1.0}}, customer.ExtraInfo)
+
+	// 移除微信时原值和规范化后的值都能匹配
+	customer.WorkWechat = pq.StringArray{"Old_Wechat", "keep"}
+	req = CustomerPatchRequest{Remove: &CustomerArrayOps{WorkWechat: []string{"Old_Wechat"}}}
+	assert.Empty(t, validateCustomerPatch(&req))
+	columns, errs = applyCustomerPatch(customer, req)
+	assert.Empty(t, errs)
+	assert.Equal(t, []string{"work_wechat"}, columns)
+	assert.Equal(t, []string{"keep"}, []string(customer.WorkWechat))
+
+	// 未传 extra_info 时不修改，显式 null 时清空
+	var absent, null CustomerPatchRequest
+	assert.NoError(t, json.Unmarshal([]byte(`{"level": 2}`), &absent))
+	columns, errs = applyCustomerPatch(customer, absent)
+	assert.Empty(t, errs)
+	assert.Empty(t, columns)
+	assert.NoError(t, json.Unmarshal([]byte(`{"extra_info": null}`), &null))
+	assert.Empty(t, validateCustomerPatch(&null))
+	columns, errs = applyCustomerPatch(customer, null)
+	assert.Empty(t, errs)
+	assert.Equal(t, []string{"extra_info"}, columns)
+	assert.Nil(t, customer.ExtraInfo)
+
+	// 只改地址时重新解析街道和区县编码
+	address := "湖北省孝感市孝南区新华街道城站路2号"
+	columns, errs = applyCustomerPatch(customer, CustomerPatchRequest{Address: &address})
+	assert.Empty(t, errs)
+	assert.ElementsMatch(t, []string{"address", "street", "district_id"}, columns)
+	assert.Equal(t, "新华街道", customer.Street)
+	assert.Equal(t, 420902, customer.DistrictID)
+
+	// 区县编码与省市区名称不一致
+	wrongDistrict := int64(420102)
+	_, errs = applyCustomerPatch(customer, CustomerPatchRequest{DistrictID: &wrongDistrict})
+	assert.Contains(t, errs, "district_id")
+}
+
+// TestCustomerHistoryDiff 测试客户快照对比生成变更字段
+func TestCustomerHistoryDiff(t *testing.T) {
+	before := customerSnapshot(&Customer{
+		ID:        7,
+		Name:      "阿亮烟酒茶",
+		Phones:    []string{"13800138000"},
+		Tags:      []string{"老客户"},
+		Level:     1,
+		UpdatedAt: time.Now(),
+	})
+	after := customerSnapshot(&Customer{
+		ID:        7,
+		Name:      "阿亮烟酒",
+		Phones:    []string{"13800138000"},
+		Tags:      []string{},
+		Level:     2,
+		UpdatedAt: time.Now().Add(time.Minute),
+		UpdatedBy: 3,
+	})
+
+	// 更新时间、更新人不记录，空数组与 null 视为相同
+	fields, oldData, newData := diffCustomerSnapshots(before, after)
+	assert.Equal(t, []string{"level", "name", "tags"}, fields)
+	assert.Equal(t, "阿亮烟酒茶", oldData["name"])
+	assert.Equal(t, "阿亮烟酒", newData["name"])
+	assert.Equal(t, []interface{}{"老客户"}, oldData["tags"])
+
+	// 新建时只记录有值的字段
+	fields, _, _ = diffCustomerSnapshots(nil, after)
+	assert.Contains(t, fields, "name")
+	assert.NotContains(t, fields, "address")
+
+	changeLog := &CustomerChangeLog{
+		ID:         1,
+		CustomerID: 7,
+		OperatorID: 3,
+		Action:     ActionUpdate,
+		Source:     CustomerChangeAPI,
+		Fields:     pq.StringArray{"is_deleted", "name"},
+		OldData:    JSONB{"is_deleted": true, "name": "阿亮烟酒茶"},
+		NewData:    JSONB{"is_deleted": false, "name": "阿亮烟酒"},
+	}
+	response := customerChangeLogToResponse(changeLog, map[uint64]string{3: "小王"})
+	assert.Equal(t, "小王", response.OperatorName)
+	assert.Equal(t, []CustomerFieldChange{
+		{Field: "is_deleted", Old: true, New: false, Revertable: false},
+		{Field: "name", Old: "阿亮烟酒茶", New: "阿亮烟酒", Revertable: true},
+	}, response.Changes)
+
+	changeLog.Action = ActionCreate
+	response = customerChangeLogToResponse(changeLog, nil)
+	assert.False(t, response.Changes[1].Revertable)
+}
+
+// TestGetTrashRetentionDays 测试回收站保留天数的默认值
+func TestGetTrashRetentionDays(t *testing.T) {
+	saved := AppConfig
+	defer func() { AppConfig = saved }()
+
+	AppConfig = nil
+	assert.Equal(t, 30, GetTrashRetentionDays())
+	AppConfig = &Config{Customer: CustomerConfig{TrashRetentionDays: 7}}
+	assert.Equal(t, 7, GetTrashRetentionDays())
+	AppConfig = &Config{Customer: CustomerConfig{TrashRetentionDays: -1}}
+	assert.Equal(t, 30, GetTrashRetentionDays())
+}
+
+// TestCustomerDeleteHistory 测试删除和恢复只改变删除状态，历史中不能单独恢复
+func TestCustomerDeleteHistory(t *testing.T) {
+	deletedAt := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	live := &Customer{ID: 7, Name: "阿亮烟酒茶"}
+	deleted := &Customer{ID: 7, Name: "阿亮烟酒茶", IsDeleted: true, DeletedAt: &deletedAt}
+	fields, _, _ := diffCustomerSnapshots(customerSnapshot(live), customerSnapshot(deleted))
+	assert.Equal(t, []string{"deleted_at", "is_deleted"}, fields)
+	response := customerChangeLogToResponse(&CustomerChangeLog{
+		Action:  ActionRestore,
+		Fields:  pq.StringArray{"is_deleted"},
+		OldData: JSONB{"is_deleted": true},
+		NewData: JSONB{"is_deleted": false},
+	}, nil)
+	assert.False(t, response.Changes[0].Revertable)
+}
+
+// TestPurgeDeletedCustomers 测试回收站清理：只彻底删除超过保留天数且没有订单或退货单的客户及其待办、提醒和跟进记录，并清理其他记录中的引用
+func TestPurgeDeletedCustomers(t *testing.T) {
+	setupTestDB(t)
+	// Todo 的 enum 列类型无法在 PostgreSQL 上自动迁移，需要测试库中已有 todos 表
+	if !DB.Migrator().HasTable(&Todo{}) {
+		t.Skip("测试库缺少 todos 表，跳过回收站清理测试")
+	}
+	if err := DB.AutoMigrate(&TodoLog{}, &Reminder{}, &FollowUpRecord{}, &CustomerBulkChange{}, &DuplicateGroup{}, &CustomerSegment{}, &CustomerPoolRecord{}, &CustomerTransfer{}, &CustomerRelation{}, &Order{}, &OrderReturn{}); err != nil {
+		t.Fatalf("failed to migrate database: %v", err)
+	}
+
+	deletedCustomer := func(days int) uint64 {
+		c := createTestCustomer(t, nil)
+		DB.Model(c).Updates(map[string]interface{}{"is_deleted": true, "deleted_at": time.Now().AddDate(0, 0, -days)})
+		return uint64(c.ID)
+	}
+	expired, recent, ordered, returned := deletedCustomer(40), deletedCustomer(5), deletedCustomer(40), deletedCustomer(40)
+	live := uint64(createTestCustomer(t, nil).ID)
+
+	todo := &Todo{CustomerID: expired, CreatorID: 1, ExecutorID: 1, Title: "回访", Status: TodoStatusPending, Priority: PriorityMedium, PlannedTime: time.Now()}
+	if err := DB.Omit("Customer", "Creator", "Executor", "ReminderUser").Create(todo).Error; err != nil {
+		t.Fatalf("failed to create todo: %v", err)
+	}
+	rows := []interface{}{
+		&Reminder{TodoID: todo.ID, UserID: 1, Type: ReminderTypeWechat, Title: "回访提醒", ScheduleTime: time.Now()},
+		&TodoLog{TodoID: todo.ID, OperatorID: 1, Action: ActionCreate},
+		&FollowUpRecord{CustomerID: expired, UserID: 1, Title: "回访"},
+		&CustomerBulkChange{OperationID: 1, CustomerID: expired, Status: CustomerBulkUpdated},
+		&CustomerStateChange{CustomerID: expired, ToState: CustomerStateDeveloping, Source: CustomerChangeAPI, ChangedAt: time.Now()},
+		&CustomerPoolRecord{CustomerID: expired, SellerID: 1, Action: CustomerPoolRelease},
+		&CustomerRelation{FromCustomerID: live, ToCustomerID: expired, Type: CustomerRelationBranchOf},
+	}
+	for _, row := range rows {
+		if err := DB.Omit("Todo", "Operator", "User", "Customer", "RelatedTodo", "ParentRecord").Create(row).Error; err != nil {
+			t.Fatalf("failed to create %T: %v", row, err)
+		}
+	}
+	stripped := &DuplicateGroup{ScanID: 1, CustomerIDs: pq.Int64Array{int64(expired), int64(recent), int64(live)}, Status: DuplicateGroupPending}
+	dissolved := &DuplicateGroup{ScanID: 1, CustomerIDs: pq.Int64Array{int64(expired), int64(live)}, Status: DuplicateGroupPending}
+	segment := &CustomerSegment{Name: "回收站清理测试", OwnerID: 1, Mode: CustomerSegmentSnapshot, SnapshotIDs: pq.Int64Array{int64(expired), int64(live)}}
+	partialTransfer := &CustomerTransfer{FromSellerID: 1, ToSellerID: 2, CustomerIDs: pq.Int64Array{int64(expired), int64(live)}, Reason: "离职交接"}
+	emptyTransfer := &CustomerTransfer{FromSellerID: 1, ToSellerID: 2, CustomerIDs: pq.Int64Array{int64(expired)}, Reason: "离职交接"}
+	for _, row := range []interface{}{stripped, dissolved, segment, partialTransfer, emptyTransfer} {
+		if err := DB.Create(row).Error; err != nil {
+			t.Fatalf("failed to create %T: %v", row, err)
+		}
+	}
+	order := &Order{OrderNo: fmt.Sprintf("PURGE-TEST-%d", ordered), CustomerID: ordered, OrderDate: time.Now()}
+	if err := DB.Omit("Items").Create(order).Error; err != nil {
+		t.Fatalf("failed to create order: %v", err)
+	}
+	orderReturn := &OrderReturn{ReturnNo: fmt.Sprintf("PURGE-TEST-%d", returned), OrderID: order.ID, CustomerID: returned, ReturnDate: time.Now(), Reason: "破损"}
+	if err := DB.Omit("Items").Create(orderReturn).Error; err != nil {
+		t.Fatalf("failed to create order return: %v", err)
+	}
+	t.Cleanup(func() {
+		DB.Where("todo_id = ?", todo.ID).Delete(&Reminder{})
+		DB.Where("todo_id = ?", todo.ID).Delete(&TodoLog{})
+		DB.Delete(&Todo{}, todo.ID)
+		DB.Where("customer_id = ?", expired).Delete(&FollowUpRecord{})
+		DB.Where("customer_id = ?", expired).Delete(&CustomerBulkChange{})
+		DB.Where("customer_id = ?", expired).Delete(&CustomerStateChange{})
+		DB.Where("customer_id = ?", expired).Delete(&CustomerPoolRecord{})
+		DB.Where("to_customer_id = ?", expired).Delete(&CustomerRelation{})
+		DB.Delete(&DuplicateGroup{}, []uint64{stripped.ID, dissolved.ID})
+		DB.Delete(&CustomerSegment{}, segment.ID)
+		DB.Delete(&CustomerTransfer{}, []uint64{partialTransfer.ID, emptyTransfer.ID})
+		DB.Delete(&Order{}, order.ID)
+		DB.Delete(&OrderReturn{}, orderReturn.ID)
+	})
+
+	resp, err := purgeDeletedCustomers(30)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.GreaterOrEqual(t, resp.Customers, int64(1))
+	assert.GreaterOrEqual(t, resp.Todos, int64(1))
+	assert.GreaterOrEqual(t, resp.Reminders, int64(1))
+	assert.GreaterOrEqual(t, resp.Records, int64(1))
+	assert.GreaterOrEqual(t, resp.Kept, int64(2))
+
+	// 未超过保留天数的客户留在回收站
+	assert.ErrorIs(t, DB.First(&Customer{}, expired).Error, gorm.ErrRecordNotFound)
+	assert.NoError(t, DB.First(&Customer{}, recent).Error)
+
+	// 有订单或退货单的客户一直保留，回收站中显示保留原因
+	assert.NoError(t, DB.First(&Customer{}, ordered).Error)
+	assert.NoError(t, DB.First(&Customer{}, returned).Error)
+	DB.Model(&Customer{}).Where("id = ?", ordered).Update("name", "回收站保留测试客户")
+	trash, _ := getCustomerTrash("回收站保留测试客户", 1, 20)
+	if assert.Len(t, trash, 1) {
+		assert.NotEmpty(t, trash[0].KeptReason)
+		assert.Nil(t, trash[0].PurgeAt)
+	}
+
+	count := func(model interface{}, query string, id uint64) int64 {
+		var n int64
+		DB.Model(model).Where(query, id).Count(&n)
+		return n
+	}
+	assert.Zero(t, count(&Todo{}, "customer_id = ?", expired))
+	assert.Zero(t, count(&Reminder{}, "todo_id = ?", todo.ID))
+	assert.Zero(t, count(&TodoLog{}, "todo_id = ?", todo.ID))
+	assert.Zero(t, count(&FollowUpRecord{}, "customer_id = ?", expired))
+	assert.Zero(t, count(&CustomerBulkChange{}, "customer_id = ?", expired))
+	assert.Zero(t, count(&CustomerStateChange{}, "customer_id = ?", expired))
+	assert.Zero(t, count(&CustomerPoolRecord{}, "customer_id = ?", expired))
+	assert.Zero(t, count(&CustomerRelation{}, "to_customer_id = ?", expired))
+
+	// 查重分组和分群快照中移除被删除的客户，不足两个客户的待处理分组一并删除
+	var group DuplicateGroup
+	assert.NoError(t, DB.First(&group, stripped.ID).Error)
+	assert.Equal(t, pq.Int64Array{int64(recent), int64(live)}, group.CustomerIDs)
+	assert.ErrorIs(t, DB.First(&DuplicateGroup{}, dissolved.ID).Error, gorm.ErrRecordNotFound)
+	var reloaded CustomerSegment
+	assert.NoError(t, DB.First(&reloaded, segment.ID).Error)
+	assert.Equal(t, pq.Int64Array{int64(live)}, reloaded.SnapshotIDs)
+
+	// 转移记录中移除被删除的客户，不再包含客户的转移记录一并删除
+	var transfer CustomerTransfer
+	assert.NoError(t, DB.First(&transfer, partialTransfer.ID).Error)
+	assert.Equal(t, pq.Int64Array{int64(live)}, transfer.CustomerIDs)
+	assert.ErrorIs(t, DB.First(&CustomerTransfer{}, emptyTransfer.ID).Error, gorm.ErrRecordNotFound)
+
+	var changeLog CustomerChangeLog
+	assert.NoError(t, DB.Where("customer_id = ? AND action = ?", expired, ActionDelete).First(&changeLog).Error)
+	assert.Equal(t, CustomerChangeSystem, changeLog.Source)
+	assert.Equal(t, "回收站超过30天自动清理", changeLog.Remark)
+}
+
+// TestCustomerStateTransition 测试客户状态流转规则和原因必填校验
+func TestCustomerStateTransition(t *testing.T) {
+	rules := make(customerStateRules)
+	for _, transition := range defaultCustomerStateTransitions {
+		rules[[2]int{transition.FromState, transition.ToState}] = transition.RequireReason
+	}
+
+	assert.NoError(t, checkCustomerStateTransition(rules, CustomerStateUndeveloped, CustomerStateDeveloping, ""))
+	assert.NoError(t, checkCustomerStateTransition(rules, CustomerStateDeveloped, CustomerStateDeveloped, ""))
+
+	// 未配置的流转被拒绝
+	err := checkCustomerStateTransition(rules, CustomerStateUndeveloped, CustomerStateTraitor, "")
+	assert.EqualError(t, err, "不允许从「未开发」变更为「叛徒」")
+
+	// 拉黑必须填写原因
+	err = checkCustomerStateTransition(rules, CustomerStateDeveloping, CustomerStateBlacklisted, "  ")
+	assert.EqualError(t, err, "从「开发中」变更为「已拉黑」必须填写原因")
+	assert.NoError(t, checkCustomerStateTransition(rules, CustomerStateDeveloping, CustomerStateBlacklisted, "恶意压价"))
+
+	// 未定义的状态
+	var validationErr *ValidationError
+	assert.ErrorAs(t, checkCustomerStateTransition(rules, CustomerStateDeveloping, 9, "x"), &validationErr)
+	state := 9
+	assert.Error(t, validateCustomerBulkActions(CustomerBulkActions{SetState: &state}))
+	assert.Equal(t, "9", customerStateName(9))
+}
+
+// TestGetCustomerPoolConfig 测试公海池配置默认值
+func TestGetCustomerPoolConfig(t *testing.T) {
+	saved := AppConfig
+	defer func() { AppConfig = saved }()
+
+	AppConfig = nil
+	assert.Equal(t, CustomerPoolConfig{DailyClaimLimit: 20, RecycleDays: -1, WarningDays: 3}, GetCustomerPoolConfig())
+	AppConfig = &Config{Customer: CustomerConfig{Pool: CustomerPoolConfig{DailyClaimLimit: 5, MaxCustomers: 200, RecycleDays: 30}}}
+	assert.Equal(t, CustomerPoolConfig{DailyClaimLimit: 5, MaxCustomers: 200, RecycleDays: 30, WarningDays: 3}, GetCustomerPoolConfig())
+}
+
+// TestCustomerPoolRecycleAt 测试回收时间计算：回收时间不早于提醒后 WarningDays 天，还没有提醒过时从现在开始倒计时
+func TestCustomerPoolRecycleAt(t *testing.T) {
+	config := CustomerPoolConfig{RecycleDays: 30, WarningDays: 3}
+	now := time.Date(2025, 6, 1, 9, 0, 0, 0, time.Local)
+	lastActivity := now.AddDate(0, 0, -60)
+	assert.Equal(t, now.AddDate(0, 0, 3), customerPoolRecycleAt(config, lastActivity, nil, now))
+	warnedAt := now.AddDate(0, 0, -5)
+	assert.Equal(t, now.AddDate(0, 0, -2), customerPoolRecycleAt(config, lastActivity, &warnedAt, now))
+	warnedAt = now.AddDate(0, 0, -1)
+	assert.Equal(t, now.AddDate(0, 0, 2), customerPoolRecycleAt(config, lastActivity, &warnedAt, now))
+	recent := now.AddDate(0, 0, -20)
+	assert.Equal(t, recent.AddDate(0, 0, 30), customerPoolRecycleAt(config, recent, nil, now))
+}
+
+// TestRecycleInactiveCustomers 测试公海自动回收：到期客户先提醒负责人，提醒期结束仍无活动才回收
+func TestRecycleInactiveCustomers(t *testing.T) {
+	// 不回收时既不回收也不提醒
+	recycled, warned, err := recycleInactiveCustomers(CustomerPoolConfig{RecycleDays: -1})
+	assert.NoError(t, err)
+	assert.Zero(t, recycled+warned)
+
+	setupTestDB(t)
+	// Todo 的 enum 列类型无法在 PostgreSQL 上自动迁移，需要测试库中已有 todos 表
+	if !DB.Migrator().HasTable(&Todo{}) {
+		t.Skip("测试库缺少 todos 表，跳过公海回收测试")
+	}
+	if err := DB.AutoMigrate(&User{}, &FollowUpRecord{}, &CustomerPoolRecord{}); err != nil {
+		t.Fatalf("failed to migrate database: %v", err)
+	}
+	seller := &User{Name: "回收测试销售员"}
+	if err := DB.Create(seller).Error; err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	customer := func(days int) uint64 {
+		c := createTestCustomer(t, nil)
+		DB.Model(c).Updates(map[string]interface{}{"sellers": pq.Int64Array{int64(seller.ID)}, "saller_name": seller.Name, "created_at": time.Now().AddDate(0, 0, -days)})
+		return uint64(c.ID)
+	}
+	inactive, active := customer(60), customer(1)
+	t.Cleanup(func() {
+		DB.Where("customer_id IN ?", []uint64{inactive, active}).Delete(&Todo{})
+		DB.Where("customer_id IN ?", []uint64{inactive, active}).Delete(&CustomerPoolRecord{})
+		DB.Delete(&User{}, seller.ID)
+	})
+	config := CustomerPoolConfig{RecycleDays: 30, WarningDays: 3}
+
+	// 首次到期只提醒负责人
+	_, warned, err = recycleInactiveCustomers(config)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.GreaterOrEqual(t, warned, 1)
+	var todo Todo
+	assert.NoError(t, DB.Where("customer_id = ? AND executor_id = ?", inactive, seller.ID).First(&todo).Error)
+	assert.Equal(t, customerPoolWarnTitle, todo.Title)
+	var reloaded Customer
+	DB.First(&reloaded, inactive)
+	assert.Equal(t, []int64{int64(seller.ID)}, []int64(reloaded.Sellers))
+
+	// 提醒期结束仍无活动时回收到公海，并取消回收提醒
+	DB.Model(&CustomerPoolRecord{}).Where("customer_id = ? AND action = ?", inactive, CustomerPoolWarn).
+		Update("created_at", time.Now().AddDate(0, 0, -5))
+	recycled, _, err = recycleInactiveCustomers(config)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.GreaterOrEqual(t, recycled, 1)
+	reloaded = Customer{}
+	DB.First(&reloaded, inactive)
+	assert.Empty(t, reloaded.Sellers)
+	assert.Empty(t, reloaded.SallerName)
+	var record CustomerPoolRecord
+	assert.NoError(t, DB.Where("customer_id = ? AND action = ?", inactive, CustomerPoolRecycle).First(&record).Error)
+	assert.Equal(t, seller.ID, record.SellerID)
+	DB.First(&todo, todo.ID)
+	assert.Equal(t, TodoStatusCancelled, todo.Status)
+
+	// 近期有活动的客户不受影响
+	reloaded = Customer{}
+	DB.First(&reloaded, active)
+	assert.Equal(t, []int64{int64(seller.ID)}, []int64(reloaded.Sellers))
+	var records int64
+	DB.Model(&CustomerPoolRecord{}).Where("customer_id = ?", active).Count(&records)
+	assert.Zero(t, records)
+}
+
+// TestUniqueUint64s 测试ID去掉重复和为0的值并保持原有顺序
+func TestUniqueUint64s(t *testing.T) {
+	assert.Equal(t, []uint64{3, 1}, uniqueUint64s([]uint64{3, 0, 1, 3}))
+	assert.Empty(t, uniqueUint64s(nil))
+}
+
+// TestAddCustomerPoolResult 测试公海操作结果计数
+func TestAddCustomerPoolResult(t *testing.T) {
+	response := &CustomerPoolResponse{}
+	addCustomerPoolResult(response, CustomerPoolResult{CustomerID: 1, Success: true})
+	addCustomerPoolResult(response, CustomerPoolResult{CustomerID: 2, Message: "客户不在公海"})
+	assert.Equal(t, 1, response.Succeeded)
+	assert.Equal(t, 1, response.Failed)
+	assert.Len(t, response.Results, 2)
+}
+
+// TestValidateCustomerTransfer 测试客户转移请求校验
+func TestValidateCustomerTransfer(t *testing.T) {
+	req := CustomerTransferRequest{CustomerIDs: []uint64{1, 2}, FromSellerID: 3, ToSellerID: 4, Reason: "区域调整"}
+	assert.NoError(t, validateCustomerTransfer(req))
+
+	same := req
+	same.ToSellerID = 3
+	assert.EqualError(t, validateCustomerTransfer(same), "原销售员和新销售员不能相同")
+
+	both := req
+	both.All = true
+	assert.Error(t, validateCustomerTransfer(both))
+
+	neither := req
+	neither.CustomerIDs = nil
+	assert.Error(t, validateCustomerTransfer(neither))
+
+	// 员工离职时转移全部客户
+	leaving := CustomerTransferRequest{All: true, FromSellerID: 3, ToSellerID: 4, Reason: "离职交接"}
+	assert.NoError(t, validateCustomerTransfer(leaving))
+
+	blank := req
+	blank.Reason = "  "
+	assert.EqualError(t, validateCustomerTransfer(blank), "请填写转移原因")
+}
+
+// TestTransferCustomers 测试客户转移替换负责销售员、写入转移记录，并拒绝已删除、公海和不属于原销售员的客户
+func TestTransferCustomers(t *testing.T) {
+	setupTestDB(t)
+	if err := DB.AutoMigrate(&User{}, &CustomerTransfer{}); err != nil {
+		t.Fatalf("failed to migrate database: %v", err)
+	}
+	from, to, other := &User{Name: "转出销售员"}, &User{Name: "转入销售员"}, &User{Name: "其他销售员"}
+	for _, user := range []*User{from, to, other} {
+		if err := DB.Create(user).Error; err != nil {
+			t.Fatalf("failed to create user: %v", err)
+		}
+	}
+	t.Cleanup(func() {
+		DB.Where("from_seller_id = ?", from.ID).Delete(&CustomerTransfer{})
+		DB.Delete(&User{}, []uint64{from.ID, to.ID, other.ID})
+	})
+
+	customer := func(sellers []int64, sallerName string, deleted bool) uint64 {
+		c := createTestCustomer(t, nil)
+		DB.Model(c).Updates(map[string]interface{}{"sellers": pq.Int64Array(sellers), "saller_name": sallerName, "is_deleted": deleted})
+		return uint64(c.ID)
+	}
+	owned := customer([]int64{int64(from.ID), int64(other.ID)}, from.Name, false)
+	pooled := customer(nil, "", false)
+	deleted := customer([]int64{int64(from.ID)}, from.Name, true)
+	foreign := customer([]int64{int64(other.ID)}, other.Name, false)
+
+	req := CustomerTransferRequest{
+		CustomerIDs:  []uint64{owned, pooled, deleted, foreign},
+		FromSellerID: from.ID,
+		ToSellerID:   to.ID,
+		Reason:       "离职交接",
+		OperatorID:   other.ID,
+	}
+	response, err := transferCustomers(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []CustomerTransferResult{
+		{CustomerID: owned, Success: true},
+		{CustomerID: pooled, Message: "该客户不属于原销售员"},
+		{CustomerID: deleted, Message: "客户不存在"},
+		{CustomerID: foreign, Message: "该客户不属于原销售员"},
+	}, response.Results)
+	assert.Equal(t, pq.Int64Array{int64(owned)}, response.CustomerIDs)
+	assert.Equal(t, "转出销售员", response.FromSellerName)
+	assert.Equal(t, "转入销售员", response.ToSellerName)
+
+	var reloaded Customer
+	DB.First(&reloaded, owned)
+	assert.Equal(t, []int64{int64(other.ID), int64(to.ID)}, []int64(reloaded.Sellers))
+	assert.Equal(t, "转入销售员", reloaded.SallerName)
+	var changeLog CustomerChangeLog
+	assert.NoError(t, DB.Where("customer_id = ?", owned).Order("id DESC").First(&changeLog).Error)
+	assert.Equal(t, "从 转出销售员 转移给 转入销售员：离职交接", changeLog.Remark)
+	transfers, total := getCustomerTransfers(owned, 0, 1, 20)
+	assert.Equal(t, int64(1), total)
+	assert.Equal(t, response.ID, transfers[0].ID)
+
+	// all=true 只转移原销售员名下未删除的客户，没有可转移的客户时不写转移记录
+	req.CustomerIDs, req.All = nil, true
+	DB.Model(&Customer{}).Where("id = ?", owned).Update("sellers", pq.Int64Array{int64(from.ID)})
+	response, err = transferCustomers(req)
+	assert.NoError(t, err)
+	assert.Equal(t, []CustomerTransferResult{{CustomerID: owned, Success: true}}, response.Results)
+	response, err = transferCustomers(req)
+	assert.NoError(t, err)
+	assert.Empty(t, response.Results)
+	assert.Zero(t, response.ID)
+
+	// 新销售员已删除
+	DB.Model(to).Update("is_deleted", true)
+	_, err = transferCustomers(CustomerTransferRequest{CustomerIDs: []uint64{foreign}, FromSellerID: other.ID, ToSellerID: to.ID, Reason: "调整"})
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+}
+
+// TestGroupCRUD 测试客户组的创建、查询、更新和删除，删除时从客户的所属客户组中移除
+func TestGroupCRUD(t *testing.T) {
+	setupTestDB(t)
+	if err := DB.AutoMigrate(&User{}, &Group{}); err != nil {
+		t.Fatalf("failed to migrate database: %v", err)
+	}
+	creator := &User{Name: "客户组测试用户"}
+	if err := DB.Create(creator).Error; err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	var groupIDs []uint64
+	t.Cleanup(func() {
+		DB.Delete(&Group{}, groupIDs)
+		DB.Delete(&User{}, creator.ID)
+	})
+
+	_, err := createGroup(GroupRequest{Name: "无创建人"}, 0)
+	assert.ErrorIs(t, err, errGroupCreatorNotFound)
+
+	roles := JSONB{"朋友": []interface{}{float64(creator.ID)}}
+	group, err := createGroup(GroupRequest{Name: " 茶友会 ", Description: "喝茶的朋友", Roles: roles}, creator.ID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	groupIDs = append(groupIDs, group.ID)
+	assert.Equal(t, "茶友会", group.Name)
+	assert.Equal(t, creator.ID, group.CreatedBy)
+	assert.Equal(t, "客户组测试用户", group.CreatorName)
+	assert.Zero(t, group.MemberCount)
+
+	groups, total := getGroups("茶友", 1, 100)
+	assert.GreaterOrEqual(t, total, int64(1))
+	var found bool
+	for _, g := range groups {
+		found = found || g.ID == group.ID
+	}
+	assert.True(t, found, "getGroups should find the new group by keyword")
+
+	// 更新时不传组成人员则保持不变
+	updated, err := updateGroup(group.ID, GroupRequest{Name: "茶友会（老客户）", SortOrder: 3})
+	assert.NoError(t, err)
+	assert.Equal(t, "茶友会（老客户）", updated.Name)
+	assert.Equal(t, 3, updated.SortOrder)
+	assert.Equal(t, roles, updated.Roles)
+
+	customer := createTestCustomer(t, nil)
+	_, err = changeGroupCustomers(group.ID, GroupCustomersRequest{CustomerIDs: []uint64{uint64(customer.ID)}}, true)
+	assert.NoError(t, err)
+
+	assert.NoError(t, deleteGroup(group.ID, creator.ID))
+	_, err = getGroup(group.ID)
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+	var reloaded Customer
+	DB.First(&reloaded, customer.ID)
+	assert.Empty(t, reloaded.GroupID)
+	assert.ErrorIs(t, deleteGroup(group.ID, creator.ID), gorm.ErrRecordNotFound)
+}
+
+// TestGroupMembers 测试客户组成员的加入、移出和成员跟进汇总
+func TestGroupMembers(t *testing.T) {
+	setupTestDB(t)
+	if err := DB.AutoMigrate(&User{}, &Group{}, &FollowUpRecord{}); err != nil {
+		t.Fatalf("failed to migrate database: %v", err)
+	}
+	group := &Group{Name: "成员测试客户组"}
+	if err := DB.Omit("Creator").Create(group).Error; err != nil {
+		t.Fatalf("failed to create group: %v", err)
+	}
+	first, second := createTestCustomer(t, nil), createTestCustomer(t, nil)
+	ids := []uint64{uint64(first.ID), uint64(second.ID)}
+	t.Cleanup(func() {
+		DB.Where("customer_id IN ?", ids).Delete(&FollowUpRecord{})
+		DB.Delete(&Group{}, group.ID)
+	})
+
+	result, err := changeGroupCustomers(group.ID, GroupCustomersRequest{CustomerIDs: []uint64{ids[0], ids[1], ids[1], 0}}, true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, ids, result.Changed)
+	assert.Equal(t, []uint64{0}, result.NotFound)
+	result, err = changeGroupCustomers(group.ID, GroupCustomersRequest{CustomerIDs: []uint64{ids[0]}}, true)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{ids[0]}, result.Skipped)
+
+	DB.Model(&Customer{}).Where("id = ?", ids[0]).Updates(map[string]interface{}{"order_count": 2, "credit_sale": 30})
+	for i := 0; i < 2; i++ {
+		if err := DB.Omit("Customer", "User", "RelatedTodo", "ParentRecord").Create(&FollowUpRecord{CustomerID: ids[1], Title: "回访"}).Error; err != nil {
+			t.Fatalf("failed to create follow-up: %v", err)
+		}
+	}
+
+	members, total, summary, err := getGroupMembers(group.ID, 1, 20)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, int64(2), total)
+	if assert.Len(t, members, 2) {
+		assert.Equal(t, 2, members[0].OrderCount)
+		assert.Equal(t, int64(2), members[1].FollowUpCount)
+		assert.NotNil(t, members[1].LastFollowUpAt)
+	}
+	assert.Equal(t, int64(2), summary.CustomerCount)
+	assert.Equal(t, int64(2), summary.OrderCount)
+	assert.Equal(t, 30.0, summary.CreditSale)
+	assert.Equal(t, int64(2), summary.FollowUpCount)
+
+	result, err = changeGroupCustomers(group.ID, GroupCustomersRequest{CustomerIDs: ids[1:]}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, ids[1:], result.Changed)
+	_, total, _, err = getGroupMembers(group.ID, 1, 20)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), total)
+}
+
+// TestParseCustomerRelationTypes 测试客户关系类型参数解析
+func TestParseCustomerRelationTypes(t *testing.T) {
+	types, err := parseCustomerRelationTypes("")
+	assert.NoError(t, err)
+	assert.Nil(t, types)
+
+	types, err = parseCustomerRelationTypes("branch_of, referred_by,")
+	assert.NoError(t, err)
+	assert.Equal(t, []CustomerRelationType{CustomerRelationBranchOf, CustomerRelationReferredBy}, types)
+
+	_, err = parseCustomerRelationTypes("friend_of")
+	var validationErr *ValidationError
+	assert.ErrorAs(t, err, &validationErr)
+
+	for _, item := range getCustomerRelationTypes() {
+		assert.NotEmpty(t, item.Name)
+	}
+}
+
+// TestRelinkCustomerRelations 测试合并客户时关系改挂到保留客户，自环、重复和多余的上级关系被删除并可还原
+func TestRelinkCustomerRelations(t *testing.T) {
+	setupTestDB(t)
+	if err := DB.AutoMigrate(&CustomerRelation{}); err != nil {
+		t.Fatalf("failed to migrate database: %v", err)
+	}
+
+	var ids []uint64
+	for i := 0; i < 4; i++ {
+		customer := createTestCustomer(t, nil)
+		ids = append(ids, uint64(customer.ID))
+	}
+	survivor, merged, shop, other := ids[0], ids[1], ids[2], ids[3]
+	t.Cleanup(func() {
+		DB.Where("from_customer_id IN ? OR to_customer_id IN ?", ids, ids).Delete(&CustomerRelation{})
+	})
+
+	relations := []CustomerRelation{
+		{FromCustomerID: survivor, ToCustomerID: merged, Type: CustomerRelationRelativeOf}, // 成为自环
+		{FromCustomerID: survivor, ToCustomerID: shop, Type: CustomerRelationBranchOf},     // 保留客户原有的上级
+		{FromCustomerID: merged, ToCustomerID: other, Type: CustomerRelationBranchOf},      // 保留客户已有上级，删除
+		{FromCustomerID: shop, ToCustomerID: merged, Type: CustomerRelationRelativeOf},     // 改挂为 shop -> survivor
+		{FromCustomerID: other, ToCustomerID: merged, Type: CustomerRelationReferredBy},    // 改挂为 other -> survivor
+	}
+	for i := range relations {
+		relations[i].CreatedAt = time.Now()
+		if err := DB.Create(&relations[i]).Error; err != nil {
+			t.Fatalf("failed to create relation: %v", err)
+		}
+	}
+
+	var moved JSONB
+	var removed []CustomerRelation
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		moved, removed, err = relinkCustomerRelations(tx, []uint64{merged}, survivor)
+		return err
+	})
+	assert.NoError(t, err)
+	assert.Len(t, moved, 2)
+	if assert.Len(t, removed, 2) {
+		assert.Equal(t, relations[0].ID, removed[0].ID)
+		assert.Equal(t, relations[2].ID, removed[1].ID)
+	}
+
+	var current []CustomerRelation
+	DB.Where("from_customer_id IN ? OR to_customer_id IN ?", ids, ids).Order("id ASC").Find(&current)
+	if assert.Len(t, current, 3) {
+		assert.Equal(t, survivor, current[1].ToCustomerID)
+		assert.Equal(t, survivor, current[2].ToCustomerID)
+	}
+
+	// 撤销时还原改挂的关系并重建删除的关系
+	relinked, err := toJSONB(map[string]interface{}{"customer_relations": moved, "removed_customer_relations": removed})
+	assert.NoError(t, err)
+	assert.NoError(t, restoreCustomerRelations(DB, CustomerMerge{Relinked: relinked}))
+	DB.Where("from_customer_id IN ? OR to_customer_id IN ?", ids, ids).Order("id ASC").Find(&current)
+	if assert.Len(t, current, len(relations)) {
+		for i := range relations {
+			assert.Equal(t, relations[i].FromCustomerID, current[i].FromCustomerID)
+			assert.Equal(t, relations[i].ToCustomerID, current[i].ToCustomerID)
+		}
+	}
+}
+
+// TestAddCustomerReferralNode 测试推荐关系树节点的统计汇总
+func TestAddCustomerReferralNode(t *testing.T) {
+	response := &CustomerReferralResponse{}
+	addCustomerReferralNode(response, CustomerReferralNode{CustomerID: 2, Level: 1, OrderCount: 3, OrderAmount: 100.1})
+	addCustomerReferralNode(response, CustomerReferralNode{CustomerID: 3, Level: 2, OrderCount: 1, OrderAmount: 0.2})
+	assert.Equal(t, 1, response.DirectCount)
+	assert.Equal(t, 2, response.TotalCount)
+	assert.Equal(t, 4, response.OrderCount)
+	assert.Equal(t, 100.3, response.OrderAmount)
+}
+
+// TestBuildOrderItems 测试订单明细的新增、更新、删除和金额计算
+func TestBuildOrderItems(t *testing.T) {
+	now := time.Now()
+	order := &Order{ID: 7, ShippingFee: 12}
+	existing := []OrderItem{{ID: 1, OrderID: 7}, {ID: 2, OrderID: 7}}
+	items, removed, err := buildOrderItems(order, []OrderItemRequest{
+		{ID: 2, ProductName: "信阳毛尖", Quantity: 2, UnitPrice: 99.9, Discount: 10},
+		{ProductName: "红茶", Quantity: 1.5, UnitPrice: 40},
+	}, existing, now)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{1}, removed)
+	assert.Len(t, items, 2)
+	assert.Equal(t, uint64(2), items[0].ID)
+	assert.Equal(t, 189.8, items[0].Amount)
+	assert.Equal(t, uint64(0), items[1].ID)
+	assert.Equal(t, 1, items[1].SortOrder)
+	assert.Equal(t, 259.8, order.ItemAmount)
+	assert.Equal(t, 10.0, order.DiscountAmount)
+	assert.Equal(t, 261.8, order.TotalAmount)
+
+	_, _, err = buildOrderItems(order, []OrderItemRequest{{ID: 9, ProductName: "红茶", Quantity: 1, UnitPrice: 1}}, existing, now)
+	assert.Error(t, err)
+	_, _, err = buildOrderItems(order, []OrderItemRequest{{ProductName: "红茶", Quantity: 1, UnitPrice: 1, Discount: 2}}, nil, now)
+	assert.Error(t, err)
+}
+
+// TestApplyOrderPayment 测试订单付款状态和付款时间计算
+func TestApplyOrderPayment(t *testing.T) {
+	now := time.Now()
+	order := &Order{TotalAmount: 100}
+	assert.NoError(t, applyOrderPayment(order, OrderRequest{}, now))
+	assert.Equal(t, OrderUnpaid, order.PaymentStatus)
+	assert.Nil(t, order.PaidAt)
+
+	assert.NoError(t, applyOrderPayment(order, OrderRequest{PaidAmount: 30}, now))
+	assert.Equal(t, OrderPartialPaid, order.PaymentStatus)
+	assert.NotNil(t, order.PaidAt)
+
+	assert.NoError(t, applyOrderPayment(order, OrderRequest{PaymentStatus: OrderPaid}, now))
+	assert.Equal(t, 100.0, order.PaidAmount)
+
+	assert.Error(t, applyOrderPayment(order, OrderRequest{PaidAmount: 120}, now))
+	assert.Error(t, applyOrderPayment(order, OrderRequest{PaymentStatus: OrderUnpaid, PaidAmount: 10}, now))
+	assert.Error(t, applyOrderPayment(order, OrderRequest{PaymentStatus: OrderPaid, PaidAmount: 50}, now))
+	assert.Error(t, applyOrderPayment(order, OrderRequest{PaymentStatus: "refunded"}, now))
+
+	assert.Regexp(t, `^SO\d{17}$`, generateOrderNo(now))
+}
+
+// TestCustomerOrderAmountSQL 测试累计下单金额按订单扣除退款汇总，统计范围与客户订单统计一致
+func TestCustomerOrderAmountSQL(t *testing.T) {
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=localhost"}), &gorm.Config{DryRun: true, DisableAutomaticPing: true})
+	if err != nil {
+		t.Fatalf("failed to open dry run database: %v", err)
+	}
+	stmt := countedOrders(db).Select("SUM(total_amount - refund_amount)").Where("customer_id IN ?", []uint64{1, 2}).Find(&[]Order{}).Statement
+	assert.Contains(t, stmt.SQL.String(), "FROM \"orders\" WHERE (is_deleted = $1 AND total_amount > refund_amount) AND customer_id IN ($2,$3)")
+
+	sql := customerOrderAmountSQL("rc.id")
+	assert.Contains(t, sql, "SUM(o.total_amount - o.refund_amount)")
+	assert.Contains(t, sql, "o.customer_id = rc.id AND o.is_deleted = false AND o.total_amount > o.refund_amount")
+}
+
+// TestCustomerOrderAmounts 测试客户组成员和介绍链的下单金额按实际订单扣除退款汇总
+func TestCustomerOrderAmounts(t *testing.T) {
+	setupTestDB(t)
+	if err := DB.AutoMigrate(&Group{}, &User{}, &FollowUpRecord{}, &CustomerRelation{}, &Order{}); err != nil {
+		t.Fatalf("failed to migrate database: %v", err)
+	}
+	group := &Group{Name: "下单金额测试客户组"}
+	if err := DB.Omit("Creator").Create(group).Error; err != nil {
+		t.Fatalf("failed to create group: %v", err)
+	}
+	referrer, referral := createTestCustomer(t, nil), createTestCustomer(t, nil)
+	ids := []uint64{uint64(referrer.ID), uint64(referral.ID)}
+	t.Cleanup(func() {
+		DB.Where("customer_id IN ?", ids).Delete(&Order{})
+		DB.Where("from_customer_id IN ?", ids).Delete(&CustomerRelation{})
+		DB.Delete(&Group{}, group.ID)
+	})
+	_, err := changeGroupCustomers(group.ID, GroupCustomersRequest{CustomerIDs: ids[1:]}, true)
+	assert.NoError(t, err)
+	relation := &CustomerRelation{FromCustomerID: ids[1], ToCustomerID: ids[0], Type: CustomerRelationReferredBy, CreatedAt: time.Now()}
+	if err := DB.Create(relation).Error; err != nil {
+		t.Fatalf("failed to create relation: %v", err)
+	}
+
+	// 已删除和全部退款的订单不计入，部分退款的订单扣除退款
+	orders := []Order{
+		{TotalAmount: 100},
+		{TotalAmount: 50, RefundAmount: 20},
+		{TotalAmount: 80, RefundAmount: 80},
+		{TotalAmount: 999, BaseModel: BaseModel{IsDeleted: true}},
+	}
+	for i := range orders {
+		orders[i].OrderNo = fmt.Sprintf("TEST-AMOUNT-%d-%d", ids[1], i)
+		orders[i].CustomerID = ids[1]
+		orders[i].OrderDate = time.Now()
+		if err := DB.Create(&orders[i]).Error; err != nil {
+			t.Fatalf("failed to create order: %v", err)
+		}
+	}
+	assert.NoError(t, refreshCustomerOrderStats(DB, ids[1]))
+
+	amounts, err := customerOrderAmounts(DB, ids)
+	assert.NoError(t, err)
+	assert.Equal(t, map[uint64]float64{ids[1]: 130}, amounts)
+
+	members, _, summary, err := getGroupMembers(group.ID, 1, 20)
+	if assert.NoError(t, err) && assert.Len(t, members, 1) {
+		assert.Equal(t, 2, members[0].OrderCount)
+		assert.Equal(t, 130.0, members[0].OrderAmount)
+		assert.Equal(t, 130.0, summary.OrderAmount)
+	}
+
+	referrals, err := getCustomerReferrals(ids[0], 0)
+	if assert.NoError(t, err) && assert.Len(t, referrals.Referrals, 1) {
+		assert.Equal(t, 130.0, referrals.Referrals[0].OrderAmount)
+		assert.Equal(t, 130.0, referrals.OrderAmount)
+	}
+	ranking, err := getCustomerReferralRanking(CustomerReferralRankingRequest{Limit: 100})
+	assert.NoError(t, err)
+	for _, item := range ranking {
+		if item.CustomerID == ids[0] {
+			assert.Equal(t, 130.0, item.OrderAmount)
+		}
+	}
+}
+
+// TestIsDuplicateKeyError 测试唯一索引冲突的识别
+func TestIsDuplicateKeyError(t *testing.T) {
+	assert.True(t, isDuplicateKeyError(&pgconn.PgError{Code: "23505"}))
+	assert.True(t, isDuplicateKeyError(gorm.ErrDuplicatedKey))
+	assert.False(t, isDuplicateKeyError(&pgconn.PgError{Code: "23503"}))
+	assert.False(t, isDuplicateKeyError(errOrderNoExists))
+}
+
+// TestCreateWithDocumentNo 测试单号冲突时自动生成的单号重新生成，手工填写的单号返回单号已存在
+func TestCreateWithDocumentNo(t *testing.T) {
+	setupTestDB(t)
+
+	no, attempts := "SO1", 0
+	create := func(tx *gorm.DB) error {
+		attempts++
+		if no == "SO1" {
+			return &pgconn.PgError{Code: "23505"}
+		}
+		return nil
+	}
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		return createWithDocumentNo(tx, create, true, func() { no = "SO2" }, errOrderNoExists)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "SO2", no)
+	assert.Equal(t, 2, attempts)
+
+	no, attempts = "SO1", 0
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		return createWithDocumentNo(tx, create, false, func() { no = "SO2" }, errOrderNoExists)
+	})
+	assert.ErrorIs(t, err, errOrderNoExists)
+	assert.Equal(t, 1, attempts)
+}
+
+// TestBuildOrderReturnItems 测试退货明细的可退数量和退款金额校验
+func TestBuildOrderReturnItems(t *testing.T) {
+	now := time.Now()
+	orderItems := map[uint64]*OrderItem{
+		1: {ID: 1, ProductName: "信阳毛尖", Quantity: 3, Amount: 100},
+		2: {ID: 2, ProductName: "红茶", Quantity: 2, Amount: 80, ReturnedQty: 1, RefundedAmount: 40},
+	}
+	items, total, err := buildOrderReturnItems(orderItems, []OrderReturnItemRequest{
+		{OrderItemID: 1, Quantity: 1},
+		{OrderItemID: 2, Quantity: 1},
+	}, now)
+	assert.NoError(t, err)
+	assert.Len(t, items, 2)
+	// 按比例折算，退完剩余数量时退还剩余金额
+	assert.Equal(t, 33.33, items[0].RefundAmount)
+	assert.Equal(t, 40.0, items[1].RefundAmount)
+	assert.Equal(t, 73.33, total)
+
+	custom := 10.0
+	items, total, err = buildOrderReturnItems(orderItems, []OrderReturnItemRequest{{OrderItemID: 1, Quantity: 3, RefundAmount: &custom}}, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 10.0, total)
+
+	_, _, err = buildOrderReturnItems(orderItems, []OrderReturnItemRequest{{OrderItemID: 2, Quantity: 2}}, now)
+	assert.Error(t, err)
+	tooMuch := 50.0
+	_, _, err = buildOrderReturnItems(orderItems, []OrderReturnItemRequest{{OrderItemID: 2, Quantity: 1, RefundAmount: &tooMuch}}, now)
+	assert.Error(t, err)
+	_, _, err = buildOrderReturnItems(orderItems, []OrderReturnItemRequest{{OrderItemID: 1, Quantity: 1}, {OrderItemID: 1, Quantity: 1}}, now)
+	assert.Error(t, err)
+	_, _, err = buildOrderReturnItems(orderItems, []OrderReturnItemRequest{{OrderItemID: 9, Quantity: 1}}, now)
+	assert.Error(t, err)
+
+	// 已有退货的明细不能删除，也不能改到少于已退数量
+	order := &Order{ID: 7}
+	existing := []OrderItem{*orderItems[1], *orderItems[2]}
+	_, _, err = buildOrderItems(order, []OrderItemRequest{{ID: 1, ProductName: "信阳毛尖", Quantity: 3, UnitPrice: 33.34}}, existing, now)
+	assert.Error(t, err)
+	_, _, err = buildOrderItems(order, []OrderItemRequest{
+		{ID: 1, ProductName: "信阳毛尖", Quantity: 3, UnitPrice: 33.34},
+		{ID: 2, ProductName: "红茶", Quantity: 0.5, UnitPrice: 40},
+	}, existing, now)
+	assert.Error(t, err)
+	items2, _, err := buildOrderItems(order, []OrderItemRequest{
+		{ID: 1, ProductName: "信阳毛尖", Quantity: 3, UnitPrice: 33.34},
+		{ID: 2, ProductName: "红茶", Quantity: 2, UnitPrice: 40},
+	}, existing, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 1.0, items2[1].ReturnedQty)
+	assert.Equal(t, 40.0, items2[1].RefundedAmount)
+}
+
+// TestMergeSellerRevenue 测试销售员销售额与退款额合并计算净收入
+func TestMergeSellerRevenue(t *testing.T) {
+	items := mergeSellerRevenue(
+		[]SellerRevenueItem{{SellerID: 1, SellerName: "张三", OrderCount: 2, SalesAmount: 300}, {SellerID: 2, SellerName: "李四", OrderCount: 1, SalesAmount: 500}},
+		[]SellerRevenueItem{{SellerID: 2, ReturnCount: 1, RefundAmount: 250.5}, {SellerID: 3, SellerName: "王五", ReturnCount: 1, RefundAmount: 20}},
+	)
+	assert.Len(t, items, 3)
+	assert.Equal(t, uint64(1), items[0].SellerID)
+	assert.Equal(t, 249.5, items[1].NetRevenue)
+	assert.Equal(t, "李四", items[1].SellerName)
+	assert.Equal(t, -20.0, items[2].NetRevenue)
+
+	assert.Equal(t, 0.3333, returnRate(1, 3))
+	assert.Equal(t, 0.0, returnRate(1, 0))
+}
+
+// TestBuildProductCategoryTree 测试商品分类树构建和商品数量汇总
+func TestBuildProductCategoryTree(t *testing.T) {
+	categories := []ProductCategory{
+		{ID: 1, Name: "茶叶", Level: 1},
+		{ID: 2, ParentID: 1, Name: "红茶", Level: 2, SortOrder: 2},
+		{ID: 3, ParentID: 1, Name: "绿茶", Level: 2, SortOrder: 1},
+		{ID: 4, ParentID: 3, Name: "毛尖", Level: 3},
+		{ID: 5, ParentID: 99, Name: "孤立分类", Level: 2},
+	}
+	tree := buildProductCategoryTree(categories, map[uint64]int64{1: 1, 2: 2, 4: 3})
+	assert.Len(t, tree, 2)
+	assert.Equal(t, "茶叶", tree[0].Name)
+	assert.Equal(t, int64(6), tree[0].ProductCount)
+	assert.Equal(t, "绿茶", tree[0].Children[0].Name)
+	assert.Equal(t, int64(3), tree[0].Children[0].ProductCount)
+	assert.Equal(t, "孤立分类", tree[1].Name)
+	assert.NotNil(t, tree[1].Children)
+
+	byID := make(map[uint64]*ProductCategory)
+	for i := range categories {
+		byID[categories[i].ID] = &categories[i]
+	}
+	assert.Equal(t, []string{"茶叶", "绿茶", "毛尖"}, productCategoryPath(byID, 4))
+	assert.Equal(t, []string{}, productCategoryPath(byID, 0))
+	assert.ElementsMatch(t, []uint64{1, 2, 3, 4}, productCategoryDescendants(byID, 1))
+}
+
+// TestProductMatchScore 测试商品搜索的匹配评分
+func TestProductMatchScore(t *testing.T) {
+	product := &Product{Code: "MJ-001", Name: "信阳毛尖", Aliases: pq.StringArray{"毛尖茶", "Maojian"}}
+	cases := []struct {
+		keyword   string
+		score     int
+		matchedBy string
+	}{
+		{"mj-001", 100, "code"},
+		{"信阳 毛尖", 90, "name"},
+		{"maojian", 80, "alias"},
+		{"信阳", 60, "name"},
+		{"尖茶", 50, "alias"},
+		{"特级信阳毛尖250g", 40, "name"},
+		{"MJ", 20, "code"},
+		{"红茶", 0, ""},
+		{" ", 0, ""},
+	}
+	for _, tc := range cases {
+		score, matchedBy := productMatchScore(product, tc.keyword)
+		assert.Equal(t, tc.score, score, tc.keyword)
+		assert.Equal(t, tc.matchedBy, matchedBy, tc.keyword)
+	}
+
+	assert.Equal(t, pq.StringArray{"毛尖", "Maojian"}, normalizeProductAliases("信阳毛尖", []string{" 毛尖 ", "", "信阳毛尖", "Maojian", "maojian"}))
+}
+
+// TestCanonicalizeProductNames 测试自由文本商品名称映射为标准商品名称
+func TestCanonicalizeProductNames(t *testing.T) {
+	product := &Product{ID: 1, Name: "信阳毛尖"}
+	matched := map[string]*Product{"毛尖": product, "xymj": product}
+	assert.Equal(t, []string{"信阳毛尖", "红茶"}, canonicalizeProductNames([]string{"毛尖", "红茶", "XYMJ ", "信阳毛尖"}, matched))
+	assert.Nil(t, canonicalizeProductNames(nil, matched))
+
+	products, changed := replaceProductText(pq.StringArray{"毛尖", "红茶", "信阳毛尖"}, "毛尖", "信阳毛尖")
+	assert.True(t, changed)
+	assert.Equal(t, pq.StringArray{"信阳毛尖", "红茶"}, products)
+	_, changed = replaceProductText(pq.StringArray{"红茶"}, "毛尖", "信阳毛尖")
+	assert.False(t, changed)
+
+	favors := JSONB{
+		"p1": map[string]interface{}{"category": "产品偏好", "name": "毛尖"},
+		"p2": map[string]interface{}{"category": "沟通偏好", "name": "毛尖"},
+		"p3": map[string]interface{}{"category": "商品偏好", "name": "信阳毛尖", "product_id": float64(1)},
+	}
+	assert.Equal(t, 1, linkProductPreferences(favors, "毛尖", product, time.Now()))
+	assert.Equal(t, uint64(1), getUint64FromMap(favors["p1"].(map[string]interface{}), "product_id"))
+	assert.Equal(t, "毛尖", getStringFromMap(favors["p2"].(map[string]interface{}), "name"))
+	assert.Equal(t, []string{"信阳毛尖"}, productPreferenceNames(favors))
+}
+
+// TestProductSuggestions 测试未匹配商品名称的候选商品推荐
+func TestProductSuggestions(t *testing.T) {
+	products := []Product{
+		{ID: 1, Code: "A1", Name: "信阳毛尖"},
+		{ID: 2, Code: "A2", Name: "都匀毛尖", Aliases: pq.StringArray{"毛尖"}},
+		{ID: 3, Code: "B1", Name: "正山小种"},
+	}
+	suggestions := productSuggestions("毛尖", products, 3)
+	assert.Len(t, suggestions, 2)
+	assert.Equal(t, uint64(2), suggestions[0].ID)
+	assert.Equal(t, 1.0, suggestions[0].Similarity)
+	assert.Equal(t, 0.5, suggestions[1].Similarity)
+	assert.Len(t, productSuggestions("毛尖", products, 1), 1)
+	assert.Empty(t, productSuggestions("普洱", products, 3))
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/lib/pq"
@@ -15,21 +16,25 @@ type CustomerRequest struct {
 	Name         string   `json:"name" binding:"required,min=1,max=100"`
 	ContactName  string   `json:"contact_name" binding:"max=50"`
 	Phones       []string `json:"phones"`
+	WorkPhone    []string `json:"work_phone"` // 工作电话，更新时不传则保持不变
 	Wechats      []string `json:"wechats"`
 	Province     string   `json:"province" binding:"max=20"`
 	City         string   `json:"city" binding:"max=20"`
 	District     string   `json:"district" binding:"max=20"`
 	Address      string   `json:"address" binding:"max=200"`
+	DistrictID   int64    `json:"district_id"`
 	Products     []string `json:"products"`
 	Category     string   `json:"category" binding:"max=50"`
 	Tags         []string `json:"tags"`
 	State        int      `json:"state" binding:"min=0,max=10"`
+	StateReason  string   `json:"state_reason" binding:"max=500"` // 状态变更原因，部分状态流转必填
 	Level        int      `json:"level" binding:"min=0,max=10"`
 	Source       string   `json:"source" binding:"max=50"`
 	ImportSource string   `json:"import_source" binding:"max=50"`
 	Remark       string   `json:"remark" binding:"max=500"`
 	SallerName   string   `json:"saller_name" binding:"max=50"`
 	Sellers      []int64  `json:"sellers"`
+	Force        bool     `json:"force"` // 忽略疑似重复提示，强制创建
 }
 
 type CustomerResponse struct {
@@ -46,6 +51,10 @@ type CustomerResponse struct {
 	Province     string   `json:"province"`
 	City         string   `json:"city"`
 	District     string   `json:"district"`
+	DistrictID   int      `json:"district_id"`
+	Street       string   `json:"street"`
+	Lat          float64  `json:"lat"`
+	Lon          float64  `json:"lon"`
 	Company      string   `json:"company"`
 	Products     []string `json:"products"`
 	Category     string   `json:"category"`
@@ -58,6 +67,8 @@ type CustomerResponse struct {
 	Remark       string   `json:"remark"`
 	Organization string   `json:"organization,omitempty"`
 	CreatedAt    string   `json:"created_at"`
+
+	Groups []GroupBrief `json:"groups,omitempty"` // 所属客户组，仅客户详情返回
 }
 
 // CustomerToResponse 将客户模型转换为响应
@@ -73,6 +84,10 @@ func CustomerToResponse(customer *Customer) *CustomerResponse {
 		Province:     customer.Province,
 		City:         customer.City,
 		District:     customer.District,
+		DistrictID:   customer.DistrictID,
+		Street:       customer.Street,
+		Lat:          customer.Lat,
+		Lon:          customer.Lon,
 		Products:     []string(customer.Products),
 		Category:     customer.Category,
 		Tags:         []string(customer.Tags),
@@ -197,7 +212,7 @@ type UserDetailResponse struct {
 	Name         string `json:"name"`
 	DisplayInfo  string `json:"display_info"`  // 显示信息（department+position 或 客户公司名）
 	IsEmployee   bool   `json:"is_employee"`   // 是否为员工
-	TodayRevenue int    `json:"today_revenue"` // 今日营业额（暂时默认0）
+	TodayRevenue int    `json:"today_revenue"` // 今日营业额（今日订单金额减去今日退款，取整）
 	TodayFollows int    `json:"today_follows"` // 今日跟进数量
 	AvatarURL    string `json:"avatar_url"`
 }
@@ -243,7 +258,7 @@ type CustomerSearchResponse struct {
 // Tag 相关请求响应
 type TagCreateRequest struct {
 	DimensionID uint64 `json:"dimension_id" binding:"required"`
-	Name        string `json:"name" binding:"required,max=128"`
+	Name        string `json:"name" binding:"required,max=256"`
 	Color       string `json:"color"`
 	Description string `json:"description"`
 	SortOrder   int    `json:"sort_order"`
@@ -280,13 +295,14 @@ type ReminderResponse struct {
 
 // 客户偏好相关请求响应
 type CustomerPreferenceItem struct {
-	ID          string      `json:"id"`          // 偏好项ID
-	Category    string      `json:"category"`    // 偏好分类（如：产品偏好、服务偏好、沟通偏好等）
-	Name        string      `json:"name"`        // 偏好名称
-	Value       interface{} `json:"value"`       // 偏好值（可以是字符串、数字、布尔值等）
-	Description string      `json:"description"` // 偏好描述
-	CreatedAt   time.Time   `json:"created_at"`  // 创建时间
-	UpdatedAt   time.Time   `json:"updated_at"`  // 更新时间
+	ID          string      `json:"id"`                   // 偏好项ID
+	Category    string      `json:"category"`             // 偏好分类（如：产品偏好、服务偏好、沟通偏好等）
+	Name        string      `json:"name"`                 // 偏好名称
+	Value       interface{} `json:"value"`                // 偏好值（可以是字符串、数字、布尔值等）
+	Description string      `json:"description"`          // 偏好描述
+	ProductID   uint64      `json:"product_id,omitempty"` // 关联的商品ID（产品偏好）
+	CreatedAt   time.Time   `json:"created_at"`           // 创建时间
+	UpdatedAt   time.Time   `json:"updated_at"`           // 更新时间
 }
 
 type CustomerPreferenceCreateRequest struct {
@@ -317,6 +333,267 @@ type CustomerPreferenceListResponse struct {
 	Total        int                      `json:"total"`
 }
 
+// CustomerImportRow 销售记录导入行（仅保留与客户档案相关的列）
+type CustomerImportRow struct {
+	RowNumber            int      `json:"row"`                    // 文件中的行号（从1开始，含表头）
+	OriginalCustomerID   string   `json:"original_customer_id"`   // 客户ID
+	CustomerName         string   `json:"customer_name"`          // 客户
+	CustomerPhone        string   `json:"customer_phone"`         // 客户电话
+	Receiver             string   `json:"receiver"`               // 收货人
+	ReceiverPhone        string   `json:"receiver_phone"`         // 收货号码
+	ReceiverAddress      string   `json:"receiver_address"`       // 收货地址
+	SellerID             string   `json:"seller_id"`              // 销售员ID
+	SellerName           string   `json:"seller_name"`            // 销售员
+	ProductName          string   `json:"product_name"`           // 商品名称
+	ProductCode          string   `json:"product_code"`           // 商品编码
+	ProductCategories    []string `json:"product_categories"`     // 商品分类一至四
+	ProductAliases       string   `json:"product_aliases"`        // 商品别名
+	ProductUnit          string   `json:"product_unit"`           // 单位
+	ProductUnitWeight    string   `json:"product_unit_weight"`    // 单位重量
+	ProductPurchasePrice string   `json:"product_purchase_price"` // 进价
+	DeliveryMethod       string   `json:"delivery_method"`        // 发货方式
+}
+
+// CustomerImportRowResult 单行导入结果
+type CustomerImportRowResult struct {
+	Row          int             `json:"row"`                     // 文件中的行号
+	Status       ImportRowStatus `json:"status"`                  // created/updated/skipped/failed
+	CustomerID   uint            `json:"customer_id,omitempty"`   // 创建或更新的客户ID
+	CustomerName string          `json:"customer_name,omitempty"` // 客户名称
+	Message      string          `json:"message,omitempty"`       // 跳过或失败原因
+}
+
+// CustomerImportResponse 客户导入结果汇总
+type CustomerImportResponse struct {
+	ImportSource string                    `json:"import_source"`
+	DryRun       bool                      `json:"dry_run"`
+	Total        int                       `json:"total"`
+	Created      int                       `json:"created"`
+	Updated      int                       `json:"updated"`
+	Skipped      int                       `json:"skipped"`
+	Failed       int                       `json:"failed"`
+	Rows         []CustomerImportRowResult `json:"rows"`
+}
+
+// ImportJobCreateRequest 创建导入任务请求（multipart表单字段）
+type ImportJobCreateRequest struct {
+	ImportSource string `form:"import_source" binding:"max=256"`
+	DryRun       bool   `form:"dry_run"`
+	CreatedBy    uint64 `form:"created_by"`
+}
+
+// ImportJobResponse 导入任务响应
+type ImportJobResponse struct {
+	ImportJob
+	Progress int `json:"progress"` // 处理进度百分比（0-100）
+}
+
+// ParsedAddress 地址解析结果
+type ParsedAddress struct {
+	Province   string `json:"province"`    // 省份
+	City       string `json:"city"`        // 城市
+	District   string `json:"district"`    // 区县
+	DistrictID int    `json:"district_id"` // 区县行政代码
+	Street     string `json:"street"`      // 街道/乡镇
+	Detail     string `json:"detail"`      // 街道之后的详细地址
+}
+
+// RegionResponse 行政区划响应
+type RegionResponse struct {
+	Code        string `json:"code"`         // 行政区划代码
+	Name        string `json:"name"`         // 名称
+	Level       int    `json:"level"`        // 层级：1=省 2=市 3=区县
+	ParentCode  string `json:"parent_code"`  // 上级代码
+	FullName    string `json:"full_name"`    // 含上级的完整名称
+	HasChildren bool   `json:"has_children"` // 是否有下级区划
+}
+
+// RegionDetailResponse 行政区划详情
+type RegionDetailResponse struct {
+	RegionResponse
+	Ancestors []RegionResponse `json:"ancestors"` // 上级区划（从省开始）
+	Children  []RegionResponse `json:"children"`  // 下级区划
+}
+
+// RegionValidateRequest 行政区划校验请求
+type RegionValidateRequest struct {
+	DistrictID    int64   `json:"district_id"`    // 客户区县编码
+	ShippingInfos []JSONB `json:"shipping_infos"` // 收货信息（校验 districtId 与省市区名称）
+}
+
+// GeoCustomerFilter 地理位置搜索的通用筛选条件（逗号分隔的多个值）
+type GeoCustomerFilter struct {
+	Level   string `form:"level"`   // 客户等级，如"1,2"
+	State   string `form:"state"`   // 客户状态，如"0,1"
+	Sellers string `form:"sellers"` // 销售员ID，任一匹配即可
+	Limit   int    `form:"limit" binding:"omitempty,min=1,max=1000"`
+}
+
+// NearbyCustomerRequest 附近客户查询
+type NearbyCustomerRequest struct {
+	Lat      *float64 `form:"lat" binding:"required,min=-90,max=90"` // 指针类型，允许纬度为0
+	Lon      *float64 `form:"lon" binding:"required,min=-180,max=180"`
+	RadiusKm float64  `form:"radius_km" binding:"omitempty,gt=0,max=500"` // 搜索半径（千米），默认5
+	GeoCustomerFilter
+}
+
+// BoundingBoxCustomerRequest 地图可视范围内的客户查询
+type BoundingBoxCustomerRequest struct {
+	MinLat *float64 `form:"min_lat" binding:"required,min=-90,max=90"` // 指针类型，允许边界为0
+	MinLon *float64 `form:"min_lon" binding:"required,min=-180,max=180"`
+	MaxLat *float64 `form:"max_lat" binding:"required,min=-90,max=90,gtefield=MinLat"`
+	MaxLon *float64 `form:"max_lon" binding:"required,min=-180,max=180,gtefield=MinLon"`
+	Lat    *float64 `form:"lat" binding:"omitempty,min=-90,max=90"`   // 距离参考点纬度，默认取矩形中心
+	Lon    *float64 `form:"lon" binding:"omitempty,min=-180,max=180"` // 距离参考点经度，默认取矩形中心
+	GeoCustomerFilter
+}
+
+// NearbyCustomerResponse 带距离的客户
+type NearbyCustomerResponse struct {
+	*CustomerResponse
+	DistanceKm float64 `json:"distance_km"` // 与参考点的距离（千米）
+}
+
+// VisitRoutePlanRequest 销售员每日拜访路线规划请求
+type VisitRoutePlanRequest struct {
+	Date              string   `form:"date" binding:"required"`                     // 拜访日期（YYYY-MM-DD）
+	StartLat          *float64 `form:"start_lat" binding:"required,min=-90,max=90"` // 指针类型，允许纬度为0
+	StartLon          *float64 `form:"start_lon" binding:"required,min=-180,max=180"`
+	VisitIntervalDays *int     `form:"visit_interval_days" binding:"omitempty,min=0,max=365"` // 超过多少天未拜访视为逾期拜访目标，默认30，0表示不纳入
+	MaxStops          int      `form:"max_stops" binding:"omitempty,min=1,max=100"`           // 最多拜访客户数，默认30
+	ReturnToStart     bool     `form:"return_to_start"`                                       // 是否返回出发点
+	GeoJSON           bool     `form:"geojson"`                                               // 是否返回 GeoJSON 路线
+}
+
+// VisitRouteStop 拜访路线中的一站
+type VisitRouteStop struct {
+	Sequence             int        `json:"sequence"` // 拜访顺序（从1开始）
+	CustomerID           uint       `json:"customer_id"`
+	CustomerName         string     `json:"customer_name"`
+	Address              string     `json:"address"`
+	Lat                  float64    `json:"lat"`
+	Lon                  float64    `json:"lon"`
+	Reason               string     `json:"reason"`   // 纳入原因：todo_due/todo_overdue/visit_overdue
+	TodoIDs              []uint64   `json:"todo_ids"` // 关联的待办
+	LastVisited          *time.Time `json:"last_visited"`
+	LegDistanceKm        float64    `json:"leg_distance_km"`        // 距上一站的距离（千米）
+	CumulativeDistanceKm float64    `json:"cumulative_distance_km"` // 累计距离（千米）
+}
+
+// VisitRoutePlanResponse 拜访路线规划结果
+type VisitRoutePlanResponse struct {
+	SellerID        uint64           `json:"seller_id"`
+	Date            string           `json:"date"`
+	Stops           []VisitRouteStop `json:"stops"`
+	Skipped         []VisitRouteStop `json:"skipped"`           // 缺少坐标无法排入路线的客户
+	Dropped         []VisitRouteStop `json:"dropped"`           // 超出 max_stops 未排入路线的客户（逾期拜访客户最多列出 max_stops 个）
+	DroppedTotal    int64            `json:"dropped_total"`     // 超出 max_stops 未排入路线的客户总数
+	TotalDistanceKm float64          `json:"total_distance_km"` // 路线总距离（千米）
+	GeoJSON         *GeoJSONFeature  `json:"geojson,omitempty"` // GeoJSON LineString Feature
+}
+
+// GeoJSONGeometry GeoJSON 几何对象（坐标顺序为 [经度, 纬度]）
+type GeoJSONGeometry struct {
+	Type        string      `json:"type"` // Point/LineString
+	Coordinates interface{} `json:"coordinates"`
+}
+
+// GeoJSONFeature GeoJSON 要素
+type GeoJSONFeature struct {
+	Type       string                 `json:"type"` // 固定为 Feature
+	ID         interface{}            `json:"id,omitempty"`
+	Geometry   GeoJSONGeometry        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// GeoJSONFeatureCollection GeoJSON 要素集合
+type GeoJSONFeatureCollection struct {
+	Type      string           `json:"type"` // 固定为 FeatureCollection
+	Features  []GeoJSONFeature `json:"features"`
+	Truncated bool             `json:"truncated"` // 是否因 limit 截断了客户或聚合网格
+}
+
+// CustomerGeoJSONRequest 客户地图数据请求，筛选条件与客户搜索一致
+type CustomerGeoJSONRequest struct {
+	Keyword    string   `form:"keyword"`
+	SystemTags string   `form:"system_tags"`                                // 逗号分隔的系统标签ID
+	RegionCode string   `form:"region_code"`                                // 行政区划代码
+	Zoom       *int     `form:"zoom" binding:"omitempty,min=0,max=22"`      // 地图缩放级别，传入时按网格聚合
+	MinLat     *float64 `form:"min_lat" binding:"omitempty,min=-90,max=90"` // 可视范围（可选）
+	MinLon     *float64 `form:"min_lon" binding:"omitempty,min=-180,max=180"`
+	MaxLat     *float64 `form:"max_lat" binding:"omitempty,min=-90,max=90"`
+	MaxLon     *float64 `form:"max_lon" binding:"omitempty,min=-180,max=180"`
+	Limit      int      `form:"limit" binding:"omitempty,min=1,max=20000"` // 最多返回的要素数，默认5000
+}
+
+// DuplicateScanRequest 创建客户查重任务请求
+type DuplicateScanRequest struct {
+	Threshold float64 `json:"threshold" binding:"omitempty,gt=0,lte=1"` // 名称地址相似度阈值，默认0.8
+	CreatedBy uint64  `json:"created_by"`
+}
+
+// DuplicateGroupCustomer 重复分组中的客户概要
+type DuplicateGroupCustomer struct {
+	ID         uint     `json:"id"`
+	Name       string   `json:"name"`
+	Phones     []string `json:"phones"`
+	Wechats    []string `json:"wechats"`
+	City       string   `json:"city"`
+	Address    string   `json:"address"`
+	Sellers    []int64  `json:"sellers"`
+	SallerName string   `json:"saller_name"`
+	CreatedAt  string   `json:"created_at"`
+}
+
+// DuplicateGroupResponse 重复分组响应
+type DuplicateGroupResponse struct {
+	DuplicateGroup
+	Customers []DuplicateGroupCustomer `json:"customers"`
+}
+
+// CustomerMergeRequest 合并客户请求
+type CustomerMergeRequest struct {
+	SurvivorID uint64   `json:"survivor_id" binding:"required"`
+	MergedIDs  []uint64 `json:"merged_ids" binding:"required,min=1"`
+	GroupID    *uint64  `json:"group_id"` // 来源重复分组，合并后标记为已合并
+	OperatorID uint64   `json:"operator_id"`
+}
+
+// CustomerMergeResponse 合并结果
+type CustomerMergeResponse struct {
+	Merge    CustomerMerge     `json:"merge"`
+	Customer *CustomerResponse `json:"customer"`
+}
+
+// CustomerDuplicateMatch 创建客户时命中的疑似重复客户
+type CustomerDuplicateMatch struct {
+	ID          uint     `json:"id"`
+	Name        string   `json:"name"`
+	Phones      []string `json:"phones"`
+	Wechats     []string `json:"wechats"`
+	City        string   `json:"city"`
+	Sellers     []int64  `json:"sellers"`      // 归属销售员ID
+	SellerNames []string `json:"seller_names"` // 归属销售员姓名
+	SallerName  string   `json:"saller_name"`
+	MatchedBy   []string `json:"matched_by"` // 命中原因
+}
+
+// AddressBackfillResponse 客户地址批量补全结果
+type AddressBackfillResponse struct {
+	Scanned             int                         `json:"scanned"`              // 扫描的客户数
+	Updated             int                         `json:"updated"`              // 补全了字段的客户数
+	Unresolved          int                         `json:"unresolved"`           // 回填后仍没有区县编码的客户数
+	UnresolvedCustomers []AddressBackfillUnresolved `json:"unresolved_customers"` // 未解析出区县的客户（最多返回前100个）
+}
+
+// AddressBackfillUnresolved 地址回填后仍无法确定区县编码的客户
+type AddressBackfillUnresolved struct {
+	CustomerID uint   `json:"customer_id"`
+	Name       string `json:"name"`
+	Address    string `json:"address"`
+	Reason     string `json:"reason"` // 未解析原因
+}
+
 // 类型转换辅助函数
 func convertJSONBToStringArray(jsonb JSONB) pq.StringArray {
 	if jsonb == nil {
@@ -988,3 +1265,740 @@ func (dto *TagDTO) FromModel(tag *Tag) {
 	dto.Description = tag.Description
 	dto.SortOrder = tag.SortOrder
 }
+
+// ContactLookupRequest 按联系方式查找客户的请求参数（至少提供一项）
+type ContactLookupRequest struct {
+	Phone   string `form:"phone"`
+	Wechat  string `form:"wechat"`
+	Douyin  string `form:"douyin"`
+	Kwai    string `form:"kwai"`
+	Redbook string `form:"redbook"`
+}
+
+// CustomerExportRequest 客户导出请求参数，筛选条件与客户列表/搜索一致
+type CustomerExportRequest struct {
+	Format     string `form:"format"`      // csv（默认）或 xlsx
+	Columns    string `form:"columns"`     // 逗号分隔的列名，为空时导出默认列
+	Keyword    string `form:"keyword"`     // 客户名称或联系人关键词
+	Search     string `form:"search"`      // 同 keyword，兼容客户列表参数
+	SystemTags string `form:"system_tags"` // 逗号分隔的系统标签ID
+	RegionCode string `form:"region_code"`
+	SegmentID  uint64 `form:"segment_id"` // 只导出该分群的成员
+	UserID     uint64 `form:"user_id"`    // 当前用户，用于校验分群访问权限
+}
+
+// CustomerExportColumnResponse 可导出的列
+type CustomerExportColumnResponse struct {
+	Key     string `json:"key"`
+	Title   string `json:"title"`
+	Default bool   `json:"default"`
+}
+
+// CustomerFilterCondition 客户筛选条件：字段 + 操作符 + 值
+// value 可为单个值或数组（in/nin/between/any/all/none），is_null/not_null 不需要值
+type CustomerFilterCondition struct {
+	Field string      `json:"field"`
+	Op    string      `json:"op"`
+	Value interface{} `json:"value"`
+}
+
+// CustomerSortField 客户排序字段，nulls 可选 first/last 指定空值排在前面还是后面
+type CustomerSortField struct {
+	Field string `json:"field"`
+	Desc  bool   `json:"desc"`
+	Nulls string `json:"nulls"`
+}
+
+// CustomerFilter 客户结构化筛选与排序条件，多个条件之间为“且”关系
+type CustomerFilter struct {
+	Search     string                    `json:"search"`
+	RegionCode string                    `json:"region_code"`
+	Conditions []CustomerFilterCondition `json:"conditions"`
+	Sort       []CustomerSortField       `json:"sort"`
+}
+
+// CustomerQueryRequest 以 JSON 请求体查询客户列表
+type CustomerQueryRequest struct {
+	CustomerFilter
+	Page  int `json:"page"`
+	Limit int `json:"limit"`
+}
+
+// CustomerSegmentRequest 创建/更新客户分群请求
+type CustomerSegmentRequest struct {
+	Name        string              `json:"name" binding:"required"`
+	Description string              `json:"description"`
+	OwnerID     uint64              `json:"owner_id"` // 创建时必填，更新时忽略
+	Shared      bool                `json:"shared"`
+	Mode        CustomerSegmentMode `json:"mode"` // dynamic（默认）或 snapshot
+	Filter      CustomerFilter      `json:"filter"`
+}
+
+// CustomerSegmentResponse 客户分群响应
+type CustomerSegmentResponse struct {
+	ID            uint64              `json:"id"`
+	Name          string              `json:"name"`
+	Description   string              `json:"description"`
+	OwnerID       uint64              `json:"owner_id"`
+	OwnerName     string              `json:"owner_name"`
+	Shared        bool                `json:"shared"`
+	Mode          CustomerSegmentMode `json:"mode"`
+	Filter        CustomerFilter      `json:"filter"`
+	SnapshotCount int                 `json:"snapshot_count"`
+	SnapshotAt    *time.Time          `json:"snapshot_at"`
+	CreatedAt     time.Time           `json:"created_at"`
+	UpdatedAt     time.Time           `json:"updated_at"`
+}
+
+// CustomerBulkActions 批量操作内容（删除不能与其他操作同时进行）
+type CustomerBulkActions struct {
+	AddTags          []string `json:"add_tags,omitempty"`
+	RemoveTags       []string `json:"remove_tags,omitempty"`
+	AddSystemTags    []int64  `json:"add_system_tags,omitempty"`
+	RemoveSystemTags []int64  `json:"remove_system_tags,omitempty"`
+	SetLevel         *int     `json:"set_level,omitempty"`
+	SetState         *int     `json:"set_state,omitempty"`
+	StateReason      string   `json:"state_reason,omitempty"` // 状态变更原因
+	SetCategory      *string  `json:"set_category,omitempty"`
+	AddSellers       []int64  `json:"add_sellers,omitempty"`
+	RemoveSellers    []int64  `json:"remove_sellers,omitempty"`
+	Delete           bool     `json:"delete,omitempty"` // 软删除
+}
+
+// CustomerBulkRequest 客户批量操作请求：ids 与 filter/segment_id 二选一
+type CustomerBulkRequest struct {
+	IDs        []uint64            `json:"ids"`
+	Filter     *CustomerFilter     `json:"filter"`
+	SegmentID  uint64              `json:"segment_id"`
+	OperatorID uint64              `json:"operator_id"`
+	Actions    CustomerBulkActions `json:"actions"`
+}
+
+// CustomerBulkResult 批量操作中单个客户的处理结果
+type CustomerBulkResult struct {
+	CustomerID uint64             `json:"customer_id"`
+	Status     CustomerBulkStatus `json:"status"`
+	Message    string             `json:"message,omitempty"`
+	Changes    JSONB              `json:"changes,omitempty"`
+}
+
+// CustomerBulkResponse 批量操作响应
+type CustomerBulkResponse struct {
+	Operation *CustomerBulkOperation `json:"operation"`
+	Results   []CustomerBulkResult   `json:"results"`
+}
+
+// CustomerArrayOps PATCH 中对数组字段逐项添加/移除的值
+type CustomerArrayOps struct {
+	Phones     []string `json:"phones"`
+	WorkPhone  []string `json:"work_phone"`
+	Wechats    []string `json:"wechats"`
+	WorkWechat []string `json:"work_wechat"`
+	Douyins    []string `json:"douyins"`
+	Kwais      []string `json:"kwais"`
+	Redbooks   []string `json:"redbooks"`
+	Tags       []string `json:"tags"`
+	Products   []string `json:"products"`
+	Sellers    []int64  `json:"sellers"`
+	SystemTags []int64  `json:"system_tags"`
+}
+
+// CustomerPatchRequest 客户部分更新请求：只修改请求中出现的字段；
+// extra_info 按 JSON Merge Patch 合并（值为 null 的键被删除，整体为 null 时清空），add/remove 对数组字段逐项增删
+type CustomerPatchRequest struct {
+	Name         *string         `json:"name"`
+	ContactName  *string         `json:"contact_name"`
+	Gender       *int            `json:"gender"`
+	Phones       *[]string       `json:"phones"`
+	WorkPhone    *[]string       `json:"work_phone"`
+	Wechats      *[]string       `json:"wechats"`
+	WorkWechat   *[]string       `json:"work_wechat"`
+	Douyins      *[]string       `json:"douyins"`
+	Kwais        *[]string       `json:"kwais"`
+	Redbooks     *[]string       `json:"redbooks"`
+	Province     *string         `json:"province"`
+	City         *string         `json:"city"`
+	District     *string         `json:"district"`
+	DistrictID   *int64          `json:"district_id"`
+	Address      *string         `json:"address"`
+	Lat          *float64        `json:"lat"`
+	Lon          *float64        `json:"lon"`
+	Products     *[]string       `json:"products"`
+	Category     *string         `json:"category"`
+	Tags         *[]string       `json:"tags"`
+	SystemTags   *[]int64        `json:"system_tags"`
+	State        *int            `json:"state"`
+	StateReason  string          `json:"state_reason"`
+	Level        *int            `json:"level"`
+	Kind         *int            `json:"kind"`
+	AddedWechat  *bool           `json:"added_wechat"`
+	CreditSale   *float64        `json:"credit_sale"`
+	Source       *string         `json:"source"`
+	ImportSource *string         `json:"import_source"`
+	Remark       *string         `json:"remark"`
+	SallerName   *string         `json:"saller_name"`
+	Sellers      *[]int64        `json:"sellers"`
+	ExtraInfo    json.RawMessage `json:"extra_info"` // 保留原始值以区分未传和显式 null
+
+	Add    *CustomerArrayOps `json:"add"`
+	Remove *CustomerArrayOps `json:"remove"`
+}
+
+// CustomerFieldChange 单个字段的变化
+type CustomerFieldChange struct {
+	Field      string      `json:"field"`
+	Old        interface{} `json:"old"`
+	New        interface{} `json:"new"`
+	Revertable bool        `json:"revertable"` // 是否可以恢复为变更前的值
+}
+
+// CustomerChangeLogResponse 客户变更日志响应
+type CustomerChangeLogResponse struct {
+	ID           uint64                `json:"id"`
+	CustomerID   uint64                `json:"customer_id"`
+	OperatorID   uint64                `json:"operator_id"`
+	OperatorName string                `json:"operator_name"`
+	Action       ActionType            `json:"action"`
+	Source       CustomerChangeSource  `json:"source"`
+	Remark       string                `json:"remark"`
+	Changes      []CustomerFieldChange `json:"changes"`
+	CreatedAt    time.Time             `json:"created_at"`
+}
+
+// CustomerRevertRequest 将单个字段恢复为某条变更日志中的旧值
+type CustomerRevertRequest struct {
+	Field      string `json:"field" binding:"required"`
+	OperatorID uint64 `json:"operator_id"`
+}
+
+// CustomerTrashResponse 回收站中的客户
+type CustomerTrashResponse struct {
+	*CustomerResponse
+	DeletedAt  *time.Time `json:"deleted_at"`
+	DeletedBy  uint       `json:"deleted_by"`
+	PurgeAt    *time.Time `json:"purge_at"`              // 到期后将被彻底删除
+	KeptReason string     `json:"kept_reason,omitempty"` // 不会被彻底删除的原因，此时 purge_at 为空
+}
+
+// CustomerPurgeResponse 清理回收站结果
+type CustomerPurgeResponse struct {
+	Customers int64 `json:"customers"`
+	Todos     int64 `json:"todos"`
+	Reminders int64 `json:"reminders"`
+	Records   int64 `json:"records"`
+	Kept      int64 `json:"kept"` // 已到期但因有订单或退货单而保留的客户数
+}
+
+// CustomerStateChangeRequest 变更客户状态请求
+type CustomerStateChangeRequest struct {
+	State      *int   `json:"state" binding:"required"`
+	Reason     string `json:"reason" binding:"max=500"`
+	OperatorID uint64 `json:"operator_id"`
+}
+
+// CustomerStateItem 客户状态
+type CustomerStateItem struct {
+	State int    `json:"state"`
+	Name  string `json:"name"`
+}
+
+// CustomerStateTransitionItem 状态流转规则
+type CustomerStateTransitionItem struct {
+	FromState     int    `json:"from_state"`
+	FromName      string `json:"from_name"`
+	ToState       int    `json:"to_state"`
+	ToName        string `json:"to_name"`
+	RequireReason bool   `json:"require_reason"`
+}
+
+// CustomerStatesResponse 客户状态及流转规则
+type CustomerStatesResponse struct {
+	States      []CustomerStateItem           `json:"states"`
+	Transitions []CustomerStateTransitionItem `json:"transitions"`
+}
+
+// CustomerStateTransitionsRequest 整体替换状态流转规则
+type CustomerStateTransitionsRequest struct {
+	Transitions []CustomerStateTransitionItem `json:"transitions" binding:"required"`
+}
+
+// CustomerStateChangeResponse 客户状态流转记录响应
+type CustomerStateChangeResponse struct {
+	CustomerStateChange
+	FromName     string  `json:"from_name"`
+	ToName       string  `json:"to_name"`
+	OperatorName string  `json:"operator_name"`
+	DurationDays float64 `json:"duration_days"` // 在该状态停留的天数，当前状态计算到现在
+}
+
+// CustomerStateDurationRequest 客户状态停留时长统计请求
+type CustomerStateDurationRequest struct {
+	SellerID uint64     `form:"seller_id"`                      // 只统计该销售员的客户
+	Since    *time.Time `form:"since" time_format:"2006-01-02"` // 只统计该日期之后进入的状态
+}
+
+// CustomerStateDurationResponse 客户在某个状态的停留时长统计（天）
+type CustomerStateDurationResponse struct {
+	State          int     `json:"state"`
+	Name           string  `json:"name"`
+	Exited         int64   `json:"exited"`           // 已离开该状态的次数
+	Current        int64   `json:"current"`          // 当前处于该状态的客户数
+	AvgDays        float64 `json:"avg_days"`         // 已离开的平均停留天数
+	MedianDays     float64 `json:"median_days"`      // 已离开的停留天数中位数
+	MaxDays        float64 `json:"max_days"`         // 已离开的最长停留天数
+	CurrentAvgDays float64 `json:"current_avg_days"` // 当前处于该状态的客户平均已停留天数
+}
+
+// CustomerPoolClaimRequest 领取公海客户请求
+type CustomerPoolClaimRequest struct {
+	CustomerIDs []uint64 `json:"customer_ids" binding:"required,min=1"`
+	SellerID    uint64   `json:"seller_id" binding:"required"`
+	OperatorID  uint64   `json:"operator_id"`
+}
+
+// CustomerPoolReleaseRequest 释放客户到公海请求
+type CustomerPoolReleaseRequest struct {
+	CustomerIDs []uint64 `json:"customer_ids" binding:"required,min=1"`
+	SellerID    uint64   `json:"seller_id" binding:"required"`
+	Reason      string   `json:"reason" binding:"max=500"`
+	OperatorID  uint64   `json:"operator_id"`
+}
+
+// CustomerPoolResult 单个客户的领取/释放结果
+type CustomerPoolResult struct {
+	CustomerID uint64 `json:"customer_id"`
+	Success    bool   `json:"success"`
+	Message    string `json:"message,omitempty"`
+}
+
+// CustomerPoolResponse 领取/释放结果
+type CustomerPoolResponse struct {
+	Succeeded int                  `json:"succeeded"`
+	Failed    int                  `json:"failed"`
+	Results   []CustomerPoolResult `json:"results"`
+	Quota     *CustomerPoolQuota   `json:"quota"`
+}
+
+// CustomerPoolQuota 销售员的公海领取额度
+type CustomerPoolQuota struct {
+	SellerID        uint64 `json:"seller_id"`
+	DailyClaimLimit int    `json:"daily_claim_limit"`
+	ClaimedToday    int    `json:"claimed_today"`
+	Owned           int    `json:"owned"`         // 当前负责的客户数
+	MaxCustomers    int    `json:"max_customers"` // 0表示不限
+}
+
+// CustomerPoolRecordResponse 公海记录响应
+type CustomerPoolRecordResponse struct {
+	CustomerPoolRecord
+	CustomerName string `json:"customer_name"`
+	SellerName   string `json:"seller_name"`
+}
+
+// CustomerPoolExpiringResponse 即将回收到公海的客户
+type CustomerPoolExpiringResponse struct {
+	CustomerID     uint64    `json:"customer_id"`
+	Name           string    `json:"name"`
+	Sellers        []int64   `json:"sellers"`
+	LastActivityAt time.Time `json:"last_activity_at"` // 最近一次跟进、通话、拜访、下单或领取的时间
+	RecycleAt      time.Time `json:"recycle_at"`
+}
+
+// UserPoolLimitRequest 设置销售员每日公海领取上限
+type UserPoolLimitRequest struct {
+	PoolClaimLimit int `json:"pool_claim_limit" binding:"min=0"` // 0表示使用系统默认
+}
+
+// CustomerTransferRequest 客户转移请求：customer_ids 与 all 二选一，all 表示转移原销售员负责的全部客户（如员工离职）
+type CustomerTransferRequest struct {
+	CustomerIDs  []uint64 `json:"customer_ids"`
+	All          bool     `json:"all"`
+	FromSellerID uint64   `json:"from_seller_id" binding:"required"`
+	ToSellerID   uint64   `json:"to_seller_id" binding:"required"`
+	Reason       string   `json:"reason" binding:"required,max=500"`
+	MoveTodos    bool     `json:"move_todos"` // 同时将未完成的待办和待发送的提醒转给新销售员
+	OperatorID   uint64   `json:"operator_id"`
+}
+
+// CustomerTransferResult 单个客户的转移结果
+type CustomerTransferResult struct {
+	CustomerID uint64 `json:"customer_id"`
+	Success    bool   `json:"success"`
+	Message    string `json:"message,omitempty"`
+}
+
+// CustomerTransferResponse 客户转移记录响应
+type CustomerTransferResponse struct {
+	CustomerTransfer
+	FromSellerName string                   `json:"from_seller_name"`
+	ToSellerName   string                   `json:"to_seller_name"`
+	Results        []CustomerTransferResult `json:"results,omitempty"`
+}
+
+// GroupRequest 创建或更新客户组请求
+type GroupRequest struct {
+	Name        string `json:"name" binding:"required,max=256"`
+	Description string `json:"description"`
+	SortOrder   int    `json:"sort_order"`
+	Roles       JSONB  `json:"roles"`      // 组成人员，如 {"朋友": [2, 3]}，更新时不传则保持不变
+	CreatedBy   uint64 `json:"created_by"` // 创建时不传则使用操作人，更新时忽略
+}
+
+// GroupResponse 客户组响应
+type GroupResponse struct {
+	ID          uint64    `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	SortOrder   int       `json:"sort_order"`
+	Roles       JSONB     `json:"roles"`
+	CreatedBy   uint64    `json:"created_by"`
+	CreatorName string    `json:"creator_name"`
+	MemberCount int64     `json:"member_count"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// GroupBrief 客户详情中展示的所属客户组
+type GroupBrief struct {
+	ID   uint64 `json:"id"`
+	Name string `json:"name"`
+}
+
+// GroupCustomersRequest 向客户组添加或移除客户
+type GroupCustomersRequest struct {
+	CustomerIDs []uint64 `json:"customer_ids" binding:"required,min=1"`
+	OperatorID  uint64   `json:"operator_id"`
+}
+
+// GroupCustomersResult 添加或移除客户的结果
+type GroupCustomersResult struct {
+	Changed  []uint64 `json:"changed"`   // 实际加入或移出的客户
+	Skipped  []uint64 `json:"skipped"`   // 已在组内（添加）或不在组内（移除）的客户
+	NotFound []uint64 `json:"not_found"` // 不存在或已删除的客户
+}
+
+// GroupMemberResponse 客户组成员及其订单、跟进数据
+type GroupMemberResponse struct {
+	CustomerID     uint64     `json:"customer_id"`
+	Name           string     `json:"name"`
+	ContactName    string     `json:"contact_name"`
+	Phone          string     `json:"phone"`
+	SallerName     string     `json:"saller_name"`
+	Level          int        `json:"level"`
+	State          int        `json:"state"`
+	OrderCount     int        `json:"order_count"`
+	OrderAmount    float64    `json:"order_amount"` // 订单金额扣除退款后的合计
+	CreditSale     float64    `json:"credit_sale"`
+	LastOrderDate  *time.Time `json:"last_order_date"`
+	FollowUpCount  int64      `json:"follow_up_count"`
+	LastFollowUpAt *time.Time `json:"last_follow_up_at"`
+}
+
+// GroupMemberSummary 客户组全部成员的汇总数据
+type GroupMemberSummary struct {
+	CustomerCount  int64      `json:"customer_count"`
+	OrderCount     int64      `json:"order_count"`
+	OrderAmount    float64    `json:"order_amount"`
+	CreditSale     float64    `json:"credit_sale"`
+	LastOrderDate  *time.Time `json:"last_order_date"`
+	FollowUpCount  int64      `json:"follow_up_count"`
+	LastFollowUpAt *time.Time `json:"last_follow_up_at"`
+}
+
+// CustomerRelationRequest 创建客户关系请求，起点为路径中的客户
+type CustomerRelationRequest struct {
+	ToCustomerID uint64               `json:"to_customer_id" binding:"required"`
+	Type         CustomerRelationType `json:"type" binding:"required"`
+	Remark       string               `json:"remark" binding:"max=500"`
+	OperatorID   uint64               `json:"operator_id"`
+}
+
+// CustomerRelationTypeItem 客户关系类型说明
+type CustomerRelationTypeItem struct {
+	Type         CustomerRelationType `json:"type"`
+	Name         string               `json:"name"`
+	SingleParent bool                 `json:"single_parent"` // 每个客户最多一条该类型的出边，且不能成环
+}
+
+// CustomerRelationResponse 客户关系响应
+type CustomerRelationResponse struct {
+	CustomerRelation
+	TypeName         string `json:"type_name"`
+	FromCustomerName string `json:"from_customer_name"`
+	ToCustomerName   string `json:"to_customer_name"`
+	Direction        string `json:"direction,omitempty"` // 相对于查询客户：out 为出边，in 为入边
+}
+
+// CustomerGraphNode 关系图中的客户节点
+type CustomerGraphNode struct {
+	ID         uint64 `json:"id"`
+	Name       string `json:"name"`
+	SallerName string `json:"saller_name"`
+	Level      int    `json:"level"`
+	State      int    `json:"state"`
+	Depth      int    `json:"depth"` // 距中心客户的跳数
+}
+
+// CustomerGraphEdge 关系图中的有向边
+type CustomerGraphEdge struct {
+	ID       uint64               `json:"id"`
+	From     uint64               `json:"from"`
+	To       uint64               `json:"to"`
+	Type     CustomerRelationType `json:"type"`
+	TypeName string               `json:"type_name"`
+}
+
+// CustomerGraphResponse 客户关系图
+type CustomerGraphResponse struct {
+	Root      uint64              `json:"root"`
+	Depth     int                 `json:"depth"`
+	Nodes     []CustomerGraphNode `json:"nodes"`
+	Edges     []CustomerGraphEdge `json:"edges"`
+	Truncated bool                `json:"truncated"` // 节点数达到上限，图不完整
+}
+
+// CustomerReferralNode 介绍链上的客户
+type CustomerReferralNode struct {
+	CustomerID    uint64     `json:"customer_id"`
+	Name          string     `json:"name"`
+	ReferrerID    uint64     `json:"referrer_id"` // 介绍该客户的客户
+	Level         int        `json:"level"`       // 1 为直接介绍
+	OrderCount    int        `json:"order_count"`
+	OrderAmount   float64    `json:"order_amount"`
+	LastOrderDate *time.Time `json:"last_order_date"`
+	ReferredAt    *time.Time `json:"referred_at"` // 被介绍的时间，链条顶端的介绍人为空
+}
+
+// CustomerReferralResponse 客户的介绍链：向上为介绍人链，向下为其直接和间接介绍的客户
+type CustomerReferralResponse struct {
+	CustomerID  uint64                 `json:"customer_id"`
+	Referrers   []CustomerReferralNode `json:"referrers"` // 由近到远
+	Referrals   []CustomerReferralNode `json:"referrals"`
+	DirectCount int                    `json:"direct_count"`
+	TotalCount  int                    `json:"total_count"`
+	OrderCount  int                    `json:"order_count"`  // 被介绍客户的订单数量合计
+	OrderAmount float64                `json:"order_amount"` // 被介绍客户的下单金额合计
+}
+
+// CustomerReferralRankingRequest 介绍客户排行查询参数
+type CustomerReferralRankingRequest struct {
+	Since *time.Time `form:"since" time_format:"2006-01-02"` // 只统计该日期之后建立的介绍关系
+	Limit int        `form:"limit"`                          // 默认20，最多100
+}
+
+// CustomerReferralRankItem 介绍客户排行
+type CustomerReferralRankItem struct {
+	CustomerID  uint64  `json:"customer_id"`
+	Name        string  `json:"name"`
+	DirectCount int64   `json:"direct_count"`
+	OrderCount  int64   `json:"order_count"`
+	OrderAmount float64 `json:"order_amount"`
+}
+
+// OrderItemRequest 订单明细请求，id 不为0时更新已有明细
+type OrderItemRequest struct {
+	ID          uint64  `json:"id"`
+	ProductCode string  `json:"product_code" binding:"max=128"`
+	ProductName string  `json:"product_name" binding:"required,max=256"`
+	Unit        string  `json:"unit" binding:"max=32"`
+	Quantity    float64 `json:"quantity" binding:"gt=0"`
+	UnitPrice   float64 `json:"unit_price" binding:"min=0"`
+	Discount    float64 `json:"discount" binding:"min=0"`
+}
+
+// OrderRequest 创建或更新订单请求，order_no 为空时自动生成
+type OrderRequest struct {
+	OrderNo       string             `json:"order_no" binding:"max=64"`
+	CustomerID    uint64             `json:"customer_id" binding:"required"`
+	OrderDate     time.Time          `json:"order_date" binding:"required"`
+	SellerID      uint64             `json:"seller_id"`
+	SellerName    string             `json:"seller_name" binding:"max=256"`
+	Warehouse     string             `json:"warehouse" binding:"max=256"`
+	ShippingFee   float64            `json:"shipping_fee" binding:"min=0"`
+	PaymentStatus OrderPaymentStatus `json:"payment_status"` // 为空时按收款金额判断
+	PaidAmount    float64            `json:"paid_amount" binding:"min=0"`
+	PaidAt        *time.Time         `json:"paid_at"`
+	Remark        string             `json:"remark"`
+	Items         []OrderItemRequest `json:"items" binding:"required,min=1,dive"`
+	OperatorID    uint64             `json:"operator_id"`
+}
+
+// OrderQuery 订单列表查询参数
+type OrderQuery struct {
+	CustomerID    uint64             `form:"customer_id"`
+	SellerID      uint64             `form:"seller_id"`
+	PaymentStatus OrderPaymentStatus `form:"payment_status"`
+	Warehouse     string             `form:"warehouse"`
+	Keyword       string             `form:"keyword"` // 销售单号或商品名称
+	StartDate     *time.Time         `form:"start_date" time_format:"2006-01-02"`
+	EndDate       *time.Time         `form:"end_date" time_format:"2006-01-02"` // 包含当天
+	Page          int                `form:"page"`
+	PageSize      int                `form:"page_size"`
+}
+
+// OrderResponse 订单响应
+type OrderResponse struct {
+	Order
+	CustomerName string `json:"customer_name"`
+}
+
+// OrderReturnItemRequest 退货明细请求，refund_amount 不传时按明细销售金额折算
+type OrderReturnItemRequest struct {
+	OrderItemID  uint64   `json:"order_item_id" binding:"required"`
+	Quantity     float64  `json:"quantity" binding:"gt=0"`
+	RefundAmount *float64 `json:"refund_amount" binding:"omitempty,min=0"`
+}
+
+// OrderReturnRequest 创建退货单请求，return_no 为空时自动生成
+type OrderReturnRequest struct {
+	ReturnNo   string                   `json:"return_no" binding:"max=64"`
+	OrderID    uint64                   `json:"order_id" binding:"required"`
+	ReturnDate time.Time                `json:"return_date" binding:"required"`
+	Reason     string                   `json:"reason" binding:"required,max=500"`
+	Remark     string                   `json:"remark"`
+	Items      []OrderReturnItemRequest `json:"items" binding:"required,min=1,dive"`
+	OperatorID uint64                   `json:"operator_id"`
+}
+
+// OrderReturnQuery 退货单列表查询参数
+type OrderReturnQuery struct {
+	OrderID    uint64     `form:"order_id"`
+	CustomerID uint64     `form:"customer_id"`
+	SellerID   uint64     `form:"seller_id"`
+	StartDate  *time.Time `form:"start_date" time_format:"2006-01-02"`
+	EndDate    *time.Time `form:"end_date" time_format:"2006-01-02"` // 包含当天
+	Page       int        `form:"page"`
+	PageSize   int        `form:"page_size"`
+}
+
+// OrderReturnResponse 退货单响应
+type OrderReturnResponse struct {
+	OrderReturn
+	OrderNo      string `json:"order_no"`
+	CustomerName string `json:"customer_name"`
+}
+
+// SalesReportQuery 销售报表查询参数
+type SalesReportQuery struct {
+	StartDate *time.Time `form:"start_date" time_format:"2006-01-02"`
+	EndDate   *time.Time `form:"end_date" time_format:"2006-01-02"` // 包含当天
+	SellerID  uint64     `form:"seller_id"`
+	Limit     int        `form:"limit"` // 默认50，最多500
+}
+
+// CustomerReturnRateItem 客户退货率（按金额）
+type CustomerReturnRateItem struct {
+	CustomerID   uint64  `json:"customer_id"`
+	Name         string  `json:"name"`
+	OrderCount   int64   `json:"order_count"`
+	SalesAmount  float64 `json:"sales_amount"`
+	ReturnCount  int64   `json:"return_count"`
+	RefundAmount float64 `json:"refund_amount"`
+	ReturnRate   float64 `json:"return_rate"` // 退款金额 / 销售金额
+}
+
+// ProductReturnRateItem 商品退货率（按数量）
+type ProductReturnRateItem struct {
+	ProductCode  string  `json:"product_code"`
+	ProductName  string  `json:"product_name"`
+	SoldQty      float64 `json:"sold_qty"`
+	ReturnedQty  float64 `json:"returned_qty"`
+	SalesAmount  float64 `json:"sales_amount"`
+	RefundAmount float64 `json:"refund_amount"`
+	ReturnRate   float64 `json:"return_rate"` // 退货数量 / 销售数量
+}
+
+// SellerRevenueItem 销售员业绩：销售额按销售单日期统计，退款按退货单日期统计
+type SellerRevenueItem struct {
+	SellerID     uint64  `json:"seller_id"`
+	SellerName   string  `json:"seller_name"`
+	OrderCount   int64   `json:"order_count"`
+	SalesAmount  float64 `json:"sales_amount"`
+	ReturnCount  int64   `json:"return_count"`
+	RefundAmount float64 `json:"refund_amount"`
+	NetRevenue   float64 `json:"net_revenue"`
+}
+
+// ProductCategoryRequest 创建或修改商品分类请求（修改时忽略 parent_id）
+type ProductCategoryRequest struct {
+	Name      string `json:"name" binding:"required,max=128"`
+	ParentID  uint64 `json:"parent_id"`
+	SortOrder int    `json:"sort_order"`
+}
+
+// ProductCategoryNode 商品分类树节点
+type ProductCategoryNode struct {
+	ProductCategory
+	ProductCount int64                  `json:"product_count"` // 本分类及下级分类的商品数
+	Children     []*ProductCategoryNode `json:"children"`
+}
+
+// ProductRequest 创建或修改商品请求，category_path 为各级分类名称（如 ["茶叶", "绿茶", "毛尖"]），不存在时自动创建，与 category_id 二选一
+type ProductRequest struct {
+	Code           string   `json:"code" binding:"required,max=128"`
+	Name           string   `json:"name" binding:"required,max=256"`
+	Aliases        []string `json:"aliases" binding:"dive,max=256"`
+	Unit           string   `json:"unit" binding:"max=32"`
+	UnitWeight     *float64 `json:"unit_weight" binding:"omitempty,min=0"`
+	CategoryID     uint64   `json:"category_id"`
+	CategoryPath   []string `json:"category_path" binding:"max=4"`
+	PurchasePrice  *float64 `json:"purchase_price" binding:"omitempty,min=0"`
+	ReferencePrice *float64 `json:"reference_price" binding:"omitempty,min=0"`
+	Remark         string   `json:"remark"`
+}
+
+// ProductResponse 商品响应
+type ProductResponse struct {
+	Product
+	CategoryPath []string `json:"category_path"`
+}
+
+// ProductQuery 商品列表查询参数
+type ProductQuery struct {
+	Keyword    string `form:"keyword"`     // 编码、名称或别名
+	CategoryID uint64 `form:"category_id"` // 包含下级分类
+	Page       int    `form:"page"`
+	PageSize   int    `form:"page_size"`
+}
+
+// ProductSearchResult 商品搜索结果
+type ProductSearchResult struct {
+	*ProductResponse
+	Score     int    `json:"score"`
+	MatchedBy string `json:"matched_by"` // code/name/alias
+}
+
+// ProductSuggestion 自由文本可能对应的商品
+type ProductSuggestion struct {
+	ID         uint64  `json:"id"`
+	Code       string  `json:"code"`
+	Name       string  `json:"name"`
+	Similarity float64 `json:"similarity"`
+}
+
+// ProductTextItem 客户产品和偏好中尚未归一到商品名称的自由文本
+type ProductTextItem struct {
+	Text          string              `json:"text"`
+	Source        string              `json:"source"` // products（客户产品）或 preferences（产品偏好）
+	CustomerCount int64               `json:"customer_count"`
+	Product       *ProductSuggestion  `json:"product"` // 编码、名称或别名完全一致的商品，可直接自动映射
+	Suggestions   []ProductSuggestion `json:"suggestions"`
+}
+
+// ProductMappingRequest 将自由文本映射到商品
+type ProductMappingRequest struct {
+	Text       string `json:"text" binding:"required,max=256"`
+	ProductID  uint64 `json:"product_id" binding:"required"`
+	AddAlias   *bool  `json:"add_alias"` // 是否将文本加入商品别名，默认是
+	OperatorID uint64 `json:"operator_id"`
+}
+
+// ProductMappingResult 映射结果
+type ProductMappingResult struct {
+	Text        string `json:"text"`
+	ProductID   uint64 `json:"product_id"`
+	ProductName string `json:"product_name"`
+	AliasAdded  bool   `json:"alias_added"`
+	Customers   int    `json:"customers"`   // 产品字段被修改的客户数
+	Preferences int    `json:"preferences"` // 被关联到商品的偏好数
+}
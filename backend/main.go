@@ -24,7 +24,31 @@ func main() {
 	// 自动迁移数据库表
 	DB.AutoMigrate(&Customer{}, &Todo{}, &TodoLog{},
 		&Reminder{}, &ReminderTemplate{}, &ReminderConfig{},
-		&FollowUpRecord{}, &User{}, &TagDimension{}, &Tag{})
+		&FollowUpRecord{}, &User{}, &TagDimension{}, &Tag{},
+		&ImportJob{}, &ImportJobRow{},
+		&DuplicateScanJob{}, &DuplicateGroup{}, &CustomerMerge{},
+		&CustomerSegment{}, &CustomerBulkOperation{}, &CustomerBulkChange{},
+		&CustomerChangeLog{}, &CustomerStateTransition{}, &CustomerStateChange{},
+		&CustomerPoolRecord{}, &CustomerTransfer{}, &Group{}, &CustomerRelation{},
+		&Order{}, &OrderItem{}, &OrderReturn{}, &OrderReturnItem{},
+		&ProductCategory{}, &Product{})
+
+	// 服务重启前未完成的导入任务标记为失败
+	recoverImportJobs()
+	recoverDuplicateScanJobs()
+
+	// 历史电话号码统一规范化为纯数字格式
+	migrateCustomerPhones()
+
+	// 写入默认状态流转规则，并为历史客户补全初始状态记录
+	seedCustomerStateTransitions()
+	backfillCustomerStateChanges()
+
+	// 定期彻底删除回收站中超过保留天数的客户
+	go runCustomerTrashPurgeJob()
+
+	// 定期将长期未跟进的客户回收到公海
+	go runCustomerPoolRecycleJob()
 
 	// 创建Gin引擎
 	r := gin.Default()
@@ -32,8 +56,8 @@ func main() {
 	// 添加CORS中间件
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"*"},
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization"},
+		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization", "X-User-ID"},
 		AllowCredentials: true,
 	}))
 
@@ -106,6 +106,7 @@ const (
 	ActionDelete   ActionType = "delete"
 	ActionComplete ActionType = "complete"
 	ActionCancel   ActionType = "cancel"
+	ActionRestore  ActionType = "restore"
 )
 
 // ReminderStatus 提醒状态枚举
@@ -128,6 +129,27 @@ const (
 	ReminderFrequencyMonthly ReminderFrequency = "monthly"
 )
 
+// ImportRowStatus 导入行处理结果枚举
+type ImportRowStatus string
+
+const (
+	ImportRowCreated ImportRowStatus = "created"
+	ImportRowUpdated ImportRowStatus = "updated"
+	ImportRowSkipped ImportRowStatus = "skipped"
+	ImportRowFailed  ImportRowStatus = "failed"
+)
+
+// ImportJobStatus 导入任务状态枚举
+type ImportJobStatus string
+
+const (
+	ImportJobPending   ImportJobStatus = "pending"
+	ImportJobRunning   ImportJobStatus = "running"
+	ImportJobCompleted ImportJobStatus = "completed"
+	ImportJobFailed    ImportJobStatus = "failed"
+	ImportJobCancelled ImportJobStatus = "cancelled"
+)
+
 // ============================================================================
 // 数据模型定义
 // ============================================================================
@@ -148,11 +170,11 @@ type Customer struct {
 	UpdatedAt time.Time `json:"updated_at"`
 	UpdatedBy uint      `json:"updated_by"`
 
-	Phones        pq.StringArray `json:"phones" gorm:"type:varchar(128)[];default:null"`
-	Wechats       pq.StringArray `json:"wechats" gorm:"type:varchar(128)[]"`
-	Douyins       pq.StringArray `json:"douyins" gorm:"type:varchar(128)[]"`
-	Kwais         pq.StringArray `json:"kwais" gorm:"type:varchar(128)[]"`
-	Redbooks      pq.StringArray `json:"redbooks" gorm:"type:varchar(128)[]"`
+	Phones        pq.StringArray `json:"phones" gorm:"type:varchar(128)[];default:null;index:idx_customers_phones,type:gin"`
+	Wechats       pq.StringArray `json:"wechats" gorm:"type:varchar(128)[];index:idx_customers_wechats,type:gin"`
+	Douyins       pq.StringArray `json:"douyins" gorm:"type:varchar(128)[];index:idx_customers_douyins,type:gin"`
+	Kwais         pq.StringArray `json:"kwais" gorm:"type:varchar(128)[];index:idx_customers_kwais,type:gin"`
+	Redbooks      pq.StringArray `json:"redbooks" gorm:"type:varchar(128)[];index:idx_customers_redbooks,type:gin"`
 	WeworkOpenids pq.StringArray `json:"wework_openids" gorm:"type:varchar(128)[]"`
 
 	Province   string  `json:"province" gorm:"size:256"`
@@ -161,8 +183,8 @@ type Customer struct {
 	DistrictID int     `json:"district_id"`
 	Street     string  `json:"street" gorm:"size:256"`
 	Address    string  `json:"address" gorm:"size:2048"`
-	Lat        float64 `json:"lat"`
-	Lon        float64 `json:"lon"`
+	Lat        float64 `json:"lat" gorm:"index:idx_customers_lat_lon"`
+	Lon        float64 `json:"lon" gorm:"index:idx_customers_lat_lon"`
 
 	Category    string         `json:"category" gorm:"size:256"`
 	Flags       int            `json:"flags"`
@@ -172,8 +194,8 @@ type Customer struct {
 	Kind        int            `json:"kind"`
 	AddedWechat bool           `json:"added_wechat"`
 
-	WorkPhone   pq.StringArray `json:"work_phone" gorm:"type:varchar(256)[]"`
-	WorkWechat  pq.StringArray `json:"work_wechat" gorm:"type:varchar(256)[]"`
+	WorkPhone   pq.StringArray `json:"work_phone" gorm:"type:varchar(256)[];index:idx_customers_work_phone,type:gin"`
+	WorkWechat  pq.StringArray `json:"work_wechat" gorm:"type:varchar(256)[];index:idx_customers_work_wechat,type:gin"`
 	CreditSale  float64        `json:"credit_sale" gorm:"type:decimal"`
 	Sellers     pq.Int64Array  `json:"sellers" gorm:"type:int4[]"`
 	LastVisited *time.Time     `json:"last_visited"`
@@ -200,6 +222,9 @@ type Customer struct {
 	OrderCount              int        `json:"order_count" gorm:"default:0;comment:订单数量"`
 	AvgOrderValue           *float64   `json:"avg_order_value" gorm:"type:decimal(15,2);comment:平均订单金额"`
 	PreferredDeliveryMethod string     `json:"preferred_delivery_method" gorm:"type:varchar(128);comment:偏好配送方式"` // 修正字段长度以匹配数据库
+
+	DeletedAt *time.Time `json:"deleted_at" gorm:"comment:删除时间"`
+	IsDeleted bool       `json:"is_deleted" gorm:"default:false;index;comment:是否删除"`
 }
 
 func (Customer) TableName() string {
@@ -222,6 +247,7 @@ type User struct {
 	Status             string     `json:"status" gorm:"type:varchar(32);default:active;comment:状态"`
 	AvatarURL          string     `json:"avatar_url" gorm:"type:varchar(512);comment:头像URL"`
 	LastLoginAt        *time.Time `json:"last_login_at" gorm:"comment:最后登录时间"`
+	PoolClaimLimit     int        `json:"pool_claim_limit" gorm:"default:0;comment:每日公海领取上限（0表示使用系统默认）"`
 	BaseModel
 
 	Manager          *User `json:"manager,omitempty" gorm:"foreignKey:ManagerID"`
@@ -315,6 +341,8 @@ type Reminder struct {
 	MaxRetries   int               `json:"max_retries" gorm:"default:3;comment:最大重试次数"`
 	CreatedAt    time.Time         `json:"created_at" gorm:"index;comment:创建时间"`
 	UpdatedAt    time.Time         `json:"updated_at" gorm:"comment:更新时间"`
+	DeletedAt    *time.Time        `json:"deleted_at" gorm:"comment:删除时间"`
+	IsDeleted    bool              `json:"is_deleted" gorm:"default:false;index;comment:是否删除"`
 
 	Todo Todo `json:"todo" gorm:"foreignKey:TodoID"`
 	User User `json:"user" gorm:"foreignKey:UserID"`
@@ -450,15 +478,503 @@ func (f *FollowUpRecord) GetTimeAgo() string {
 // Group 分组模型
 type Group struct {
 	ID          uint64 `json:"id" gorm:"primaryKey;autoIncrement;comment:分组ID"`
-	Name        string `json:"name" gorm:"type:varchar(128);not null;comment:分组名称"`
+	Name        string `json:"name" gorm:"type:varchar(256);not null;index;comment:分组名称"`
+	Roles       JSONB  `json:"roles" gorm:"type:jsonb;comment:组成人员，格式：{\"朋友\": [2, 3], \"同事\": [4, 5]}"`
 	Description string `json:"description" gorm:"type:text;comment:分组描述"`
-	CreatedBy   uint64 `json:"created_by" gorm:"not null;index;comment:创建人ID"`
-	SortOrder   int    `json:"sort_order" gorm:"default:0;index;comment:排序顺序"`
+	// 早期的 groups 表没有创建人，迁移时已有记录的创建人为0
+	CreatedBy uint64 `json:"created_by" gorm:"not null;default:0;index;comment:创建人ID"`
+	SortOrder int    `json:"sort_order" gorm:"default:0;index;comment:排序顺序"`
 	BaseModel
 
-	Creator User `json:"creator" gorm:"foreignKey:CreatedBy"`
+	// 已有记录的创建人为0，不建外键约束
+	Creator User `json:"creator" gorm:"foreignKey:CreatedBy;-:migration"`
 }
 
 func (Group) TableName() string {
 	return "groups"
 }
+
+// ImportJob 客户导入任务
+type ImportJob struct {
+	ID            uint64          `json:"id" gorm:"primaryKey;autoIncrement;comment:任务ID"`
+	FileName      string          `json:"file_name" gorm:"type:varchar(512);comment:上传文件名"`
+	ImportSource  string          `json:"import_source" gorm:"type:varchar(256);comment:导入来源"`
+	DryRun        bool            `json:"dry_run" gorm:"default:false;comment:是否试运行（不写入客户表）"`
+	Header        pq.StringArray  `json:"header" gorm:"type:text[];comment:文件表头"`
+	Status        ImportJobStatus `json:"status" gorm:"type:varchar(32);default:pending;index;comment:任务状态"`
+	TotalRows     int             `json:"total_rows" gorm:"default:0;comment:总行数"`
+	ProcessedRows int             `json:"processed_rows" gorm:"default:0;comment:已处理行数"`
+	CreatedRows   int             `json:"created_rows" gorm:"default:0;comment:新建客户行数"`
+	UpdatedRows   int             `json:"updated_rows" gorm:"default:0;comment:合并更新行数"`
+	SkippedRows   int             `json:"skipped_rows" gorm:"default:0;comment:跳过行数"`
+	FailedRows    int             `json:"failed_rows" gorm:"default:0;comment:失败行数"`
+	ErrorMessage  string          `json:"error_message" gorm:"type:text;comment:任务级错误信息"`
+	CreatedBy     uint64          `json:"created_by" gorm:"index;comment:创建人ID"`
+	StartedAt     *time.Time      `json:"started_at" gorm:"comment:开始时间"`
+	FinishedAt    *time.Time      `json:"finished_at" gorm:"comment:结束时间"`
+	CreatedAt     time.Time       `json:"created_at" gorm:"index;comment:创建时间"`
+	UpdatedAt     time.Time       `json:"updated_at" gorm:"comment:更新时间"`
+}
+
+func (ImportJob) TableName() string {
+	return "import_jobs"
+}
+
+// ImportJobRow 导入任务逐行结果
+type ImportJobRow struct {
+	ID         uint64          `json:"id" gorm:"primaryKey;autoIncrement;comment:记录ID"`
+	JobID      uint64          `json:"job_id" gorm:"not null;index;comment:导入任务ID"`
+	RowNumber  int             `json:"row" gorm:"comment:文件中的行号"`
+	Status     ImportRowStatus `json:"status" gorm:"type:varchar(32);index;comment:处理结果"`
+	CustomerID uint            `json:"customer_id" gorm:"comment:创建或合并的客户ID"`
+	Message    string          `json:"message" gorm:"type:text;comment:跳过或失败原因"`
+	RawData    pq.StringArray  `json:"raw_data" gorm:"type:text[];comment:原始行数据"`
+}
+
+func (ImportJobRow) TableName() string {
+	return "import_job_rows"
+}
+
+// DuplicateGroupStatus 重复客户分组状态
+type DuplicateGroupStatus string
+
+const (
+	DuplicateGroupPending DuplicateGroupStatus = "pending" // 待处理
+	DuplicateGroupMerged  DuplicateGroupStatus = "merged"  // 已合并
+	DuplicateGroupIgnored DuplicateGroupStatus = "ignored" // 已忽略（不是重复客户）
+)
+
+// CustomerMergeStatus 客户合并记录状态
+type CustomerMergeStatus string
+
+const (
+	CustomerMergeDone   CustomerMergeStatus = "merged" // 已合并
+	CustomerMergeUndone CustomerMergeStatus = "undone" // 已撤销
+)
+
+// DuplicateScanJob 客户查重任务
+type DuplicateScanJob struct {
+	ID             uint64          `json:"id" gorm:"primaryKey;autoIncrement;comment:任务ID"`
+	Status         ImportJobStatus `json:"status" gorm:"type:varchar(32);default:pending;index;comment:任务状态（同导入任务）"`
+	Threshold      float64         `json:"threshold" gorm:"comment:名称地址相似度阈值"`
+	TotalCustomers int             `json:"total_customers" gorm:"default:0;comment:扫描客户数"`
+	GroupCount     int             `json:"group_count" gorm:"default:0;comment:发现的重复分组数"`
+	ErrorMessage   string          `json:"error_message" gorm:"type:text;comment:任务级错误信息"`
+	CreatedBy      uint64          `json:"created_by" gorm:"index;comment:创建人ID"`
+	StartedAt      *time.Time      `json:"started_at" gorm:"comment:开始时间"`
+	FinishedAt     *time.Time      `json:"finished_at" gorm:"comment:结束时间"`
+	CreatedAt      time.Time       `json:"created_at" gorm:"index;comment:创建时间"`
+	UpdatedAt      time.Time       `json:"updated_at" gorm:"comment:更新时间"`
+}
+
+func (DuplicateScanJob) TableName() string {
+	return "duplicate_scan_jobs"
+}
+
+// DuplicateGroup 疑似重复客户分组
+type DuplicateGroup struct {
+	ID          uint64               `json:"id" gorm:"primaryKey;autoIncrement;comment:分组ID"`
+	ScanID      uint64               `json:"scan_id" gorm:"not null;index;comment:查重任务ID"`
+	CustomerIDs pq.Int64Array        `json:"customer_ids" gorm:"type:int8[];comment:分组内客户ID"`
+	Reasons     pq.StringArray       `json:"reasons" gorm:"type:text[];comment:判定原因"`
+	Score       float64              `json:"score" gorm:"comment:相似度（电话微信重合为1）"`
+	Status      DuplicateGroupStatus `json:"status" gorm:"type:varchar(32);default:pending;index;comment:处理状态"`
+	MergeID     *uint64              `json:"merge_id" gorm:"comment:合并记录ID"`
+	CreatedAt   time.Time            `json:"created_at" gorm:"comment:创建时间"`
+	UpdatedAt   time.Time            `json:"updated_at" gorm:"comment:更新时间"`
+}
+
+func (DuplicateGroup) TableName() string {
+	return "duplicate_groups"
+}
+
+// CustomerMerge 客户合并记录（保存合并前快照，用于撤销）
+type CustomerMerge struct {
+	ID         uint64              `json:"id" gorm:"primaryKey;autoIncrement;comment:合并记录ID"`
+	SurvivorID uint64              `json:"survivor_id" gorm:"not null;index;comment:保留的客户ID"`
+	MergedIDs  pq.Int64Array       `json:"merged_ids" gorm:"type:int8[];comment:被合并的客户ID"`
+	GroupID    *uint64             `json:"group_id" gorm:"index;comment:来源重复分组ID"`
+	Snapshot   JSONB               `json:"-" gorm:"type:jsonb;comment:合并前客户快照（survivor/merged）"`
+	Relinked   JSONB               `json:"relinked" gorm:"type:jsonb;comment:改挂到保留客户的记录（todos/follow_up_records/orders/order_returns：记录ID->原客户ID；customer_relations：关系ID->原起点/终点；removed_customer_relations：合并时删除的关系）"`
+	Status     CustomerMergeStatus `json:"status" gorm:"type:varchar(32);default:merged;index;comment:状态"`
+	OperatorID uint64              `json:"operator_id" gorm:"index;comment:操作人ID"`
+	UndoneAt   *time.Time          `json:"undone_at" gorm:"comment:撤销时间"`
+	CreatedAt  time.Time           `json:"created_at" gorm:"index;comment:合并时间"`
+}
+
+func (CustomerMerge) TableName() string {
+	return "customer_merges"
+}
+
+// Region 行政区划（省/市/区县），数据来自内嵌的 regions.json，不落库
+type Region struct {
+	Code     string    `json:"code"`               // 行政区划代码（省2位/市4位/区县6位）
+	Name     string    `json:"name"`               // 名称
+	Level    int       `json:"level"`              // 层级：1=省 2=市 3=区县
+	Children []*Region `json:"children,omitempty"` // 下级区划
+	parent   *Region
+}
+
+// CustomerSegmentMode 客户分群模式
+type CustomerSegmentMode string
+
+const (
+	CustomerSegmentDynamic  CustomerSegmentMode = "dynamic"  // 每次按筛选条件实时计算成员
+	CustomerSegmentSnapshot CustomerSegmentMode = "snapshot" // 成员固定为快照时符合条件的客户
+)
+
+// CustomerSegment 保存的客户分群（保存筛选条件，快照模式下另存快照时的客户ID）
+type CustomerSegment struct {
+	ID          uint64              `json:"id" gorm:"primaryKey;autoIncrement;comment:分群ID"`
+	Name        string              `json:"name" gorm:"type:varchar(128);not null;comment:分群名称"`
+	Description string              `json:"description" gorm:"type:text;comment:分群说明"`
+	OwnerID     uint64              `json:"owner_id" gorm:"not null;index;comment:创建人ID"`
+	Shared      bool                `json:"shared" gorm:"default:false;index;comment:是否团队共享"`
+	Filter      JSONB               `json:"filter" gorm:"type:jsonb;comment:筛选条件（CustomerFilter）"`
+	Mode        CustomerSegmentMode `json:"mode" gorm:"type:varchar(32);default:dynamic;comment:分群模式"`
+	SnapshotIDs pq.Int64Array       `json:"-" gorm:"type:int8[];comment:快照客户ID"`
+	SnapshotAt  *time.Time          `json:"snapshot_at" gorm:"comment:快照时间"`
+	CreatedAt   time.Time           `json:"created_at" gorm:"comment:创建时间"`
+	UpdatedAt   time.Time           `json:"updated_at" gorm:"comment:更新时间"`
+}
+
+func (CustomerSegment) TableName() string {
+	return "customer_segments"
+}
+
+// CustomerBulkStatus 批量操作中单个客户的处理结果
+type CustomerBulkStatus string
+
+const (
+	CustomerBulkUpdated   CustomerBulkStatus = "updated"
+	CustomerBulkDeleted   CustomerBulkStatus = "deleted"
+	CustomerBulkUnchanged CustomerBulkStatus = "unchanged"
+	CustomerBulkNotFound  CustomerBulkStatus = "not_found"
+	CustomerBulkFailed    CustomerBulkStatus = "failed"
+)
+
+// CustomerBulkOperation 客户批量操作记录
+type CustomerBulkOperation struct {
+	ID         uint64    `json:"id" gorm:"primaryKey;autoIncrement;comment:批量操作ID"`
+	OperatorID uint64    `json:"operator_id" gorm:"index;comment:操作人ID"`
+	Target     JSONB     `json:"target" gorm:"type:jsonb;comment:操作对象（ids/filter/segment_id）"`
+	Actions    JSONB     `json:"actions" gorm:"type:jsonb;comment:执行的操作"`
+	Total      int       `json:"total" gorm:"default:0;comment:目标客户数"`
+	Updated    int       `json:"updated" gorm:"default:0;comment:更新的客户数"`
+	Deleted    int       `json:"deleted" gorm:"default:0;comment:删除的客户数"`
+	Unchanged  int       `json:"unchanged" gorm:"default:0;comment:无变化的客户数"`
+	NotFound   int       `json:"not_found" gorm:"default:0;comment:不存在的客户数"`
+	Failed     int       `json:"failed" gorm:"default:0;comment:失败的客户数"`
+	CreatedAt  time.Time `json:"created_at" gorm:"index;comment:操作时间"`
+}
+
+func (CustomerBulkOperation) TableName() string {
+	return "customer_bulk_operations"
+}
+
+// CustomerBulkChange 批量操作中每个客户的处理结果和字段变化
+type CustomerBulkChange struct {
+	ID          uint64             `json:"id" gorm:"primaryKey;autoIncrement;comment:记录ID"`
+	OperationID uint64             `json:"operation_id" gorm:"not null;index;comment:批量操作ID"`
+	CustomerID  uint64             `json:"customer_id" gorm:"not null;index;comment:客户ID"`
+	Status      CustomerBulkStatus `json:"status" gorm:"type:varchar(32);index;comment:处理结果"`
+	Message     string             `json:"message" gorm:"type:text;comment:失败原因"`
+	Changes     JSONB              `json:"changes" gorm:"type:jsonb;comment:字段变化（字段->{old,new}）"`
+	CreatedAt   time.Time          `json:"created_at" gorm:"comment:创建时间"`
+}
+
+func (CustomerBulkChange) TableName() string {
+	return "customer_bulk_changes"
+}
+
+// CustomerChangeSource 客户变更来源
+type CustomerChangeSource string
+
+const (
+	CustomerChangeAPI    CustomerChangeSource = "api"    // 接口直接修改
+	CustomerChangeImport CustomerChangeSource = "import" // 销售记录导入
+	CustomerChangeMerge  CustomerChangeSource = "merge"  // 合并及撤销合并
+	CustomerChangeBulk   CustomerChangeSource = "bulk"   // 批量操作
+	CustomerChangeSystem CustomerChangeSource = "system" // 地址补全、数据迁移等系统任务
+)
+
+// CustomerChangeLog 客户变更日志（字段级，只记录变化的字段）
+type CustomerChangeLog struct {
+	ID         uint64               `json:"id" gorm:"primaryKey;autoIncrement;comment:日志ID"`
+	CustomerID uint64               `json:"customer_id" gorm:"not null;index;comment:客户ID"`
+	OperatorID uint64               `json:"operator_id" gorm:"index;comment:操作人ID"`
+	Action     ActionType           `json:"action" gorm:"type:varchar(32);not null;index;comment:操作类型"`
+	Source     CustomerChangeSource `json:"source" gorm:"type:varchar(32);not null;index;comment:变更来源"`
+	Fields     pq.StringArray       `json:"fields" gorm:"type:varchar(64)[];comment:变化的字段"`
+	OldData    JSONB                `json:"old_data" gorm:"type:jsonb;comment:变更前字段值"`
+	NewData    JSONB                `json:"new_data" gorm:"type:jsonb;comment:变更后字段值"`
+	Remark     string               `json:"remark" gorm:"type:varchar(500);comment:操作备注"`
+	CreatedAt  time.Time            `json:"created_at" gorm:"index;comment:操作时间"`
+}
+
+func (CustomerChangeLog) TableName() string {
+	return "customer_change_logs"
+}
+
+// 客户状态（customers.state）
+const (
+	CustomerStateUnknown     = 0 // 未知
+	CustomerStateUndeveloped = 1 // 未开发
+	CustomerStateDeveloping  = 2 // 开发中
+	CustomerStateDeveloped   = 3 // 已开发
+	CustomerStateBlacklisted = 4 // 已拉黑
+	CustomerStateClosed      = 5 // 已倒闭
+	CustomerStateColleague   = 6 // 同事
+	CustomerStateTraitor     = 7 // 叛徒
+	CustomerStatePeer        = 8 // 同行
+)
+
+// CustomerStateNames 客户状态名称
+var CustomerStateNames = map[int]string{
+	CustomerStateUnknown:     "未知",
+	CustomerStateUndeveloped: "未开发",
+	CustomerStateDeveloping:  "开发中",
+	CustomerStateDeveloped:   "已开发",
+	CustomerStateBlacklisted: "已拉黑",
+	CustomerStateClosed:      "已倒闭",
+	CustomerStateColleague:   "同事",
+	CustomerStateTraitor:     "叛徒",
+	CustomerStatePeer:        "同行",
+}
+
+// CustomerStateTransition 允许的客户状态流转
+type CustomerStateTransition struct {
+	ID            uint64    `json:"id" gorm:"primaryKey;autoIncrement;comment:流转规则ID"`
+	FromState     int       `json:"from_state" gorm:"not null;uniqueIndex:idx_customer_state_transition;comment:原状态"`
+	ToState       int       `json:"to_state" gorm:"not null;uniqueIndex:idx_customer_state_transition;comment:目标状态"`
+	RequireReason bool      `json:"require_reason" gorm:"default:false;comment:是否必须填写原因"`
+	CreatedAt     time.Time `json:"created_at" gorm:"comment:创建时间"`
+	UpdatedAt     time.Time `json:"updated_at" gorm:"comment:更新时间"`
+}
+
+func (CustomerStateTransition) TableName() string {
+	return "customer_state_transitions"
+}
+
+// CustomerStateChange 客户状态流转记录，FromState 为空表示客户创建时的初始状态
+type CustomerStateChange struct {
+	ID         uint64               `json:"id" gorm:"primaryKey;autoIncrement;comment:记录ID"`
+	CustomerID uint64               `json:"customer_id" gorm:"not null;index:idx_customer_state_changes_customer;comment:客户ID"`
+	FromState  *int                 `json:"from_state" gorm:"comment:原状态"`
+	ToState    int                  `json:"to_state" gorm:"not null;index;comment:新状态"`
+	Reason     string               `json:"reason" gorm:"type:varchar(500);comment:变更原因"`
+	Source     CustomerChangeSource `json:"source" gorm:"type:varchar(16);not null;comment:变更来源"`
+	OperatorID uint64               `json:"operator_id" gorm:"comment:操作人ID"`
+	ChangedAt  time.Time            `json:"changed_at" gorm:"not null;index:idx_customer_state_changes_customer;comment:变更时间"`
+}
+
+func (CustomerStateChange) TableName() string {
+	return "customer_state_changes"
+}
+
+// CustomerPoolAction 公海操作类型
+type CustomerPoolAction string
+
+const (
+	CustomerPoolClaim   CustomerPoolAction = "claim"   // 销售员领取
+	CustomerPoolRelease CustomerPoolAction = "release" // 销售员释放
+	CustomerPoolRecycle CustomerPoolAction = "recycle" // 长期未跟进自动回收
+	CustomerPoolWarn    CustomerPoolAction = "warn"    // 回收前提醒
+)
+
+// CustomerPoolRecord 公海领取、释放、回收记录
+type CustomerPoolRecord struct {
+	ID         uint64             `json:"id" gorm:"primaryKey;autoIncrement;comment:记录ID"`
+	CustomerID uint64             `json:"customer_id" gorm:"not null;index;comment:客户ID"`
+	SellerID   uint64             `json:"seller_id" gorm:"not null;index;comment:销售员ID"`
+	Action     CustomerPoolAction `json:"action" gorm:"type:varchar(16);not null;index;comment:操作类型"`
+	Reason     string             `json:"reason" gorm:"type:varchar(500);comment:原因"`
+	OperatorID uint64             `json:"operator_id" gorm:"comment:操作人ID"`
+	CreatedAt  time.Time          `json:"created_at" gorm:"index;comment:操作时间"`
+}
+
+func (CustomerPoolRecord) TableName() string {
+	return "customer_pool_records"
+}
+
+// CustomerTransfer 客户转移记录：将客户从一个销售员转给另一个销售员
+type CustomerTransfer struct {
+	ID           uint64        `json:"id" gorm:"primaryKey;autoIncrement;comment:转移记录ID"`
+	FromSellerID uint64        `json:"from_seller_id" gorm:"not null;index;comment:原销售员ID"`
+	ToSellerID   uint64        `json:"to_seller_id" gorm:"not null;index;comment:新销售员ID"`
+	CustomerIDs  pq.Int64Array `json:"customer_ids" gorm:"type:int8[];comment:转移的客户ID"`
+	Reason       string        `json:"reason" gorm:"type:varchar(500);not null;comment:转移原因"`
+	MoveTodos    bool          `json:"move_todos" gorm:"comment:是否同时转移未完成的待办和提醒"`
+	TodoIDs      pq.Int64Array `json:"todo_ids" gorm:"type:int8[];comment:转移的待办ID"`
+	ReminderIDs  pq.Int64Array `json:"reminder_ids" gorm:"type:int8[];comment:转移的提醒ID"`
+	OperatorID   uint64        `json:"operator_id" gorm:"index;comment:操作人ID"`
+	CreatedAt    time.Time     `json:"created_at" gorm:"index;comment:转移时间"`
+}
+
+func (CustomerTransfer) TableName() string {
+	return "customer_transfers"
+}
+
+// CustomerRelationType 客户关系类型，方向为“起点客户 是 终点客户 的……”
+type CustomerRelationType string
+
+const (
+	CustomerRelationBranchOf   CustomerRelationType = "branch_of"   // 分店：起点是终点的分店
+	CustomerRelationRelativeOf CustomerRelationType = "relative_of" // 亲属：起点是终点的亲属
+	CustomerRelationReferredBy CustomerRelationType = "referred_by" // 介绍：起点由终点介绍而来
+	CustomerRelationSupplierTo CustomerRelationType = "supplier_to" // 供货：起点为终点供货
+)
+
+// CustomerRelationTypeNames 客户关系类型名称
+var CustomerRelationTypeNames = map[CustomerRelationType]string{
+	CustomerRelationBranchOf:   "分店",
+	CustomerRelationRelativeOf: "亲属",
+	CustomerRelationReferredBy: "介绍人",
+	CustomerRelationSupplierTo: "供货商",
+}
+
+// CustomerRelation 客户之间的有向关系
+type CustomerRelation struct {
+	ID             uint64               `json:"id" gorm:"primaryKey;autoIncrement;comment:关系ID"`
+	FromCustomerID uint64               `json:"from_customer_id" gorm:"not null;uniqueIndex:idx_customer_relations_pair;comment:起点客户ID"`
+	ToCustomerID   uint64               `json:"to_customer_id" gorm:"not null;uniqueIndex:idx_customer_relations_pair;index;comment:终点客户ID"`
+	Type           CustomerRelationType `json:"type" gorm:"type:varchar(32);not null;uniqueIndex:idx_customer_relations_pair;index;comment:关系类型"`
+	Remark         string               `json:"remark" gorm:"type:varchar(500);comment:备注"`
+	CreatedBy      uint64               `json:"created_by" gorm:"comment:创建人ID"`
+	CreatedAt      time.Time            `json:"created_at" gorm:"index;comment:创建时间"`
+}
+
+func (CustomerRelation) TableName() string {
+	return "customer_relations"
+}
+
+// OrderPaymentStatus 订单收款状态
+type OrderPaymentStatus string
+
+const (
+	OrderUnpaid      OrderPaymentStatus = "unpaid"  // 未收款
+	OrderPartialPaid OrderPaymentStatus = "partial" // 部分收款
+	OrderPaid        OrderPaymentStatus = "paid"    // 已收款
+)
+
+// Order 销售订单，金额由订单明细汇总
+type Order struct {
+	ID             uint64             `json:"id" gorm:"primaryKey;autoIncrement;comment:订单ID"`
+	OrderNo        string             `json:"order_no" gorm:"type:varchar(64);not null;uniqueIndex;comment:销售单号"`
+	CustomerID     uint64             `json:"customer_id" gorm:"not null;index;comment:客户ID"`
+	OrderDate      time.Time          `json:"order_date" gorm:"not null;index;comment:销售单日期"`
+	SellerID       uint64             `json:"seller_id" gorm:"index;comment:销售员ID"`
+	SellerName     string             `json:"seller_name" gorm:"type:varchar(256);comment:销售员"`
+	Warehouse      string             `json:"warehouse" gorm:"type:varchar(256);comment:仓库名称"`
+	ItemAmount     float64            `json:"item_amount" gorm:"type:decimal(15,2);default:0;comment:商品金额（数量×单价合计）"`
+	DiscountAmount float64            `json:"discount_amount" gorm:"type:decimal(15,2);default:0;comment:折扣金额合计"`
+	ShippingFee    float64            `json:"shipping_fee" gorm:"type:decimal(15,2);default:0;comment:运费"`
+	TotalAmount    float64            `json:"total_amount" gorm:"type:decimal(15,2);default:0;comment:订单金额（商品金额-折扣+运费）"`
+	PaymentStatus  OrderPaymentStatus `json:"payment_status" gorm:"type:varchar(16);default:unpaid;index;comment:收款状态"`
+	PaidAmount     float64            `json:"paid_amount" gorm:"type:decimal(15,2);default:0;comment:收款金额"`
+	PaidAt         *time.Time         `json:"paid_at" gorm:"comment:收款日期"`
+	RefundAmount   float64            `json:"refund_amount" gorm:"type:decimal(15,2);default:0;comment:退款金额合计"`
+	Remark         string             `json:"remark" gorm:"type:text;comment:备注"`
+	CreatedBy      uint64             `json:"created_by" gorm:"comment:创建人ID"`
+	UpdatedBy      uint64             `json:"updated_by" gorm:"comment:更新人ID"`
+	BaseModel
+
+	Items []OrderItem `json:"items" gorm:"foreignKey:OrderID"`
+}
+
+func (Order) TableName() string {
+	return "orders"
+}
+
+// OrderItem 订单明细
+type OrderItem struct {
+	ID             uint64    `json:"id" gorm:"primaryKey;autoIncrement;comment:明细ID"`
+	OrderID        uint64    `json:"order_id" gorm:"not null;index;comment:订单ID"`
+	ProductCode    string    `json:"product_code" gorm:"type:varchar(128);index;comment:商品编码"`
+	ProductName    string    `json:"product_name" gorm:"type:varchar(256);not null;comment:商品名称"`
+	Unit           string    `json:"unit" gorm:"type:varchar(32);comment:单位"`
+	Quantity       float64   `json:"quantity" gorm:"type:decimal(15,3);not null;comment:数量"`
+	UnitPrice      float64   `json:"unit_price" gorm:"type:decimal(15,2);not null;comment:商品单价（含税）"`
+	Discount       float64   `json:"discount" gorm:"type:decimal(15,2);default:0;comment:折扣金额"`
+	Amount         float64   `json:"amount" gorm:"type:decimal(15,2);comment:销售金额（数量×单价-折扣）"`
+	ReturnedQty    float64   `json:"returned_qty" gorm:"type:decimal(15,3);default:0;comment:已退货数量"`
+	RefundedAmount float64   `json:"refunded_amount" gorm:"type:decimal(15,2);default:0;comment:已退款金额"`
+	SortOrder      int       `json:"sort_order" gorm:"default:0;comment:明细顺序"`
+	CreatedAt      time.Time `json:"created_at" gorm:"comment:创建时间"`
+	UpdatedAt      time.Time `json:"updated_at" gorm:"comment:更新时间"`
+}
+
+func (OrderItem) TableName() string {
+	return "order_items"
+}
+
+// OrderReturn 退货单：针对订单明细退货并退款
+type OrderReturn struct {
+	ID           uint64    `json:"id" gorm:"primaryKey;autoIncrement;comment:退货单ID"`
+	ReturnNo     string    `json:"return_no" gorm:"type:varchar(64);not null;uniqueIndex;comment:退货单号"`
+	OrderID      uint64    `json:"order_id" gorm:"not null;index;comment:订单ID"`
+	CustomerID   uint64    `json:"customer_id" gorm:"not null;index;comment:客户ID"`
+	SellerID     uint64    `json:"seller_id" gorm:"index;comment:销售员ID（取自订单）"`
+	ReturnDate   time.Time `json:"return_date" gorm:"not null;index;comment:退货单日期"`
+	Reason       string    `json:"reason" gorm:"type:varchar(500);not null;comment:退货原因"`
+	RefundAmount float64   `json:"refund_amount" gorm:"type:decimal(15,2);default:0;comment:退款金额"`
+	Remark       string    `json:"remark" gorm:"type:text;comment:备注"`
+	CreatedBy    uint64    `json:"created_by" gorm:"comment:创建人ID"`
+	BaseModel
+
+	Items []OrderReturnItem `json:"items" gorm:"foreignKey:ReturnID"`
+}
+
+func (OrderReturn) TableName() string {
+	return "order_returns"
+}
+
+// OrderReturnItem 退货明细
+type OrderReturnItem struct {
+	ID           uint64    `json:"id" gorm:"primaryKey;autoIncrement;comment:退货明细ID"`
+	ReturnID     uint64    `json:"return_id" gorm:"not null;index;comment:退货单ID"`
+	OrderItemID  uint64    `json:"order_item_id" gorm:"not null;index;comment:订单明细ID"`
+	ProductCode  string    `json:"product_code" gorm:"type:varchar(128);comment:商品编码"`
+	ProductName  string    `json:"product_name" gorm:"type:varchar(256);comment:商品名称"`
+	Quantity     float64   `json:"quantity" gorm:"type:decimal(15,3);not null;comment:退货数量"`
+	RefundAmount float64   `json:"refund_amount" gorm:"type:decimal(15,2);default:0;comment:退款金额"`
+	CreatedAt    time.Time `json:"created_at" gorm:"comment:创建时间"`
+}
+
+func (OrderReturnItem) TableName() string {
+	return "order_return_items"
+}
+
+// ProductCategory 商品分类，最多四级（对应导入文件的商品分类一至四）
+type ProductCategory struct {
+	ID        uint64    `json:"id" gorm:"primaryKey;autoIncrement;comment:分类ID"`
+	ParentID  uint64    `json:"parent_id" gorm:"not null;default:0;uniqueIndex:idx_product_categories_parent_name;comment:上级分类ID（0为一级分类）"`
+	Level     int       `json:"level" gorm:"not null;comment:层级（1-4）"`
+	Name      string    `json:"name" gorm:"type:varchar(128);not null;uniqueIndex:idx_product_categories_parent_name;comment:分类名称"`
+	SortOrder int       `json:"sort_order" gorm:"default:0;comment:排序顺序"`
+	CreatedAt time.Time `json:"created_at" gorm:"comment:创建时间"`
+	UpdatedAt time.Time `json:"updated_at" gorm:"comment:更新时间"`
+}
+
+func (ProductCategory) TableName() string {
+	return "product_categories"
+}
+
+// Product 商品目录，名称、别名和编码用于将自由填写的商品名称归一到同一商品
+type Product struct {
+	ID             uint64         `json:"id" gorm:"primaryKey;autoIncrement;comment:商品ID"`
+	Code           string         `json:"code" gorm:"type:varchar(128);not null;uniqueIndex:idx_products_code,where:is_deleted = false;comment:商品编码"`
+	Name           string         `json:"name" gorm:"type:varchar(256);not null;index;comment:商品名称"`
+	Aliases        pq.StringArray `json:"aliases" gorm:"type:varchar(256)[];index:idx_products_aliases,type:gin;comment:商品别名"`
+	Unit           string         `json:"unit" gorm:"type:varchar(32);comment:单位"`
+	UnitWeight     *float64       `json:"unit_weight" gorm:"type:decimal(15,3);comment:单位重量"`
+	CategoryID     uint64         `json:"category_id" gorm:"index;comment:商品分类ID（末级）"`
+	PurchasePrice  *float64       `json:"purchase_price" gorm:"type:decimal(15,2);comment:参考进价"`
+	ReferencePrice *float64       `json:"reference_price" gorm:"type:decimal(15,2);comment:参考售价"`
+	Remark         string         `json:"remark" gorm:"type:text;comment:备注"`
+	BaseModel
+}
+
+func (Product) TableName() string {
+	return "products"
+}
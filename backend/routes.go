@@ -1,10 +1,19 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 // SetupRoutes 设置所有路由
@@ -12,8 +21,8 @@ func SetupRoutes(r *gin.Engine) {
 	// CORS中间件
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"*"},
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization"},
+		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization", "X-User-ID"},
 		AllowCredentials: true,
 	}))
 
@@ -26,12 +35,64 @@ func SetupRoutes(r *gin.Engine) {
 	// API路由组
 	api := r.Group("/api/v1")
 	{
+		// 当前操作人：优先取 X-User-ID 请求头，其次取 operator_id 查询参数，用于记录客户变更历史
+		getOperatorID := func(c *gin.Context) uint64 {
+			id := c.GetHeader("X-User-ID")
+			if id == "" {
+				id = c.Query("operator_id")
+			}
+			operatorID, _ := strconv.ParseUint(id, 10, 64)
+			return operatorID
+		}
+
+		// 客户分群错误响应（分群接口、导出和批量操作共用）
+		segmentError := func(c *gin.Context, err error) {
+			switch {
+			case errors.Is(err, gorm.ErrRecordNotFound):
+				c.JSON(404, gin.H{"error": "客户分群不存在"})
+			case errors.Is(err, errSegmentForbidden):
+				c.JSON(403, gin.H{"error": err.Error()})
+			default:
+				c.JSON(400, gin.H{"error": err.Error()})
+			}
+		}
+
 		// 客户相关路由
 		api.GET("/customers", func(c *gin.Context) {
 			page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
 			limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
-			search := c.Query("search")
-			customers, total := getCustomers(page, limit, search)
+			// search、region_code（省/市/区县任意层级的行政区划代码）、filter（可重复）、sort
+			filter, err := parseCustomerFilterQuery(c.Request.URL.Query())
+			if err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			customers, total, err := getCustomers(page, limit, filter)
+			if err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"data": customers, "total": total})
+		})
+
+		// 以 JSON 请求体传入结构化筛选条件查询客户列表
+		api.POST("/customers/query", func(c *gin.Context) {
+			var req CustomerQueryRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			if req.Page <= 0 {
+				req.Page = 1
+			}
+			if req.Limit <= 0 {
+				req.Limit = 20
+			}
+			customers, total, err := getCustomers(req.Page, req.Limit, req.CustomerFilter)
+			if err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
 			c.JSON(200, gin.H{"data": customers, "total": total})
 		})
 
@@ -41,147 +102,1659 @@ func SetupRoutes(r *gin.Engine) {
 				c.JSON(400, gin.H{"error": err.Error()})
 				return
 			}
-			customer := createCustomer(req)
+			if err := validateCustomerRegion(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			if err := validateCustomerPhones(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			if err := validateCustomerState(req.State); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			if !req.Force {
+				if duplicates := findCreateDuplicates(req); len(duplicates) > 0 {
+					c.JSON(409, gin.H{"error": "疑似重复客户，确认后可传 force=true 强制创建", "duplicates": duplicates})
+					return
+				}
+			}
+			customer, err := createCustomer(req, getOperatorID(c))
+			if err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
 			c.JSON(200, gin.H{"data": customer})
 		})
 
 		api.GET("/customers/:id", func(c *gin.Context) {
 			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
 			customer := getCustomer(id)
+			if customer == nil {
+				c.JSON(404, gin.H{"error": "客户不存在"})
+				return
+			}
 			c.JSON(200, gin.H{"data": customer})
 		})
 
 		api.PUT("/customers/:id", func(c *gin.Context) {
 			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
 			var req CustomerRequest
-			c.ShouldBindJSON(&req)
-			customer := updateCustomer(id, req)
-			c.JSON(200, gin.H{"data": customer})
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			if err := validateCustomerRegion(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			if err := validateCustomerPhones(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			customer, err := updateCustomer(id, req, getOperatorID(c))
+			var validationErr *ValidationError
+			switch {
+			case errors.Is(err, gorm.ErrRecordNotFound):
+				c.JSON(404, gin.H{"error": "客户不存在"})
+			case errors.As(err, &validationErr):
+				c.JSON(400, gin.H{"error": err.Error()})
+			case err != nil:
+				c.JSON(500, gin.H{"error": err.Error()})
+			default:
+				c.JSON(200, gin.H{"data": customer})
+			}
+		})
+
+		// 部分更新：只修改请求中出现的字段，参数错误返回 422 和逐字段错误
+		api.PATCH("/customers/:id", func(c *gin.Context) {
+			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+			var req CustomerPatchRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				var typeErr *json.UnmarshalTypeError
+				if errors.As(err, &typeErr) {
+					c.JSON(422, gin.H{"error": "参数校验失败", "fields": FieldErrors{typeErr.Field: "类型应为 " + typeErr.Type.String()}})
+					return
+				}
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			customer, err := patchCustomer(id, req, getOperatorID(c))
+			var fieldErrs FieldErrors
+			switch {
+			case errors.As(err, &fieldErrs):
+				c.JSON(422, gin.H{"error": "参数校验失败", "fields": fieldErrs})
+			case errors.Is(err, gorm.ErrRecordNotFound):
+				c.JSON(404, gin.H{"error": "客户不存在"})
+			case err != nil:
+				c.JSON(500, gin.H{"error": err.Error()})
+			default:
+				c.JSON(200, gin.H{"data": customer})
+			}
 		})
 
 		api.DELETE("/customers/:id", func(c *gin.Context) {
 			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
-			deleteCustomer(id)
-			c.JSON(200, gin.H{"message": "删除成功"})
+			err := deleteCustomer(id, getOperatorID(c))
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(404, gin.H{"error": "客户不存在"})
+				return
+			}
+			if err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"message": "删除成功，客户已移入回收站"})
 		})
 
-		// 客户搜索路由
-		api.GET("/customers/search", func(c *gin.Context) {
-			keyword := c.Query("keyword")
-			systemTagsStr := c.Query("system_tags") // 逗号分隔的标签ID，如"1,2,3"
-			customers := searchCustomers(keyword, systemTagsStr)
-			c.JSON(200, gin.H{"data": customers})
+		// 客户状态流转路由
+		api.GET("/customers/states", func(c *gin.Context) {
+			c.JSON(200, gin.H{"data": getCustomerStates()})
 		})
 
-		// 客户偏好管理路由
-		api.GET("/customers/:id/preferences", func(c *gin.Context) {
-			customerID, _ := strconv.ParseUint(c.Param("id"), 10, 64)
-			preferences := getCustomerPreferences(customerID)
-			c.JSON(200, gin.H{"data": preferences})
+		api.PUT("/customers/states/transitions", func(c *gin.Context) {
+			var req CustomerStateTransitionsRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			states, err := replaceCustomerStateTransitions(req.Transitions)
+			var validationErr *ValidationError
+			if errors.As(err, &validationErr) {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			if err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"data": states})
 		})
 
-		api.POST("/customers/:id/preferences", func(c *gin.Context) {
-			customerID, _ := strconv.ParseUint(c.Param("id"), 10, 64)
-			var req CustomerPreferenceCreateRequest
+		api.GET("/customers/states/durations", func(c *gin.Context) {
+			var req CustomerStateDurationRequest
+			if err := c.ShouldBindQuery(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			durations, err := getCustomerStateDurations(req)
+			if err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"data": durations})
+		})
+
+		api.POST("/customers/:id/state", func(c *gin.Context) {
+			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+			var req CustomerStateChangeRequest
 			if err := c.ShouldBindJSON(&req); err != nil {
 				c.JSON(400, gin.H{"error": err.Error()})
 				return
 			}
-			req.CustomerID = customerID
-			preference := createCustomerPreference(req)
-			c.JSON(200, gin.H{"data": preference})
+			if req.OperatorID == 0 {
+				req.OperatorID = getOperatorID(c)
+			}
+			customer, err := changeCustomerState(id, req)
+			var validationErr *ValidationError
+			switch {
+			case errors.Is(err, gorm.ErrRecordNotFound):
+				c.JSON(404, gin.H{"error": "客户不存在"})
+			case errors.As(err, &validationErr):
+				c.JSON(400, gin.H{"error": err.Error()})
+			case err != nil:
+				c.JSON(500, gin.H{"error": err.Error()})
+			default:
+				c.JSON(200, gin.H{"data": customer})
+			}
 		})
 
-		api.PUT("/customers/:id/preferences/:preference_id", func(c *gin.Context) {
-			customerID, _ := strconv.ParseUint(c.Param("id"), 10, 64)
-			preferenceID := c.Param("preference_id")
-			var req CustomerPreferenceUpdateRequest
+		api.GET("/customers/:id/states", func(c *gin.Context) {
+			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+			c.JSON(200, gin.H{"data": getCustomerStateHistory(id)})
+		})
+
+		// 公海路由
+		api.GET("/customers/pool", func(c *gin.Context) {
+			page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+			limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+			customers, total := getPoolCustomers(c.Query("keyword"), page, limit)
+			c.JSON(200, gin.H{"data": customers, "total": total})
+		})
+
+		api.POST("/customers/pool/claim", func(c *gin.Context) {
+			var req CustomerPoolClaimRequest
 			if err := c.ShouldBindJSON(&req); err != nil {
 				c.JSON(400, gin.H{"error": err.Error()})
 				return
 			}
-			preference := updateCustomerPreference(customerID, preferenceID, req)
-			c.JSON(200, gin.H{"data": preference})
+			if req.OperatorID == 0 {
+				req.OperatorID = getOperatorID(c)
+			}
+			result, err := claimPoolCustomers(req)
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(404, gin.H{"error": "销售员不存在"})
+				return
+			}
+			if err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"data": result})
 		})
 
-		api.DELETE("/customers/:id/preferences/:preference_id", func(c *gin.Context) {
-			customerID, _ := strconv.ParseUint(c.Param("id"), 10, 64)
-			preferenceID := c.Param("preference_id")
-			deleteCustomerPreference(customerID, preferenceID)
-			c.JSON(200, gin.H{"message": "偏好删除成功"})
+		api.POST("/customers/pool/release", func(c *gin.Context) {
+			var req CustomerPoolReleaseRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			if req.OperatorID == 0 {
+				req.OperatorID = getOperatorID(c)
+			}
+			result, err := releasePoolCustomers(req)
+			if err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"data": result})
 		})
 
-		// 待办事项路由
-		api.GET("/todos", func(c *gin.Context) {
+		api.GET("/customers/pool/quota", func(c *gin.Context) {
+			sellerID, _ := strconv.ParseUint(c.Query("seller_id"), 10, 64)
+			quota, err := getCustomerPoolQuota(DB, sellerID)
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(404, gin.H{"error": "销售员不存在"})
+				return
+			}
+			if err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"data": quota})
+		})
+
+		api.GET("/customers/pool/records", func(c *gin.Context) {
 			customerID, _ := strconv.ParseUint(c.Query("customer_id"), 10, 64)
+			sellerID, _ := strconv.ParseUint(c.Query("seller_id"), 10, 64)
 			page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
 			pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "20"))
-			todos, total := getTodos(customerID, page, pageSize)
-			c.JSON(200, gin.H{"data": todos, "total": total})
+			records, total := getCustomerPoolRecords(customerID, sellerID, c.Query("action"), page, pageSize)
+			c.JSON(200, gin.H{"data": records, "total": total})
 		})
 
-		api.POST("/todos", func(c *gin.Context) {
-			var req TodoCreateRequest
-			c.ShouldBindJSON(&req)
-			todo := createTodo(req)
-			c.JSON(200, gin.H{"data": todo})
+		api.GET("/customers/pool/expiring", func(c *gin.Context) {
+			sellerID, _ := strconv.ParseUint(c.Query("seller_id"), 10, 64)
+			customers, err := getExpiringPoolCustomers(sellerID)
+			if err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"data": customers})
 		})
 
-		api.PUT("/todos/:id", func(c *gin.Context) {
-			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
-			var req TodoUpdateRequest
-			c.ShouldBindJSON(&req)
-			todo := updateTodo(id, req)
-			c.JSON(200, gin.H{"data": todo})
+		// 客户转移路由（换人跟进、员工离职交接）
+		api.POST("/customers/transfer", func(c *gin.Context) {
+			var req CustomerTransferRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			if err := validateCustomerTransfer(req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			if req.OperatorID == 0 {
+				req.OperatorID = getOperatorID(c)
+			}
+			result, err := transferCustomers(req)
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(404, gin.H{"error": "销售员不存在"})
+				return
+			}
+			if err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"data": result})
 		})
 
-		// 跟进记录路由
-		// 注意：以下接口操作的是 follow_up_records 表，该表是从原 activities 表迁移而来
-		api.GET("/follow-up-records", func(c *gin.Context) {
+		api.GET("/customers/transfers", func(c *gin.Context) {
 			customerID, _ := strconv.ParseUint(c.Query("customer_id"), 10, 64)
+			sellerID, _ := strconv.ParseUint(c.Query("seller_id"), 10, 64)
 			page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
 			pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "20"))
-			records, total := getFollowUpRecords(customerID, page, pageSize)
-			c.JSON(200, gin.H{"data": records, "total": total})
+			transfers, total := getCustomerTransfers(customerID, sellerID, page, pageSize)
+			c.JSON(200, gin.H{"data": transfers, "total": total})
 		})
 
-		api.POST("/follow-up-records", func(c *gin.Context) {
-			var req FollowUpRecordCreateRequest
-			c.ShouldBindJSON(&req)
-			record := createFollowUpRecord(req)
-			c.JSON(200, gin.H{"data": record})
+		api.GET("/customers/transfers/:transfer_id", func(c *gin.Context) {
+			id, _ := strconv.ParseUint(c.Param("transfer_id"), 10, 64)
+			transfer, err := getCustomerTransfer(id)
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(404, gin.H{"error": "转移记录不存在"})
+				return
+			}
+			if err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"data": transfer})
 		})
 
-		api.GET("/follow-up-records/:id", func(c *gin.Context) {
+		// 客户关系路由（分店、亲属、介绍、供货）
+		customerRelationError := func(c *gin.Context, err error) {
+			var validationErr *ValidationError
+			switch {
+			case errors.Is(err, gorm.ErrRecordNotFound):
+				c.JSON(404, gin.H{"error": "客户或关系不存在"})
+			case errors.Is(err, errCustomerRelationExists):
+				c.JSON(409, gin.H{"error": err.Error()})
+			case errors.As(err, &validationErr):
+				c.JSON(400, gin.H{"error": err.Error()})
+			default:
+				c.JSON(500, gin.H{"error": err.Error()})
+			}
+		}
+
+		api.GET("/customers/relations/types", func(c *gin.Context) {
+			c.JSON(200, gin.H{"data": getCustomerRelationTypes()})
+		})
+
+		api.GET("/customers/referrals/ranking", func(c *gin.Context) {
+			var req CustomerReferralRankingRequest
+			if err := c.ShouldBindQuery(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			ranking, err := getCustomerReferralRanking(req)
+			if err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"data": ranking})
+		})
+
+		api.GET("/customers/:id/relations", func(c *gin.Context) {
 			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
-			record := getFollowUpRecord(id)
-			c.JSON(200, gin.H{"data": record})
+			relationType := CustomerRelationType(c.Query("type"))
+			c.JSON(200, gin.H{"data": getCustomerRelations(id, relationType)})
 		})
 
-		api.PUT("/follow-up-records/:id", func(c *gin.Context) {
+		api.POST("/customers/:id/relations", func(c *gin.Context) {
 			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
-			var req FollowUpRecordUpdateRequest
-			c.ShouldBindJSON(&req)
-			record := updateFollowUpRecord(id, req)
-			c.JSON(200, gin.H{"data": record})
+			var req CustomerRelationRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			if req.OperatorID == 0 {
+				req.OperatorID = getOperatorID(c)
+			}
+			relation, err := createCustomerRelation(id, req)
+			if err != nil {
+				customerRelationError(c, err)
+				return
+			}
+			c.JSON(200, gin.H{"data": relation})
 		})
 
-		api.DELETE("/follow-up-records/:id", func(c *gin.Context) {
+		api.DELETE("/customers/:id/relations/:relation_id", func(c *gin.Context) {
 			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
-			deleteFollowUpRecord(id)
+			relationID, _ := strconv.ParseUint(c.Param("relation_id"), 10, 64)
+			if err := deleteCustomerRelation(id, relationID); err != nil {
+				customerRelationError(c, err)
+				return
+			}
 			c.JSON(200, gin.H{"message": "删除成功"})
 		})
 
-		// 用户路由
-		api.GET("/users", func(c *gin.Context) {
-			users := getUsers()
-			c.JSON(200, gin.H{"data": users})
+		api.GET("/customers/:id/relations/graph", func(c *gin.Context) {
+			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+			depth, _ := strconv.Atoi(c.DefaultQuery("depth", "2"))
+			types, err := parseCustomerRelationTypes(c.Query("types"))
+			if err != nil {
+				customerRelationError(c, err)
+				return
+			}
+			graph, err := getCustomerRelationGraph(id, depth, types)
+			if err != nil {
+				customerRelationError(c, err)
+				return
+			}
+			c.JSON(200, gin.H{"data": graph})
 		})
 
-		api.GET("/users/:id", func(c *gin.Context) {
+		api.GET("/customers/:id/referrals", func(c *gin.Context) {
 			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
-			user := getUserDetail(id)
-			c.JSON(200, gin.H{"data": user})
+			depth, _ := strconv.Atoi(c.DefaultQuery("depth", "0"))
+			referrals, err := getCustomerReferrals(id, depth)
+			if err != nil {
+				customerRelationError(c, err)
+				return
+			}
+			c.JSON(200, gin.H{"data": referrals})
+		})
+
+		// 客户回收站路由
+		api.GET("/customers/trash", func(c *gin.Context) {
+			page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+			limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+			customers, total := getCustomerTrash(c.Query("keyword"), page, limit)
+			c.JSON(200, gin.H{"data": customers, "total": total, "retention_days": GetTrashRetentionDays()})
+		})
+
+		api.POST("/customers/:id/restore", func(c *gin.Context) {
+			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+			customer, err := restoreCustomer(id, getOperatorID(c))
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(404, gin.H{"error": "回收站中没有该客户"})
+				return
+			}
+			if err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"data": customer})
+		})
+
+		// 客户搜索路由
+		api.GET("/customers/search", func(c *gin.Context) {
+			keyword := c.Query("keyword")
+			systemTagsStr := c.Query("system_tags") // 逗号分隔的标签ID，如"1,2,3"
+			regionCode := c.Query("region_code")
+			if regionCode != "" && findRegion(regionCode) == nil {
+				c.JSON(400, gin.H{"error": "行政区划代码不存在"})
+				return
+			}
+			customers := searchCustomers(keyword, systemTagsStr, regionCode)
+			c.JSON(200, gin.H{"data": customers})
+		})
+
+		// 客户导出路由（CSV/XLSX 流式下载）
+		api.GET("/customers/export/columns", func(c *gin.Context) {
+			c.JSON(200, gin.H{"data": getCustomerExportColumns()})
+		})
+
+		api.GET("/customers/export", func(c *gin.Context) {
+			var req CustomerExportRequest
+			if err := c.ShouldBindQuery(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			format := strings.ToLower(req.Format)
+			if format == "" {
+				format = "csv"
+			}
+			if format != "csv" && format != "xlsx" {
+				c.JSON(400, gin.H{"error": "导出格式只支持 csv 或 xlsx"})
+				return
+			}
+			columns, err := resolveCustomerExportColumns(req.Columns)
+			if err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			if req.RegionCode != "" && findRegion(req.RegionCode) == nil {
+				c.JSON(400, gin.H{"error": "行政区划代码不存在"})
+				return
+			}
+			keyword := req.Keyword
+			if keyword == "" {
+				keyword = req.Search
+			}
+			query := buildCustomerSearchQuery(keyword, req.SystemTags, req.RegionCode)
+			filter, err := parseCustomerFilterQuery(c.Request.URL.Query())
+			if err == nil {
+				query, err = applyCustomerFilter(query, filter)
+			}
+			if err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			if req.SegmentID > 0 {
+				if query, err = applyCustomerSegmentScope(query, req.SegmentID, req.UserID); err != nil {
+					segmentError(c, err)
+					return
+				}
+			}
+
+			filename := fmt.Sprintf("customers_%s.%s", time.Now().Format("20060102150405"), format)
+			if format == "xlsx" {
+				c.Header("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+			} else {
+				c.Header("Content-Type", "text/csv; charset=utf-8")
+			}
+			c.Header("Content-Disposition", "attachment; filename="+filename)
+			c.Status(200)
+			// 响应头已发出，导出中途出错只能记录日志
+			if err := exportCustomers(c.Writer, query, filter.Sort, format, columns); err != nil {
+				log.Printf("客户导出失败: %v", err)
+			}
+		})
+
+		// 客户联系方式查找路由（来电识别，按电话/微信/抖音/快手/小红书反查客户）
+		api.GET("/customers/by-contact", func(c *gin.Context) {
+			var req ContactLookupRequest
+			if err := c.ShouldBindQuery(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			if strings.TrimSpace(req.Phone+req.Wechat+req.Douyin+req.Kwai+req.Redbook) == "" {
+				c.JSON(400, gin.H{"error": "请至少提供 phone、wechat、douyin、kwai、redbook 中的一项"})
+				return
+			}
+			customers := findCustomersByContact(req)
+			c.JSON(200, gin.H{"data": customers, "total": len(customers)})
+		})
+
+		// 客户地理位置路由（附近客户、地图范围内客户）
+		api.GET("/customers/nearby", func(c *gin.Context) {
+			var req NearbyCustomerRequest
+			if err := c.ShouldBindQuery(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			customers := getNearbyCustomers(req)
+			c.JSON(200, gin.H{"data": customers, "total": len(customers)})
+		})
+
+		api.GET("/customers/within", func(c *gin.Context) {
+			var req BoundingBoxCustomerRequest
+			if err := c.ShouldBindQuery(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			customers := getCustomersInBoundingBox(req)
+			c.JSON(200, gin.H{"data": customers, "total": len(customers)})
+		})
+
+		// 客户地图数据（GeoJSON，可按缩放级别网格聚合）
+		api.GET("/customers/geojson", func(c *gin.Context) {
+			var req CustomerGeoJSONRequest
+			if err := c.ShouldBindQuery(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			if req.RegionCode != "" && findRegion(req.RegionCode) == nil {
+				c.JSON(400, gin.H{"error": "行政区划代码不存在"})
+				return
+			}
+			c.JSON(200, getCustomerGeoJSON(req))
+		})
+
+		// 客户导入路由（销售记录 .xlsx/.csv，以电话号码合并客户），上传文件大小受 importFileMaxBytes 限制
+		importUploadError := func(c *gin.Context, err error) {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				c.JSON(413, gin.H{"error": fmt.Sprintf("导入文件不能超过 %dMB", importFileMaxBytes>>20)})
+				return
+			}
+			c.JSON(400, gin.H{"error": "请上传导入文件"})
+		}
+
+		api.POST("/customers/import", func(c *gin.Context) {
+			c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, importFileMaxBytes)
+			file, header, err := c.Request.FormFile("file")
+			if err != nil {
+				importUploadError(c, err)
+				return
+			}
+			defer file.Close()
+
+			records, err := readImportRecords(header.Filename, file)
+			if err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+
+			importSource := c.DefaultPostForm("import_source", header.Filename)
+			dryRun, _ := strconv.ParseBool(c.DefaultPostForm("dry_run", "false"))
+			result := importCustomers(parseCustomerImportRows(records), importSource, dryRun, getOperatorID(c))
+			c.JSON(200, gin.H{"data": result})
+		})
+
+		// 客户导入任务路由（大文件后台导入、试运行、进度查询与取消）
+		api.POST("/customers/import/jobs", func(c *gin.Context) {
+			c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, importFileMaxBytes)
+			var req ImportJobCreateRequest
+			if err := c.ShouldBind(&req); err != nil {
+				var maxBytesErr *http.MaxBytesError
+				if errors.As(err, &maxBytesErr) {
+					importUploadError(c, err)
+					return
+				}
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+
+			file, header, err := c.Request.FormFile("file")
+			if err != nil {
+				importUploadError(c, err)
+				return
+			}
+			defer file.Close()
+
+			data, err := io.ReadAll(file)
+			if err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+
+			job, err := createImportJob(header.Filename, data, req)
+			if err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"data": job})
+		})
+
+		api.GET("/customers/import/jobs", func(c *gin.Context) {
+			page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+			pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "20"))
+			jobs, total := getImportJobs(page, pageSize)
+			c.JSON(200, gin.H{"data": jobs, "total": total})
+		})
+
+		api.GET("/customers/import/jobs/:job_id", func(c *gin.Context) {
+			jobID, _ := strconv.ParseUint(c.Param("job_id"), 10, 64)
+			job, err := getImportJob(jobID)
+			if err != nil {
+				c.JSON(404, gin.H{"error": "导入任务不存在"})
+				return
+			}
+			c.JSON(200, gin.H{"data": job})
+		})
+
+		api.GET("/customers/import/jobs/:job_id/rows", func(c *gin.Context) {
+			jobID, _ := strconv.ParseUint(c.Param("job_id"), 10, 64)
+			page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+			pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "50"))
+			rows, total := getImportJobRows(jobID, c.Query("status"), page, pageSize)
+			c.JSON(200, gin.H{"data": rows, "total": total})
+		})
+
+		api.GET("/customers/import/jobs/:job_id/errors", func(c *gin.Context) {
+			jobID, _ := strconv.ParseUint(c.Param("job_id"), 10, 64)
+			data, err := exportImportJobErrors(jobID)
+			if err != nil {
+				c.JSON(404, gin.H{"error": "导入任务不存在"})
+				return
+			}
+			c.Header("Content-Type", "text/csv; charset=utf-8")
+			c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=import_job_%d_errors.csv", jobID))
+			c.Data(200, "text/csv; charset=utf-8", data)
+		})
+
+		api.POST("/customers/import/jobs/:job_id/cancel", func(c *gin.Context) {
+			jobID, _ := strconv.ParseUint(c.Param("job_id"), 10, 64)
+			job, err := cancelImportJob(jobID)
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(404, gin.H{"error": "导入任务不存在"})
+				return
+			}
+			if err != nil {
+				c.JSON(409, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"data": job})
+		})
+
+		// 客户查重与合并路由
+		api.POST("/customers/duplicates/scans", func(c *gin.Context) {
+			var req DuplicateScanRequest
+			if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			job, err := createDuplicateScanJob(req)
+			if err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"data": job})
+		})
+
+		api.GET("/customers/duplicates/scans/:scan_id", func(c *gin.Context) {
+			scanID, _ := strconv.ParseUint(c.Param("scan_id"), 10, 64)
+			job, err := getDuplicateScanJob(scanID)
+			if err != nil {
+				c.JSON(404, gin.H{"error": "查重任务不存在"})
+				return
+			}
+			c.JSON(200, gin.H{"data": job})
+		})
+
+		api.GET("/customers/duplicates/groups", func(c *gin.Context) {
+			scanID, _ := strconv.ParseUint(c.Query("scan_id"), 10, 64)
+			page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+			pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "20"))
+			groups, total := getDuplicateGroups(scanID, c.DefaultQuery("status", string(DuplicateGroupPending)), page, pageSize)
+			c.JSON(200, gin.H{"data": groups, "total": total})
+		})
+
+		api.POST("/customers/duplicates/groups/:group_id/ignore", func(c *gin.Context) {
+			groupID, _ := strconv.ParseUint(c.Param("group_id"), 10, 64)
+			group, err := ignoreDuplicateGroup(groupID)
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(404, gin.H{"error": "重复分组不存在"})
+				return
+			}
+			if err != nil {
+				c.JSON(409, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"data": group})
+		})
+
+		// 客户批量操作路由（ids 或 filter/segment_id 指定目标）
+		api.POST("/customers/bulk", func(c *gin.Context) {
+			var req CustomerBulkRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			result, err := bulkUpdateCustomers(req)
+			if err != nil {
+				segmentError(c, err)
+				return
+			}
+			c.JSON(200, gin.H{"data": result})
+		})
+
+		api.GET("/customers/bulk/:operation_id", func(c *gin.Context) {
+			operationID, _ := strconv.ParseUint(c.Param("operation_id"), 10, 64)
+			page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+			pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "20"))
+			operation, changes, total, err := getCustomerBulkOperation(operationID, c.Query("status"), page, pageSize)
+			if err != nil {
+				c.JSON(404, gin.H{"error": "批量操作记录不存在"})
+				return
+			}
+			c.JSON(200, gin.H{"data": gin.H{"operation": operation, "changes": changes}, "total": total})
+		})
+
+		api.POST("/customers/merge", func(c *gin.Context) {
+			var req CustomerMergeRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			result, err := mergeCustomers(req)
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(404, gin.H{"error": "客户不存在"})
+				return
+			}
+			if err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"data": result})
+		})
+
+		api.GET("/customers/merges", func(c *gin.Context) {
+			customerID, _ := strconv.ParseUint(c.Query("customer_id"), 10, 64)
+			page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+			pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "20"))
+			merges, total := getCustomerMerges(customerID, page, pageSize)
+			c.JSON(200, gin.H{"data": merges, "total": total})
+		})
+
+		api.POST("/customers/merges/:merge_id/undo", func(c *gin.Context) {
+			mergeID, _ := strconv.ParseUint(c.Param("merge_id"), 10, 64)
+			result, err := undoCustomerMerge(mergeID, getOperatorID(c))
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(404, gin.H{"error": "合并记录不存在"})
+				return
+			}
+			if errors.Is(err, errMergeAlreadyUndone) || errors.Is(err, errMergeSurvivorModified) {
+				c.JSON(409, gin.H{"error": err.Error()})
+				return
+			}
+			if err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"data": result})
+		})
+
+		// 地址解析路由（基于内嵌行政区划字典识别省市区、街道）
+		api.GET("/customers/address/parse", func(c *gin.Context) {
+			address := c.Query("address")
+			if address == "" {
+				c.JSON(400, gin.H{"error": "请提供地址"})
+				return
+			}
+			c.JSON(200, gin.H{"data": parseChineseAddress(address)})
+		})
+
+		api.POST("/customers/address/backfill", func(c *gin.Context) {
+			result, err := backfillCustomerAddresses()
+			if err != nil {
+				c.JSON(500, gin.H{"error": err.Error(), "data": result})
+				return
+			}
+			c.JSON(200, gin.H{"data": result})
+		})
+
+		// 行政区划字典路由
+		api.GET("/regions", func(c *gin.Context) {
+			regions, err := getRegionChildren(c.Query("parent_code"))
+			if err != nil {
+				c.JSON(404, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"data": regions})
+		})
+
+		api.GET("/regions/search", func(c *gin.Context) {
+			level, _ := strconv.Atoi(c.DefaultQuery("level", "0"))
+			limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+			regions, err := searchRegions(c.Query("keyword"), level, c.Query("parent_code"), limit)
+			if err != nil {
+				c.JSON(404, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"data": regions})
+		})
+
+		api.POST("/regions/validate", func(c *gin.Context) {
+			var req RegionValidateRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			var errs []string
+			if req.DistrictID != 0 {
+				if _, err := validateDistrictID(req.DistrictID); err != nil {
+					errs = append(errs, err.Error())
+				}
+			}
+			errs = append(errs, validateShippingInfos(req.ShippingInfos)...)
+			c.JSON(200, gin.H{"data": gin.H{"valid": len(errs) == 0, "errors": errs}})
+		})
+
+		api.GET("/regions/:code", func(c *gin.Context) {
+			region, err := getRegionDetail(c.Param("code"))
+			if err != nil {
+				c.JSON(404, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"data": region})
+		})
+
+		// 客户偏好管理路由
+		api.GET("/customers/:id/preferences", func(c *gin.Context) {
+			customerID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+			if err != nil {
+				c.JSON(400, gin.H{"error": "无效的客户ID"})
+				return
+			}
+			preferences := getCustomerPreferences(customerID)
+			if preferences == nil {
+				c.JSON(404, gin.H{"error": "客户不存在"})
+				return
+			}
+			c.JSON(200, gin.H{"data": preferences})
+		})
+
+		api.POST("/customers/:id/preferences", func(c *gin.Context) {
+			customerID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+			if err != nil {
+				c.JSON(400, gin.H{"error": "无效的客户ID"})
+				return
+			}
+			// 客户ID取自路径，请求体可不传
+			req := CustomerPreferenceCreateRequest{CustomerID: customerID}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			req.CustomerID = customerID
+			preference, err := createCustomerPreference(req, getOperatorID(c))
+			switch {
+			case errors.Is(err, gorm.ErrRecordNotFound):
+				c.JSON(404, gin.H{"error": "客户不存在"})
+			case err != nil:
+				c.JSON(500, gin.H{"error": err.Error()})
+			default:
+				c.JSON(200, gin.H{"data": preference})
+			}
+		})
+
+		api.PUT("/customers/:id/preferences/:preference_id", func(c *gin.Context) {
+			customerID, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+			preferenceID := c.Param("preference_id")
+			var req CustomerPreferenceUpdateRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			preference, err := updateCustomerPreference(customerID, preferenceID, req, getOperatorID(c))
+			switch {
+			case errors.Is(err, gorm.ErrRecordNotFound):
+				c.JSON(404, gin.H{"error": "客户或偏好不存在"})
+			case err != nil:
+				c.JSON(500, gin.H{"error": err.Error()})
+			default:
+				c.JSON(200, gin.H{"data": preference})
+			}
+		})
+
+		api.DELETE("/customers/:id/preferences/:preference_id", func(c *gin.Context) {
+			customerID, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+			preferenceID := c.Param("preference_id")
+			err := deleteCustomerPreference(customerID, preferenceID, getOperatorID(c))
+			switch {
+			case errors.Is(err, gorm.ErrRecordNotFound):
+				c.JSON(404, gin.H{"error": "客户或偏好不存在"})
+			case err != nil:
+				c.JSON(500, gin.H{"error": err.Error()})
+			default:
+				c.JSON(200, gin.H{"message": "偏好删除成功"})
+			}
+		})
+
+		// 客户变更历史路由
+		api.GET("/customers/:id/history", func(c *gin.Context) {
+			customerID, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+			page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+			pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "20"))
+			logs, total := getCustomerHistory(customerID, c.Query("field"), c.Query("source"), page, pageSize)
+			c.JSON(200, gin.H{"data": logs, "total": total})
+		})
+
+		api.POST("/customers/:id/history/:log_id/revert", func(c *gin.Context) {
+			customerID, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+			logID, _ := strconv.ParseUint(c.Param("log_id"), 10, 64)
+			var req CustomerRevertRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			if req.OperatorID == 0 {
+				req.OperatorID = getOperatorID(c)
+			}
+			customer, err := revertCustomerField(customerID, logID, req)
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(404, gin.H{"error": "客户或变更记录不存在"})
+				return
+			}
+			if err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"data": customer})
+		})
+
+		// 待办事项路由
+		api.GET("/todos", func(c *gin.Context) {
+			customerID, _ := strconv.ParseUint(c.Query("customer_id"), 10, 64)
+			page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+			pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "20"))
+			todos, total := getTodos(customerID, page, pageSize)
+			c.JSON(200, gin.H{"data": todos, "total": total})
+		})
+
+		api.POST("/todos", func(c *gin.Context) {
+			var req TodoCreateRequest
+			c.ShouldBindJSON(&req)
+			todo := createTodo(req)
+			c.JSON(200, gin.H{"data": todo})
+		})
+
+		api.PUT("/todos/:id", func(c *gin.Context) {
+			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+			var req TodoUpdateRequest
+			c.ShouldBindJSON(&req)
+			todo := updateTodo(id, req)
+			c.JSON(200, gin.H{"data": todo})
+		})
+
+		// 跟进记录路由
+		// 注意：以下接口操作的是 follow_up_records 表，该表是从原 activities 表迁移而来
+		api.GET("/follow-up-records", func(c *gin.Context) {
+			customerID, _ := strconv.ParseUint(c.Query("customer_id"), 10, 64)
+			page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+			pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "20"))
+			records, total := getFollowUpRecords(customerID, page, pageSize)
+			c.JSON(200, gin.H{"data": records, "total": total})
+		})
+
+		api.POST("/follow-up-records", func(c *gin.Context) {
+			var req FollowUpRecordCreateRequest
+			c.ShouldBindJSON(&req)
+			record := createFollowUpRecord(req)
+			c.JSON(200, gin.H{"data": record})
+		})
+
+		api.GET("/follow-up-records/:id", func(c *gin.Context) {
+			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+			record := getFollowUpRecord(id)
+			c.JSON(200, gin.H{"data": record})
+		})
+
+		api.PUT("/follow-up-records/:id", func(c *gin.Context) {
+			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+			var req FollowUpRecordUpdateRequest
+			c.ShouldBindJSON(&req)
+			record := updateFollowUpRecord(id, req)
+			c.JSON(200, gin.H{"data": record})
+		})
+
+		api.DELETE("/follow-up-records/:id", func(c *gin.Context) {
+			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+			deleteFollowUpRecord(id)
+			c.JSON(200, gin.H{"message": "删除成功"})
+		})
+
+		// 客户分群路由（user_id 为当前用户，私有分群只有创建人可以访问）
+		api.GET("/segments", func(c *gin.Context) {
+			userID, _ := strconv.ParseUint(c.Query("user_id"), 10, 64)
+			c.JSON(200, gin.H{"data": getCustomerSegments(userID)})
+		})
+
+		api.POST("/segments", func(c *gin.Context) {
+			var req CustomerSegmentRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			segment, err := createCustomerSegment(req)
+			if err != nil {
+				segmentError(c, err)
+				return
+			}
+			c.JSON(200, gin.H{"data": segment})
+		})
+
+		api.GET("/segments/:id", func(c *gin.Context) {
+			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+			userID, _ := strconv.ParseUint(c.Query("user_id"), 10, 64)
+			segment, err := getCustomerSegment(id, userID)
+			if err != nil {
+				segmentError(c, err)
+				return
+			}
+			c.JSON(200, gin.H{"data": segment})
+		})
+
+		api.PUT("/segments/:id", func(c *gin.Context) {
+			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+			userID, _ := strconv.ParseUint(c.Query("user_id"), 10, 64)
+			var req CustomerSegmentRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			segment, err := updateCustomerSegment(id, userID, req)
+			if err != nil {
+				segmentError(c, err)
+				return
+			}
+			c.JSON(200, gin.H{"data": segment})
+		})
+
+		api.DELETE("/segments/:id", func(c *gin.Context) {
+			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+			userID, _ := strconv.ParseUint(c.Query("user_id"), 10, 64)
+			if err := deleteCustomerSegment(id, userID); err != nil {
+				segmentError(c, err)
+				return
+			}
+			c.JSON(200, gin.H{"message": "删除成功"})
+		})
+
+		api.GET("/segments/:id/customers", func(c *gin.Context) {
+			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+			userID, _ := strconv.ParseUint(c.Query("user_id"), 10, 64)
+			page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+			limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+			customers, total, err := evaluateCustomerSegment(id, userID, page, limit)
+			if err != nil {
+				segmentError(c, err)
+				return
+			}
+			c.JSON(200, gin.H{"data": customers, "total": total})
+		})
+
+		api.GET("/segments/:id/count", func(c *gin.Context) {
+			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+			userID, _ := strconv.ParseUint(c.Query("user_id"), 10, 64)
+			count, err := countCustomerSegment(id, userID)
+			if err != nil {
+				segmentError(c, err)
+				return
+			}
+			c.JSON(200, gin.H{"data": gin.H{"count": count}})
+		})
+
+		api.POST("/segments/:id/snapshot", func(c *gin.Context) {
+			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+			userID, _ := strconv.ParseUint(c.Query("user_id"), 10, 64)
+			segment, err := refreshCustomerSegmentSnapshot(id, userID)
+			if err != nil {
+				segmentError(c, err)
+				return
+			}
+			c.JSON(200, gin.H{"data": segment})
+		})
+
+		// 订单路由
+		orderError := func(c *gin.Context, err error) {
+			var validationErr *ValidationError
+			switch {
+			case errors.Is(err, gorm.ErrRecordNotFound):
+				c.JSON(404, gin.H{"error": "订单或客户不存在"})
+			case errors.Is(err, errOrderNoExists):
+				c.JSON(409, gin.H{"error": err.Error()})
+			case errors.As(err, &validationErr):
+				c.JSON(400, gin.H{"error": err.Error()})
+			default:
+				c.JSON(500, gin.H{"error": err.Error()})
+			}
+		}
+
+		api.GET("/orders", func(c *gin.Context) {
+			var query OrderQuery
+			if err := c.ShouldBindQuery(&query); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			orders, total := getOrders(query)
+			c.JSON(200, gin.H{"data": orders, "total": total})
+		})
+
+		api.POST("/orders", func(c *gin.Context) {
+			var req OrderRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			if req.OperatorID == 0 {
+				req.OperatorID = getOperatorID(c)
+			}
+			order, err := createOrder(req)
+			if err != nil {
+				orderError(c, err)
+				return
+			}
+			c.JSON(200, gin.H{"data": order})
+		})
+
+		api.GET("/orders/:id", func(c *gin.Context) {
+			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+			order, err := getOrder(id)
+			if err != nil {
+				orderError(c, err)
+				return
+			}
+			c.JSON(200, gin.H{"data": order})
+		})
+
+		api.PUT("/orders/:id", func(c *gin.Context) {
+			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+			var req OrderRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			if req.OperatorID == 0 {
+				req.OperatorID = getOperatorID(c)
+			}
+			order, err := updateOrder(id, req)
+			if err != nil {
+				orderError(c, err)
+				return
+			}
+			c.JSON(200, gin.H{"data": order})
+		})
+
+		api.DELETE("/orders/:id", func(c *gin.Context) {
+			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+			if err := deleteOrder(id, getOperatorID(c)); err != nil {
+				orderError(c, err)
+				return
+			}
+			c.JSON(200, gin.H{"message": "删除成功"})
+		})
+
+		api.GET("/customers/:id/orders", func(c *gin.Context) {
+			var query OrderQuery
+			if err := c.ShouldBindQuery(&query); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			query.CustomerID, _ = strconv.ParseUint(c.Param("id"), 10, 64)
+			orders, total := getOrders(query)
+			c.JSON(200, gin.H{"data": orders, "total": total})
+		})
+
+		// 退货单路由（订单错误响应共用）
+		api.GET("/returns", func(c *gin.Context) {
+			var query OrderReturnQuery
+			if err := c.ShouldBindQuery(&query); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			returns, total := getOrderReturns(query)
+			c.JSON(200, gin.H{"data": returns, "total": total})
+		})
+
+		api.POST("/returns", func(c *gin.Context) {
+			var req OrderReturnRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			if req.OperatorID == 0 {
+				req.OperatorID = getOperatorID(c)
+			}
+			orderReturn, err := createOrderReturn(req)
+			if errors.Is(err, errReturnNoExists) {
+				c.JSON(409, gin.H{"error": err.Error()})
+				return
+			}
+			if err != nil {
+				orderError(c, err)
+				return
+			}
+			c.JSON(200, gin.H{"data": orderReturn})
+		})
+
+		api.GET("/returns/:id", func(c *gin.Context) {
+			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+			orderReturn, err := getOrderReturn(id)
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(404, gin.H{"error": "退货单不存在"})
+				return
+			}
+			if err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"data": orderReturn})
+		})
+
+		api.DELETE("/returns/:id", func(c *gin.Context) {
+			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+			err := deleteOrderReturn(id, getOperatorID(c))
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(404, gin.H{"error": "退货单不存在"})
+				return
+			}
+			if err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"message": "删除成功"})
+		})
+
+		api.GET("/orders/:id/returns", func(c *gin.Context) {
+			var query OrderReturnQuery
+			if err := c.ShouldBindQuery(&query); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			query.OrderID, _ = strconv.ParseUint(c.Param("id"), 10, 64)
+			returns, total := getOrderReturns(query)
+			c.JSON(200, gin.H{"data": returns, "total": total})
+		})
+
+		api.GET("/customers/:id/returns", func(c *gin.Context) {
+			var query OrderReturnQuery
+			if err := c.ShouldBindQuery(&query); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			query.CustomerID, _ = strconv.ParseUint(c.Param("id"), 10, 64)
+			returns, total := getOrderReturns(query)
+			c.JSON(200, gin.H{"data": returns, "total": total})
+		})
+
+		// 销售报表路由
+		api.GET("/reports/returns/customers", func(c *gin.Context) {
+			var query SalesReportQuery
+			if err := c.ShouldBindQuery(&query); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			items, err := getCustomerReturnRates(query)
+			if err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"data": items})
+		})
+
+		api.GET("/reports/returns/products", func(c *gin.Context) {
+			var query SalesReportQuery
+			if err := c.ShouldBindQuery(&query); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			items, err := getProductReturnRates(query)
+			if err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"data": items})
+		})
+
+		api.GET("/reports/seller-revenue", func(c *gin.Context) {
+			var query SalesReportQuery
+			if err := c.ShouldBindQuery(&query); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			items, err := getSellerRevenue(query)
+			if err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"data": items})
+		})
+
+		// 商品目录路由
+		productError := func(c *gin.Context, err error) {
+			var validationErr *ValidationError
+			switch {
+			case errors.Is(err, gorm.ErrRecordNotFound):
+				c.JSON(404, gin.H{"error": "商品或商品分类不存在"})
+			case errors.Is(err, errProductExists), errors.Is(err, errProductCategoryExists):
+				c.JSON(409, gin.H{"error": err.Error()})
+			case errors.As(err, &validationErr):
+				c.JSON(400, gin.H{"error": err.Error()})
+			default:
+				c.JSON(500, gin.H{"error": err.Error()})
+			}
+		}
+
+		api.GET("/products", func(c *gin.Context) {
+			var query ProductQuery
+			if err := c.ShouldBindQuery(&query); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			products, total, err := getProducts(query)
+			if err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"data": products, "total": total})
+		})
+
+		api.GET("/products/search", func(c *gin.Context) {
+			limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+			results, err := searchProducts(c.Query("keyword"), limit)
+			if err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"data": results})
+		})
+
+		api.POST("/products", func(c *gin.Context) {
+			var req ProductRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			product, err := createProduct(req)
+			if err != nil {
+				productError(c, err)
+				return
+			}
+			c.JSON(200, gin.H{"data": product})
+		})
+
+		api.GET("/products/:id", func(c *gin.Context) {
+			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+			product, err := getProduct(id)
+			if err != nil {
+				productError(c, err)
+				return
+			}
+			c.JSON(200, gin.H{"data": product})
+		})
+
+		api.PUT("/products/:id", func(c *gin.Context) {
+			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+			var req ProductRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			product, err := updateProduct(id, req)
+			if err != nil {
+				productError(c, err)
+				return
+			}
+			c.JSON(200, gin.H{"data": product})
+		})
+
+		api.DELETE("/products/:id", func(c *gin.Context) {
+			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+			if err := deleteProduct(id); err != nil {
+				productError(c, err)
+				return
+			}
+			c.JSON(200, gin.H{"message": "删除成功"})
+		})
+
+		api.GET("/products/categories", func(c *gin.Context) {
+			tree, err := getProductCategoryTree()
+			if err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"data": tree})
+		})
+
+		api.POST("/products/categories", func(c *gin.Context) {
+			var req ProductCategoryRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			category, err := createProductCategory(req)
+			if err != nil {
+				productError(c, err)
+				return
+			}
+			c.JSON(200, gin.H{"data": category})
+		})
+
+		api.PUT("/products/categories/:id", func(c *gin.Context) {
+			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+			var req ProductCategoryRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			category, err := updateProductCategory(id, req)
+			if err != nil {
+				productError(c, err)
+				return
+			}
+			c.JSON(200, gin.H{"data": category})
+		})
+
+		api.DELETE("/products/categories/:id", func(c *gin.Context) {
+			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+			if err := deleteProductCategory(id); err != nil {
+				productError(c, err)
+				return
+			}
+			c.JSON(200, gin.H{"message": "删除成功"})
+		})
+
+		// 自由文本商品映射路由
+		api.GET("/products/mappings", func(c *gin.Context) {
+			limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+			if limit < 1 || limit > 500 {
+				limit = 100
+			}
+			items, err := getUnmappedProductTexts()
+			if err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			total := len(items)
+			if total > limit {
+				items = items[:limit]
+			}
+			c.JSON(200, gin.H{"data": items, "total": total})
+		})
+
+		api.POST("/products/mappings", func(c *gin.Context) {
+			var req ProductMappingRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			if req.OperatorID == 0 {
+				req.OperatorID = getOperatorID(c)
+			}
+			result, err := applyProductMapping(req)
+			if err != nil {
+				productError(c, err)
+				return
+			}
+			c.JSON(200, gin.H{"data": result})
+		})
+
+		api.POST("/products/mappings/auto", func(c *gin.Context) {
+			results, err := autoMapProductTexts(getOperatorID(c))
+			if err != nil {
+				productError(c, err)
+				return
+			}
+			c.JSON(200, gin.H{"data": results, "total": len(results)})
+		})
+
+		// 客户组路由（连锁门店、亲属关系等）
+		groupError := func(c *gin.Context, err error) {
+			switch {
+			case errors.Is(err, gorm.ErrRecordNotFound):
+				c.JSON(404, gin.H{"error": "客户组不存在"})
+			case errors.Is(err, errGroupCreatorNotFound):
+				c.JSON(400, gin.H{"error": err.Error()})
+			default:
+				c.JSON(500, gin.H{"error": err.Error()})
+			}
+		}
+
+		api.GET("/groups", func(c *gin.Context) {
+			page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+			pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "20"))
+			groups, total := getGroups(c.Query("keyword"), page, pageSize)
+			c.JSON(200, gin.H{"data": groups, "total": total})
+		})
+
+		api.POST("/groups", func(c *gin.Context) {
+			var req GroupRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			group, err := createGroup(req, getOperatorID(c))
+			if err != nil {
+				groupError(c, err)
+				return
+			}
+			c.JSON(200, gin.H{"data": group})
+		})
+
+		api.GET("/groups/:id", func(c *gin.Context) {
+			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+			group, err := getGroup(id)
+			if err != nil {
+				groupError(c, err)
+				return
+			}
+			c.JSON(200, gin.H{"data": group})
+		})
+
+		api.PUT("/groups/:id", func(c *gin.Context) {
+			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+			var req GroupRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			group, err := updateGroup(id, req)
+			if err != nil {
+				groupError(c, err)
+				return
+			}
+			c.JSON(200, gin.H{"data": group})
+		})
+
+		api.DELETE("/groups/:id", func(c *gin.Context) {
+			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+			if err := deleteGroup(id, getOperatorID(c)); err != nil {
+				groupError(c, err)
+				return
+			}
+			c.JSON(200, gin.H{"message": "删除成功"})
+		})
+
+		api.GET("/groups/:id/customers", func(c *gin.Context) {
+			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+			page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+			pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "20"))
+			members, total, summary, err := getGroupMembers(id, page, pageSize)
+			if err != nil {
+				groupError(c, err)
+				return
+			}
+			c.JSON(200, gin.H{"data": members, "total": total, "summary": summary})
+		})
+
+		api.POST("/groups/:id/customers", func(c *gin.Context) {
+			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+			var req GroupCustomersRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			if req.OperatorID == 0 {
+				req.OperatorID = getOperatorID(c)
+			}
+			result, err := changeGroupCustomers(id, req, true)
+			if err != nil {
+				groupError(c, err)
+				return
+			}
+			c.JSON(200, gin.H{"data": result})
+		})
+
+		api.DELETE("/groups/:id/customers", func(c *gin.Context) {
+			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+			var req GroupCustomersRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			if req.OperatorID == 0 {
+				req.OperatorID = getOperatorID(c)
+			}
+			result, err := changeGroupCustomers(id, req, false)
+			if err != nil {
+				groupError(c, err)
+				return
+			}
+			c.JSON(200, gin.H{"data": result})
+		})
+
+		// 用户路由
+		api.GET("/users", func(c *gin.Context) {
+			users := getUsers()
+			c.JSON(200, gin.H{"data": users})
+		})
+
+		api.GET("/users/:id", func(c *gin.Context) {
+			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+			user := getUserDetail(id)
+			c.JSON(200, gin.H{"data": user})
+		})
+
+		// 销售员每日公海领取上限
+		api.PUT("/users/:id/pool-limit", func(c *gin.Context) {
+			id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+			var req UserPoolLimitRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			quota, err := updateUserPoolClaimLimit(id, req.PoolClaimLimit)
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(404, gin.H{"error": "用户不存在"})
+				return
+			}
+			if err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"data": quota})
+		})
+
+		// 销售员每日拜访路线规划
+		api.GET("/users/:id/visit-route", func(c *gin.Context) {
+			sellerID, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+			var req VisitRoutePlanRequest
+			if err := c.ShouldBindQuery(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			plan, err := planVisitRoute(sellerID, req)
+			if err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"data": plan})
 		})
 
 		// 仪表板搜索路由
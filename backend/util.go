@@ -1,8 +1,17 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
+
+	"github.com/lib/pq"
 )
 
 // joinStrings 用指定分隔符连接字符串数组
@@ -133,6 +142,23 @@ func getStringFromMap(m map[string]interface{}, key string) string {
 	return ""
 }
 
+// getUint64FromMap 从map中安全获取非负整数值（JSON 解析后的数字为 float64）
+func getUint64FromMap(m map[string]interface{}, key string) uint64 {
+	switch value := m[key].(type) {
+	case float64:
+		if value > 0 {
+			return uint64(value)
+		}
+	case uint64:
+		return value
+	case json.Number:
+		if n, err := strconv.ParseUint(string(value), 10, 64); err == nil {
+			return n
+		}
+	}
+	return 0
+}
+
 // getTimeFromMap 从map中安全获取时间值
 func getTimeFromMap(m map[string]interface{}, key string) time.Time {
 	if value, ok := m[key]; ok {
@@ -147,3 +173,353 @@ func getTimeFromMap(m map[string]interface{}, key string) time.Time {
 	}
 	return time.Time{}
 }
+
+// splitMultiValue 拆分单元格中以常见分隔符连接的多个值（如多个电话号码），去空去重
+func splitMultiValue(s string) []string {
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		switch r {
+		case ',', '，', '/', '、', ';', '；', '|', ' ', '\t', '\n', '\r':
+			return true
+		}
+		return false
+	})
+
+	var result []string
+	seen := make(map[string]bool)
+	for _, field := range fields {
+		if field == "" || seen[field] {
+			continue
+		}
+		seen[field] = true
+		result = append(result, field)
+	}
+	return result
+}
+
+// mergeStringArray 将新值并入数组（保持原顺序、忽略空值和重复值），返回合并结果和是否有变化
+func mergeStringArray(arr pq.StringArray, values ...string) (pq.StringArray, bool) {
+	changed := false
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" || containsString(arr, value) {
+			continue
+		}
+		arr = append(arr, value)
+		changed = true
+	}
+	return arr, changed
+}
+
+// mergeInt64Array 将新值并入整型数组（忽略0和重复值），返回合并结果和是否有变化
+func mergeInt64Array(arr pq.Int64Array, values ...int64) (pq.Int64Array, bool) {
+	changed := false
+	for _, value := range values {
+		if value == 0 || containsInt64(arr, value) {
+			continue
+		}
+		arr = append(arr, value)
+		changed = true
+	}
+	return arr, changed
+}
+
+// removeStringArray 从字符串数组中移除指定值，返回新数组和是否有变化
+func removeStringArray(arr pq.StringArray, values ...string) (pq.StringArray, bool) {
+	result := pq.StringArray{}
+	for _, v := range arr {
+		if !containsString(values, v) {
+			result = append(result, v)
+		}
+	}
+	return result, len(result) != len(arr)
+}
+
+// removeInt64Array 从整型数组中移除指定值，返回新数组和是否有变化
+func removeInt64Array(arr pq.Int64Array, values ...int64) (pq.Int64Array, bool) {
+	result := pq.Int64Array{}
+	for _, v := range arr {
+		if !containsInt64(values, v) {
+			result = append(result, v)
+		}
+	}
+	return result, len(result) != len(arr)
+}
+
+// containsString 判断字符串数组是否包含指定值
+func containsString(arr []string, value string) bool {
+	for _, v := range arr {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// containsInt64 判断整型数组是否包含指定值
+func containsInt64(arr []int64, value int64) bool {
+	for _, v := range arr {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// fillEmptyString 仅当目标为空时填入新值，返回是否有变化
+func fillEmptyString(dst *string, value string) bool {
+	value = strings.TrimSpace(value)
+	if *dst != "" || value == "" {
+		return false
+	}
+	*dst = value
+	return true
+}
+
+// earthRadiusKm 地球平均半径（千米）
+const earthRadiusKm = 6371.0
+
+// haversineKm 按球面距离公式计算两个经纬度之间的距离（千米）
+func haversineKm(lat1, lon1, lat2, lon2 float64) float64 {
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRad(lat2 - lat1)
+	dLon := toRad(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// geoBoundingBox 以某点为中心、指定半径的经纬度外接矩形，用于数据库预筛选
+func geoBoundingBox(lat, lon, radiusKm float64) (minLat, minLon, maxLat, maxLon float64) {
+	dLat := radiusKm / (earthRadiusKm * math.Pi / 180)
+	// 高纬度地区经度跨度急剧变大，限制余弦下限避免除零
+	dLon := dLat / math.Max(math.Cos(lat*math.Pi/180), 0.01)
+	return math.Max(lat-dLat, -90), math.Max(lon-dLon, -180), math.Min(lat+dLat, 90), math.Min(lon+dLon, 180)
+}
+
+// normalizeWechat 规范化微信号：去掉首尾空白并忽略大小写，与 normalizedWechatSQL 一致
+func normalizeWechat(wechat string) string {
+	return strings.ToLower(strings.TrimSpace(wechat))
+}
+
+// normalizeWechats 规范化微信号数组并去重，忽略空值
+func normalizeWechats(wechats []string) []string {
+	var result []string
+	for _, wechat := range wechats {
+		if w := normalizeWechat(wechat); w != "" && !containsString(result, w) {
+			result = append(result, w)
+		}
+	}
+	return result
+}
+
+// normalizePhone 规范化电话号码：只保留数字，去掉 +86/0086 国家码前缀
+func normalizePhone(phone string) string {
+	var b strings.Builder
+	for _, r := range phone {
+		if r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	digits := b.String()
+	switch {
+	case strings.HasPrefix(digits, "0086") && len(digits) > 11:
+		digits = digits[4:]
+	case strings.HasPrefix(digits, "86") && len(digits) == 13:
+		digits = digits[2:]
+	}
+	return digits
+}
+
+// 中国大陆电话号码格式（规范化后的纯数字）
+var (
+	mobilePhonePattern   = regexp.MustCompile(`^1[3-9]\d{9}$`)
+	landlinePhonePattern = regexp.MustCompile(`^(0(10|2\d)\d{8}|0[3-9]\d{2}\d{7,8})$`)
+	servicePhonePattern  = regexp.MustCompile(`^[48]00\d{7}$`)
+)
+
+// validatePhone 规范化并校验大陆手机号、带区号的固定电话和400/800号码，返回规范化后的号码
+func validatePhone(phone string) (string, error) {
+	p := normalizePhone(phone)
+	if p == "" {
+		return "", fmt.Errorf("电话号码 %q 不能为空", phone)
+	}
+	if !mobilePhonePattern.MatchString(p) && !landlinePhonePattern.MatchString(p) && !servicePhonePattern.MatchString(p) {
+		return "", fmt.Errorf("电话号码 %q 格式不正确，需为11位手机号或带区号的固定电话", phone)
+	}
+	return p, nil
+}
+
+// normalizePhones 规范化电话号码数组并去重，忽略空值；存在格式不正确的号码时返回错误
+func normalizePhones(phones []string) (pq.StringArray, error) {
+	var result pq.StringArray
+	for _, phone := range phones {
+		if strings.TrimSpace(phone) == "" {
+			continue
+		}
+		p, err := validatePhone(phone)
+		if err != nil {
+			return nil, err
+		}
+		if !containsString(result, p) {
+			result = append(result, p)
+		}
+	}
+	return result, nil
+}
+
+// FieldErrors 字段级校验错误（字段名->错误信息）
+type FieldErrors map[string]string
+
+func (e FieldErrors) Error() string {
+	fields := make([]string, 0, len(e))
+	for field := range e {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for i, field := range fields {
+		fields[i] = field + ": " + e[field]
+	}
+	return strings.Join(fields, "; ")
+}
+
+// ValidationError 业务规则校验错误（如状态流转不合法），接口返回400
+type ValidationError struct {
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+// mergePatchJSONB 按 JSON Merge Patch（RFC 7386）将 patch 合并到 target：值为 null 的键被删除，对象递归合并
+func mergePatchJSONB(target, patch map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(target))
+	for k, v := range target {
+		result[k] = v
+	}
+	for k, v := range patch {
+		if v == nil {
+			delete(result, k)
+			continue
+		}
+		if child, ok := v.(map[string]interface{}); ok {
+			existing, _ := result[k].(map[string]interface{})
+			result[k] = mergePatchJSONB(existing, child)
+			continue
+		}
+		result[k] = v
+	}
+	return result
+}
+
+// escapeLike 转义 LIKE 模式中的通配符
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// normalizeText 去掉空白、标点和符号并转小写，用于模糊比较
+func normalizeText(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) || unicode.IsPunct(r) || unicode.IsSymbol(r) {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, s)
+}
+
+// textSimilarity 基于相邻两字组合的 Dice 系数计算文本相似度（0~1）
+func textSimilarity(a, b string) float64 {
+	ra, rb := []rune(normalizeText(a)), []rune(normalizeText(b))
+	if len(ra) == 0 || len(rb) == 0 {
+		return 0
+	}
+	if string(ra) == string(rb) {
+		return 1
+	}
+	if len(ra) < 2 || len(rb) < 2 {
+		return 0
+	}
+	grams := make(map[string]int)
+	for i := 0; i < len(ra)-1; i++ {
+		grams[string(ra[i:i+2])]++
+	}
+	common := 0
+	for i := 0; i < len(rb)-1; i++ {
+		gram := string(rb[i : i+2])
+		if grams[gram] > 0 {
+			grams[gram]--
+			common++
+		}
+	}
+	return 2 * float64(common) / float64(len(ra)-1+len(rb)-1)
+}
+
+// containsUint64 判断数组是否包含指定值
+func containsUint64(arr []uint64, value uint64) bool {
+	for _, v := range arr {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// uniqueUint64s 去掉重复和为0的ID，保持原有顺序
+func uniqueUint64s(ids []uint64) []uint64 {
+	var result []uint64
+	for _, id := range ids {
+		if id > 0 && !containsUint64(result, id) {
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+// laterTime 返回两个时间中较晚的一个（nil 视为最早）
+func laterTime(a, b *time.Time) *time.Time {
+	if a == nil || (b != nil && b.After(*a)) {
+		return b
+	}
+	return a
+}
+
+// roundMoney 金额保留两位小数
+func roundMoney(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// mergeJSONB 将 src 中 dst 没有的键补充到 dst，返回合并后的结果
+func mergeJSONB(dst, src JSONB) JSONB {
+	if len(src) == 0 {
+		return dst
+	}
+	if dst == nil {
+		dst = JSONB{}
+	}
+	for k, v := range src {
+		if _, ok := dst[k]; !ok {
+			dst[k] = v
+		}
+	}
+	return dst
+}
+
+// toJSONB 通过 JSON 序列化将任意值转换为 JSONB（深拷贝）
+func toJSONB(v interface{}) (JSONB, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var result JSONB
+	err = json.Unmarshal(data, &result)
+	return result, err
+}
+
+// fromJSONB 将 JSONB 反序列化到目标结构体
+func fromJSONB(j JSONB, v interface{}) error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}